@@ -0,0 +1,92 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+
+	"github.com/google/uuid"
+	"gorm.io/gorm"
+)
+
+type accessPolicyController struct {
+	store accessPolicyStore
+}
+
+// GET /policies
+func (accessPolicyController accessPolicyController) getAccessPolicies(w http.ResponseWriter, r *http.Request) {
+	policies, err := accessPolicyController.store.readAccessPolicies()
+	if err != nil {
+		writeStoreError(w, r, err)
+		return
+	}
+
+	httpJson, err := json.Marshal(policies)
+	if err != nil {
+		writeInternalError(w, r, "Cannot encode response JSON", err)
+		return
+	}
+
+	w.WriteHeader(http.StatusOK)
+	w.Write(httpJson)
+}
+
+// POST /policies
+// The policy is assigned an ID, which is returned.
+func (accessPolicyController accessPolicyController) postAccessPolicies(w http.ResponseWriter, r *http.Request) {
+	decoder := json.NewDecoder(r.Body)
+	var policy accessPolicy
+	err := decoder.Decode(&policy)
+	if err != nil {
+		writeProblem(w, r, http.StatusBadRequest, errorCodeInvalidBody, fmt.Sprintf("Cannot decode request JSON: %s", err))
+		return
+	}
+	if policy.Subject == "" {
+		writeProblem(w, r, http.StatusBadRequest, errorCodeInvalidValue, "Policy subject is required")
+		return
+	}
+	_, err = parseRecFilter(policy.Filter)
+	if err != nil {
+		writeProblem(w, r, http.StatusBadRequest, errorCodeInvalidValue, fmt.Sprintf("Invalid policy filter: %s", err))
+		return
+	}
+	policy.ID = uuid.New()
+
+	err = accessPolicyController.store.createAccessPolicy(policy)
+	if err != nil {
+		writeStoreError(w, r, err)
+		return
+	}
+
+	httpJson, err := json.Marshal(policy)
+	if err != nil {
+		writeInternalError(w, r, "Cannot encode response JSON", err)
+		return
+	}
+
+	w.WriteHeader(http.StatusOK)
+	w.Write(httpJson)
+}
+
+// DELETE /policies/:id
+func (accessPolicyController accessPolicyController) deleteAccessPolicy(w http.ResponseWriter, r *http.Request) {
+	idString := r.PathValue("id")
+	id, err := uuid.Parse(idString)
+	if err != nil {
+		writeProblem(w, r, http.StatusNotFound, errorCodeInvalidID, fmt.Sprintf("Invalid UUID: %s", idString))
+		return
+	}
+
+	err = accessPolicyController.store.deleteAccessPolicy(id)
+	if errors.Is(err, gorm.ErrRecordNotFound) {
+		writeProblem(w, r, http.StatusNotFound, errorCodeNotFound, "Access policy not found")
+		return
+	}
+	if err != nil {
+		writeStoreError(w, r, err)
+		return
+	}
+
+	w.WriteHeader(http.StatusOK)
+}
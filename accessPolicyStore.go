@@ -0,0 +1,88 @@
+package main
+
+import (
+	"github.com/google/uuid"
+	"gorm.io/gorm"
+)
+
+// accessPolicyStore is able to store the policies that restrict which recs users and API keys may access.
+type accessPolicyStore interface {
+	readAccessPolicies() ([]accessPolicy, error)
+	// readSubjectAccessPolicies returns the policies of a single subject.
+	readSubjectAccessPolicies(string) ([]accessPolicy, error)
+	createAccessPolicy(accessPolicy) error
+	deleteAccessPolicy(uuid.UUID) error
+}
+
+// accessPolicy grants its subject access to the recs matching the filter. The subject is a username, or
+// `apiKey:<name>` for requests authenticated by the API key with the name. Subjects with several policies may access
+// the recs matching any of them. Subjects without policies may access all recs if they are admins, or if that is
+// allowed by the config, and otherwise none.
+type accessPolicy struct {
+	ID      uuid.UUID `json:"id"`
+	Subject string    `json:"subject"`
+	Filter  string    `json:"filter"`
+}
+
+// gormAccessPolicyStore stores access policies in a GORM database.
+type gormAccessPolicyStore struct {
+	db *gorm.DB
+}
+
+func newGormAccessPolicyStore(db *gorm.DB) gormAccessPolicyStore {
+	return gormAccessPolicyStore{db: db}
+}
+
+func (s gormAccessPolicyStore) readAccessPolicies() ([]accessPolicy, error) {
+	var sqlResult []gormAccessPolicy
+	err := s.db.Order("subject").Order("filter").Find(&sqlResult).Error
+	if err != nil {
+		return []accessPolicy{}, err
+	}
+
+	result := []accessPolicy{}
+	for _, sqlRow := range sqlResult {
+		result = append(result, accessPolicy(sqlRow))
+	}
+	return result, nil
+}
+
+func (s gormAccessPolicyStore) readSubjectAccessPolicies(subject string) ([]accessPolicy, error) {
+	var sqlResult []gormAccessPolicy
+	err := s.db.Where("subject = ?", subject).Order("filter").Find(&sqlResult).Error
+	if err != nil {
+		return []accessPolicy{}, err
+	}
+
+	result := []accessPolicy{}
+	for _, sqlRow := range sqlResult {
+		result = append(result, accessPolicy(sqlRow))
+	}
+	return result, nil
+}
+
+func (s gormAccessPolicyStore) createAccessPolicy(policy accessPolicy) error {
+	gormAccessPolicy := gormAccessPolicy(policy)
+	return s.db.Create(&gormAccessPolicy).Error
+}
+
+func (s gormAccessPolicyStore) deleteAccessPolicy(id uuid.UUID) error {
+	result := s.db.Delete(&gormAccessPolicy{}, "id = ?", id)
+	if result.Error != nil {
+		return result.Error
+	}
+	if result.RowsAffected == 0 {
+		return gorm.ErrRecordNotFound
+	}
+	return nil
+}
+
+type gormAccessPolicy struct {
+	ID      uuid.UUID `gorm:"column:id;type:uuid;primaryKey"`
+	Subject string    `gorm:"not null;index"`
+	Filter  string    `gorm:"not null"`
+}
+
+func (gormAccessPolicy) TableName() string {
+	return "access_policy"
+}
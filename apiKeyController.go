@@ -0,0 +1,113 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"net/http"
+	"time"
+
+	"github.com/google/uuid"
+	"gorm.io/gorm"
+)
+
+type apiKeyController struct {
+	store apiKeyStore
+}
+
+// GET /apikeys
+func (apiKeyController apiKeyController) getAPIKeys(w http.ResponseWriter, r *http.Request) {
+	apiKeys, err := apiKeyController.store.readAPIKeys()
+	if err != nil {
+		writeStoreError(w, r, err)
+		return
+	}
+
+	httpJson, err := json.Marshal(apiKeys)
+	if err != nil {
+		writeInternalError(w, r, "Cannot encode response JSON", err)
+		return
+	}
+
+	w.WriteHeader(http.StatusOK)
+	w.Write(httpJson)
+}
+
+// POST /apikeys
+// Responds with the key, including its secret. The secret is not stored, so it cannot be retrieved again.
+func (apiKeyController apiKeyController) postAPIKeys(w http.ResponseWriter, r *http.Request) {
+	decoder := json.NewDecoder(r.Body)
+	var apiKeyInput apiKeyInput
+	err := decoder.Decode(&apiKeyInput)
+	if err != nil {
+		writeProblem(w, r, http.StatusBadRequest, errorCodeInvalidBody, fmt.Sprintf("Cannot decode request JSON: %s", err))
+		return
+	}
+	if apiKeyInput.Name == "" || len(apiKeyInput.Scopes) == 0 {
+		writeProblem(w, r, http.StatusBadRequest, errorCodeInvalidValue, "Name and scopes are required")
+		return
+	}
+	for _, scope := range apiKeyInput.Scopes {
+		if !isValidScope(scope) {
+			writeProblem(w, r, http.StatusBadRequest, errorCodeInvalidValue, fmt.Sprintf("Invalid scope: %s", scope))
+			return
+		}
+	}
+
+	secret, err := newSecret()
+	if err != nil {
+		writeInternalError(w, r, "Cannot generate API key", err)
+		return
+	}
+	apiKey := apiKey{
+		ID:        uuid.New(),
+		Name:      apiKeyInput.Name,
+		Scopes:    apiKeyInput.Scopes,
+		CreatedAt: time.Now(),
+		ExpiresAt: apiKeyInput.ExpiresAt,
+	}
+	err = apiKeyController.store.createAPIKey(apiKey, hashSecret(secret))
+	if errors.Is(err, errAPIKeyExists) {
+		writeProblem(w, r, http.StatusConflict, errorCodeConflict, "API key already exists")
+		return
+	}
+	if err != nil {
+		writeStoreError(w, r, err)
+		return
+	}
+	log.Printf("API key %s created by %s", apiKey.Name, requestUsername(r))
+
+	httpJson, err := json.Marshal(createdAPIKey{apiKey: apiKey, Secret: secret})
+	if err != nil {
+		writeInternalError(w, r, "Cannot encode response JSON", err)
+		return
+	}
+
+	w.WriteHeader(http.StatusOK)
+	w.Write(httpJson)
+}
+
+// DELETE /apikeys/:id
+// Revokes the key. It is kept so that its usage remains visible.
+func (apiKeyController apiKeyController) deleteAPIKey(w http.ResponseWriter, r *http.Request) {
+	idString := r.PathValue("id")
+	id, err := uuid.Parse(idString)
+	if err != nil {
+		writeProblem(w, r, http.StatusNotFound, errorCodeInvalidID, fmt.Sprintf("Invalid UUID: %s", idString))
+		return
+	}
+
+	err = apiKeyController.store.revokeAPIKey(id, time.Now())
+	if errors.Is(err, gorm.ErrRecordNotFound) {
+		writeProblem(w, r, http.StatusNotFound, errorCodeNotFound, "API key not found")
+		return
+	}
+	if err != nil {
+		writeStoreError(w, r, err)
+		return
+	}
+	log.Printf("API key %s revoked by %s", id, requestUsername(r))
+
+	w.WriteHeader(http.StatusOK)
+}
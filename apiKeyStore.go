@@ -0,0 +1,226 @@
+package main
+
+import (
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/hex"
+	"errors"
+	"time"
+
+	"github.com/google/uuid"
+	"gorm.io/datatypes"
+	"gorm.io/gorm"
+)
+
+// apiKeyStore is able to store API keys. Only the SHA-256 hashes of the secrets are stored, so they cannot be
+// recovered after creation.
+type apiKeyStore interface {
+	readAPIKeys() ([]apiKey, error)
+	// readAPIKeyByHash returns the key with the secret hash, whether or not it is usable.
+	readAPIKeyByHash(string) (*apiKey, error)
+	// createAPIKey fails with errAPIKeyExists if the name is taken.
+	createAPIKey(apiKey, string) error
+	setAPIKeyHash(uuid.UUID, string) error
+	revokeAPIKey(uuid.UUID, time.Time) error
+	setAPIKeyLastUsed(uuid.UUID, time.Time) error
+}
+
+type apiKey struct {
+	ID         uuid.UUID                   `json:"id"`
+	Name       string                      `json:"name"`
+	Scopes     datatypes.JSONSlice[string] `json:"scopes"`
+	CreatedAt  time.Time                   `json:"createdAt"`
+	ExpiresAt  *time.Time                  `json:"expiresAt"`
+	LastUsedAt *time.Time                  `json:"lastUsedAt"`
+	RevokedAt  *time.Time                  `json:"revokedAt"`
+}
+
+// usable returns true if the key is neither revoked nor expired.
+func (k apiKey) usable(now time.Time) bool {
+	if k.RevokedAt != nil {
+		return false
+	}
+	return k.ExpiresAt == nil || now.Before(*k.ExpiresAt)
+}
+
+// subject is the username given to requests authenticated by the key, as used by access policies.
+func (k apiKey) subject() string {
+	return apiKeySubjectPrefix + k.Name
+}
+
+const apiKeySubjectPrefix = "apiKey:"
+
+// defaultAPIKeyName is the name of the API key from the config.
+const defaultAPIKeyName = "default"
+
+// apiKeyInput is the body used to create an API key.
+type apiKeyInput struct {
+	Name      string     `json:"name"`
+	Scopes    []string   `json:"scopes"`
+	ExpiresAt *time.Time `json:"expiresAt"`
+}
+
+// createdAPIKey is the response when an API key is created. It is the only time the secret is available.
+type createdAPIKey struct {
+	apiKey
+	Secret string `json:"secret"`
+}
+
+var errAPIKeyExists = errors.New("API key already exists")
+
+// newSecret returns a random secret, such as for an API key or refresh token.
+func newSecret() (string, error) {
+	bytes := make([]byte, 32)
+	_, err := rand.Read(bytes)
+	if err != nil {
+		return "", err
+	}
+	return base64.RawURLEncoding.EncodeToString(bytes), nil
+}
+
+// hashSecret returns the stored hash of a secret from newSecret. Secrets are random, so a fast unsalted hash
+// suffices and allows them to be looked up by hash.
+func hashSecret(secret string) string {
+	hash := sha256.Sum256([]byte(secret))
+	return hex.EncodeToString(hash[:])
+}
+
+// seedAPIKey ensures that a key with the name and secret exists, creating it with the scopes if needed. If a key
+// with the name exists, its secret is replaced, but its scopes, expiry and revocation are kept.
+// If the secret is empty, the key with the name is revoked instead, so that removing the secret from the config stops
+// it from being accepted.
+func seedAPIKey(store apiKeyStore, name string, secret string, scopes []string) error {
+	keys, err := store.readAPIKeys()
+	if err != nil {
+		return err
+	}
+	for _, key := range keys {
+		if key.Name != name {
+			continue
+		}
+		if secret == "" {
+			if key.RevokedAt != nil {
+				return nil
+			}
+			return store.revokeAPIKey(key.ID, time.Now())
+		}
+		return store.setAPIKeyHash(key.ID, hashSecret(secret))
+	}
+	if secret == "" {
+		return nil
+	}
+	hash := hashSecret(secret)
+	return store.createAPIKey(apiKey{
+		ID:        uuid.New(),
+		Name:      name,
+		Scopes:    scopes,
+		CreatedAt: time.Now(),
+	}, hash)
+}
+
+// gormAPIKeyStore stores API keys in a GORM database.
+type gormAPIKeyStore struct {
+	db *gorm.DB
+}
+
+func newGormAPIKeyStore(db *gorm.DB) gormAPIKeyStore {
+	return gormAPIKeyStore{db: db}
+}
+
+func (s gormAPIKeyStore) readAPIKeys() ([]apiKey, error) {
+	var sqlResult []gormAPIKey
+	err := s.db.Order("name").Find(&sqlResult).Error
+	if err != nil {
+		return []apiKey{}, err
+	}
+
+	result := []apiKey{}
+	for _, sqlRow := range sqlResult {
+		result = append(result, sqlRow.toAPIKey())
+	}
+	return result, nil
+}
+
+func (s gormAPIKeyStore) readAPIKeyByHash(hash string) (*apiKey, error) {
+	var gormAPIKey gormAPIKey
+	err := s.db.First(&gormAPIKey, "hash = ?", hash).Error
+	if err != nil {
+		return nil, err
+	}
+	apiKey := gormAPIKey.toAPIKey()
+	return &apiKey, nil
+}
+
+func (s gormAPIKeyStore) createAPIKey(apiKey apiKey, hash string) error {
+	return s.db.Transaction(func(tx *gorm.DB) error {
+		var count int64
+		err := tx.Model(&gormAPIKey{}).Where("name = ?", apiKey.Name).Count(&count).Error
+		if err != nil {
+			return err
+		}
+		if count > 0 {
+			return errAPIKeyExists
+		}
+		return tx.Create(&gormAPIKey{
+			ID:         apiKey.ID,
+			Name:       apiKey.Name,
+			Hash:       hash,
+			Scopes:     apiKey.Scopes,
+			CreatedAt:  apiKey.CreatedAt,
+			ExpiresAt:  apiKey.ExpiresAt,
+			LastUsedAt: apiKey.LastUsedAt,
+			RevokedAt:  apiKey.RevokedAt,
+		}).Error
+	})
+}
+
+func (s gormAPIKeyStore) setAPIKeyHash(id uuid.UUID, hash string) error {
+	return s.update(id, "hash", hash)
+}
+
+func (s gormAPIKeyStore) revokeAPIKey(id uuid.UUID, revokedAt time.Time) error {
+	return s.update(id, "revoked_at", revokedAt)
+}
+
+func (s gormAPIKeyStore) setAPIKeyLastUsed(id uuid.UUID, lastUsedAt time.Time) error {
+	return s.update(id, "last_used_at", lastUsedAt)
+}
+
+func (s gormAPIKeyStore) update(id uuid.UUID, column string, value interface{}) error {
+	result := s.db.Model(&gormAPIKey{}).Where("id = ?", id).Update(column, value)
+	if result.Error != nil {
+		return result.Error
+	}
+	if result.RowsAffected == 0 {
+		return gorm.ErrRecordNotFound
+	}
+	return nil
+}
+
+type gormAPIKey struct {
+	ID         uuid.UUID `gorm:"column:id;type:uuid;primaryKey"`
+	Name       string    `gorm:"not null;uniqueIndex"`
+	Hash       string    `gorm:"not null;uniqueIndex"`
+	Scopes     datatypes.JSONSlice[string]
+	CreatedAt  time.Time
+	ExpiresAt  *time.Time
+	LastUsedAt *time.Time
+	RevokedAt  *time.Time
+}
+
+func (gormAPIKey) TableName() string {
+	return "api_key"
+}
+
+func (k gormAPIKey) toAPIKey() apiKey {
+	return apiKey{
+		ID:         k.ID,
+		Name:       k.Name,
+		Scopes:     k.Scopes,
+		CreatedAt:  k.CreatedAt,
+		ExpiresAt:  k.ExpiresAt,
+		LastUsedAt: k.LastUsedAt,
+		RevokedAt:  k.RevokedAt,
+	}
+}
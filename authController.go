@@ -1,41 +1,175 @@
 package main
 
 import (
+	"context"
 	"encoding/json"
+	"errors"
 	"fmt"
+	"io"
 	"log"
 	"net/http"
+	"net/netip"
+	"slices"
 	"strings"
 	"time"
 
 	"github.com/golang-jwt/jwt/v5"
+	"github.com/google/uuid"
+	"gorm.io/gorm"
 )
 
 type authController struct {
 	jwtSecret            string
 	tokenDurationSeconds int
 	authenticator        authenticator
+
+	// refreshTokenStore is optional. If set, refresh tokens are issued alongside access tokens.
+	refreshTokenStore    refreshTokenStore
+	refreshTokenDuration time.Duration
+	// userStore is optional. If set, refreshes are rejected for users that have been disabled or removed.
+	userStore userStore
+	denylist  tokenDenylist
+	// loginLimiter is optional. If set, clients and usernames are locked out after repeated failed logins.
+	loginLimiter *loginLimiter
+	// trustedProxies are the proxies whose X-Forwarded-For header gives the client IP.
+	trustedProxies []netip.Prefix
 }
 
 // GET /auth/token
 // Requires basic auth
 func (a authController) getAuthToken(w http.ResponseWriter, r *http.Request) {
 	reqUsername, reqPassword, _ := r.BasicAuth()
-	valid, err := a.authenticator.authenticate(reqUsername, reqPassword)
-	if !valid {
-		w.WriteHeader(http.StatusForbidden)
+	usernameKey := "username:" + reqUsername
+	limiterKeys := []string{"ip:" + clientIP(r, a.trustedProxies), usernameKey}
+	if a.loginLimiter != nil {
+		retryAfter := a.loginLimiter.retryAfter(limiterKeys...)
+		if retryAfter > 0 {
+			writeRetryAfter(w, retryAfter)
+			writeProblem(w, r, http.StatusTooManyRequests, errorCodeRateLimited, "Too many failed logins")
+			return
+		}
+	}
+	user, err := a.authenticator.authenticate(reqUsername, reqPassword)
+	if err != nil {
+		if a.loginLimiter != nil {
+			a.loginLimiter.fail(limiterKeys...)
+		}
+		writeProblem(w, r, http.StatusForbidden, errorCodeForbidden, "Invalid username or password")
+		return
+	}
+	if a.loginLimiter != nil {
+		// The client IP is not reset, so that a client with one valid login cannot go on guessing others
+		a.loginLimiter.succeed(usernameKey)
+	}
+
+	a.writeTokens(w, r, user.Username, user.Role, uuid.New())
+}
+
+// POST /auth/refresh
+// Exchanges a refresh token for a new access token and refresh token. Each refresh token may only be used once.
+// If a used token is presented again, it has likely been stolen, so every token descended from the same login is
+// revoked.
+func (a authController) postAuthRefresh(w http.ResponseWriter, r *http.Request) {
+	decoder := json.NewDecoder(r.Body)
+	var refreshTokenInput refreshTokenInput
+	err := decoder.Decode(&refreshTokenInput)
+	if err != nil {
+		writeProblem(w, r, http.StatusBadRequest, errorCodeInvalidBody, fmt.Sprintf("Cannot decode request JSON: %s", err))
+		return
+	}
+
+	now := time.Now()
+	token, err := a.refreshTokenStore.readRefreshTokenByHash(hashSecret(refreshTokenInput.RefreshToken))
+	if errors.Is(err, gorm.ErrRecordNotFound) {
+		writeProblem(w, r, http.StatusUnauthorized, errorCodeUnauthorized, "Invalid refresh token")
+		return
+	}
+	if err != nil {
+		writeStoreError(w, r, err)
+		return
+	}
+	if token.RevokedAt != nil || now.After(token.ExpiresAt) {
+		writeProblem(w, r, http.StatusUnauthorized, errorCodeUnauthorized, "Revoked or expired refresh token")
+		return
+	}
+	unused, err := a.refreshTokenStore.useRefreshToken(token.ID, now)
+	if err != nil {
+		writeStoreError(w, r, err)
+		return
+	}
+	if !unused {
+		err = a.refreshTokenStore.revokeRefreshTokenFamily(token.FamilyID, now)
+		if err != nil {
+			log.Printf("Storage Error: %s", err)
+		}
+		writeProblem(w, r, http.StatusUnauthorized, errorCodeUnauthorized, "Refresh token has already been used")
+		return
+	}
+
+	role := token.Role
+	if a.userStore != nil {
+		user, err := a.userStore.readUser(token.Username)
+		if err != nil || user.Disabled {
+			writeProblem(w, r, http.StatusUnauthorized, errorCodeUnauthorized, "Refresh rejected for unavailable user")
+			return
+		}
+		// Role changes take effect on refresh.
+		role = user.Role
+	}
+
+	a.writeTokens(w, r, token.Username, role, token.FamilyID)
+}
+
+// POST /auth/logout
+// Revokes the access token of the request and, if given, the refresh token and every token descended from the same
+// login.
+func (a authController) postAuthLogout(w http.ResponseWriter, r *http.Request) {
+	jti, expiresAt, ok := requestTokenID(r)
+	if !ok {
+		writeProblem(w, r, http.StatusBadRequest, errorCodeInvalidParameter, "Only JWTs can be logged out")
+		return
+	}
+
+	var refreshTokenInput refreshTokenInput
+	err := json.NewDecoder(r.Body).Decode(&refreshTokenInput)
+	if err != nil && !errors.Is(err, io.EOF) {
+		writeProblem(w, r, http.StatusBadRequest, errorCodeInvalidBody, fmt.Sprintf("Cannot decode request JSON: %s", err))
 		return
 	}
 
+	now := time.Now()
+	err = a.denylist.deny(jti, expiresAt)
+	if err != nil {
+		writeStoreError(w, r, err)
+		return
+	}
+	if refreshTokenInput.RefreshToken != "" && a.refreshTokenStore != nil {
+		token, err := a.refreshTokenStore.readRefreshTokenByHash(hashSecret(refreshTokenInput.RefreshToken))
+		if err == nil && token.Username == requestUsername(r) {
+			err = a.refreshTokenStore.revokeRefreshTokenFamily(token.FamilyID, now)
+		}
+		if err != nil && !errors.Is(err, gorm.ErrRecordNotFound) {
+			writeStoreError(w, r, err)
+			return
+		}
+	}
+
+	w.WriteHeader(http.StatusOK)
+}
+
+// writeTokens responds with a new access token and, if refresh tokens are enabled, a refresh token in the family.
+func (a authController) writeTokens(w http.ResponseWriter, r *http.Request, username string, role string, familyID uuid.UUID) {
+	now := time.Now()
 	token := jwt.NewWithClaims(jwt.SigningMethodHS256, jwt.MapClaims{
 		"subject":  "go",
-		"username": reqUsername,
-		"exp":      time.Now().Unix() + int64(a.tokenDurationSeconds),
+		"username": username,
+		"role":     role,
+		"jti":      uuid.NewString(),
+		"exp":      now.Unix() + int64(a.tokenDurationSeconds),
 	})
 	tokenString, err := token.SignedString([]byte(a.jwtSecret))
 	if err != nil {
-		log.Printf("Unable to sign JWT: %s", err)
-		w.WriteHeader(http.StatusInternalServerError)
+		writeInternalError(w, r, "Unable to sign JWT", err)
 		return
 	}
 
@@ -43,10 +177,30 @@ func (a authController) getAuthToken(w http.ResponseWriter, r *http.Request) {
 		Token: tokenString,
 	}
 
+	if a.refreshTokenStore != nil {
+		secret, err := newSecret()
+		if err != nil {
+			writeInternalError(w, r, "Cannot generate refresh token", err)
+			return
+		}
+		err = a.refreshTokenStore.createRefreshToken(refreshToken{
+			ID:        uuid.New(),
+			FamilyID:  familyID,
+			Username:  username,
+			Role:      role,
+			CreatedAt: now,
+			ExpiresAt: now.Add(a.refreshTokenDuration),
+		}, hashSecret(secret))
+		if err != nil {
+			writeStoreError(w, r, err)
+			return
+		}
+		clientToken.RefreshToken = secret
+	}
+
 	httpJson, err := json.Marshal(clientToken)
 	if err != nil {
-		log.Printf("Cannot encode response JSON")
-		w.WriteHeader(http.StatusInternalServerError)
+		writeInternalError(w, r, "Cannot encode response JSON", err)
 		return
 	}
 
@@ -54,7 +208,13 @@ func (a authController) getAuthToken(w http.ResponseWriter, r *http.Request) {
 	w.Write(httpJson)
 }
 
-func authMiddleware(jwtSecret string, apiKey string, next http.Handler) http.Handler {
+// authMiddleware authenticates requests by JWT or API key, and records the username and scopes in the request
+// context. JWTs are given the scopes of their role, and are rejected if their ID is in the denylist. HMAC-signed
+// JWTs are those issued by this server, and are rejected if their user has since been disabled or removed from the
+// userStore, if it is set. Others are verified by the externalVerifier, if it is set. API keys are looked up in the
+// apiKeyStore, if it is set. Requests with neither may authenticate with a verified TLS client certificate, whose
+// common name is mapped to a role by clientCertificateRoles.
+func authMiddleware(jwtSecret string, externalVerifier *externalTokenVerifier, denylist tokenDenylist, userStore userStore, apiKeyStore apiKeyStore, clientCertificateRoles map[string]string, next http.Handler) http.Handler {
 	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
 		var bearerTokenString string
 		var apiKeyString string
@@ -68,15 +228,19 @@ func authMiddleware(jwtSecret string, apiKey string, next http.Handler) http.Han
 		}
 
 		if bearerTokenString != "" {
+			external := false
 			token, err := jwt.Parse(bearerTokenString, func(token *jwt.Token) (interface{}, error) {
-				if _, ok := token.Method.(*jwt.SigningMethodHMAC); !ok {
+				if _, ok := token.Method.(*jwt.SigningMethodHMAC); ok {
+					return []byte(jwtSecret), nil
+				}
+				if externalVerifier == nil {
 					return nil, fmt.Errorf("unexpected signing method: %v", token.Header["alg"])
 				}
-				return []byte(jwtSecret), nil
+				external = true
+				return externalVerifier.key(token)
 			})
 			if err != nil {
-				log.Printf("JWT parsing failed: %s", err)
-				w.WriteHeader(http.StatusUnauthorized)
+				writeProblem(w, r, http.StatusUnauthorized, errorCodeUnauthorized, fmt.Sprintf("JWT parsing failed: %s", err))
 				return
 			}
 
@@ -85,20 +249,88 @@ func authMiddleware(jwtSecret string, apiKey string, next http.Handler) http.Han
 				log.Printf("JWT claims failed: %s", err)
 			}
 			exp, _ := claims.GetExpirationTime()
-			if exp.Before(time.Now()) {
-				log.Printf("JWT expired at: %s", exp)
-				w.WriteHeader(http.StatusUnauthorized)
+			if exp == nil || exp.Before(time.Now()) {
+				writeProblem(w, r, http.StatusUnauthorized, errorCodeUnauthorized, fmt.Sprintf("JWT expired at: %s", exp))
+				return
+			}
+			var username, role string
+			if external {
+				username, role, err = externalVerifier.identify(claims)
+				if err != nil {
+					writeProblem(w, r, http.StatusUnauthorized, errorCodeUnauthorized, fmt.Sprintf("External JWT rejected: %s", err))
+					return
+				}
+			} else {
+				username, _ = claims["username"].(string)
+				role, _ = claims["role"].(string)
+				if userStore != nil {
+					// Otherwise, the tokens of disabled users would be accepted until they expire.
+					user, err := userStore.readUser(username)
+					if errors.Is(err, gorm.ErrRecordNotFound) || (err == nil && user.Disabled) {
+						writeProblem(w, r, http.StatusUnauthorized, errorCodeUnauthorized, "JWT rejected for unavailable user")
+						return
+					}
+					if err != nil {
+						writeStoreError(w, r, err)
+						return
+					}
+				}
+			}
+			jti, _ := claims["jti"].(string)
+			if jti == "" && !external {
+				// Tokens without IDs cannot be revoked, so they are not accepted.
+				writeProblem(w, r, http.StatusUnauthorized, errorCodeUnauthorized, "JWT has no ID")
+				return
+			}
+			if jti != "" {
+				denied, err := denylist.isDenied(jti)
+				if err != nil {
+					writeInternalError(w, r, "Cannot check token denylist", err)
+					return
+				}
+				if denied {
+					writeProblem(w, r, http.StatusUnauthorized, errorCodeUnauthorized, "JWT has been revoked")
+					return
+				}
+			}
+			ctx := context.WithValue(r.Context(), usernameContextKey, username)
+			ctx = context.WithValue(ctx, scopesContextKey, roleScopes[role])
+			if jti != "" {
+				ctx = context.WithValue(ctx, tokenIDContextKey, jti)
+				ctx = context.WithValue(ctx, tokenExpiryContextKey, exp.Time)
+			}
+			r = r.WithContext(ctx)
+		} else if apiKeyStore != nil && apiKeyString != "" {
+			now := time.Now()
+			apiKey, err := apiKeyStore.readAPIKeyByHash(hashSecret(apiKeyString))
+			if errors.Is(err, gorm.ErrRecordNotFound) {
+				writeProblem(w, r, http.StatusUnauthorized, errorCodeUnauthorized, "Invalid API key")
+				return
+			}
+			if err != nil {
+				writeStoreError(w, r, err)
 				return
 			}
-		} else if apiKey != "" && apiKeyString != "" {
-			if apiKeyString != apiKey {
-				log.Printf("Invalid API key")
-				w.WriteHeader(http.StatusUnauthorized)
+			if !apiKey.usable(now) {
+				writeProblem(w, r, http.StatusUnauthorized, errorCodeUnauthorized, fmt.Sprintf("Revoked or expired API key: %s", apiKey.Name))
 				return
 			}
+			// Only record usage periodically, so that every request does not cause a write.
+			if apiKey.LastUsedAt == nil || now.Sub(*apiKey.LastUsedAt) > apiKeyLastUsedInterval {
+				err = apiKeyStore.setAPIKeyLastUsed(apiKey.ID, now)
+				if err != nil {
+					log.Printf("Storage Error: %s", err)
+				}
+			}
+			ctx := context.WithValue(r.Context(), usernameContextKey, apiKey.subject())
+			ctx = context.WithValue(ctx, scopesContextKey, []string(apiKey.Scopes))
+			r = r.WithContext(ctx)
+		} else if username, role, ok := clientCertificateIdentity(r, clientCertificateRoles); ok {
+			ctx := context.WithValue(r.Context(), usernameContextKey, username)
+			ctx = context.WithValue(ctx, scopesContextKey, roleScopes[role])
+			r = r.WithContext(ctx)
 		} else {
-			log.Printf("Authorization scheme not supported")
-			w.WriteHeader(http.StatusUnauthorized)
+			writeProblem(w, r, http.StatusUnauthorized, errorCodeUnauthorized, "Authorization scheme not supported")
 			return
 		}
 
@@ -107,6 +339,52 @@ func authMiddleware(jwtSecret string, apiKey string, next http.Handler) http.Han
 	})
 }
 
+// authContextKey is the type of the request context values set by authMiddleware.
+type authContextKey string
+
+const (
+	usernameContextKey authContextKey = "username"
+	scopesContextKey   authContextKey = "scopes"
+	// tokenIDContextKey and tokenExpiryContextKey are only set for requests authenticated by JWT.
+	tokenIDContextKey     authContextKey = "tokenID"
+	tokenExpiryContextKey authContextKey = "tokenExpiry"
+)
+
+// apiKeyLastUsedInterval is how out of date the last used time of an API key may be.
+const apiKeyLastUsedInterval = time.Minute
+
+// requestUsername returns the authenticated username of the request, or an empty string if there is none.
+func requestUsername(r *http.Request) string {
+	username, _ := r.Context().Value(usernameContextKey).(string)
+	return username
+}
+
+// requestTokenID returns the ID and expiry of the JWT that authenticated the request. ok is false if the request
+// was not authenticated by JWT.
+func requestTokenID(r *http.Request) (jti string, expiresAt time.Time, ok bool) {
+	jti, ok = r.Context().Value(tokenIDContextKey).(string)
+	expiresAt, _ = r.Context().Value(tokenExpiryContextKey).(time.Time)
+	return jti, expiresAt, ok
+}
+
+// requestScopes returns the scopes granted to the request.
+func requestScopes(r *http.Request) []string {
+	scopes, _ := r.Context().Value(scopesContextKey).([]string)
+	return scopes
+}
+
+// requireScope responds with 403 unless the request has the required scope.
+func requireScope(required string, next func(http.ResponseWriter, *http.Request)) func(http.ResponseWriter, *http.Request) {
+	return func(w http.ResponseWriter, r *http.Request) {
+		if !slices.Contains(requestScopes(r), required) {
+			writeProblem(w, r, http.StatusForbidden, errorCodeForbidden, fmt.Sprintf("Scope %s required: %s", required, requestUsername(r)))
+			return
+		}
+		next(w, r)
+	}
+}
+
 type clientToken struct {
-	Token string `json:"token"`
+	Token        string `json:"token"`
+	RefreshToken string `json:"refreshToken,omitempty"`
 }
@@ -1,31 +1,75 @@
 package main
 
 import (
+	"crypto/subtle"
+	"errors"
 	"fmt"
 	"log"
+
+	"golang.org/x/crypto/bcrypt"
+	"gorm.io/gorm"
 )
 
 // authenticator is an interface for validating usernames and passwords.
 type authenticator interface {
-	// authenticate returns true if the username and password are valid.
-	authenticate(username string, password string) (bool, error)
+	// authenticate returns the user if the username and password are valid, and an error otherwise.
+	authenticate(username string, password string) (*user, error)
 }
 
 // singleUserAuthenticator is a simple authenticator that only accepts a literal single username and password.
-// In real applications, these should be injected by environment variables.
+// In real applications, these should be injected by environment variables. The user is an admin.
 type singleUserAuthenticator struct {
 	username string
 	password string
 }
 
-func (a singleUserAuthenticator) authenticate(username string, password string) (bool, error) {
-	if username != a.username {
-		log.Printf("Invalid username: %s", username)
-		return false, fmt.Errorf("Invalid username: %s", username)
+func (a singleUserAuthenticator) authenticate(username string, password string) (*user, error) {
+	// Attempted usernames are not logged, since they are often passwords typed into the wrong field.
+	if subtle.ConstantTimeCompare([]byte(username), []byte(a.username)) != 1 {
+		log.Printf("Invalid username")
+		return nil, fmt.Errorf("Invalid username")
 	}
-	if password != a.password {
+	if subtle.ConstantTimeCompare([]byte(password), []byte(a.password)) != 1 {
 		log.Printf("Invalid password")
-		return false, fmt.Errorf("Invalid password")
+		return nil, fmt.Errorf("Invalid password")
+	}
+	return &user{Username: username, Role: roleAdmin}, nil
+}
+
+// gormUserAuthenticator validates against the bcrypt password hashes of the users in a GORM database.
+// Disabled users are rejected.
+type gormUserAuthenticator struct {
+	db *gorm.DB
+}
+
+func newGormUserAuthenticator(db *gorm.DB) gormUserAuthenticator {
+	return gormUserAuthenticator{db: db}
+}
+
+// unknownUserHash is compared against when the username does not exist, so that unknown usernames take as long
+// to reject as wrong passwords.
+var unknownUserHash, _ = bcrypt.GenerateFromPassword([]byte("unknown"), bcrypt.DefaultCost)
+
+func (a gormUserAuthenticator) authenticate(username string, password string) (*user, error) {
+	var gormUser gormUser
+	err := a.db.First(&gormUser, "username = ?", username).Error
+	if errors.Is(err, gorm.ErrRecordNotFound) {
+		bcrypt.CompareHashAndPassword(unknownUserHash, []byte(password))
+		log.Printf("Invalid username")
+		return nil, fmt.Errorf("Invalid username")
+	}
+	if err != nil {
+		return nil, err
+	}
+	err = bcrypt.CompareHashAndPassword([]byte(gormUser.PasswordHash), []byte(password))
+	if err != nil {
+		log.Printf("Invalid password")
+		return nil, fmt.Errorf("Invalid password")
+	}
+	if gormUser.Disabled {
+		log.Printf("Disabled user: %s", username)
+		return nil, fmt.Errorf("Disabled user: %s", username)
 	}
-	return true, nil
+	user := gormUser.toUser()
+	return &user, nil
 }
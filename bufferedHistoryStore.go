@@ -0,0 +1,488 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log"
+	"os"
+	"slices"
+	"sync"
+	"time"
+
+	"github.com/google/uuid"
+	"go.opentelemetry.io/otel"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/metric"
+)
+
+// bufferedHistoryStore writes history to another store in the background, in batches, so that writers do not wait
+// for a database round trip per value. Values are batched until the batch is full or the flush interval passes.
+// Reads include the values that have not been written yet.
+//
+// If a batch cannot be written while the database is down, it is spilled to a file on disk, and later values are
+// spilled after it to keep their order. The spilled values are retried at each flush, before any newer ones. While
+// spilled, values are missing from reads. If the queue is full, writers wait for it to drain. If a batch cannot be
+// written while the database is up, it holds values that never will be, which are found and dropped so that they do
+// not hold up the rest.
+//
+// Queued values are lost if the process crashes. On close, they are written or spilled.
+type bufferedHistoryStore struct {
+	store         historyBatchWriter
+	batchSize     int
+	maxQueued     int
+	flushInterval time.Duration
+
+	mux sync.Mutex
+	// notFull is signalled when the queue has room, or the store is closed.
+	notFull *sync.Cond
+	queue   []historyWrite
+	// flushing are the values being written, which reads still include until they are.
+	flushing []historyWrite
+	closed   bool
+
+	// flushMux is held while flushing, so that flushes and the spill file are not used concurrently.
+	flushMux sync.Mutex
+	spill    *os.File
+	// spillSize is the size of the valid frames in the spill file, and spillReplayed the size of those written.
+	spillSize     int64
+	spillReplayed int64
+	// spilled is the number of values in the spill file. It is read by metrics, so it is guarded by mux.
+	spilled int
+
+	wake chan struct{}
+	stop chan struct{}
+	done chan struct{}
+
+	flushDuration metric.Float64Histogram
+	registration  metric.Registration
+}
+
+// newBufferedHistoryStore opens the spill file, creating it if needed, and starts flushing. Values spilled before a
+// restart are written at the first flush.
+func newBufferedHistoryStore(
+	store historyBatchWriter,
+	spillFile string,
+	batchSize int,
+	maxQueued int,
+	flushInterval time.Duration,
+) (*bufferedHistoryStore, error) {
+	spill, err := os.OpenFile(spillFile, os.O_RDWR|os.O_CREATE|os.O_APPEND, 0o644)
+	if err != nil {
+		return nil, err
+	}
+	s := &bufferedHistoryStore{
+		store:         store,
+		batchSize:     batchSize,
+		maxQueued:     maxQueued,
+		flushInterval: flushInterval,
+		spill:         spill,
+		wake:          make(chan struct{}, 1),
+		stop:          make(chan struct{}),
+		done:          make(chan struct{}),
+	}
+	s.notFull = sync.NewCond(&s.mux)
+	err = s.openSpill()
+	if err == nil {
+		err = s.registerMetrics()
+	}
+	if err != nil {
+		spill.Close()
+		return nil, err
+	}
+	go s.run()
+	return s, nil
+}
+
+// openSpill counts the spilled values, and removes any frame torn by a crash from the end of the spill file.
+func (s *bufferedHistoryStore) openSpill() error {
+	data, err := os.ReadFile(s.spill.Name())
+	if err != nil {
+		return err
+	}
+	spilled := 0
+	valid, err := readFrames(data, func(frameType byte, payload []byte) error {
+		if frameType != frameWrite {
+			return errCorruptNativeHistory
+		}
+		spilled++
+		return nil
+	})
+	if err != nil {
+		return fmt.Errorf("cannot read %s: %w", s.spill.Name(), err)
+	}
+	if valid < len(data) {
+		err = s.spill.Truncate(int64(valid))
+		if err != nil {
+			return err
+		}
+	}
+	s.spillSize = int64(valid)
+	s.spilled = spilled
+	return nil
+}
+
+func (s *bufferedHistoryStore) registerMetrics() error {
+	meter := otel.Meter("timeseries-api")
+	var err error
+	s.flushDuration, err = meter.Float64Histogram(
+		"history.buffer.flush.duration",
+		metric.WithDescription("The time taken to write a batch of history values"),
+		metric.WithUnit("s"),
+	)
+	if err != nil {
+		return err
+	}
+	queued, err := meter.Int64ObservableGauge(
+		"history.buffer.queued",
+		metric.WithDescription("The number of history values waiting to be written"),
+	)
+	if err != nil {
+		return err
+	}
+	spilled, err := meter.Int64ObservableGauge(
+		"history.buffer.spilled",
+		metric.WithDescription("The number of history values spilled to disk, waiting to be written"),
+	)
+	if err != nil {
+		return err
+	}
+	s.registration, err = meter.RegisterCallback(func(ctx context.Context, observer metric.Observer) error {
+		s.mux.Lock()
+		defer s.mux.Unlock()
+		observer.ObserveInt64(queued, int64(len(s.queue)+len(s.flushing)))
+		observer.ObserveInt64(spilled, int64(s.spilled))
+		return nil
+	}, queued, spilled)
+	return err
+}
+
+// close writes or spills the queued values, and stops flushing. Later writes fail.
+func (s *bufferedHistoryStore) close() error {
+	s.mux.Lock()
+	if s.closed {
+		s.mux.Unlock()
+		return nil
+	}
+	s.closed = true
+	s.notFull.Broadcast()
+	s.mux.Unlock()
+
+	close(s.stop)
+	<-s.done
+	s.flush()
+	s.registration.Unregister()
+
+	s.flushMux.Lock()
+	defer s.flushMux.Unlock()
+	s.mux.Lock()
+	defer s.mux.Unlock()
+	if len(s.queue) > 0 {
+		return fmt.Errorf("%d history values could not be written or spilled", len(s.queue))
+	}
+	return s.spill.Close()
+}
+
+func (s *bufferedHistoryStore) ping(ctx context.Context) error {
+	store, ok := s.store.(pinger)
+	if !ok {
+		return nil
+	}
+	return store.ping(ctx)
+}
+
+func (s *bufferedHistoryStore) readHistory(
+	pointId uuid.UUID,
+	start *time.Time,
+	end *time.Time,
+) ([]hisItem, error) {
+	// Pending values are found first, so that none are missed by being written while the store is read
+	pending := s.pending(pointId)
+	result, err := s.store.readHistory(pointId, start, end)
+	if err != nil || len(pending) == 0 {
+		return result, err
+	}
+	from, to := hisRange(pending, start, end)
+	for _, item := range pending[from:to] {
+		i, found := slices.BinarySearchFunc(result, *item.Ts, compareHisItemTs)
+		if found {
+			result[i] = item
+		} else {
+			result = slices.Insert(result, i, item)
+		}
+	}
+	return result, nil
+}
+
+func (s *bufferedHistoryStore) readLatestHistory(pointId uuid.UUID) (*hisItem, error) {
+	pending := s.pending(pointId)
+	latest, err := s.store.readLatestHistory(pointId)
+	if err != nil || len(pending) == 0 {
+		return latest, err
+	}
+	item := pending[len(pending)-1]
+	if latest == nil || !item.Ts.Before(*latest.Ts) {
+		return &item, nil
+	}
+	return latest, nil
+}
+
+// pending returns the point's values that have not been written yet, sorted by time. Later values at a time replace
+// earlier ones.
+func (s *bufferedHistoryStore) pending(pointId uuid.UUID) []hisItem {
+	s.mux.Lock()
+	defer s.mux.Unlock()
+	result := []hisItem{}
+	for _, writes := range [][]historyWrite{s.flushing, s.queue} {
+		for _, write := range writes {
+			if write.pointId != pointId {
+				continue
+			}
+			i, found := slices.BinarySearchFunc(result, *write.item.Ts, compareHisItemTs)
+			if found {
+				result[i] = copyHisItem(write.item)
+			} else {
+				result = slices.Insert(result, i, copyHisItem(write.item))
+			}
+		}
+	}
+	return result
+}
+
+// writeHistory queues the value to be written. It waits while the queue is full.
+func (s *bufferedHistoryStore) writeHistory(
+	pointId uuid.UUID,
+	hisItem hisItem,
+) error {
+	if hisItem.Ts == nil {
+		return errors.New("history must have a timestamp")
+	}
+	s.mux.Lock()
+	defer s.mux.Unlock()
+	for len(s.queue) >= s.maxQueued && !s.closed {
+		s.notFull.Wait()
+	}
+	if s.closed {
+		return errors.New("buffered history store is closed")
+	}
+	s.queue = append(s.queue, historyWrite{pointId: pointId, item: copyHisItem(hisItem)})
+	if len(s.queue) >= s.batchSize {
+		select {
+		case s.wake <- struct{}{}:
+		default:
+		}
+	}
+	return nil
+}
+
+// deleteHistory writes the values written before it, so that they are deleted too. It fails if they cannot be
+// written.
+func (s *bufferedHistoryStore) deleteHistory(
+	pointId uuid.UUID,
+	start *time.Time,
+	end *time.Time,
+) error {
+	err := s.flush()
+	if err != nil {
+		return err
+	}
+	return s.store.deleteHistory(pointId, start, end)
+}
+
+// run flushes whenever a batch is full or the interval passes, until stopped.
+func (s *bufferedHistoryStore) run() {
+	defer close(s.done)
+	ticker := time.NewTicker(s.flushInterval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-s.stop:
+			return
+		case <-ticker.C:
+		case <-s.wake:
+		}
+		s.flush()
+	}
+}
+
+// flush writes the spilled values, then the queued values, in batches. If any cannot be written, they and the rest of
+// the queue are spilled, and the error is returned.
+func (s *bufferedHistoryStore) flush() error {
+	s.flushMux.Lock()
+	defer s.flushMux.Unlock()
+
+	err := s.replaySpill()
+	for err == nil {
+		batch := s.takeBatch()
+		if len(batch) == 0 {
+			return nil
+		}
+		err = s.writeBatch(batch)
+		if err != nil {
+			// Spill this batch before those after it
+			s.mux.Lock()
+			s.queue = append(batch, s.queue...)
+			s.mux.Unlock()
+		}
+		s.mux.Lock()
+		s.flushing = nil
+		s.mux.Unlock()
+	}
+	spillErr := s.spillQueue()
+	s.mux.Lock()
+	spilled := s.spilled
+	s.mux.Unlock()
+	log.Printf("Unable to write history, %d values are spilled to %s: %s", spilled, s.spill.Name(), err)
+	if spillErr != nil {
+		log.Printf("Unable to spill history, keeping it queued: %s", spillErr)
+	}
+	return err
+}
+
+// takeBatch moves the next batch from the queue to the values being flushed.
+func (s *bufferedHistoryStore) takeBatch() []historyWrite {
+	s.mux.Lock()
+	defer s.mux.Unlock()
+	n := min(len(s.queue), s.batchSize)
+	batch := slices.Clone(s.queue[:n])
+	s.queue = slices.Delete(s.queue, 0, n)
+	s.flushing = batch
+	s.notFull.Broadcast()
+	return batch
+}
+
+// writeBatch writes the batch. If it fails while the store is available, the failure is permanent, so the batch is
+// split in half until the values that cannot be written are found, and those are dropped. An error is only returned
+// if the store may be unavailable, so that the batch is retried.
+func (s *bufferedHistoryStore) writeBatch(batch []historyWrite) error {
+	err := s.writeBatchOnce(batch)
+	if err == nil || !s.available() {
+		return err
+	}
+	if len(batch) == 1 {
+		log.Printf("Dropping history for %s at %s, as it cannot be written: %s", batch[0].pointId, batch[0].item.Ts, err)
+		return nil
+	}
+	half := len(batch) / 2
+	err = s.writeBatch(batch[:half])
+	if err != nil {
+		return err
+	}
+	return s.writeBatch(batch[half:])
+}
+
+// available returns whether the store can be reached. Stores that cannot be pinged are never known to be available,
+// so that their failures are always retried.
+func (s *bufferedHistoryStore) available() bool {
+	store, ok := s.store.(pinger)
+	if !ok {
+		return false
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	return store.ping(ctx) == nil
+}
+
+func (s *bufferedHistoryStore) writeBatchOnce(batch []historyWrite) error {
+	start := time.Now()
+	err := s.store.writeHistoryBatch(batch)
+	s.flushDuration.Record(
+		context.Background(),
+		time.Since(start).Seconds(),
+		metric.WithAttributes(attribute.Bool("error", err != nil)),
+	)
+	return err
+}
+
+// replaySpill writes the spilled values in batches, and empties the spill file once all are written. If a batch
+// fails, the next replay resumes from it.
+func (s *bufferedHistoryStore) replaySpill() error {
+	if s.spillSize == 0 {
+		return nil
+	}
+	data := make([]byte, s.spillSize-s.spillReplayed)
+	_, err := s.spill.ReadAt(data, s.spillReplayed)
+	if err != nil {
+		return err
+	}
+	batch := []historyWrite{}
+	batchSize := int64(0)
+	writeBatch := func() error {
+		err := s.writeBatch(batch)
+		if err != nil {
+			return err
+		}
+		s.spillReplayed += batchSize
+		s.mux.Lock()
+		s.spilled -= len(batch)
+		s.mux.Unlock()
+		batch = batch[:0]
+		batchSize = 0
+		return nil
+	}
+	_, err = readFrames(data, func(frameType byte, payload []byte) error {
+		pointId, point, err := decodeWrite(payload)
+		if err != nil {
+			return err
+		}
+		ts := time.Unix(0, point.ts).UTC()
+		batch = append(batch, historyWrite{pointId: pointId, item: hisItem{Ts: &ts, Value: point.value}})
+		batchSize += int64(frameHeaderSize + len(payload))
+		if len(batch) < s.batchSize {
+			return nil
+		}
+		return writeBatch()
+	})
+	if err == nil && len(batch) > 0 {
+		err = writeBatch()
+	}
+	if err != nil {
+		return err
+	}
+	err = s.spill.Truncate(0)
+	if err != nil {
+		return err
+	}
+	s.spillSize = 0
+	s.spillReplayed = 0
+	log.Printf("Wrote the history spilled to %s", s.spill.Name())
+	return nil
+}
+
+// spillQueue appends the queued values to the spill file, and syncs it. The queue is not locked while the file is
+// written, so that writers and reads do not wait for the sync.
+func (s *bufferedHistoryStore) spillQueue() error {
+	s.mux.Lock()
+	spilling := s.queue
+	s.queue = nil
+	s.flushing = spilling
+	s.mux.Unlock()
+
+	frames := []byte{}
+	for _, write := range spilling {
+		point := nativePoint{ts: write.item.Ts.UnixNano(), value: write.item.Value}
+		frames = appendFrame(frames, frameWrite, encodeWrite(write.pointId, point))
+	}
+	_, err := s.spill.Write(frames)
+	if err == nil {
+		err = s.spill.Sync()
+	}
+	if err != nil {
+		// Remove any partial frame, so that later frames can be replayed
+		s.spill.Truncate(s.spillSize)
+	} else {
+		s.spillSize += int64(len(frames))
+	}
+
+	s.mux.Lock()
+	defer s.mux.Unlock()
+	s.flushing = nil
+	if err != nil {
+		// Keep the values queued before those written since
+		s.queue = append(spilling, s.queue...)
+		return err
+	}
+	s.spilled += len(spilling)
+	s.notFull.Broadcast()
+	return nil
+}
@@ -0,0 +1,219 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"os"
+	"path/filepath"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/google/uuid"
+	"github.com/stretchr/testify/assert"
+)
+
+// fakeBatchHistoryStore is an in-memory history store that records its batches, and can be made to fail or wait.
+// Batches with negative values always fail, even while it is up.
+type fakeBatchHistoryStore struct {
+	inMemoryHistoryStore
+	mux     *sync.Mutex
+	batches *[]int
+	failing *bool
+	// gate is optional. If set, batches wait to receive from it.
+	gate chan struct{}
+}
+
+func newFakeBatchHistoryStore() fakeBatchHistoryStore {
+	store, _ := newInMemoryHistoryStore("")
+	return fakeBatchHistoryStore{
+		inMemoryHistoryStore: store,
+		mux:                  &sync.Mutex{},
+		batches:              &[]int{},
+		failing:              new(bool),
+	}
+}
+
+func (s fakeBatchHistoryStore) writeHistoryBatch(writes []historyWrite) error {
+	if s.gate != nil {
+		<-s.gate
+	}
+	s.mux.Lock()
+	defer s.mux.Unlock()
+	if *s.failing {
+		return errors.New("database is down")
+	}
+	for _, write := range writes {
+		if write.item.Value != nil && *write.item.Value < 0 {
+			return errors.New("value rejected")
+		}
+	}
+	*s.batches = append(*s.batches, len(writes))
+	for _, write := range writes {
+		s.inMemoryHistoryStore.writeHistory(write.pointId, write.item)
+	}
+	return nil
+}
+
+func (s fakeBatchHistoryStore) ping(ctx context.Context) error {
+	s.mux.Lock()
+	defer s.mux.Unlock()
+	if *s.failing {
+		return errors.New("database is down")
+	}
+	return nil
+}
+
+func (s fakeBatchHistoryStore) setFailing(failing bool) {
+	s.mux.Lock()
+	defer s.mux.Unlock()
+	*s.failing = failing
+}
+
+func (s fakeBatchHistoryStore) batchSizes() []int {
+	s.mux.Lock()
+	defer s.mux.Unlock()
+	return append([]int{}, *s.batches...)
+}
+
+func TestBufferedHistoryStore(t *testing.T) {
+	spillFile := filepath.Join(t.TempDir(), "spill.log")
+	fake := newFakeBatchHistoryStore()
+	store, err := newBufferedHistoryStore(fake, spillFile, 3, 100, time.Hour)
+	assert.Nil(t, err)
+	pointId := uuid.New()
+	start := time.Date(2024, 1, 1, 0, 0, 0, 0, time.UTC)
+	write := func(store historyStore, i int) {
+		ts := start.Add(time.Duration(i) * time.Minute)
+		err := store.writeHistory(pointId, hisItem{Ts: &ts, Value: f(float64(i))})
+		assert.Nil(t, err)
+	}
+	assertHistory := func(store historyStore, count int) {
+		history, err := store.readHistory(pointId, nil, nil)
+		assert.Nil(t, err)
+		assert.Len(t, history, count)
+		for i, item := range history {
+			assert.Equal(t, f(float64(i)), item.Value)
+		}
+	}
+
+	// Values are read before they are written
+	write(store, 0)
+	assertHistory(store, 1)
+	history, err := fake.readHistory(pointId, nil, nil)
+	assert.Nil(t, err)
+	assert.Len(t, history, 0)
+
+	// Filling a batch flushes without waiting for the interval, in batches of at most the size
+	for i := 1; i < 7; i++ {
+		write(store, i)
+	}
+	assert.Eventually(t, func() bool {
+		history, err := fake.readHistory(pointId, nil, nil)
+		return err == nil && len(history) == 7
+	}, time.Second, time.Millisecond)
+	batchSizes := fake.batchSizes()
+	for _, size := range batchSizes {
+		assert.LessOrEqual(t, size, 3)
+	}
+	assertHistory(store, 7)
+
+	// While the store fails, values are spilled to disk, and survive a restart
+	fake.setFailing(true)
+	for i := 7; i < 10; i++ {
+		write(store, i)
+	}
+	err = store.close()
+	assert.Nil(t, err)
+	info, err := os.Stat(spillFile)
+	assert.Nil(t, err)
+	assert.Greater(t, info.Size(), int64(0))
+	history, err = fake.readHistory(pointId, nil, nil)
+	assert.Nil(t, err)
+	assert.Len(t, history, 7)
+
+	// Once the store recovers, spilled values are written before newer ones
+	fake.setFailing(false)
+	restarted, err := newBufferedHistoryStore(fake, spillFile, 3, 100, time.Hour)
+	assert.Nil(t, err)
+	write(restarted, 10)
+	err = restarted.deleteHistory(uuid.New(), nil, nil)
+	assert.Nil(t, err)
+	assert.Equal(t, append(batchSizes, 3, 1), fake.batchSizes())
+	assertHistory(fake, 11)
+	info, err = os.Stat(spillFile)
+	assert.Nil(t, err)
+	assert.Equal(t, int64(0), info.Size())
+	err = restarted.close()
+	assert.Nil(t, err)
+}
+
+func TestBufferedHistoryStoreBackpressure(t *testing.T) {
+	fake := newFakeBatchHistoryStore()
+	fake.gate = make(chan struct{})
+	store, err := newBufferedHistoryStore(fake, filepath.Join(t.TempDir(), "spill.log"), 1, 1, time.Hour)
+	assert.Nil(t, err)
+	pointId := uuid.New()
+	ts := time.Date(2024, 1, 1, 0, 0, 0, 0, time.UTC)
+
+	// The first value is being written, and the second fills the queue
+	err = store.writeHistory(pointId, hisItem{Ts: &ts, Value: f(1)})
+	assert.Nil(t, err)
+	assert.Eventually(t, func() bool {
+		store.mux.Lock()
+		defer store.mux.Unlock()
+		return len(store.flushing) == 1
+	}, time.Second, time.Millisecond)
+	err = store.writeHistory(pointId, hisItem{Ts: &ts, Value: f(2)})
+	assert.Nil(t, err)
+
+	// The third waits until there is room
+	written := make(chan struct{})
+	go func() {
+		store.writeHistory(pointId, hisItem{Ts: &ts, Value: f(3)})
+		close(written)
+	}()
+	select {
+	case <-written:
+		t.Fatal("write did not wait for the full queue")
+	case <-time.After(50 * time.Millisecond):
+	}
+	fake.gate <- struct{}{}
+	<-written
+
+	close(fake.gate)
+	err = store.close()
+	assert.Nil(t, err)
+	history, err := fake.readHistory(pointId, nil, nil)
+	assert.Nil(t, err)
+	assert.Equal(t, f(3), history[0].Value)
+}
+
+func TestBufferedHistoryStoreRejectedValues(t *testing.T) {
+	spillFile := filepath.Join(t.TempDir(), "spill.log")
+	fake := newFakeBatchHistoryStore()
+	store, err := newBufferedHistoryStore(fake, spillFile, 4, 100, time.Hour)
+	assert.Nil(t, err)
+	pointId := uuid.New()
+	start := time.Date(2024, 1, 1, 0, 0, 0, 0, time.UTC)
+	for i, value := range []float64{0, 1, -1, 3, 4} {
+		ts := start.Add(time.Duration(i) * time.Minute)
+		err = store.writeHistory(pointId, hisItem{Ts: &ts, Value: f(value)})
+		assert.Nil(t, err)
+	}
+
+	// While the store is up, a value it rejects is dropped rather than spilled, and the others are written
+	err = store.deleteHistory(uuid.New(), nil, nil)
+	assert.Nil(t, err)
+	history, err := fake.readHistory(pointId, nil, nil)
+	assert.Nil(t, err)
+	assert.Len(t, history, 4)
+	for _, item := range history {
+		assert.GreaterOrEqual(t, *item.Value, 0.0)
+	}
+	err = store.close()
+	assert.Nil(t, err)
+	info, err := os.Stat(spillFile)
+	assert.Nil(t, err)
+	assert.Equal(t, int64(0), info.Size())
+}
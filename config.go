@@ -0,0 +1,542 @@
+package main
+
+import (
+	"bytes"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"os"
+	"reflect"
+	"slices"
+	"strconv"
+	"strings"
+
+	"gopkg.in/yaml.v3"
+)
+
+// config is the configuration of the server. Settings are loaded from a YAML file, then environment variables, then
+// command-line flags, each overriding the last, so that flags given explicitly win over ambient variables. Settings that none of them set keep the defaults from
+// defaultConfig.
+//
+// The env tag of each setting names its environment variable. Its flag is the same in lower kebab case, such as
+// -database-host for DATABASE_HOST. Settings tagged secret are redacted when the config is printed.
+type config struct {
+	Server       serverSettings       `yaml:"server"`
+	Auth         authSettings         `yaml:"auth"`
+	Database     databaseSettings     `yaml:"database"`
+	HistoryStore historyStoreSettings `yaml:"historyStore"`
+	RecStore     recStoreSettings     `yaml:"recStore"`
+	CurrentStore currentStoreSettings `yaml:"currentStore"`
+	MQTT         mqttSettings         `yaml:"mqtt"`
+
+	TrashRetentionDays      int `yaml:"trashRetentionDays" env:"TRASH_RETENTION_DAYS" usage:"Days to keep deleted recs and their history before purging. 0 purges immediately."`
+	SnapshotIntervalSeconds int `yaml:"snapshotIntervalSeconds" env:"SNAPSHOT_INTERVAL_SECONDS" usage:"How often memory stores with a snapshot file are saved. They are also saved on shutdown."`
+}
+
+type serverSettings struct {
+	Host                   string      `yaml:"host" env:"HOST" usage:"The host name to log the server URL with"`
+	Port                   int         `yaml:"port" env:"PORT" usage:"The port to serve the API on"`
+	MetricsPort            int         `yaml:"metricsPort" env:"METRICS_PORT" usage:"The port to serve Prometheus metrics on"`
+	ShutdownTimeoutSeconds int         `yaml:"shutdownTimeoutSeconds" env:"SHUTDOWN_TIMEOUT_SECONDS" usage:"On SIGTERM, how long to wait for requests in flight before exiting"`
+	ShutdownDelaySeconds   int         `yaml:"shutdownDelaySeconds" env:"SHUTDOWN_DELAY_SECONDS" usage:"On SIGTERM, how long /readyz fails before requests stop being accepted"`
+	TrustedProxies         string      `yaml:"trustedProxies" env:"TRUSTED_PROXIES" usage:"IPs or CIDRs of proxies whose X-Forwarded-For header gives the client IP, like 10.0.0.0/8,192.168.1.10"`
+	TLS                    tlsSettings `yaml:"tls"`
+}
+
+type tlsSettings struct {
+	CertFile          string `yaml:"certFile" env:"TLS_CERT_FILE" usage:"To serve HTTPS, the certificate file. It is reloaded when it changes."`
+	KeyFile           string `yaml:"keyFile" env:"TLS_KEY_FILE" usage:"To serve HTTPS, the key file. It is reloaded when it changes."`
+	ClientCAFile      string `yaml:"clientCAFile" env:"TLS_CLIENT_CA_FILE" usage:"To accept client certificates, the CAs that sign them"`
+	ClientRoleMapping string `yaml:"clientRoleMapping" env:"TLS_CLIENT_ROLE_MAPPING" usage:"Client certificate common names to roles, like ingest-01=writer"`
+	HTTPRedirectPort  int    `yaml:"httpRedirectPort" env:"HTTP_REDIRECT_PORT" usage:"With TLS, a port that redirects HTTP requests to HTTPS. 0 disables it."`
+}
+
+type authSettings struct {
+	AuthenticatorType        string            `yaml:"authenticatorType" env:"AUTHENTICATOR_TYPE" usage:"Options: single, database"`
+	Username                 string            `yaml:"username" env:"USERNAME" usage:"The single user, or with the database authenticator, the first admin user"`
+	Password                 string            `yaml:"password" env:"PASSWORD" secret:"true" usage:"The password of the username"`
+	APIKey                   string            `yaml:"apiKey" env:"API_KEY" secret:"true" usage:"Kept as the API key named default, which is revoked if this is empty"`
+	APIKeyRole               string            `yaml:"apiKeyRole" env:"API_KEY_ROLE" usage:"The scopes of a new default API key. Options: viewer, writer, admin"`
+	AccessPolicyDefault      string            `yaml:"accessPolicyDefault" env:"ACCESS_POLICY_DEFAULT" usage:"The rec access of non-admin users and API keys without access policies. Options: deny, allow"`
+	JWTSecret                string            `yaml:"jwtSecret" env:"JWT_SECRET" secret:"true" usage:"The secret that signs tokens"`
+	TokenDurationSeconds     int               `yaml:"tokenDurationSeconds" env:"TOKEN_DURATION_SECONDS" usage:"How long tokens last"`
+	RefreshTokenDurationDays int               `yaml:"refreshTokenDurationDays" env:"REFRESH_TOKEN_DURATION_DAYS" usage:"How long refresh tokens last"`
+	Login                    loginSettings     `yaml:"login"`
+	RateLimit                rateLimitSettings `yaml:"rateLimit"`
+	OIDC                     oidcSettings      `yaml:"oidc"`
+}
+
+type loginSettings struct {
+	MaxFailures       int `yaml:"maxFailures" env:"LOGIN_MAX_FAILURES" usage:"Failed logins per client IP or username before it is locked out"`
+	LockoutSeconds    int `yaml:"lockoutSeconds" env:"LOGIN_LOCKOUT_SECONDS" usage:"The first lockout, which doubles with each further failure"`
+	MaxLockoutSeconds int `yaml:"maxLockoutSeconds" env:"LOGIN_MAX_LOCKOUT_SECONDS" usage:"The longest lockout"`
+}
+
+type rateLimitSettings struct {
+	Rate  float64 `yaml:"rate" env:"RATE_LIMIT" usage:"Requests per second allowed for each user and API key. 0 disables the limit."`
+	Burst int     `yaml:"burst" env:"RATE_LIMIT_BURST" usage:"Requests allowed at once before the rate limit applies"`
+}
+
+type oidcSettings struct {
+	JWKSURL       string `yaml:"jwksURL" env:"OIDC_JWKS_URL" usage:"To accept RS256/ES256 tokens from an identity provider, its JWKS URL"`
+	KeyFile       string `yaml:"keyFile" env:"OIDC_KEY_FILE" usage:"Or a PEM public key file, if there is no JWKS URL"`
+	Issuer        string `yaml:"issuer" env:"OIDC_ISSUER" usage:"The issuer of external tokens"`
+	Audience      string `yaml:"audience" env:"OIDC_AUDIENCE" usage:"The audience of external tokens"`
+	UsernameClaim string `yaml:"usernameClaim" env:"OIDC_USERNAME_CLAIM" usage:"The claim of external tokens with the username"`
+	RoleClaim     string `yaml:"roleClaim" env:"OIDC_ROLE_CLAIM" usage:"The claim of external tokens with roles, as a string or list of strings"`
+	RoleMapping   string `yaml:"roleMapping" env:"OIDC_ROLE_MAPPING" usage:"Role claim values to roles, like ts-admins=admin,ts-viewers=viewer"`
+}
+
+type databaseSettings struct {
+	Type     string `yaml:"type" env:"DATABASE_TYPE" usage:"Options: postgres, sqlite, mysql"`
+	Path     string `yaml:"path" env:"DATABASE_PATH" usage:"With sqlite, the database file"`
+	Host     string `yaml:"host" env:"DATABASE_HOST" usage:"The database host"`
+	Port     int    `yaml:"port" env:"DATABASE_PORT" usage:"The database port. 0 uses the default port of the type."`
+	Username string `yaml:"username" env:"DATABASE_USERNAME" usage:"The database user"`
+	Password string `yaml:"password" env:"DATABASE_PASSWORD" secret:"true" usage:"The database password"`
+	Name     string `yaml:"name" env:"DATABASE_NAME" usage:"The database name"`
+	SSL      string `yaml:"ssl" env:"DATABASE_SSL" usage:"A Postgres sslmode. With mysql, it is mapped to the closest TLS setting."`
+}
+
+type historyStoreSettings struct {
+	Type         string                `yaml:"type" env:"HISTORY_STORE_TYPE" usage:"Options: database, native, memory. The native store keeps history in local files."`
+	Path         string                `yaml:"path" env:"HISTORY_STORE_PATH" usage:"With native, the directory to keep history in"`
+	SnapshotFile string                `yaml:"snapshotFile" env:"HISTORY_STORE_SNAPSHOT_FILE" usage:"With memory, the file to save history to. If unset, history is lost on restart."`
+	Buffer       historyBufferSettings `yaml:"buffer"`
+}
+
+type historyBufferSettings struct {
+	Enabled              bool   `yaml:"enabled" env:"HISTORY_BUFFER_ENABLED" usage:"With database, write history in batches in the background, spilling to disk while the database is down"`
+	BatchSize            int    `yaml:"batchSize" env:"HISTORY_BUFFER_BATCH_SIZE" usage:"The most values to write at once"`
+	MaxQueued            int    `yaml:"maxQueued" env:"HISTORY_BUFFER_MAX_QUEUED" usage:"The most values to queue in memory. Writers wait while the queue is full."`
+	FlushIntervalSeconds int    `yaml:"flushIntervalSeconds" env:"HISTORY_BUFFER_FLUSH_INTERVAL_SECONDS" usage:"How often to write queued values, if a batch is not filled first"`
+	SpillFile            string `yaml:"spillFile" env:"HISTORY_BUFFER_SPILL_FILE" usage:"The file to keep values in while they cannot be written"`
+}
+
+type recStoreSettings struct {
+	Type         string `yaml:"type" env:"REC_STORE_TYPE" usage:"Options: database, memory. Rec revisions are kept in the same store."`
+	SnapshotFile string `yaml:"snapshotFile" env:"REC_STORE_SNAPSHOT_FILE" usage:"With memory, the file to save recs to. If unset, recs and their revisions are lost on restart."`
+}
+
+type currentStoreSettings struct {
+	Type            string        `yaml:"type" env:"CURRENT_STORE_TYPE" usage:"Options: redis, postgres, memory. Revoked tokens are also kept in redis or postgres if selected. postgres requires the postgres database type."`
+	SnapshotFile    string        `yaml:"snapshotFile" env:"CURRENT_STORE_SNAPSHOT_FILE" usage:"With memory, the file to save current values to, so that they survive a restart"`
+	SeedFromHistory bool          `yaml:"seedFromHistory" env:"CURRENT_STORE_SEED_FROM_HISTORY" usage:"With memory, on startup, set points without a current value to their latest history value"`
+	Redis           redisSettings `yaml:"redis"`
+}
+
+type redisSettings struct {
+	Mode              string `yaml:"mode" env:"REDIS_MODE" usage:"Options: single, sentinel, cluster"`
+	Address           string `yaml:"address" env:"REDIS_ADDRESS" usage:"The Redis address. With sentinel or cluster, a comma-separated list of the sentinel or node addresses."`
+	MasterName        string `yaml:"masterName" env:"REDIS_MASTER_NAME" usage:"With sentinel, the name of the master"`
+	Password          string `yaml:"password" env:"REDIS_PASSWORD" secret:"true" usage:"The Redis password"`
+	SentinelPassword  string `yaml:"sentinelPassword" env:"REDIS_SENTINEL_PASSWORD" secret:"true" usage:"With sentinel, the password of the sentinels"`
+	Database          int    `yaml:"database" env:"REDIS_DATABASE" usage:"The Redis database. Must be 0 with cluster."`
+	CurrentTTLSeconds int    `yaml:"currentTTLSeconds" env:"REDIS_CURRENT_TTL_SECONDS" usage:"How long each point's current value is kept after it is last set. 0 keeps it until deleted."`
+}
+
+type mqttSettings struct {
+	Address                  string `yaml:"address" env:"MQTT_ADDRESS" usage:"The MQTT broker to ingest from"`
+	Username                 string `yaml:"username" env:"MQTT_USERNAME" usage:"The MQTT user"`
+	Password                 string `yaml:"password" env:"MQTT_PASSWORD" secret:"true" usage:"The MQTT password"`
+	ConnectionTimeoutSeconds int    `yaml:"connectionTimeoutSeconds" env:"MQTT_CONNECTION_TIMEOUT_SECONDS" usage:"How long to wait to connect to the broker"`
+	SubscribeTimeoutSeconds  int    `yaml:"subscribeTimeoutSeconds" env:"MQTT_SUBSCRIBE_TIMEOUT_SECONDS" usage:"How long to wait to subscribe to a topic"`
+	DisconnectQuiesceSeconds int    `yaml:"disconnectQuiesceSeconds" env:"MQTT_DISCONNECT_QUIESCE_SECONDS" usage:"On shutdown, how long to wait for received messages to be handled"`
+}
+
+func defaultConfig() config {
+	return config{
+		Server: serverSettings{
+			Host:                   "localhost",
+			Port:                   80,
+			MetricsPort:            2112,
+			ShutdownTimeoutSeconds: 30,
+		},
+		Auth: authSettings{
+			AuthenticatorType:        "single",
+			APIKeyRole:               roleWriter,
+			AccessPolicyDefault:      "deny",
+			TokenDurationSeconds:     60 * 60, // 1 hour
+			RefreshTokenDurationDays: 30,
+			Login: loginSettings{
+				MaxFailures:       5,
+				LockoutSeconds:    1,
+				MaxLockoutSeconds: 900,
+			},
+			RateLimit: rateLimitSettings{Burst: 20},
+			OIDC: oidcSettings{
+				UsernameClaim: "sub",
+				RoleClaim:     "groups",
+			},
+		},
+		Database: databaseSettings{
+			Type:     databaseTypePostgres,
+			Path:     "timeseries.db",
+			Host:     "localhost",
+			Username: "postgres",
+			Password: "postgres",
+			Name:     "postgres",
+			SSL:      "disable",
+		},
+		HistoryStore: historyStoreSettings{
+			Type: "database",
+			Path: "history",
+			Buffer: historyBufferSettings{
+				BatchSize:            1000,
+				MaxQueued:            100000,
+				FlushIntervalSeconds: 1,
+				SpillFile:            "history-spill.log",
+			},
+		},
+		RecStore: recStoreSettings{
+			Type: "database",
+		},
+		CurrentStore: currentStoreSettings{
+			Type: "memory",
+			Redis: redisSettings{
+				Mode:    redisModeSingle,
+				Address: "localhost:6379",
+			},
+		},
+		MQTT: mqttSettings{
+			ConnectionTimeoutSeconds: 5,
+			SubscribeTimeoutSeconds:  5,
+			DisconnectQuiesceSeconds: 5,
+		},
+		SnapshotIntervalSeconds: 60,
+	}
+}
+
+// configFileEnv is the environment variable that names the config file, if the -config flag does not.
+const configFileEnv = "CONFIG_FILE"
+
+// loadConfig loads the config from the file named by the -config flag or CONFIG_FILE, the flags in args, and the
+// environment. It must be validated before use.
+func loadConfig(name string, args []string, lookupEnv func(string) (string, bool)) (config, error) {
+	result := defaultConfig()
+	settings := result.settings()
+
+	flags := flag.NewFlagSet(name, flag.ContinueOnError)
+	configFile := flags.String("config", "", fmt.Sprintf("A YAML config file. Env: %s", configFileEnv))
+	flagValues := map[string]string{}
+	for _, setting := range settings {
+		usage := fmt.Sprintf("%s. Env: %s", strings.TrimSuffix(setting.usage, "."), setting.env)
+		if !setting.value.IsZero() {
+			usage += fmt.Sprintf(" (default %v)", setting.value.Interface())
+		}
+		setFlag := func(value string) error {
+			flagValues[setting.flag] = value
+			return nil
+		}
+		// Boolean flags may be given without a value, to set them
+		if setting.value.Kind() == reflect.Bool {
+			flags.BoolFunc(setting.flag, usage, setFlag)
+		} else {
+			flags.Func(setting.flag, usage, setFlag)
+		}
+	}
+	err := flags.Parse(args)
+	if err != nil {
+		return config{}, err
+	}
+
+	if *configFile == "" {
+		*configFile, _ = lookupEnv(configFileEnv)
+	}
+	if *configFile != "" {
+		err = result.readFile(*configFile)
+		if err != nil {
+			return config{}, err
+		}
+	}
+	for _, setting := range settings {
+		value, ok := lookupEnv(setting.env)
+		if !ok {
+			continue
+		}
+		err = setting.set(value)
+		if err != nil {
+			return config{}, fmt.Errorf("invalid %s: %w", setting.env, err)
+		}
+	}
+	// Flags are applied last, even though they are parsed first to find the file.
+	for _, setting := range settings {
+		value, ok := flagValues[setting.flag]
+		if !ok {
+			continue
+		}
+		err = setting.set(value)
+		if err != nil {
+			return config{}, fmt.Errorf("invalid -%s: %w", setting.flag, err)
+		}
+	}
+
+	return result, nil
+}
+
+// readFile overrides the config with the settings in a YAML file. Unknown settings are rejected, so that typos are
+// not silently ignored.
+func (c *config) readFile(path string) error {
+	content, err := os.ReadFile(path)
+	if err != nil {
+		return err
+	}
+	decoder := yaml.NewDecoder(bytes.NewReader(content))
+	decoder.KnownFields(true)
+	err = decoder.Decode(c)
+	// An empty file sets nothing
+	if err != nil && !errors.Is(err, io.EOF) {
+		return fmt.Errorf("invalid config file %s: %w", path, err)
+	}
+	return nil
+}
+
+// validate returns an error describing each invalid setting, or nil if all are valid.
+func (c config) validate() error {
+	var errs []error
+	invalid := func(env string, format string, args ...any) {
+		errs = append(errs, fmt.Errorf("%s: %s", c.describe(env), fmt.Sprintf(format, args...)))
+	}
+	port := func(env string, value int) {
+		if value < 1 || value > 65535 {
+			invalid(env, "must be a port from 1 to 65535, not %d", value)
+		}
+	}
+	atLeast := func(env string, value int, minimum int) {
+		if value < minimum {
+			invalid(env, "must be at least %d, not %d", minimum, value)
+		}
+	}
+	required := func(env string, value string) {
+		if value == "" {
+			invalid(env, "is required")
+		}
+	}
+
+	port("PORT", c.Server.Port)
+	port("METRICS_PORT", c.Server.MetricsPort)
+	atLeast("SHUTDOWN_TIMEOUT_SECONDS", c.Server.ShutdownTimeoutSeconds, 0)
+	atLeast("SHUTDOWN_DELAY_SECONDS", c.Server.ShutdownDelaySeconds, 0)
+	_, err := parseTrustedProxies(c.Server.TrustedProxies)
+	if err != nil {
+		invalid("TRUSTED_PROXIES", "%s", err)
+	}
+	tls := c.Server.TLS
+	if (tls.CertFile == "") != (tls.KeyFile == "") {
+		invalid("TLS_KEY_FILE", "must be set if and only if TLS_CERT_FILE is")
+	}
+	if tls.CertFile == "" {
+		if tls.ClientCAFile != "" {
+			invalid("TLS_CLIENT_CA_FILE", "requires TLS_CERT_FILE")
+		}
+		if tls.ClientRoleMapping != "" {
+			invalid("TLS_CLIENT_ROLE_MAPPING", "requires TLS_CERT_FILE")
+		}
+		if tls.HTTPRedirectPort != 0 {
+			invalid("HTTP_REDIRECT_PORT", "requires TLS_CERT_FILE")
+		}
+	}
+	if tls.HTTPRedirectPort != 0 {
+		port("HTTP_REDIRECT_PORT", tls.HTTPRedirectPort)
+	}
+	_, err = parseRoleMapping(tls.ClientRoleMapping)
+	if err != nil {
+		invalid("TLS_CLIENT_ROLE_MAPPING", "%s", err)
+	}
+
+	auth := c.Auth
+	if auth.AuthenticatorType != "single" && auth.AuthenticatorType != "database" {
+		invalid("AUTHENTICATOR_TYPE", "must be single or database, not %q", auth.AuthenticatorType)
+	}
+	if auth.AuthenticatorType == "database" && auth.Username != "" {
+		// Otherwise, the first admin could log in without a password
+		required("PASSWORD", auth.Password)
+	}
+	if !isValidRole(auth.APIKeyRole) {
+		invalid("API_KEY_ROLE", "must be viewer, writer or admin, not %q", auth.APIKeyRole)
+	}
+	if auth.AccessPolicyDefault != "deny" && auth.AccessPolicyDefault != "allow" {
+		invalid("ACCESS_POLICY_DEFAULT", "must be deny or allow, not %q", auth.AccessPolicyDefault)
+	}
+	required("JWT_SECRET", auth.JWTSecret)
+	atLeast("TOKEN_DURATION_SECONDS", auth.TokenDurationSeconds, 1)
+	atLeast("REFRESH_TOKEN_DURATION_DAYS", auth.RefreshTokenDurationDays, 1)
+	atLeast("LOGIN_MAX_FAILURES", auth.Login.MaxFailures, 1)
+	atLeast("LOGIN_LOCKOUT_SECONDS", auth.Login.LockoutSeconds, 1)
+	atLeast("LOGIN_MAX_LOCKOUT_SECONDS", auth.Login.MaxLockoutSeconds, auth.Login.LockoutSeconds)
+	if auth.RateLimit.Rate < 0 {
+		invalid("RATE_LIMIT", "must not be negative")
+	}
+	if auth.RateLimit.Rate > 0 {
+		atLeast("RATE_LIMIT_BURST", auth.RateLimit.Burst, 1)
+	}
+	if auth.OIDC.JWKSURL != "" || auth.OIDC.KeyFile != "" {
+		required("OIDC_ISSUER", auth.OIDC.Issuer)
+		required("OIDC_AUDIENCE", auth.OIDC.Audience)
+	}
+	_, err = parseRoleMapping(auth.OIDC.RoleMapping)
+	if err != nil {
+		invalid("OIDC_ROLE_MAPPING", "%s", err)
+	}
+
+	switch c.Database.Type {
+	case databaseTypePostgres, databaseTypeMySQL:
+		required("DATABASE_HOST", c.Database.Host)
+		if c.Database.Port != 0 {
+			port("DATABASE_PORT", c.Database.Port)
+		}
+		if !slices.Contains([]string{"disable", "allow", "prefer", "require", "verify-ca", "verify-full"}, c.Database.SSL) {
+			invalid("DATABASE_SSL", "must be a Postgres sslmode, not %q", c.Database.SSL)
+		}
+	case databaseTypeSQLite:
+		required("DATABASE_PATH", c.Database.Path)
+	default:
+		invalid("DATABASE_TYPE", "must be postgres, sqlite or mysql, not %q", c.Database.Type)
+	}
+	switch c.HistoryStore.Type {
+	case "database":
+	case "native":
+		required("HISTORY_STORE_PATH", c.HistoryStore.Path)
+	case "memory":
+	default:
+		invalid("HISTORY_STORE_TYPE", "must be database, native or memory, not %q", c.HistoryStore.Type)
+	}
+	if buffer := c.HistoryStore.Buffer; buffer.Enabled {
+		if c.HistoryStore.Type != "database" {
+			invalid("HISTORY_BUFFER_ENABLED", "requires HISTORY_STORE_TYPE database, not %q", c.HistoryStore.Type)
+		}
+		atLeast("HISTORY_BUFFER_BATCH_SIZE", buffer.BatchSize, 1)
+		atLeast("HISTORY_BUFFER_MAX_QUEUED", buffer.MaxQueued, buffer.BatchSize)
+		atLeast("HISTORY_BUFFER_FLUSH_INTERVAL_SECONDS", buffer.FlushIntervalSeconds, 1)
+		required("HISTORY_BUFFER_SPILL_FILE", buffer.SpillFile)
+	}
+	if c.RecStore.Type != "database" && c.RecStore.Type != "memory" {
+		invalid("REC_STORE_TYPE", "must be database or memory, not %q", c.RecStore.Type)
+	}
+	switch c.CurrentStore.Type {
+	case "memory", "redis":
+	case "postgres":
+		if c.Database.Type != databaseTypePostgres {
+			invalid("CURRENT_STORE_TYPE", "requires DATABASE_TYPE postgres, not %q", c.Database.Type)
+		}
+	default:
+		invalid("CURRENT_STORE_TYPE", "must be memory, redis or postgres, not %q", c.CurrentStore.Type)
+	}
+	redisSettings := c.CurrentStore.Redis
+	atLeast("REDIS_DATABASE", redisSettings.Database, 0)
+	atLeast("REDIS_CURRENT_TTL_SECONDS", redisSettings.CurrentTTLSeconds, 0)
+	switch redisSettings.Mode {
+	case redisModeSingle:
+	case redisModeSentinel:
+		if c.CurrentStore.Type == "redis" {
+			required("REDIS_MASTER_NAME", redisSettings.MasterName)
+		}
+	case redisModeCluster:
+		if redisSettings.Database != 0 {
+			invalid("REDIS_DATABASE", "must be 0 with cluster, not %d", redisSettings.Database)
+		}
+	default:
+		invalid("REDIS_MODE", "must be single, sentinel or cluster, not %q", redisSettings.Mode)
+	}
+	required("MQTT_ADDRESS", c.MQTT.Address)
+	atLeast("MQTT_CONNECTION_TIMEOUT_SECONDS", c.MQTT.ConnectionTimeoutSeconds, 1)
+	atLeast("MQTT_SUBSCRIBE_TIMEOUT_SECONDS", c.MQTT.SubscribeTimeoutSeconds, 1)
+	atLeast("MQTT_DISCONNECT_QUIESCE_SECONDS", c.MQTT.DisconnectQuiesceSeconds, 0)
+	atLeast("TRASH_RETENTION_DAYS", c.TrashRetentionDays, 0)
+	atLeast("SNAPSHOT_INTERVAL_SECONDS", c.SnapshotIntervalSeconds, 1)
+
+	return errors.Join(errs...)
+}
+
+// describe names the setting with the environment variable in each of the ways it can be set.
+func (c config) describe(env string) string {
+	for _, setting := range c.settings() {
+		if setting.env == env {
+			return fmt.Sprintf("%s (%s, -%s)", setting.path, setting.env, setting.flag)
+		}
+	}
+	return env
+}
+
+// redacted returns a copy of the config with the secrets replaced, so that it can be printed.
+func (c config) redacted() config {
+	for _, setting := range c.settings() {
+		if setting.secret && !setting.value.IsZero() {
+			setting.value.SetString("REDACTED")
+		}
+	}
+	return c
+}
+
+// redactedYAML encodes the config as a YAML file, with the secrets redacted.
+func (c config) redactedYAML() ([]byte, error) {
+	return yaml.Marshal(c.redacted())
+}
+
+// configSetting is a single setting of a config.
+type configSetting struct {
+	// path is its key in the config file, such as database.host.
+	path   string
+	env    string
+	flag   string
+	usage  string
+	secret bool
+	// value is the field of the config that holds it.
+	value reflect.Value
+}
+
+// settings returns the settings of the config, whose values refer to its fields.
+func (c *config) settings() []configSetting {
+	return appendConfigSettings(nil, "", reflect.ValueOf(c).Elem())
+}
+
+func appendConfigSettings(settings []configSetting, prefix string, value reflect.Value) []configSetting {
+	for i := 0; i < value.NumField(); i++ {
+		field := value.Type().Field(i)
+		path := prefix + field.Tag.Get("yaml")
+		env := field.Tag.Get("env")
+		if env == "" {
+			settings = appendConfigSettings(settings, path+".", value.Field(i))
+			continue
+		}
+		settings = append(settings, configSetting{
+			path:   path,
+			env:    env,
+			flag:   strings.ReplaceAll(strings.ToLower(env), "_", "-"),
+			usage:  field.Tag.Get("usage"),
+			secret: field.Tag.Get("secret") == "true",
+			value:  value.Field(i),
+		})
+	}
+	return settings
+}
+
+// set parses the string into the setting.
+func (s configSetting) set(value string) error {
+	switch s.value.Kind() {
+	case reflect.String:
+		s.value.SetString(value)
+	case reflect.Int:
+		parsed, err := strconv.Atoi(value)
+		if err != nil {
+			return err
+		}
+		s.value.SetInt(int64(parsed))
+	case reflect.Float64:
+		parsed, err := strconv.ParseFloat(value, 64)
+		if err != nil {
+			return err
+		}
+		s.value.SetFloat(parsed)
+	case reflect.Bool:
+		parsed, err := strconv.ParseBool(value)
+		if err != nil {
+			return err
+		}
+		s.value.SetBool(parsed)
+	default:
+		return fmt.Errorf("unsupported setting type %s", s.value.Kind())
+	}
+	return nil
+}
@@ -0,0 +1,148 @@
+package main
+
+import (
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestLoadConfig(t *testing.T) {
+	file := filepath.Join(t.TempDir(), "config.yaml")
+	err := os.WriteFile(file, []byte(`
+server:
+  port: 8080
+  metricsPort: 9090
+database:
+  host: db
+  port: 5433
+mqtt:
+  address: tcp://broker:1883
+`), 0600)
+	assert.Nil(t, err)
+	env := map[string]string{
+		"CONFIG_FILE":   file,
+		"DATABASE_HOST": "db-env",
+		"DATABASE_PORT": "5434",
+		"JWT_SECRET":    "secret",
+	}
+	lookupEnv := func(name string) (string, bool) {
+		value, ok := env[name]
+		return value, ok
+	}
+
+	config, err := loadConfig("test", []string{"-port", "8081", "-database-host", "db-flag", "-rate-limit", "2.5", "-current-store-seed-from-history"}, lookupEnv)
+	assert.Nil(t, err)
+	assert.Nil(t, config.validate())
+	// The environment overrides the file, and flags override both
+	assert.Equal(t, 8081, config.Server.Port)
+	assert.Equal(t, "db-flag", config.Database.Host)
+	assert.Equal(t, 9090, config.Server.MetricsPort)
+	assert.Equal(t, 5434, config.Database.Port)
+	assert.Equal(t, 2.5, config.Auth.RateLimit.Rate)
+	// Boolean flags are set without a value
+	assert.True(t, config.CurrentStore.SeedFromHistory)
+	// Others keep their defaults
+	assert.Equal(t, "localhost", config.Server.Host)
+	assert.Equal(t, 3600, config.Auth.TokenDurationSeconds)
+	assert.Equal(t, 5, config.MQTT.ConnectionTimeoutSeconds)
+
+	_, err = loadConfig("test", []string{"-port", "eighty"}, lookupEnv)
+	assert.ErrorContains(t, err, "-port")
+
+	err = os.WriteFile(file, []byte("server:\n  prot: 8080\n"), 0600)
+	assert.Nil(t, err)
+	_, err = loadConfig("test", []string{}, lookupEnv)
+	assert.ErrorContains(t, err, "prot")
+}
+
+func TestConfigValidate(t *testing.T) {
+	config := defaultConfig()
+	config.Auth.JWTSecret = "secret"
+	config.MQTT.Address = "tcp://broker:1883"
+	assert.Nil(t, config.validate())
+
+	config.Server.Port = 0
+	config.Server.TrustedProxies = "10.0.0.0/8,proxy"
+	config.Auth.AuthenticatorType = "ldap"
+	config.Auth.AccessPolicyDefault = "open"
+	config.Server.TLS.ClientCAFile = "ca.pem"
+	config.Auth.OIDC.JWKSURL = "https://idp.example.com/jwks"
+	config.Auth.OIDC.RoleMapping = "admins"
+	err := config.validate()
+	assert.NotNil(t, err)
+	lines := strings.Split(err.Error(), "\n")
+	assert.Equal(t, []string{
+		"server.port (PORT, -port): must be a port from 1 to 65535, not 0",
+		"server.trustedProxies (TRUSTED_PROXIES, -trusted-proxies): invalid proxy: proxy",
+		"server.tls.clientCAFile (TLS_CLIENT_CA_FILE, -tls-client-ca-file): requires TLS_CERT_FILE",
+		`auth.authenticatorType (AUTHENTICATOR_TYPE, -authenticator-type): must be single or database, not "ldap"`,
+		`auth.accessPolicyDefault (ACCESS_POLICY_DEFAULT, -access-policy-default): must be deny or allow, not "open"`,
+		"auth.oidc.issuer (OIDC_ISSUER, -oidc-issuer): is required",
+		"auth.oidc.audience (OIDC_AUDIENCE, -oidc-audience): is required",
+		"auth.oidc.roleMapping (OIDC_ROLE_MAPPING, -oidc-role-mapping): invalid role mapping: admins",
+	}, lines)
+
+	// The first admin of the database authenticator needs a password
+	config = defaultConfig()
+	config.Auth.JWTSecret = "secret"
+	config.MQTT.Address = "tcp://broker:1883"
+	config.Auth.AuthenticatorType = "database"
+	config.Auth.Username = "admin"
+	assert.EqualError(t, config.validate(), "auth.password (PASSWORD, -password): is required")
+	config.Auth.Password = "secret"
+	assert.Nil(t, config.validate())
+
+	// Current values may only be kept in Postgres if it is the database
+	config = defaultConfig()
+	config.Auth.JWTSecret = "secret"
+	config.MQTT.Address = "tcp://broker:1883"
+	config.CurrentStore.Type = "postgres"
+	assert.Nil(t, config.validate())
+	config.Database.Type = databaseTypeSQLite
+	assert.EqualError(t, config.validate(), `currentStore.type (CURRENT_STORE_TYPE, -current-store-type): requires DATABASE_TYPE postgres, not "sqlite"`)
+
+	// Redis Sentinel needs a master, and Redis Cluster has only one database
+	config = defaultConfig()
+	config.Auth.JWTSecret = "secret"
+	config.MQTT.Address = "tcp://broker:1883"
+	config.CurrentStore.Type = "redis"
+	config.CurrentStore.Redis.Mode = redisModeSentinel
+	assert.EqualError(t, config.validate(), "currentStore.redis.masterName (REDIS_MASTER_NAME, -redis-master-name): is required")
+	config.CurrentStore.Redis.Mode = redisModeCluster
+	config.CurrentStore.Redis.Database = 1
+	assert.EqualError(t, config.validate(), "currentStore.redis.database (REDIS_DATABASE, -redis-database): must be 0 with cluster, not 1")
+
+	// History is only buffered in front of the database
+	config = defaultConfig()
+	config.Auth.JWTSecret = "secret"
+	config.MQTT.Address = "tcp://broker:1883"
+	config.HistoryStore.Buffer.Enabled = true
+	assert.Nil(t, config.validate())
+	config.HistoryStore.Type = "native"
+	config.HistoryStore.Buffer.MaxQueued = 10
+	err = config.validate()
+	assert.NotNil(t, err)
+	assert.Equal(t, []string{
+		`historyStore.buffer.enabled (HISTORY_BUFFER_ENABLED, -history-buffer-enabled): requires HISTORY_STORE_TYPE database, not "native"`,
+		"historyStore.buffer.maxQueued (HISTORY_BUFFER_MAX_QUEUED, -history-buffer-max-queued): must be at least 1000, not 10",
+	}, strings.Split(err.Error(), "\n"))
+}
+
+func TestConfigRedacted(t *testing.T) {
+	config := defaultConfig()
+	config.Auth.JWTSecret = "secret"
+	config.Auth.Username = "admin"
+
+	printed, err := config.redactedYAML()
+	assert.Nil(t, err)
+	assert.Contains(t, string(printed), "jwtSecret: REDACTED")
+	assert.Contains(t, string(printed), "username: admin")
+	// Unset secrets are left empty, so that it is clear that they are unset
+	assert.Contains(t, string(printed), "apiKey: \"\"")
+	assert.NotContains(t, string(printed), "secret\n")
+	// The config itself is unchanged
+	assert.Equal(t, "secret", config.Auth.JWTSecret)
+}
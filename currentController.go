@@ -2,7 +2,7 @@ package main
 
 import (
 	"encoding/json"
-	"log"
+	"fmt"
 	"net/http"
 
 	"github.com/google/uuid"
@@ -10,6 +10,8 @@ import (
 
 type currentController struct {
 	store currentStore
+	// recStore is used to check access to the rec.
+	recStore recStore
 }
 
 // GET /recs/:pointId/current
@@ -18,28 +20,27 @@ func (h currentController) getCurrent(w http.ResponseWriter, request *http.Reque
 	pointIdString := request.PathValue("pointId")
 	pointId, err := uuid.Parse(pointIdString)
 	if err != nil {
-		log.Printf("Invalid UUID: %s", pointIdString)
-		w.WriteHeader(http.StatusNotFound)
+		writeProblem(w, request, http.StatusNotFound, errorCodeInvalidID, fmt.Sprintf("Invalid UUID: %s", pointIdString))
+		return
+	}
+	if !checkRecAccess(w, request, h.recStore, pointId) {
 		return
 	}
 	err = request.ParseForm()
 	if err != nil {
-		log.Printf("Cannot parse form: %s", err)
-		w.WriteHeader(http.StatusBadRequest)
+		writeProblem(w, request, http.StatusBadRequest, errorCodeInvalidParameter, fmt.Sprintf("Cannot parse form: %s", err))
 		return
 	}
 
 	httpResult, err := h.store.getCurrent(pointId)
 	if err != nil {
-		log.Printf("Cannot retrieve current value")
-		w.WriteHeader(http.StatusInternalServerError)
+		writeInternalError(w, request, "Cannot retrieve current value", err)
 		return
 	}
 
 	httpJson, err := json.Marshal(httpResult)
 	if err != nil {
-		log.Printf("Cannot encode response JSON")
-		w.WriteHeader(http.StatusBadRequest)
+		writeInternalError(w, request, "Cannot encode response JSON", err)
 		return
 	}
 
@@ -53,23 +54,23 @@ func (h currentController) postCurrent(writer http.ResponseWriter, request *http
 	pointIdString := request.PathValue("pointId")
 	pointId, err := uuid.Parse(pointIdString)
 	if err != nil {
-		log.Printf("Invalid UUID: %s", pointIdString)
-		writer.WriteHeader(http.StatusNotFound)
+		writeProblem(writer, request, http.StatusNotFound, errorCodeInvalidID, fmt.Sprintf("Invalid UUID: %s", pointIdString))
+		return
+	}
+	if !checkRecWritable(writer, request, h.recStore, pointId) {
 		return
 	}
 	decoder := json.NewDecoder(request.Body)
 	var currentItem currentInput
 	err = decoder.Decode(&currentItem)
 	if err != nil {
-		log.Printf("Cannot decode request JSON: %s", err)
-		writer.WriteHeader(http.StatusBadRequest)
+		writeProblem(writer, request, http.StatusBadRequest, errorCodeInvalidBody, fmt.Sprintf("Cannot decode request JSON: %s", err))
 		return
 	}
 
 	err = h.store.setCurrent(pointId, currentItem)
 	if err != nil {
-		log.Printf("Cannot save current value")
-		writer.WriteHeader(http.StatusInternalServerError)
+		writeInternalError(writer, request, "Cannot save current value", err)
 		return
 	}
 
@@ -3,7 +3,9 @@ package main
 import (
 	"context"
 	"encoding/json"
+	"errors"
 	"log"
+	"strings"
 	"sync"
 	"time"
 
@@ -15,6 +17,7 @@ import (
 type currentStore interface {
 	getCurrent(uuid.UUID) (current, error)
 	setCurrent(uuid.UUID, currentInput) error
+	deleteCurrent(uuid.UUID) error
 }
 
 type currentInput struct {
@@ -27,17 +30,25 @@ type current struct {
 }
 
 // inMemoryCurrentStore stores point current values in a local in-memory cache.
-// These are not shared between instances.
+// These are not shared between instances, and are lost on restart unless a snapshot file is set.
 type inMemoryCurrentStore struct {
 	mux   *sync.Mutex
 	cache map[uuid.UUID]current
+	// snapshotFile is optional. If set, the values are loaded from it when the store is created, and saved to it on
+	// snapshot.
+	snapshotFile string
 }
 
-func newInMemoryCurrentStore() inMemoryCurrentStore {
-	return inMemoryCurrentStore{
-		mux:   &sync.Mutex{},
-		cache: map[uuid.UUID]current{},
+func newInMemoryCurrentStore(snapshotFile string) (inMemoryCurrentStore, error) {
+	s := inMemoryCurrentStore{
+		mux:          &sync.Mutex{},
+		cache:        map[uuid.UUID]current{},
+		snapshotFile: snapshotFile,
 	}
+	if snapshotFile == "" {
+		return s, nil
+	}
+	return s, readSnapshot(snapshotFile, &s.cache)
 }
 
 func (s inMemoryCurrentStore) getCurrent(id uuid.UUID) (current, error) {
@@ -57,23 +68,114 @@ func (s inMemoryCurrentStore) setCurrent(id uuid.UUID, input currentInput) error
 	return nil
 }
 
+func (s inMemoryCurrentStore) deleteCurrent(id uuid.UUID) error {
+	s.mux.Lock()
+	defer s.mux.Unlock()
+	delete(s.cache, id)
+	return nil
+}
+
+// snapshot saves the values to the snapshot file, if set.
+func (s inMemoryCurrentStore) snapshot() error {
+	if s.snapshotFile == "" {
+		return nil
+	}
+	s.mux.Lock()
+	defer s.mux.Unlock()
+	return writeSnapshot(s.snapshotFile, s.cache)
+}
+
+// seedCurrent sets the current value of the point, with its own time, unless it already has one. It returns whether
+// the value was set.
+func (s inMemoryCurrentStore) seedCurrent(id uuid.UUID, value current) bool {
+	s.mux.Lock()
+	defer s.mux.Unlock()
+	if _, ok := s.cache[id]; ok {
+		return false
+	}
+	s.cache[id] = value
+	return true
+}
+
+// seedCurrentFromHistory sets the recs without a current value to their latest history value, so that they are not
+// null after a restart until new values arrive. It returns the number of recs seeded.
+func seedCurrentFromHistory(store inMemoryCurrentStore, recStore recStore, historyStore historyStore) (int, error) {
+	recs, err := recStore.readRecs("")
+	if err != nil {
+		return 0, err
+	}
+	count := 0
+	for _, rec := range recs {
+		latest, err := historyStore.readLatestHistory(rec.ID)
+		if err != nil {
+			return count, err
+		}
+		if latest != nil && store.seedCurrent(rec.ID, current{Ts: latest.Ts, Value: latest.Value}) {
+			count++
+		}
+	}
+	return count, nil
+}
+
+// Redis modes
+const (
+	redisModeSingle   = "single"
+	redisModeSentinel = "sentinel"
+	redisModeCluster  = "cluster"
+)
+
+// newRedisClient returns a client of a single Redis node, of the master found through Redis Sentinel, or of a Redis
+// Cluster, depending on the mode.
+func newRedisClient(settings redisSettings) redis.UniversalClient {
+	addresses := []string{}
+	for _, address := range strings.Split(settings.Address, ",") {
+		addresses = append(addresses, strings.TrimSpace(address))
+	}
+	options := &redis.UniversalOptions{
+		Addrs:            addresses,
+		MasterName:       settings.MasterName,
+		Password:         settings.Password,
+		SentinelPassword: settings.SentinelPassword,
+		DB:               settings.Database,
+	}
+	switch settings.Mode {
+	case redisModeSentinel:
+		return redis.NewFailoverClient(options.Failover())
+	case redisModeCluster:
+		return redis.NewClusterClient(options.Cluster())
+	default:
+		return redis.NewClient(options.Simple())
+	}
+}
+
 // redisCurrentStore stores point current values in a Redis database.
 type redisCurrentStore struct {
-	db        *redis.Client
+	db        redis.UniversalClient
 	keyPrefix string
 	ctx       context.Context
+	// ttl is optional. If set, each point's current value expires after this long without being set.
+	ttl time.Duration
 }
 
-func newRedisCurrentStore(db *redis.Client) redisCurrentStore {
+func newRedisCurrentStore(db redis.UniversalClient, ttl time.Duration) redisCurrentStore {
 	return redisCurrentStore{
 		db:        db,
 		keyPrefix: "timeseries-api:",
 		ctx:       context.Background(),
+		ttl:       ttl,
 	}
 }
 
+func (s redisCurrentStore) ping(ctx context.Context) error {
+	return s.db.Ping(ctx).Err()
+}
+
 func (s redisCurrentStore) getCurrent(id uuid.UUID) (current, error) {
 	currentJson, err := s.db.Get(s.ctx, s.keyPrefix+id.String()).Bytes()
+	// Points without a current value have an empty one, as in the other stores
+	if errors.Is(err, redis.Nil) {
+		return current{}, nil
+	}
 	if err != nil {
 		log.Printf("Cannot retrieve current: %s", err)
 		return current{}, err
@@ -97,10 +199,19 @@ func (s redisCurrentStore) setCurrent(id uuid.UUID, input currentInput) error {
 		log.Printf("Cannot encode current JSON: %s", err)
 		return err
 	}
-	err = s.db.Set(s.ctx, s.keyPrefix+id.String(), currentJson, 0).Err()
+	err = s.db.Set(s.ctx, s.keyPrefix+id.String(), currentJson, s.ttl).Err()
 	if err != nil {
 		log.Printf("Cannot store current: %s", err)
 		return err
 	}
 	return nil
 }
+
+func (s redisCurrentStore) deleteCurrent(id uuid.UUID) error {
+	err := s.db.Del(s.ctx, s.keyPrefix+id.String()).Err()
+	if err != nil {
+		log.Printf("Cannot delete current: %s", err)
+		return err
+	}
+	return nil
+}
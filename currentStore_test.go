@@ -0,0 +1,206 @@
+package main
+
+import (
+	"context"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/google/uuid"
+	"github.com/redis/go-redis/v9"
+	"github.com/stretchr/testify/assert"
+	"gorm.io/datatypes"
+	"gorm.io/driver/postgres"
+	"gorm.io/gorm"
+)
+
+// TestCurrentStores runs the same behaviour against every current store implementation. Postgres is tested if
+// TEST_POSTGRES_DSN is set, and Redis if TEST_REDIS_ADDRESS is.
+func TestCurrentStores(t *testing.T) {
+	stores := map[string]func(t *testing.T) currentStore{
+		"memory": func(t *testing.T) currentStore {
+			store, err := newInMemoryCurrentStore("")
+			assert.Nil(t, err)
+			return store
+		},
+	}
+	if dsn := os.Getenv("TEST_POSTGRES_DSN"); dsn != "" {
+		stores["postgres"] = func(t *testing.T) currentStore {
+			db, err := gorm.Open(postgres.Open(dsn), &gorm.Config{TranslateError: true})
+			assert.Nil(t, err)
+			store, err := newPostgresCurrentStore(db, dsn)
+			assert.Nil(t, err)
+			t.Cleanup(store.close)
+			return store
+		}
+	}
+	if address := os.Getenv("TEST_REDIS_ADDRESS"); address != "" {
+		stores["redis"] = func(t *testing.T) currentStore {
+			client := newRedisClient(redisSettings{Mode: redisModeSingle, Address: address})
+			t.Cleanup(func() { client.Close() })
+			return newRedisCurrentStore(client, time.Minute)
+		}
+	}
+	for name, newStore := range stores {
+		t.Run(name, func(t *testing.T) {
+			testCurrentStore(t, newStore(t))
+		})
+	}
+}
+
+func testCurrentStore(t *testing.T, store currentStore) {
+	pointId := uuid.New()
+
+	// Points without a current value have an empty one
+	value, err := store.getCurrent(pointId)
+	assert.Nil(t, err)
+	assert.Equal(t, current{}, value)
+
+	before := time.Now().Add(-time.Second)
+	for _, v := range []*float64{f(1), nil, f(2)} {
+		err = store.setCurrent(pointId, currentInput{Value: v})
+		assert.Nil(t, err)
+		value, err = store.getCurrent(pointId)
+		assert.Nil(t, err)
+		assert.Equal(t, v, value.Value)
+		assert.True(t, value.Ts.After(before))
+	}
+
+	err = store.deleteCurrent(pointId)
+	assert.Nil(t, err)
+	value, err = store.getCurrent(pointId)
+	assert.Nil(t, err)
+	assert.Equal(t, current{}, value)
+	err = store.deleteCurrent(pointId)
+	assert.Nil(t, err)
+}
+
+// fakeRedis answers Redis commands from a map, and records the commands, without a server.
+type fakeRedis struct {
+	values   map[string]string
+	commands [][]interface{}
+}
+
+func (r *fakeRedis) DialHook(next redis.DialHook) redis.DialHook {
+	return next
+}
+
+func (r *fakeRedis) ProcessHook(next redis.ProcessHook) redis.ProcessHook {
+	return func(ctx context.Context, cmd redis.Cmder) error {
+		r.commands = append(r.commands, cmd.Args())
+		key, _ := cmd.Args()[1].(string)
+		switch cmd := cmd.(type) {
+		case *redis.StringCmd:
+			value, ok := r.values[key]
+			if !ok {
+				cmd.SetErr(redis.Nil)
+				return redis.Nil
+			}
+			cmd.SetVal(value)
+		case *redis.StatusCmd:
+			r.values[key] = string(cmd.Args()[2].([]byte))
+			cmd.SetVal("OK")
+		case *redis.IntCmd:
+			delete(r.values, key)
+			cmd.SetVal(1)
+		}
+		return nil
+	}
+}
+
+func (r *fakeRedis) ProcessPipelineHook(next redis.ProcessPipelineHook) redis.ProcessPipelineHook {
+	return next
+}
+
+func TestRedisCurrentStore(t *testing.T) {
+	fake := &fakeRedis{values: map[string]string{}}
+	client := redis.NewClient(&redis.Options{Addr: "localhost:0"})
+	client.AddHook(fake)
+	store := newRedisCurrentStore(client, time.Minute)
+	testCurrentStore(t, store)
+
+	// Values are set with the TTL
+	setCommand := fake.commands[1]
+	assert.Equal(t, "set", setCommand[0])
+	assert.Equal(t, []interface{}{"ex", int64(60)}, setCommand[3:])
+}
+
+func TestNewRedisClient(t *testing.T) {
+	client := newRedisClient(redisSettings{Mode: redisModeSingle, Address: "redis:6379", Database: 1})
+	defer client.Close()
+	assert.IsType(t, &redis.Client{}, client)
+	assert.Equal(t, "redis:6379", client.(*redis.Client).Options().Addr)
+	assert.Equal(t, 1, client.(*redis.Client).Options().DB)
+
+	client = newRedisClient(redisSettings{Mode: redisModeSentinel, Address: "sentinel-1:26379, sentinel-2:26379", MasterName: "main"})
+	defer client.Close()
+	assert.IsType(t, &redis.Client{}, client)
+
+	client = newRedisClient(redisSettings{Mode: redisModeCluster, Address: "node-1:6379,node-2:6379"})
+	defer client.Close()
+	assert.IsType(t, &redis.ClusterClient{}, client)
+	assert.Equal(t, []string{"node-1:6379", "node-2:6379"}, client.(*redis.ClusterClient).Options().Addrs)
+}
+
+func TestInMemoryCurrentStoreSnapshot(t *testing.T) {
+	snapshotFile := filepath.Join(t.TempDir(), "current.json")
+	store, err := newInMemoryCurrentStore(snapshotFile)
+	assert.Nil(t, err)
+	pointId := uuid.New()
+	err = store.setCurrent(pointId, currentInput{Value: f(1)})
+	assert.Nil(t, err)
+	set, err := store.getCurrent(pointId)
+	assert.Nil(t, err)
+
+	err = store.snapshot()
+	assert.Nil(t, err)
+	restored, err := newInMemoryCurrentStore(snapshotFile)
+	assert.Nil(t, err)
+	value, err := restored.getCurrent(pointId)
+	assert.Nil(t, err)
+	assert.True(t, set.Ts.Equal(*value.Ts))
+	assert.Equal(t, f(1), value.Value)
+}
+
+func TestSeedCurrentFromHistory(t *testing.T) {
+	store, err := newInMemoryCurrentStore("")
+	assert.Nil(t, err)
+	recStore, err := newInMemoryRecStore("")
+	assert.Nil(t, err)
+	historyStore, err := newInMemoryHistoryStore("")
+	assert.Nil(t, err)
+
+	withHistory := rec{ID: uuid.New(), Tags: datatypes.JSONMap{}}
+	withCurrent := rec{ID: uuid.New(), Tags: datatypes.JSONMap{}}
+	withNeither := rec{ID: uuid.New(), Tags: datatypes.JSONMap{}}
+	for _, rec := range []rec{withHistory, withCurrent, withNeither} {
+		err = recStore.createRec(rec, recAudit{})
+		assert.Nil(t, err)
+	}
+	start := time.Date(2024, 1, 1, 0, 0, 0, 0, time.UTC)
+	for i := 0; i < 3; i++ {
+		ts := start.Add(time.Duration(i) * time.Minute)
+		for _, id := range []uuid.UUID{withHistory.ID, withCurrent.ID} {
+			err = historyStore.writeHistory(id, hisItem{Ts: &ts, Value: f(float64(i))})
+			assert.Nil(t, err)
+		}
+	}
+	err = store.setCurrent(withCurrent.ID, currentInput{Value: f(10)})
+	assert.Nil(t, err)
+
+	// Only points without a current value are seeded, with the time of their latest history value
+	count, err := seedCurrentFromHistory(store, recStore, historyStore)
+	assert.Nil(t, err)
+	assert.Equal(t, 1, count)
+	value, err := store.getCurrent(withHistory.ID)
+	assert.Nil(t, err)
+	assert.Equal(t, f(2), value.Value)
+	assert.True(t, start.Add(2*time.Minute).Equal(*value.Ts))
+	value, err = store.getCurrent(withCurrent.ID)
+	assert.Nil(t, err)
+	assert.Equal(t, f(10), value.Value)
+	value, err = store.getCurrent(withNeither.ID)
+	assert.Nil(t, err)
+	assert.Nil(t, value.Ts)
+}
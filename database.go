@@ -0,0 +1,129 @@
+package main
+
+import (
+	"fmt"
+	"net"
+	"net/url"
+	"strconv"
+	"time"
+
+	gomysql "github.com/go-sql-driver/mysql"
+	"gorm.io/driver/mysql"
+	"gorm.io/driver/postgres"
+	"gorm.io/driver/sqlite"
+	"gorm.io/gorm"
+	"gorm.io/gorm/schema"
+)
+
+// Database types
+const (
+	databaseTypePostgres = "postgres"
+	databaseTypeSQLite   = "sqlite"
+	databaseTypeMySQL    = "mysql"
+)
+
+// openDatabase opens the database of the configured type. Errors are translated so that, for example, duplicate keys
+// are reported as conflicts.
+func openDatabase(settings databaseSettings) (*gorm.DB, error) {
+	var dialector gorm.Dialector
+	switch settings.Type {
+	case databaseTypePostgres:
+		dialector = postgres.Open(postgresDSN(settings))
+	case databaseTypeSQLite:
+		dialector = sqlite.Open(sqliteDSN(settings.Path))
+	case databaseTypeMySQL:
+		dialector = mysqlDialector{mysql.New(mysql.Config{
+			DSN: mysqlDSN(settings),
+			// Strings are otherwise longtext, which cannot be indexed.
+			DefaultStringSize: 256,
+			// Times are otherwise kept to the millisecond, rather than the microsecond of the other databases.
+			DefaultDatetimePrecision: &mysqlDatetimePrecision,
+		}).(*mysql.Dialector)}
+	default:
+		return nil, fmt.Errorf("unknown database type: %s", settings.Type)
+	}
+	return gorm.Open(dialector, &gorm.Config{TranslateError: true})
+}
+
+// postgresDSN returns a connection URL, so that values such as passwords may contain any characters.
+func postgresDSN(settings databaseSettings) string {
+	port := settings.Port
+	if port == 0 {
+		port = 5432
+	}
+	dsn := url.URL{
+		Scheme:   "postgres",
+		User:     url.UserPassword(settings.Username, settings.Password),
+		Host:     net.JoinHostPort(settings.Host, strconv.Itoa(port)),
+		Path:     settings.Name,
+		RawQuery: url.Values{"sslmode": {settings.SSL}}.Encode(),
+	}
+	return dsn.String()
+}
+
+// sqliteDSN returns a DSN for the file that suits a server: the write-ahead log lets reads proceed during writes,
+// waiting on a busy database avoids spurious errors from concurrent writes, and transactions take the write lock
+// when they begin, so that two cannot deadlock upgrading from reads. Syncing less often is safe with the
+// write-ahead log, which can lose only the latest transactions on power loss, not corrupt the database.
+func sqliteDSN(path string) string {
+	pragmas := url.Values{
+		"_journal_mode": {"WAL"},
+		"_busy_timeout": {"5000"},
+		"_txlock":       {"immediate"},
+		"_synchronous":  {"NORMAL"},
+		"_foreign_keys": {"on"},
+	}
+	// The path is escaped, as the DSN is a URI
+	return "file:" + (&url.URL{Path: path}).EscapedPath() + "?" + pragmas.Encode()
+}
+
+// mysqlDSN returns a DSN that parses times in UTC, to match the other databases. The SSL setting takes the Postgres
+// sslmode values, which are mapped to the closest MySQL TLS setting.
+func mysqlDSN(settings databaseSettings) string {
+	port := settings.Port
+	if port == 0 {
+		port = 3306
+	}
+	config := gomysql.NewConfig()
+	config.User = settings.Username
+	config.Passwd = settings.Password
+	config.Net = "tcp"
+	config.Addr = net.JoinHostPort(settings.Host, strconv.Itoa(port))
+	config.DBName = settings.Name
+	config.ParseTime = true
+	config.Loc = time.UTC
+	// Count matched rather than changed rows, as the other databases do, so that an update that changes nothing is
+	// not taken for a missing or conflicting row
+	config.ClientFoundRows = true
+	switch settings.SSL {
+	case "disable":
+	case "allow", "prefer":
+		config.TLSConfig = "preferred"
+	case "require":
+		config.TLSConfig = "skip-verify"
+	default:
+		config.TLSConfig = "true"
+	}
+	return config.FormatDSN()
+}
+
+var mysqlDatetimePrecision = 6
+
+// mysqlDialector maps the uuid column types of the models, which MySQL does not have, to strings.
+type mysqlDialector struct {
+	*mysql.Dialector
+}
+
+func (d mysqlDialector) DataTypeOf(field *schema.Field) string {
+	if field.DataType == "uuid" {
+		return "char(36)"
+	}
+	return d.Dialector.DataTypeOf(field)
+}
+
+// Migrator returns the MySQL migrator, using this dialector for column types.
+func (d mysqlDialector) Migrator(db *gorm.DB) gorm.Migrator {
+	migrator := d.Dialector.Migrator(db).(mysql.Migrator)
+	migrator.Migrator.Dialector = d
+	return migrator
+}
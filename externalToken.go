@@ -0,0 +1,296 @@
+package main
+
+import (
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rsa"
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"math/big"
+	"net/http"
+	"os"
+	"slices"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/golang-jwt/jwt/v5"
+	"golang.org/x/sync/singleflight"
+)
+
+// externalTokenAlgorithms are the signing methods accepted for tokens from an external identity provider.
+var externalTokenAlgorithms = []string{jwt.SigningMethodRS256.Alg(), jwt.SigningMethodES256.Alg()}
+
+// externalTokenVerifier verifies JWTs issued by an external identity provider, such as an OIDC provider, and maps
+// their claims to a username and role.
+type externalTokenVerifier struct {
+	keys     publicKeySource
+	issuer   string
+	audience string
+	// usernameClaim is the claim used as the username, such as `sub` or `email`.
+	usernameClaim string
+	// roleClaim is the claim whose values are mapped to roles. It may be a string or a list of strings.
+	roleClaim string
+	// roleMapping maps values of the role claim to roles. If several values map to roles, the most permissive is
+	// used.
+	roleMapping map[string]string
+}
+
+// publicKeySource is able to provide the public keys that external tokens are signed with.
+type publicKeySource interface {
+	// publicKey returns the key with the ID. The ID may be empty if the token does not specify one.
+	publicKey(kid string) (crypto.PublicKey, error)
+}
+
+// parseRoleMapping parses a mapping like `ts-admins=admin,ts-viewers=viewer` from claim values to roles.
+func parseRoleMapping(value string) (map[string]string, error) {
+	result := map[string]string{}
+	if value == "" {
+		return result, nil
+	}
+	for _, entry := range strings.Split(value, ",") {
+		claimValue, role, ok := strings.Cut(strings.TrimSpace(entry), "=")
+		if !ok || claimValue == "" {
+			return nil, fmt.Errorf("invalid role mapping: %s", entry)
+		}
+		if !isValidRole(role) {
+			return nil, fmt.Errorf("invalid role: %s", role)
+		}
+		result[claimValue] = role
+	}
+	return result, nil
+}
+
+// key returns the key that the token should be verified with. It is intended for use as a jwt.Keyfunc.
+func (v externalTokenVerifier) key(token *jwt.Token) (interface{}, error) {
+	if !slices.Contains(externalTokenAlgorithms, token.Method.Alg()) {
+		return nil, fmt.Errorf("unexpected signing method: %v", token.Header["alg"])
+	}
+	kid, _ := token.Header["kid"].(string)
+	return v.keys.publicKey(kid)
+}
+
+// identify checks the issuer and audience of verified claims, and returns the username and role they map to.
+func (v externalTokenVerifier) identify(claims jwt.MapClaims) (username string, role string, err error) {
+	issuer, _ := claims.GetIssuer()
+	if issuer != v.issuer {
+		return "", "", fmt.Errorf("unexpected issuer: %s", issuer)
+	}
+	audience, _ := claims.GetAudience()
+	if !slices.Contains(audience, v.audience) {
+		return "", "", fmt.Errorf("unexpected audience: %s", audience)
+	}
+	username, _ = claims[v.usernameClaim].(string)
+	if username == "" {
+		return "", "", fmt.Errorf("missing username claim: %s", v.usernameClaim)
+	}
+
+	var claimValues []string
+	switch value := claims[v.roleClaim].(type) {
+	case string:
+		claimValues = []string{value}
+	case []interface{}:
+		for _, element := range value {
+			if s, ok := element.(string); ok {
+				claimValues = append(claimValues, s)
+			}
+		}
+	}
+	for _, claimValue := range claimValues {
+		mappedRole, ok := v.roleMapping[claimValue]
+		if ok && len(roleScopes[mappedRole]) > len(roleScopes[role]) {
+			role = mappedRole
+		}
+	}
+	if role == "" {
+		return "", "", fmt.Errorf("no role mapped for %s", username)
+	}
+	return username, role, nil
+}
+
+// fileKeySource provides a single public key read from a PEM file. It is used for every token, whatever its key ID.
+type fileKeySource struct {
+	key crypto.PublicKey
+}
+
+func newFileKeySource(path string) (fileKeySource, error) {
+	bytes, err := os.ReadFile(path)
+	if err != nil {
+		return fileKeySource{}, err
+	}
+	rsaKey, err := jwt.ParseRSAPublicKeyFromPEM(bytes)
+	if err == nil {
+		return fileKeySource{key: rsaKey}, nil
+	}
+	ecKey, err := jwt.ParseECPublicKeyFromPEM(bytes)
+	if err == nil {
+		return fileKeySource{key: ecKey}, nil
+	}
+	return fileKeySource{}, fmt.Errorf("%s is not an RSA or EC public key", path)
+}
+
+func (s fileKeySource) publicKey(kid string) (crypto.PublicKey, error) {
+	return s.key, nil
+}
+
+// jwksKeySource provides public keys from a JSON Web Key Set URL. Keys are cached, and are fetched again when a
+// token refers to an unknown key, so that the identity provider can rotate them.
+type jwksKeySource struct {
+	url    string
+	client *http.Client
+	// minRefreshInterval limits how often unknown key IDs can cause the keys to be fetched.
+	minRefreshInterval time.Duration
+
+	// fetches shares a fetch between concurrent requests, which is made without holding mux.
+	fetches singleflight.Group
+
+	mux  sync.Mutex
+	keys map[string]crypto.PublicKey
+	// lastAttempt is the time of the last fetch, even if it failed, so that an unavailable identity provider is
+	// not requested for every token.
+	lastAttempt time.Time
+}
+
+func newJWKSKeySource(url string) *jwksKeySource {
+	return &jwksKeySource{
+		url:                url,
+		client:             &http.Client{Timeout: 10 * time.Second},
+		minRefreshInterval: time.Minute,
+		keys:               map[string]crypto.PublicKey{},
+	}
+}
+
+func (s *jwksKeySource) publicKey(kid string) (crypto.PublicKey, error) {
+	s.mux.Lock()
+	key, ok := s.lookup(kid)
+	s.mux.Unlock()
+	if ok {
+		return key, nil
+	}
+
+	_, err, _ := s.fetches.Do(s.url, func() (any, error) {
+		s.mux.Lock()
+		if time.Since(s.lastAttempt) < s.minRefreshInterval {
+			s.mux.Unlock()
+			return nil, nil
+		}
+		s.lastAttempt = time.Now()
+		s.mux.Unlock()
+
+		keys, err := s.fetch()
+		if err != nil {
+			return nil, err
+		}
+		s.mux.Lock()
+		s.keys = keys
+		s.mux.Unlock()
+		return nil, nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	s.mux.Lock()
+	key, ok = s.lookup(kid)
+	s.mux.Unlock()
+	if !ok {
+		return nil, fmt.Errorf("unknown key: %s", kid)
+	}
+	return key, nil
+}
+
+// lookup returns the key with the ID. If the ID is empty, the only key is returned.
+func (s *jwksKeySource) lookup(kid string) (crypto.PublicKey, bool) {
+	if kid == "" && len(s.keys) == 1 {
+		for _, key := range s.keys {
+			return key, true
+		}
+	}
+	key, ok := s.keys[kid]
+	return key, ok
+}
+
+func (s *jwksKeySource) fetch() (map[string]crypto.PublicKey, error) {
+	response, err := s.client.Get(s.url)
+	if err != nil {
+		return nil, err
+	}
+	defer response.Body.Close()
+	if response.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("JWKS request failed: %s", response.Status)
+	}
+
+	var jwks struct {
+		Keys []jsonWebKey `json:"keys"`
+	}
+	err = json.NewDecoder(response.Body).Decode(&jwks)
+	if err != nil {
+		return nil, err
+	}
+	result := map[string]crypto.PublicKey{}
+	for _, jwk := range jwks.Keys {
+		if jwk.Use != "" && jwk.Use != "sig" {
+			continue
+		}
+		key, err := jwk.publicKey()
+		if err != nil {
+			// Skip keys of unsupported types, so that they do not prevent the others from being used.
+			continue
+		}
+		result[jwk.Kid] = key
+	}
+	return result, nil
+}
+
+// jsonWebKey is an RSA or EC public key in JWK format.
+type jsonWebKey struct {
+	Kty string `json:"kty"`
+	Kid string `json:"kid"`
+	Use string `json:"use"`
+	// RSA
+	N string `json:"n"`
+	E string `json:"e"`
+	// EC
+	Crv string `json:"crv"`
+	X   string `json:"x"`
+	Y   string `json:"y"`
+}
+
+func (k jsonWebKey) publicKey() (crypto.PublicKey, error) {
+	switch k.Kty {
+	case "RSA":
+		n, err := decodeJWKInt(k.N)
+		if err != nil {
+			return nil, err
+		}
+		e, err := decodeJWKInt(k.E)
+		if err != nil {
+			return nil, err
+		}
+		return &rsa.PublicKey{N: n, E: int(e.Int64())}, nil
+	case "EC":
+		if k.Crv != "P-256" {
+			return nil, fmt.Errorf("unsupported curve: %s", k.Crv)
+		}
+		x, err := decodeJWKInt(k.X)
+		if err != nil {
+			return nil, err
+		}
+		y, err := decodeJWKInt(k.Y)
+		if err != nil {
+			return nil, err
+		}
+		return &ecdsa.PublicKey{Curve: elliptic.P256(), X: x, Y: y}, nil
+	default:
+		return nil, fmt.Errorf("unsupported key type: %s", k.Kty)
+	}
+}
+
+func decodeJWKInt(value string) (*big.Int, error) {
+	bytes, err := base64.RawURLEncoding.DecodeString(value)
+	if err != nil {
+		return nil, err
+	}
+	return new(big.Int).SetBytes(bytes), nil
+}
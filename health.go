@@ -0,0 +1,126 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"log"
+	"net/http"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"gorm.io/gorm"
+)
+
+// pinger is implemented by stores and clients that depend on external services, to check that they are reachable.
+type pinger interface {
+	ping(ctx context.Context) error
+}
+
+// pingGormDB pings the database behind a GORM connection.
+func pingGormDB(ctx context.Context, db *gorm.DB) error {
+	sqlDB, err := db.DB()
+	if err != nil {
+		return err
+	}
+	return sqlDB.PingContext(ctx)
+}
+
+// Health statuses
+const (
+	healthStatusOK           = "ok"
+	healthStatusUnavailable  = "unavailable"
+	healthStatusShuttingDown = "shuttingDown"
+)
+
+type healthController struct {
+	// dependencies are pinged by name.
+	dependencies map[string]pinger
+	// timeout limits how long each dependency may take to respond.
+	timeout time.Duration
+	// shuttingDown is optional. If set, the service is not ready once it is true.
+	shuttingDown *atomic.Bool
+}
+
+type health struct {
+	Status       string                      `json:"status"`
+	Dependencies map[string]dependencyHealth `json:"dependencies"`
+}
+
+type dependencyHealth struct {
+	Status    string  `json:"status"`
+	LatencyMs float64 `json:"latencyMs"`
+}
+
+// GET /healthz
+// Responds 200 whenever the service is running, so that it is not restarted while a dependency is down. The
+// dependencies are reported for information.
+func (h healthController) getHealthz(w http.ResponseWriter, r *http.Request) {
+	health := h.check(r.Context())
+	h.write(w, r, http.StatusOK, health)
+}
+
+// GET /readyz
+// Responds 503 if any dependency is unavailable, or the service is shutting down, so that it is sent no requests.
+func (h healthController) getReadyz(w http.ResponseWriter, r *http.Request) {
+	health := h.check(r.Context())
+	if h.shuttingDown != nil && h.shuttingDown.Load() {
+		health.Status = healthStatusShuttingDown
+	}
+	status := http.StatusOK
+	if health.Status != healthStatusOK {
+		status = http.StatusServiceUnavailable
+	}
+	h.write(w, r, status, health)
+}
+
+// check pings the dependencies concurrently.
+func (h healthController) check(ctx context.Context) health {
+	result := health{
+		Status:       healthStatusOK,
+		Dependencies: map[string]dependencyHealth{},
+	}
+	mux := sync.Mutex{}
+	wg := sync.WaitGroup{}
+	for name, dependency := range h.dependencies {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			pingCtx, cancel := context.WithTimeout(ctx, h.timeout)
+			defer cancel()
+			start := time.Now()
+			err := dependency.ping(pingCtx)
+			dependencyHealth := dependencyHealth{
+				Status:    healthStatusOK,
+				LatencyMs: float64(time.Since(start).Microseconds()) / 1000,
+			}
+			if err != nil {
+				// Errors are only logged, since the endpoints are not authenticated.
+				log.Printf("Health check of %s failed: %s", name, err)
+				dependencyHealth.Status = healthStatusUnavailable
+			}
+
+			mux.Lock()
+			defer mux.Unlock()
+			result.Dependencies[name] = dependencyHealth
+			if err != nil {
+				result.Status = healthStatusUnavailable
+			}
+		}()
+	}
+	wg.Wait()
+	return result
+}
+
+func (h healthController) write(w http.ResponseWriter, r *http.Request, status int, health health) {
+	httpJson, err := json.Marshal(health)
+	if err != nil {
+		writeInternalError(w, r, "Cannot encode response JSON", err)
+		return
+	}
+
+	// Health must always be checked live.
+	w.Header().Set("Cache-Control", "no-store")
+	w.WriteHeader(status)
+	w.Write(httpJson)
+}
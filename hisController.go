@@ -2,7 +2,7 @@ package main
 
 import (
 	"encoding/json"
-	"log"
+	"fmt"
 	"net/http"
 	"strconv"
 	"time"
@@ -12,6 +12,8 @@ import (
 
 type hisController struct {
 	store historyStore
+	// recStore is used to check access to the rec.
+	recStore recStore
 }
 
 // GET /recs/:pointId/history?start=...&end=...
@@ -20,14 +22,15 @@ func (h hisController) getHis(w http.ResponseWriter, request *http.Request) {
 	pointIdString := request.PathValue("pointId")
 	pointId, err := uuid.Parse(pointIdString)
 	if err != nil {
-		log.Printf("Invalid UUID: %s", pointIdString)
-		w.WriteHeader(http.StatusNotFound)
+		writeProblem(w, request, http.StatusNotFound, errorCodeInvalidID, fmt.Sprintf("Invalid UUID: %s", pointIdString))
+		return
+	}
+	if !checkRecAccess(w, request, h.recStore, pointId) {
 		return
 	}
 	err = request.ParseForm()
 	if err != nil {
-		log.Printf("Cannot parse form: %s", err)
-		w.WriteHeader(http.StatusBadRequest)
+		writeProblem(w, request, http.StatusBadRequest, errorCodeInvalidParameter, fmt.Sprintf("Cannot parse form: %s", err))
 		return
 	}
 	params := request.Form
@@ -38,8 +41,7 @@ func (h hisController) getHis(w http.ResponseWriter, request *http.Request) {
 		startStr := params["start"][0]
 		startUnix, err := strconv.ParseInt(startStr, 0, 64)
 		if err != nil {
-			log.Printf("Cannot parse time: %s", startStr)
-			w.WriteHeader(http.StatusBadRequest)
+			writeProblem(w, request, http.StatusBadRequest, errorCodeInvalidParameter, fmt.Sprintf("Cannot parse time: %s", startStr))
 			return
 		}
 		startTime := time.Unix(startUnix, 0)
@@ -50,8 +52,7 @@ func (h hisController) getHis(w http.ResponseWriter, request *http.Request) {
 		endStr := params["end"][0]
 		endUnix, err := strconv.ParseInt(endStr, 0, 64)
 		if err != nil {
-			log.Printf("Cannot parse time: %s", endStr)
-			w.WriteHeader(http.StatusBadRequest)
+			writeProblem(w, request, http.StatusBadRequest, errorCodeInvalidParameter, fmt.Sprintf("Cannot parse time: %s", endStr))
 			return
 		}
 		endTime := time.Unix(endUnix, 0)
@@ -59,15 +60,13 @@ func (h hisController) getHis(w http.ResponseWriter, request *http.Request) {
 	}
 	httpResult, err := h.store.readHistory(pointId, start, end)
 	if err != nil {
-		log.Printf("Storage Error: %s", err)
-		w.WriteHeader(http.StatusInternalServerError)
+		writeStoreError(w, request, err)
 		return
 	}
 
 	httpJson, err := json.Marshal(httpResult)
 	if err != nil {
-		log.Printf("Cannot encode response JSON")
-		w.WriteHeader(http.StatusBadRequest)
+		writeInternalError(w, request, "Cannot encode response JSON", err)
 		return
 	}
 
@@ -81,22 +80,22 @@ func (h hisController) postHis(writer http.ResponseWriter, request *http.Request
 	pointIdString := request.PathValue("pointId")
 	pointId, err := uuid.Parse(pointIdString)
 	if err != nil {
-		log.Printf("Invalid UUID: %s", pointIdString)
-		writer.WriteHeader(http.StatusNotFound)
+		writeProblem(writer, request, http.StatusNotFound, errorCodeInvalidID, fmt.Sprintf("Invalid UUID: %s", pointIdString))
+		return
+	}
+	if !checkRecWritable(writer, request, h.recStore, pointId) {
 		return
 	}
 	decoder := json.NewDecoder(request.Body)
 	var hisItem hisItem
 	err = decoder.Decode(&hisItem)
 	if err != nil {
-		log.Printf("Cannot decode request JSON: %s", err)
-		writer.WriteHeader(http.StatusBadRequest)
+		writeProblem(writer, request, http.StatusBadRequest, errorCodeInvalidBody, fmt.Sprintf("Cannot decode request JSON: %s", err))
 		return
 	}
 	err = h.store.writeHistory(pointId, hisItem)
 	if err != nil {
-		log.Printf("Storage Error: %s", err)
-		writer.WriteHeader(http.StatusInternalServerError)
+		writeStoreError(writer, request, err)
 		return
 	}
 	writer.WriteHeader(http.StatusOK)
@@ -108,14 +107,15 @@ func (h hisController) deleteHis(writer http.ResponseWriter, request *http.Reque
 	pointIdString := request.PathValue("pointId")
 	pointId, err := uuid.Parse(pointIdString)
 	if err != nil {
-		log.Printf("Invalid UUID: %s", pointIdString)
-		writer.WriteHeader(http.StatusNotFound)
+		writeProblem(writer, request, http.StatusNotFound, errorCodeInvalidID, fmt.Sprintf("Invalid UUID: %s", pointIdString))
+		return
+	}
+	if !checkRecAccess(writer, request, h.recStore, pointId) {
 		return
 	}
 	err = request.ParseForm()
 	if err != nil {
-		log.Printf("Cannot parse form: %s", err)
-		writer.WriteHeader(http.StatusBadRequest)
+		writeProblem(writer, request, http.StatusBadRequest, errorCodeInvalidParameter, fmt.Sprintf("Cannot parse form: %s", err))
 		return
 	}
 	params := request.Form
@@ -126,8 +126,7 @@ func (h hisController) deleteHis(writer http.ResponseWriter, request *http.Reque
 		startStr := params["start"][0]
 		startUnix, err := strconv.ParseInt(startStr, 0, 64)
 		if err != nil {
-			log.Printf("Cannot parse time: %s", startStr)
-			writer.WriteHeader(http.StatusBadRequest)
+			writeProblem(writer, request, http.StatusBadRequest, errorCodeInvalidParameter, fmt.Sprintf("Cannot parse time: %s", startStr))
 			return
 		}
 		startTime := time.Unix(startUnix, 0)
@@ -138,8 +137,7 @@ func (h hisController) deleteHis(writer http.ResponseWriter, request *http.Reque
 		endStr := params["end"][0]
 		endUnix, err := strconv.ParseInt(endStr, 0, 64)
 		if err != nil {
-			log.Printf("Cannot parse time: %s", endStr)
-			writer.WriteHeader(http.StatusBadRequest)
+			writeProblem(writer, request, http.StatusBadRequest, errorCodeInvalidParameter, fmt.Sprintf("Cannot parse time: %s", endStr))
 			return
 		}
 		endTime := time.Unix(endUnix, 0)
@@ -147,8 +145,7 @@ func (h hisController) deleteHis(writer http.ResponseWriter, request *http.Reque
 	}
 	err = h.store.deleteHistory(pointId, start, end)
 	if err != nil {
-		log.Printf("SQL Error: %s", err)
-		writer.WriteHeader(http.StatusInternalServerError)
+		writeStoreError(writer, request, err)
 		return
 	}
 
@@ -1,6 +1,10 @@
 package main
 
 import (
+	"context"
+	"errors"
+	"slices"
+	"sync"
 	"time"
 
 	"github.com/google/uuid"
@@ -11,6 +15,8 @@ import (
 // historyStore is able to store point historical values
 type historyStore interface {
 	readHistory(uuid.UUID, *time.Time, *time.Time) ([]hisItem, error)
+	// readLatestHistory returns the value with the latest time, or nil if the point has no history.
+	readLatestHistory(uuid.UUID) (*hisItem, error)
 	writeHistory(uuid.UUID, hisItem) error
 	deleteHistory(uuid.UUID, *time.Time, *time.Time) error
 }
@@ -20,6 +26,142 @@ type hisItem struct {
 	Value *float64   `json:"value"`
 }
 
+// historyWrite is a value written to a point's history.
+type historyWrite struct {
+	pointId uuid.UUID
+	item    hisItem
+}
+
+// historyBatchWriter is a historyStore that can write many values at once, more efficiently than one at a time.
+type historyBatchWriter interface {
+	historyStore
+	// writeHistoryBatch writes the values in order, so that a later value at a point and time replaces an earlier one.
+	writeHistoryBatch([]historyWrite) error
+}
+
+// inMemoryHistoryStore stores point historical values in a local in-memory map, sorted by time.
+// These are not shared between instances, and are lost on restart unless a snapshot file is set.
+type inMemoryHistoryStore struct {
+	mux     *sync.RWMutex
+	history map[uuid.UUID][]hisItem
+	// snapshotFile is optional. If set, the values are loaded from it when the store is created, and saved to it on
+	// snapshot.
+	snapshotFile string
+}
+
+func newInMemoryHistoryStore(snapshotFile string) (inMemoryHistoryStore, error) {
+	s := inMemoryHistoryStore{
+		mux:          &sync.RWMutex{},
+		history:      map[uuid.UUID][]hisItem{},
+		snapshotFile: snapshotFile,
+	}
+	if snapshotFile == "" {
+		return s, nil
+	}
+	return s, readSnapshot(snapshotFile, &s.history)
+}
+
+func (s inMemoryHistoryStore) readHistory(
+	pointId uuid.UUID,
+	start *time.Time,
+	end *time.Time,
+) ([]hisItem, error) {
+	s.mux.RLock()
+	defer s.mux.RUnlock()
+	items := s.history[pointId]
+	from, to := hisRange(items, start, end)
+	result := []hisItem{}
+	for _, item := range items[from:to] {
+		result = append(result, copyHisItem(item))
+	}
+	return result, nil
+}
+
+func (s inMemoryHistoryStore) readLatestHistory(pointId uuid.UUID) (*hisItem, error) {
+	s.mux.RLock()
+	defer s.mux.RUnlock()
+	items := s.history[pointId]
+	if len(items) == 0 {
+		return nil, nil
+	}
+	result := copyHisItem(items[len(items)-1])
+	return &result, nil
+}
+
+func (s inMemoryHistoryStore) writeHistory(
+	pointId uuid.UUID,
+	hisItem hisItem,
+) error {
+	if hisItem.Ts == nil {
+		return errors.New("history must have a timestamp")
+	}
+	s.mux.Lock()
+	defer s.mux.Unlock()
+	items := s.history[pointId]
+	i, found := slices.BinarySearchFunc(items, *hisItem.Ts, compareHisItemTs)
+	if found {
+		items[i] = copyHisItem(hisItem)
+	} else {
+		s.history[pointId] = slices.Insert(items, i, copyHisItem(hisItem))
+	}
+	return nil
+}
+
+func (s inMemoryHistoryStore) deleteHistory(
+	pointId uuid.UUID,
+	start *time.Time,
+	end *time.Time,
+) error {
+	s.mux.Lock()
+	defer s.mux.Unlock()
+	items := s.history[pointId]
+	from, to := hisRange(items, start, end)
+	items = slices.Delete(items, from, to)
+	if len(items) == 0 {
+		delete(s.history, pointId)
+	} else {
+		s.history[pointId] = items
+	}
+	return nil
+}
+
+// snapshot saves the values to the snapshot file, if set.
+func (s inMemoryHistoryStore) snapshot() error {
+	if s.snapshotFile == "" {
+		return nil
+	}
+	s.mux.RLock()
+	defer s.mux.RUnlock()
+	return writeSnapshot(s.snapshotFile, s.history)
+}
+
+// hisRange returns the indexes of the sorted items from start, inclusive, to end, exclusive. Nil bounds are unbounded.
+func hisRange(items []hisItem, start *time.Time, end *time.Time) (int, int) {
+	from, to := 0, len(items)
+	if start != nil {
+		from, _ = slices.BinarySearchFunc(items, *start, compareHisItemTs)
+	}
+	if end != nil {
+		to, _ = slices.BinarySearchFunc(items, *end, compareHisItemTs)
+	}
+	return from, max(from, to)
+}
+
+func compareHisItemTs(item hisItem, ts time.Time) int {
+	return item.Ts.Compare(ts)
+}
+
+// copyHisItem copies the item, so that callers cannot change stored values through its pointers.
+func copyHisItem(item hisItem) hisItem {
+	ts := *item.Ts
+	result := hisItem{Ts: &ts}
+	if item.Value != nil {
+		value := *item.Value
+		result.Value = &value
+	}
+	return result
+}
+
 // gormHistoryStore stores point historical values in a GORM database.
 type gormHistoryStore struct {
 	db *gorm.DB
@@ -29,6 +171,10 @@ func newGormHistoryStore(db *gorm.DB) gormHistoryStore {
 	return gormHistoryStore{db: db}
 }
 
+func (s gormHistoryStore) ping(ctx context.Context) error {
+	return pingGormDB(ctx, s.db)
+}
+
 func (s gormHistoryStore) readHistory(
 	pointId uuid.UUID,
 	start *time.Time,
@@ -54,13 +200,22 @@ func (s gormHistoryStore) readHistory(
 	return result, nil
 }
 
+func (s gormHistoryStore) readLatestHistory(pointId uuid.UUID) (*hisItem, error) {
+	var sqlResult []gormHis
+	err := s.db.Where(&gormHis{PointId: pointId}).Order("ts desc").Limit(1).Find(&sqlResult).Error
+	if err != nil || len(sqlResult) == 0 {
+		return nil, err
+	}
+	return &hisItem{Ts: sqlResult[0].Ts, Value: sqlResult[0].Value}, nil
+}
+
 func (s gormHistoryStore) writeHistory(
 	pointId uuid.UUID,
 	hisItem hisItem,
 ) error {
 	gormHis := gormHis{
 		PointId: pointId,
-		Ts:      hisItem.Ts,
+		Ts:      gormHisTs(hisItem.Ts),
 		Value:   hisItem.Value,
 	}
 
@@ -70,6 +225,46 @@ func (s gormHistoryStore) writeHistory(
 	}).Create(&gormHis).Error
 }
 
+// writeHistoryBatch upserts the values with multi-row inserts.
+func (s gormHistoryStore) writeHistoryBatch(writes []historyWrite) error {
+	// A row may only be upserted once per statement, so only the last value at each point and time is kept. The
+	// times are those stored, so that values are only merged if the database would store them in the same row.
+	type key struct {
+		pointId uuid.UUID
+		ts      time.Time
+	}
+	rows := make([]gormHis, 0, len(writes))
+	indexes := map[key]int{}
+	for _, write := range writes {
+		row := gormHis{PointId: write.pointId, Ts: gormHisTs(write.item.Ts), Value: write.item.Value}
+		k := key{pointId: write.pointId, ts: *row.Ts}
+		if i, ok := indexes[k]; ok {
+			rows[i] = row
+			continue
+		}
+		indexes[k] = len(rows)
+		rows = append(rows, row)
+	}
+	if len(rows) == 0 {
+		return nil
+	}
+	return s.db.Clauses(clause.OnConflict{
+		Columns:   []clause.Column{{Name: "pointId"}, {Name: "ts"}},
+		DoUpdates: clause.AssignmentColumns([]string{"value"}),
+	}).CreateInBatches(rows, 1000).Error
+}
+
+// gormHisTs returns the time as it is stored: in UTC, to the microsecond. Postgres keeps no more, and SQLite, which
+// stores the text of the time, and MySQL, which would round it, are given the same, so that every database stores
+// values at the same times in the same rows.
+func gormHisTs(ts *time.Time) *time.Time {
+	if ts == nil {
+		return nil
+	}
+	result := ts.Truncate(time.Microsecond).UTC()
+	return &result
+}
+
 func (s gormHistoryStore) deleteHistory(
 	pointId uuid.UUID,
 	start *time.Time,
@@ -0,0 +1,216 @@
+package main
+
+import (
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/google/uuid"
+	"github.com/stretchr/testify/assert"
+)
+
+// TestHistoryStores runs the same behaviour against every history store implementation.
+func TestHistoryStores(t *testing.T) {
+	stores := map[string]func(t *testing.T) historyStore{
+		"memory": func(t *testing.T) historyStore {
+			store, err := newInMemoryHistoryStore("")
+			assert.Nil(t, err)
+			return store
+		},
+		"native": func(t *testing.T) historyStore {
+			store, err := newNativeHistoryStore(t.TempDir())
+			assert.Nil(t, err)
+			t.Cleanup(func() { store.close() })
+			return store
+		},
+		// Every write is flushed, so that values are read from segments rather than the write-ahead log
+		"nativeFlushed": func(t *testing.T) historyStore {
+			store, err := newNativeHistoryStore(t.TempDir())
+			assert.Nil(t, err)
+			store.maxWALSize = 0
+			t.Cleanup(func() { store.close() })
+			return store
+		},
+	}
+	for name, db := range testDatabases(t) {
+		stores[name] = func(t *testing.T) historyStore {
+			err := db.Where("1 = 1").Delete(&gormHis{}).Error
+			assert.Nil(t, err)
+			return newGormHistoryStore(db)
+		}
+		stores[name+"Buffered"] = func(t *testing.T) historyStore {
+			err := db.Where("1 = 1").Delete(&gormHis{}).Error
+			assert.Nil(t, err)
+			store, err := newBufferedHistoryStore(newGormHistoryStore(db), filepath.Join(t.TempDir(), "spill.log"), 3, 10, 10*time.Millisecond)
+			assert.Nil(t, err)
+			t.Cleanup(func() { store.close() })
+			return store
+		}
+	}
+	for name, newStore := range stores {
+		t.Run(name, func(t *testing.T) {
+			testHistoryStore(t, newStore(t))
+		})
+	}
+}
+
+func TestGormHistoryBatch(t *testing.T) {
+	for name, db := range testDatabases(t) {
+		t.Run(name, func(t *testing.T) {
+			store := newGormHistoryStore(db)
+			pointId := uuid.New()
+			ts := time.Date(2024, 1, 1, 0, 0, 0, 1000, time.UTC)
+			// Times in the same microsecond are the same row, whatever their zone
+			later := ts.Add(time.Nanosecond).In(time.FixedZone("UTC+1", 60*60))
+			err := store.writeHistoryBatch([]historyWrite{
+				{pointId: pointId, item: hisItem{Ts: &ts, Value: f(1)}},
+				{pointId: pointId, item: hisItem{Ts: &later, Value: f(2)}},
+			})
+			assert.Nil(t, err)
+			history, err := store.readHistory(pointId, nil, nil)
+			assert.Nil(t, err)
+			assert.Len(t, history, 1)
+			assert.Equal(t, f(2), history[0].Value)
+			assert.True(t, ts.Equal(*history[0].Ts))
+
+			// Single writes are stored in the same rows as batches
+			err = store.writeHistory(pointId, hisItem{Ts: &later, Value: f(3)})
+			assert.Nil(t, err)
+			history, err = store.readHistory(pointId, nil, nil)
+			assert.Nil(t, err)
+			assert.Len(t, history, 1)
+			assert.Equal(t, f(3), history[0].Value)
+		})
+	}
+}
+
+func testHistoryStore(t *testing.T, store historyStore) {
+	pointId := uuid.New()
+	otherId := uuid.New()
+	start := time.Date(2024, 1, 1, 0, 0, 0, 0, time.UTC)
+	at := func(minutes int) *time.Time {
+		ts := start.Add(time.Duration(minutes) * time.Minute)
+		return &ts
+	}
+	assertHistory := func(from *time.Time, to *time.Time, expected []hisItem) {
+		history, err := store.readHistory(pointId, from, to)
+		assert.Nil(t, err)
+		assert.NotNil(t, history)
+		assert.Len(t, history, len(expected))
+		for i := range min(len(history), len(expected)) {
+			assert.True(t, expected[i].Ts.Equal(*history[i].Ts), "expected %s, got %s", expected[i].Ts, history[i].Ts)
+			assert.Equal(t, expected[i].Value, history[i].Value)
+		}
+	}
+
+	// No history is empty, not nil
+	assertHistory(nil, nil, []hisItem{})
+	latest, err := store.readLatestHistory(pointId)
+	assert.Nil(t, err)
+	assert.Nil(t, latest)
+
+	// Values are read in time order, whatever order they are written in
+	for _, minutes := range []int{2, 0, 3, 1} {
+		err := store.writeHistory(pointId, hisItem{Ts: at(minutes), Value: f(float64(minutes))})
+		assert.Nil(t, err)
+	}
+	err = store.writeHistory(otherId, hisItem{Ts: at(0), Value: f(-1)})
+	assert.Nil(t, err)
+	assertHistory(nil, nil, []hisItem{
+		{Ts: at(0), Value: f(0)},
+		{Ts: at(1), Value: f(1)},
+		{Ts: at(2), Value: f(2)},
+		{Ts: at(3), Value: f(3)},
+	})
+
+	latest, err = store.readLatestHistory(pointId)
+	assert.Nil(t, err)
+	assert.True(t, at(3).Equal(*latest.Ts))
+	assert.Equal(t, f(3), latest.Value)
+
+	// The start is inclusive and the end exclusive
+	assertHistory(at(1), at(3), []hisItem{
+		{Ts: at(1), Value: f(1)},
+		{Ts: at(2), Value: f(2)},
+	})
+	assertHistory(at(2), nil, []hisItem{
+		{Ts: at(2), Value: f(2)},
+		{Ts: at(3), Value: f(3)},
+	})
+	assertHistory(nil, at(1), []hisItem{
+		{Ts: at(0), Value: f(0)},
+	})
+	assertHistory(at(3), at(1), []hisItem{})
+
+	// Writing again at a time replaces the value, which may be null
+	err = store.writeHistory(pointId, hisItem{Ts: at(1), Value: nil})
+	assert.Nil(t, err)
+	err = store.writeHistory(pointId, hisItem{Ts: at(2), Value: f(20)})
+	assert.Nil(t, err)
+	assertHistory(at(1), at(3), []hisItem{
+		{Ts: at(1), Value: nil},
+		{Ts: at(2), Value: f(20)},
+	})
+
+	// Deleting a range keeps the values around it, and other points' values
+	err = store.deleteHistory(pointId, at(1), at(3))
+	assert.Nil(t, err)
+	assertHistory(nil, nil, []hisItem{
+		{Ts: at(0), Value: f(0)},
+		{Ts: at(3), Value: f(3)},
+	})
+	err = store.deleteHistory(pointId, at(3), nil)
+	assert.Nil(t, err)
+	latest, err = store.readLatestHistory(pointId)
+	assert.Nil(t, err)
+	assert.True(t, at(0).Equal(*latest.Ts))
+	err = store.deleteHistory(pointId, nil, nil)
+	assert.Nil(t, err)
+	assertHistory(nil, nil, []hisItem{})
+	history, err := store.readHistory(otherId, nil, nil)
+	assert.Nil(t, err)
+	assert.Len(t, history, 1)
+
+	// A deletion across days does not remove values written after it
+	day := 24 * 60
+	for _, minutes := range []int{6 * 60, day + 6*60} {
+		err = store.writeHistory(pointId, hisItem{Ts: at(minutes), Value: f(float64(minutes))})
+		assert.Nil(t, err)
+	}
+	err = store.deleteHistory(pointId, at(12*60), at(day+12*60))
+	assert.Nil(t, err)
+	err = store.writeHistory(pointId, hisItem{Ts: at(13 * 60), Value: f(13 * 60)})
+	assert.Nil(t, err)
+	assertHistory(nil, nil, []hisItem{
+		{Ts: at(6 * 60), Value: f(6 * 60)},
+		{Ts: at(13 * 60), Value: f(13 * 60)},
+	})
+	latest, err = store.readLatestHistory(pointId)
+	assert.Nil(t, err)
+	assert.True(t, at(13*60).Equal(*latest.Ts))
+}
+
+func TestInMemoryHistoryStoreSnapshot(t *testing.T) {
+	snapshotFile := filepath.Join(t.TempDir(), "history.json")
+	store, err := newInMemoryHistoryStore(snapshotFile)
+	assert.Nil(t, err)
+	pointId := uuid.New()
+	ts := time.Date(2024, 1, 1, 0, 0, 0, 0, time.UTC)
+	err = store.writeHistory(pointId, hisItem{Ts: &ts, Value: f(1)})
+	assert.Nil(t, err)
+
+	// Changing a written or read value does not change the stored one
+	history, err := store.readHistory(pointId, nil, nil)
+	assert.Nil(t, err)
+	*history[0].Value = 2
+
+	err = store.snapshot()
+	assert.Nil(t, err)
+	restored, err := newInMemoryHistoryStore(snapshotFile)
+	assert.Nil(t, err)
+	history, err = restored.readHistory(pointId, nil, nil)
+	assert.Nil(t, err)
+	assert.Len(t, history, 1)
+	assert.True(t, ts.Equal(*history[0].Ts))
+	assert.Equal(t, 1.0, *history[0].Value)
+}
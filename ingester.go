@@ -79,6 +79,23 @@ func (i *ingester) refreshSubscriptions(recs []rec) {
 	}
 }
 
+// removeRec unsubscribes the rec from every topic, so that no more values are written for it.
+func (i *ingester) removeRec(recID uuid.UUID) {
+	i.mux.Lock()
+	defer i.mux.Unlock()
+	for topic, recIDs := range i.topics {
+		if recIDs[recID] {
+			i.unsubscribe(topic, recID)
+		}
+	}
+}
+
+// stop unsubscribes from every topic. Once it returns, no messages are being processed, and no more will be.
+func (i *ingester) stop() {
+	// refreshSubscriptions holds the write lock, so it waits for messages being processed to finish.
+	i.refreshSubscriptions([]rec{})
+}
+
 // Helper methods
 
 // Subscribe to a topic, and associate the rec with the topic
@@ -20,7 +20,8 @@ func TestIngesterTestSuite(t *testing.T) {
 }
 
 func (suite *IngesterTestSuite) SetupTest() {
-	currentStore := newInMemoryCurrentStore()
+	currentStore, err := newInMemoryCurrentStore("")
+	assert.Nil(suite.T(), err)
 	valueEmitter := mockValueEmitter{}
 	ingester := newIngester(
 		currentStore,
@@ -89,3 +90,36 @@ func (suite *IngesterTestSuite) TestIngester() {
 	actualRec3, _ = suite.currentStore.getCurrent(rec3.ID)
 	assert.Equal(suite.T(), *actualRec3.Value, 0.0)
 }
+
+func (suite *IngesterTestSuite) TestRemoveRec() {
+	rec1 := rec{ID: uuid.New(), Tags: map[string]interface{}{"mqttTopic": "test"}}
+	rec2 := rec{ID: uuid.New(), Tags: map[string]interface{}{"mqttTopic": "test"}}
+	suite.ingester.refreshSubscriptions([]rec{rec1, rec2})
+	suite.valueEmitter.emit(0.0)
+
+	// Check that removed records no longer have their current value set, while others on the topic do
+	suite.ingester.removeRec(rec1.ID)
+	suite.valueEmitter.emit(1.0)
+	actualRec1, _ := suite.currentStore.getCurrent(rec1.ID)
+	assert.Equal(suite.T(), *actualRec1.Value, 0.0)
+	actualRec2, _ := suite.currentStore.getCurrent(rec2.ID)
+	assert.Equal(suite.T(), *actualRec2.Value, 1.0)
+}
+
+func (suite *IngesterTestSuite) TestStop() {
+	rec1 := rec{
+		ID: uuid.New(),
+		Tags: map[string]interface{}{
+			"mqttTopic": "test",
+		},
+	}
+	suite.ingester.refreshSubscriptions([]rec{rec1})
+	suite.valueEmitter.emit(0.0)
+
+	// Check that messages received after stopping do not set current values
+	suite.ingester.stop()
+	suite.valueEmitter.emit(1.0)
+	assert.Empty(suite.T(), suite.ingester.topics["test"])
+	actual, _ := suite.currentStore.getCurrent(rec1.ID)
+	assert.Equal(suite.T(), *actual.Value, 0.0)
+}
@@ -0,0 +1,267 @@
+package main
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+)
+
+// This file implements JSON Merge Patch (RFC 7396) and JSON Patch (RFC 6902) over generic decoded JSON values,
+// as produced by json.Unmarshal into an interface{}.
+
+// applyMergePatch returns the target with the merge patch applied. The target is modified in place where possible.
+func applyMergePatch(target interface{}, patch interface{}) interface{} {
+	patchObject, ok := patch.(map[string]interface{})
+	if !ok {
+		return patch
+	}
+	targetObject, ok := target.(map[string]interface{})
+	if !ok {
+		targetObject = map[string]interface{}{}
+	}
+	for name, value := range patchObject {
+		if value == nil {
+			delete(targetObject, name)
+		} else {
+			targetObject[name] = applyMergePatch(targetObject[name], value)
+		}
+	}
+	return targetObject
+}
+
+// jsonPatchOperation is a single operation of a JSON Patch document.
+type jsonPatchOperation struct {
+	Op    string      `json:"op"`
+	Path  string      `json:"path"`
+	From  string      `json:"from"`
+	Value interface{} `json:"value"`
+}
+
+// applyJSONPatch returns the document with the operations applied in order. If any operation fails, an error is
+// returned and the patch should be considered not applied, although the document may have been partially modified.
+func applyJSONPatch(document interface{}, operations []jsonPatchOperation) (interface{}, error) {
+	var err error
+	for index, operation := range operations {
+		document, err = applyJSONPatchOperation(document, operation)
+		if err != nil {
+			return nil, fmt.Errorf("operation %d (%s %s): %w", index, operation.Op, operation.Path, err)
+		}
+	}
+	return document, nil
+}
+
+func applyJSONPatchOperation(document interface{}, operation jsonPatchOperation) (interface{}, error) {
+	path, err := parseJSONPointer(operation.Path)
+	if err != nil {
+		return nil, err
+	}
+	switch operation.Op {
+	case "add":
+		return jsonPointerAdd(document, path, operation.Value)
+	case "remove":
+		document, _, err := jsonPointerRemove(document, path)
+		return document, err
+	case "replace":
+		if len(path) == 0 {
+			return operation.Value, nil
+		}
+		document, _, err := jsonPointerRemove(document, path)
+		if err != nil {
+			return nil, err
+		}
+		return jsonPointerAdd(document, path, operation.Value)
+	case "move":
+		from, err := parseJSONPointer(operation.From)
+		if err != nil {
+			return nil, err
+		}
+		if len(path) > len(from) && jsonPointerHasPrefix(path, from) {
+			return nil, fmt.Errorf("cannot move a value into itself")
+		}
+		document, value, err := jsonPointerRemove(document, from)
+		if err != nil {
+			return nil, err
+		}
+		return jsonPointerAdd(document, path, value)
+	case "copy":
+		from, err := parseJSONPointer(operation.From)
+		if err != nil {
+			return nil, err
+		}
+		value, err := jsonPointerGet(document, from)
+		if err != nil {
+			return nil, err
+		}
+		return jsonPointerAdd(document, path, deepCopyJSON(value))
+	case "test":
+		value, err := jsonPointerGet(document, path)
+		if err != nil {
+			return nil, err
+		}
+		if !jsonEqual(value, operation.Value) {
+			return nil, fmt.Errorf("test failed")
+		}
+		return document, nil
+	}
+	return nil, fmt.Errorf("unknown op: %s", operation.Op)
+}
+
+// parseJSONPointer splits an RFC 6901 JSON Pointer into its unescaped reference tokens.
+func parseJSONPointer(pointer string) ([]string, error) {
+	if pointer == "" {
+		return []string{}, nil
+	}
+	if !strings.HasPrefix(pointer, "/") {
+		return nil, fmt.Errorf("invalid JSON pointer: %s", pointer)
+	}
+	tokens := strings.Split(pointer[1:], "/")
+	for i, token := range tokens {
+		tokens[i] = strings.ReplaceAll(strings.ReplaceAll(token, "~1", "/"), "~0", "~")
+	}
+	return tokens, nil
+}
+
+func jsonPointerHasPrefix(path []string, prefix []string) bool {
+	for i := range prefix {
+		if path[i] != prefix[i] {
+			return false
+		}
+	}
+	return true
+}
+
+func jsonPointerGet(document interface{}, path []string) (interface{}, error) {
+	current := document
+	for _, token := range path {
+		switch container := current.(type) {
+		case map[string]interface{}:
+			value, ok := container[token]
+			if !ok {
+				return nil, fmt.Errorf("path not found")
+			}
+			current = value
+		case []interface{}:
+			index, err := jsonArrayIndex(token, len(container)-1)
+			if err != nil {
+				return nil, err
+			}
+			current = container[index]
+		default:
+			return nil, fmt.Errorf("path not found")
+		}
+	}
+	return current, nil
+}
+
+// jsonPointerAdd returns the document with the value added at the path, following the RFC 6902 add semantics.
+func jsonPointerAdd(document interface{}, path []string, value interface{}) (interface{}, error) {
+	if len(path) == 0 {
+		return value, nil
+	}
+	parent, err := jsonPointerGet(document, path[:len(path)-1])
+	if err != nil {
+		return nil, err
+	}
+	token := path[len(path)-1]
+	switch container := parent.(type) {
+	case map[string]interface{}:
+		container[token] = value
+		return document, nil
+	case []interface{}:
+		index := len(container)
+		if token != "-" {
+			index, err = jsonArrayIndex(token, len(container))
+			if err != nil {
+				return nil, err
+			}
+		}
+		updated := append(container[:index:index], append([]interface{}{value}, container[index:]...)...)
+		return jsonPointerSet(document, path[:len(path)-1], updated)
+	}
+	return nil, fmt.Errorf("path not found")
+}
+
+// jsonPointerRemove returns the document with the value at the path removed, and the removed value.
+func jsonPointerRemove(document interface{}, path []string) (interface{}, interface{}, error) {
+	if len(path) == 0 {
+		return nil, nil, fmt.Errorf("cannot remove the whole document")
+	}
+	parent, err := jsonPointerGet(document, path[:len(path)-1])
+	if err != nil {
+		return nil, nil, err
+	}
+	token := path[len(path)-1]
+	switch container := parent.(type) {
+	case map[string]interface{}:
+		value, ok := container[token]
+		if !ok {
+			return nil, nil, fmt.Errorf("path not found")
+		}
+		delete(container, token)
+		return document, value, nil
+	case []interface{}:
+		index, err := jsonArrayIndex(token, len(container)-1)
+		if err != nil {
+			return nil, nil, err
+		}
+		value := container[index]
+		updated := append(container[:index:index], container[index+1:]...)
+		document, err := jsonPointerSet(document, path[:len(path)-1], updated)
+		return document, value, err
+	}
+	return nil, nil, fmt.Errorf("path not found")
+}
+
+// jsonPointerSet returns the document with the value at the path replaced. It is used for arrays, whose
+// slices cannot be modified in place.
+func jsonPointerSet(document interface{}, path []string, value interface{}) (interface{}, error) {
+	if len(path) == 0 {
+		return value, nil
+	}
+	parent, err := jsonPointerGet(document, path[:len(path)-1])
+	if err != nil {
+		return nil, err
+	}
+	token := path[len(path)-1]
+	switch container := parent.(type) {
+	case map[string]interface{}:
+		container[token] = value
+	case []interface{}:
+		index, err := jsonArrayIndex(token, len(container)-1)
+		if err != nil {
+			return nil, err
+		}
+		container[index] = value
+	}
+	return document, nil
+}
+
+// jsonArrayIndex parses an array index token, which must be between 0 and max inclusive.
+func jsonArrayIndex(token string, max int) (int, error) {
+	if token == "" || (len(token) > 1 && token[0] == '0') {
+		return 0, fmt.Errorf("invalid array index: %s", token)
+	}
+	index, err := strconv.Atoi(token)
+	if err != nil || index < 0 || index > max {
+		return 0, fmt.Errorf("invalid array index: %s", token)
+	}
+	return index, nil
+}
+
+func deepCopyJSON(value interface{}) interface{} {
+	switch typed := value.(type) {
+	case map[string]interface{}:
+		result := map[string]interface{}{}
+		for name, element := range typed {
+			result[name] = deepCopyJSON(element)
+		}
+		return result
+	case []interface{}:
+		result := []interface{}{}
+		for _, element := range typed {
+			result = append(result, deepCopyJSON(element))
+		}
+		return result
+	}
+	return value
+}
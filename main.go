@@ -1,11 +1,16 @@
 package main
 
 import (
+	"context"
+	"errors"
+	"flag"
 	"fmt"
 	"log"
 	"net/http"
 	"os"
-	"strconv"
+	"os/signal"
+	"sync/atomic"
+	"syscall"
 	"time"
 
 	mqtt "github.com/eclipse/paho.mqtt.golang"
@@ -18,8 +23,6 @@ import (
 	"go.opentelemetry.io/otel/sdk/metric"
 	"go.opentelemetry.io/otel/sdk/resource"
 	semconv "go.opentelemetry.io/otel/semconv/v1.17.0"
-	"gorm.io/driver/postgres"
-	"gorm.io/gorm"
 )
 
 func main() {
@@ -28,21 +31,44 @@ func main() {
 		log.Printf("Error loading .env file: %s", err)
 	}
 
+	// The config subcommand prints the config that the server would run with
+	if len(os.Args) > 1 && os.Args[1] == "config" {
+		config, err := loadConfig(os.Args[0]+" config", os.Args[2:], os.LookupEnv)
+		if errors.Is(err, flag.ErrHelp) {
+			return
+		}
+		if err != nil {
+			log.Fatal(err)
+		}
+		printed, err := config.redactedYAML()
+		if err != nil {
+			log.Fatal(err)
+		}
+		os.Stdout.Write(printed)
+		err = config.validate()
+		if err != nil {
+			log.Fatalf("Invalid config:\n%s", err)
+		}
+		return
+	}
+	config, err := loadConfig(os.Args[0], os.Args[1:], os.LookupEnv)
+	if errors.Is(err, flag.ErrHelp) {
+		return
+	}
+	if err != nil {
+		log.Fatal(err)
+	}
+	err = config.validate()
+	if err != nil {
+		log.Fatalf("Invalid config:\n%s", err)
+	}
+
 	// Database
-	dsn := fmt.Sprintf(
-		"host=%s port=%s user=%s password=%s dbname=%s sslmode=%s",
-		envOrDefault("DATABASE_HOST", "localhost"),
-		envOrDefault("DATABASE_PORT", "5432"),
-		envOrDefault("DATABASE_USERNAME", "postgres"),
-		envOrDefault("DATABASE_PASSWORD", "postgres"),
-		envOrDefault("DATABASE_NAME", "postgres"),
-		envOrDefault("DATABASE_SSL", "disable"),
-	)
-	db, err := gorm.Open(postgres.Open(dsn), &gorm.Config{})
+	db, err := openDatabase(config.Database)
 	if err != nil {
 		log.Fatal(err)
 	}
-	err = db.AutoMigrate(&gormHis{}, &gormRec{})
+	err = db.AutoMigrate(&gormHis{}, &gormRec{}, &gormTagDef{}, &gormRecRevision{}, &gormUser{}, &gormAccessPolicy{}, &gormAPIKey{}, &gormRefreshToken{}, &gormDeniedToken{})
 	if err != nil {
 		log.Fatal(err)
 	}
@@ -63,57 +89,204 @@ func main() {
 		metric.WithReader(metricExporter.Reader),
 	)
 	otel.SetMeterProvider(meterProvider) // Sets global
-	go serveMetrics()
+	metricsServer := serveMetrics(config.Server.MetricsPort)
 
 	// Stores
-	authenticator := singleUserAuthenticator{
-		username: os.Getenv("USERNAME"),
-		password: os.Getenv("PASSWORD"),
+	var authenticator authenticator
+	var userStore userStore
+	if config.Auth.AuthenticatorType == "database" {
+		gormUserStore := newGormUserStore(db)
+		err = bootstrapAdmin(gormUserStore, config.Auth.Username, config.Auth.Password)
+		if err != nil {
+			log.Fatal(err)
+		}
+		authenticator = newGormUserAuthenticator(db)
+		userStore = gormUserStore
+	} else {
+		authenticator = singleUserAuthenticator{
+			username: config.Auth.Username,
+			password: config.Auth.Password,
+		}
 	}
-	historyStore := newGormHistoryStore(db)
-	recStore := newGormRecStore(db)
+	// snapshotters are the memory stores that are saved to their snapshot files periodically and on shutdown.
+	var snapshotters []snapshotter
+	var historyStore historyStore = newGormHistoryStore(db)
+	var nativeHistoryStore *nativeHistoryStore
+	var bufferedHistoryStore *bufferedHistoryStore
+	switch config.HistoryStore.Type {
+	case "database":
+		buffer := config.HistoryStore.Buffer
+		if buffer.Enabled {
+			bufferedHistoryStore, err = newBufferedHistoryStore(
+				newGormHistoryStore(db),
+				buffer.SpillFile,
+				buffer.BatchSize,
+				buffer.MaxQueued,
+				time.Duration(buffer.FlushIntervalSeconds)*time.Second,
+			)
+			if err != nil {
+				log.Fatal(err)
+			}
+			historyStore = bufferedHistoryStore
+		}
+	case "native":
+		nativeHistoryStore, err = newNativeHistoryStore(config.HistoryStore.Path)
+		if err != nil {
+			log.Fatal(err)
+		}
+		historyStore = nativeHistoryStore
+	case "memory":
+		inMemoryHistoryStore, err := newInMemoryHistoryStore(config.HistoryStore.SnapshotFile)
+		if err != nil {
+			log.Fatal(err)
+		}
+		historyStore = inMemoryHistoryStore
+		snapshotters = append(snapshotters, inMemoryHistoryStore)
+	}
+	var recStore recStore = newGormRecStore(db)
+	var revisionStore revisionStore = newGormRevisionStore(db)
+	if config.RecStore.Type == "memory" {
+		inMemoryRecStore, err := newInMemoryRecStore(config.RecStore.SnapshotFile)
+		if err != nil {
+			log.Fatal(err)
+		}
+		recStore = inMemoryRecStore
+		revisionStore = inMemoryRecStore
+		snapshotters = append(snapshotters, inMemoryRecStore)
+	}
+	tagDefStore := newGormTagDefStore(db)
+	accessPolicyStore := newGormAccessPolicyStore(db)
+	apiKeyStore := newGormAPIKeyStore(db)
+	refreshTokenStore := newGormRefreshTokenStore(db)
 
 	var currentStore currentStore
-	currentStoreType := envOrDefault("CURRENT_STORE_TYPE", "memory")
-	if currentStoreType == "redis" {
-		redisDatabase, err := strconv.Atoi(envOrDefault("REDIS_DATABASE", "0"))
+	var tokenDenylist tokenDenylist
+	var redisClient redis.UniversalClient
+	var postgresCurrentStore *postgresCurrentStore
+	switch config.CurrentStore.Type {
+	case "redis":
+		redisClient = newRedisClient(config.CurrentStore.Redis)
+		currentStore = newRedisCurrentStore(redisClient, time.Duration(config.CurrentStore.Redis.CurrentTTLSeconds)*time.Second)
+		// Revoked tokens must be shared between instances, so they are stored with the current values.
+		tokenDenylist = newRedisTokenDenylist(redisClient)
+	case "postgres":
+		postgresCurrentStore, err = newPostgresCurrentStore(db, postgresDSN(config.Database))
 		if err != nil {
 			log.Fatal(err)
 		}
-		redisClient := redis.NewClient(&redis.Options{
-			Addr:     envOrDefault("REDIS_ADDRESS", "localhost:6379"),
-			Password: envOrDefault("REDIS_PASSWORD", ""),
-			DB:       redisDatabase,
-		})
-		currentStore = newRedisCurrentStore(redisClient)
-	} else if currentStoreType == "memory" {
-		currentStore = newInMemoryCurrentStore()
-	} else {
-		log.Fatalf("Unknown current store type: %s", currentStoreType)
+		currentStore = postgresCurrentStore
+		// Revoked tokens must be shared between instances, so they are stored in the database with the current values.
+		tokenDenylist = newGormTokenDenylist(db)
+	default:
+		inMemoryCurrentStore, err := newInMemoryCurrentStore(config.CurrentStore.SnapshotFile)
+		if err != nil {
+			log.Fatal(err)
+		}
+		currentStore = inMemoryCurrentStore
+		tokenDenylist = newInMemoryTokenDenylist()
+		snapshotters = append(snapshotters, inMemoryCurrentStore)
+		if config.CurrentStore.SeedFromHistory {
+			// Values that arrive while seeding are not replaced, so requests need not wait for it
+			go func() {
+				count, err := seedCurrentFromHistory(inMemoryCurrentStore, recStore, historyStore)
+				if err != nil {
+					log.Printf("Unable to seed current values from history: %s", err)
+					return
+				}
+				log.Printf("Seeded %d current values from history", count)
+			}()
+		}
+	}
+
+	trashRetention := time.Duration(config.TrashRetentionDays) * 24 * time.Hour
+	refreshTokenDuration := time.Duration(config.Auth.RefreshTokenDurationDays) * 24 * time.Hour
+
+	loginLimiter := newLoginLimiter(
+		config.Auth.Login.MaxFailures,
+		time.Duration(config.Auth.Login.LockoutSeconds)*time.Second,
+		time.Duration(config.Auth.Login.MaxLockoutSeconds)*time.Second,
+	)
+
+	trustedProxies, _ := parseTrustedProxies(config.Server.TrustedProxies)
+
+	var requestLimiter *requestLimiter
+	if config.Auth.RateLimit.Rate > 0 {
+		requestLimiter = newRequestLimiter(config.Auth.RateLimit.Rate, config.Auth.RateLimit.Burst)
+	}
+
+	// Role mappings were checked when the config was validated
+	clientCertificateRoles, _ := parseRoleMapping(config.Server.TLS.ClientRoleMapping)
+
+	var tokenVerifier *externalTokenVerifier
+	oidc := config.Auth.OIDC
+	if oidc.JWKSURL != "" || oidc.KeyFile != "" {
+		var keys publicKeySource
+		if oidc.JWKSURL != "" {
+			keys = newJWKSKeySource(oidc.JWKSURL)
+		} else {
+			keys, err = newFileKeySource(oidc.KeyFile)
+			if err != nil {
+				log.Fatal(err)
+			}
+		}
+		roleMapping, _ := parseRoleMapping(oidc.RoleMapping)
+		tokenVerifier = &externalTokenVerifier{
+			keys:          keys,
+			issuer:        oidc.Issuer,
+			audience:      oidc.Audience,
+			usernameClaim: oidc.UsernameClaim,
+			roleClaim:     oidc.RoleClaim,
+			roleMapping:   roleMapping,
+		}
+	}
+
+	// The API key from the config is kept as the default key, so that existing integrations keep working. It is
+	// revoked if the config no longer has one.
+	err = seedAPIKey(apiKeyStore, defaultAPIKeyName, config.Auth.APIKey, roleScopes[config.Auth.APIKeyRole])
+	if err != nil {
+		log.Fatal(err)
 	}
 
 	serverConfig := ServerConfig{
 		authenticator:        authenticator,
-		apiKey:               os.Getenv("API_KEY"),
-		jwtSecret:            os.Getenv("JWT_SECRET"),
-		tokenDurationSeconds: 60 * 60, // 1 hour
+		jwtSecret:            config.Auth.JWTSecret,
+		tokenDurationSeconds: config.Auth.TokenDurationSeconds,
+		tokenDenylist:        tokenDenylist,
+		refreshTokenStore:    refreshTokenStore,
+		refreshTokenDuration: refreshTokenDuration,
+		loginLimiter:         loginLimiter,
+		trustedProxies:       trustedProxies,
+		requestLimiter:       requestLimiter,
+
+		externalTokenVerifier:  tokenVerifier,
+		clientCertificateRoles: clientCertificateRoles,
+
+		historyStore:               historyStore,
+		recStore:                   recStore,
+		currentStore:               currentStore,
+		tagDefStore:                tagDefStore,
+		revisionStore:              revisionStore,
+		userStore:                  userStore,
+		apiKeyStore:                apiKeyStore,
+		accessPolicyStore:          accessPolicyStore,
+		allowWithoutAccessPolicies: config.Auth.AccessPolicyDefault == "allow",
 
-		historyStore: historyStore,
-		recStore:     recStore,
-		currentStore: currentStore,
+		trashRetention: trashRetention,
+
+		shuttingDown: &atomic.Bool{},
 	}
 
 	// Start MQTT
-	mqttAddress := os.Getenv("MQTT_ADDRESS")
-	mqttUsername := os.Getenv("MQTT_USERNAME")
-	mqttPassword := os.Getenv("MQTT_PASSWORD")
-	mqttConnectionTimeout := time.Duration(5 * time.Second)
+	mqttAddress := config.MQTT.Address
+	mqttConnectionTimeout := time.Duration(config.MQTT.ConnectionTimeoutSeconds) * time.Second
+	mqttSubscribeTimeout := time.Duration(config.MQTT.SubscribeTimeoutSeconds) * time.Second
+	mqttDisconnectQuiesce := time.Duration(config.MQTT.DisconnectQuiesceSeconds) * time.Second
 
 	options := mqtt.NewClientOptions()
 	options.AddBroker(mqttAddress)
 	options.SetClientID(uuid.NewString())
-	options.SetUsername(mqttUsername)
-	options.SetPassword(mqttPassword)
+	options.SetUsername(config.MQTT.Username)
+	options.SetPassword(config.MQTT.Password)
 	mqttClient := mqtt.NewClient(options)
 	connectToken := mqttClient.Connect()
 	if !connectToken.WaitTimeout(mqttConnectionTimeout) {
@@ -123,7 +296,7 @@ func main() {
 		log.Fatal(connectToken.Error())
 	}
 	log.Printf("MQTT connected to %s", mqttAddress)
-	valueEmitter := newMQTTValueEmitter(mqttClient)
+	valueEmitter := newMQTTValueEmitter(mqttClient, mqttConnectionTimeout, mqttSubscribeTimeout)
 
 	// Setup ingester
 	ingester := newIngester(
@@ -136,44 +309,173 @@ func main() {
 	}
 	ingester.refreshSubscriptions(recs)
 
-	defer func() {
-		ingester.refreshSubscriptions([]rec{})
-		mqttClient.Disconnect(1)
-		log.Printf("Disconnected from %s", mqttAddress)
-	}()
+	serverConfig.ingester = &ingester
+	serverConfig.dependencies = map[string]pinger{"mqtt": &valueEmitter}
+
+	// Purge expired recs from the trash
+	stopPurges := make(chan struct{})
+	purgesDone := make(chan struct{})
+	if trashRetention > 0 {
+		deleter := recDeleter{
+			recStore:       recStore,
+			historyStore:   historyStore,
+			currentStore:   currentStore,
+			ingester:       &ingester,
+			trashRetention: trashRetention,
+		}
+		go deleter.runPurges(time.Hour, stopPurges, purgesDone)
+	} else {
+		close(purgesDone)
+	}
+	stopSnapshots := make(chan struct{})
+	snapshotsDone := make(chan struct{})
+	if len(snapshotters) > 0 {
+		go runSnapshots(snapshotters, time.Duration(config.SnapshotIntervalSeconds)*time.Second, stopSnapshots, snapshotsDone)
+	} else {
+		close(snapshotsDone)
+	}
 
 	server, err := NewServer(serverConfig)
 	if err != nil {
 		log.Fatal(err)
 	}
 
-	host := envOrDefault("HOST", "localhost")
-	port, err := strconv.ParseInt(envOrDefault("PORT", "80"), 10, 0)
+	host := config.Server.Host
+	port := config.Server.Port
+	httpServer := &http.Server{
+		Addr:    fmt.Sprintf(":%d", port),
+		Handler: server,
+	}
+	// httpServers are shut down together, once requests stop being accepted.
+	httpServers := []*http.Server{httpServer}
+
+	tlsConfig := config.Server.TLS
+	if tlsConfig.CertFile == "" {
+		log.Printf("Serving at http://%s:%d", host, port)
+		go serve(httpServer.ListenAndServe)
+	} else {
+		certificateReloader, err := newCertificateReloader(tlsConfig.CertFile, tlsConfig.KeyFile)
+		if err != nil {
+			log.Fatal(err)
+		}
+		httpServer.TLSConfig, err = newTLSConfig(certificateReloader, tlsConfig.ClientCAFile)
+		if err != nil {
+			log.Fatal(err)
+		}
+		if tlsConfig.HTTPRedirectPort != 0 {
+			redirectServer := &http.Server{
+				Addr:    fmt.Sprintf(":%d", tlsConfig.HTTPRedirectPort),
+				Handler: httpsRedirectHandler(port),
+			}
+			httpServers = append(httpServers, redirectServer)
+			log.Printf("Redirecting http://%s:%d to HTTPS", host, tlsConfig.HTTPRedirectPort)
+			go serve(redirectServer.ListenAndServe)
+		}
+		log.Printf("Serving at https://%s:%d", host, port)
+		// The certificate is provided by the TLS configuration, so that it can be reloaded.
+		go serve(func() error { return httpServer.ListenAndServeTLS("", "") })
+	}
+
+	// Shut down gracefully on SIGINT or SIGTERM
+	signals, stopSignals := signal.NotifyContext(context.Background(), os.Interrupt, syscall.SIGTERM)
+	defer stopSignals()
+	<-signals.Done()
+	shutdownTimeoutSeconds := config.Server.ShutdownTimeoutSeconds
+	shutdownDelaySeconds := config.Server.ShutdownDelaySeconds
+	// Fail readiness first, and keep serving while load balancers notice, so that no requests are refused
+	serverConfig.shuttingDown.Store(true)
+	if shutdownDelaySeconds > 0 {
+		log.Printf("Shutting down, failing readiness for %d seconds", shutdownDelaySeconds)
+		time.Sleep(time.Duration(shutdownDelaySeconds) * time.Second)
+	}
+	log.Printf("Shutting down, waiting up to %d seconds for requests to complete", shutdownTimeoutSeconds)
+	shutdownCtx, cancel := context.WithTimeout(context.Background(), time.Duration(shutdownTimeoutSeconds)*time.Second)
+	defer cancel()
+
+	// Stop accepting requests, and wait for those in flight
+	for _, httpServer := range httpServers {
+		err = httpServer.Shutdown(shutdownCtx)
+		if err != nil {
+			log.Printf("Unable to shut down the server gracefully: %s", err)
+		}
+	}
+	// Stop ingesting, then give the MQTT client time to finish handling received messages
+	ingester.stop()
+	mqttClient.Disconnect(uint(mqttDisconnectQuiesce.Milliseconds()))
+	log.Printf("Disconnected from %s", mqttAddress)
+	// Wait for a purge or snapshot in progress, so that the stores are not closed under it
+	close(stopPurges)
+	close(stopSnapshots)
+	<-purgesDone
+	<-snapshotsDone
+
+	// Nothing writes to the stores any more, so they can be saved and their connections closed
+	if bufferedHistoryStore != nil {
+		// Buffered history is written to the database, or spilled, before it is closed
+		err = bufferedHistoryStore.close()
+		if err != nil {
+			log.Printf("Unable to write buffered history: %s", err)
+		}
+	}
+	for _, snapshotter := range snapshotters {
+		err = snapshotter.snapshot()
+		if err != nil {
+			log.Printf("Unable to snapshot store: %s", err)
+		}
+	}
+	if nativeHistoryStore != nil {
+		err = nativeHistoryStore.close()
+		if err != nil {
+			log.Printf("Unable to close the history store: %s", err)
+		}
+	}
+	if postgresCurrentStore != nil {
+		postgresCurrentStore.close()
+	}
+	if redisClient != nil {
+		err = redisClient.Close()
+		if err != nil {
+			log.Printf("Unable to close Redis: %s", err)
+		}
+	}
+	sqlDB, err := db.DB()
+	if err == nil {
+		err = sqlDB.Close()
+	}
 	if err != nil {
-		log.Fatal(err)
+		log.Printf("Unable to close the database: %s", err)
 	}
-	log.Printf("Serving at http://%s:%d", host, port)
-	err = http.ListenAndServe(fmt.Sprintf(":%d", port), server)
+
+	// Metrics are served until last, so that the shutdown can be observed. The shutdown has its own timeout, as the
+	// requests may have used up the first.
+	metricsShutdownCtx, cancelMetricsShutdown := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancelMetricsShutdown()
+	err = metricsServer.Shutdown(metricsShutdownCtx)
 	if err != nil {
-		log.Fatalf("%s", err)
+		log.Printf("Unable to shut down the metrics server: %s", err)
 	}
+	log.Printf("Shut down")
 }
 
-func envOrDefault(name string, def string) string {
-	value, ok := os.LookupEnv(name)
-	if ok {
-		return value
-	} else {
-		return def
+// serve runs an http.Server listen function, exiting if it fails for any reason other than being shut down.
+func serve(listen func() error) {
+	err := listen()
+	if err != nil && !errors.Is(err, http.ErrServerClosed) {
+		log.Fatalf("%s", err)
 	}
 }
 
-func serveMetrics() {
-	log.Printf("Serving metrics at localhost:2112/metrics")
-	http.Handle("/metrics", promhttp.Handler())
-	err := http.ListenAndServe(":2112", nil)
-	if err != nil {
-		fmt.Printf("error serving http: %v", err)
-		return
-	}
+// serveMetrics serves the metrics in the background, returning the server so that it can be shut down.
+func serveMetrics(port int) *http.Server {
+	log.Printf("Serving metrics at localhost:%d/metrics", port)
+	mux := http.NewServeMux()
+	mux.Handle("/metrics", promhttp.Handler())
+	metricsServer := &http.Server{Addr: fmt.Sprintf(":%d", port), Handler: mux}
+	go func() {
+		err := metricsServer.ListenAndServe()
+		if err != nil && !errors.Is(err, http.ErrServerClosed) {
+			fmt.Printf("error serving http: %v", err)
+		}
+	}()
+	return metricsServer
 }
@@ -0,0 +1,405 @@
+package main
+
+import (
+	"encoding/binary"
+	"errors"
+	"hash/crc32"
+	"math"
+	"math/bits"
+
+	"github.com/google/uuid"
+)
+
+// This file implements the formats of the native history store. Values are stored in blocks, which compress the
+// timestamps with delta-of-delta encoding and the values with Gorilla XOR encoding, as described in "Gorilla: A Fast,
+// Scalable, In-Memory Time Series Database". Blocks, and the other records of the store, are written in frames with
+// checksums, so that a frame torn by a crash can be detected and ignored.
+
+var errCorruptNativeHistory = errors.New("corrupt native history data")
+
+// nativePoint is a historical value at a time in Unix nanoseconds. The value is nil if it is null.
+type nativePoint struct {
+	ts    int64
+	value *float64
+}
+
+// Frame types
+const (
+	// frameBlock is a block of points in a segment.
+	frameBlock byte = 1
+	// frameTombstone deletes the points written before it in a segment, within a time range.
+	frameTombstone byte = 2
+	// frameWrite is a point written to the write-ahead log.
+	frameWrite byte = 3
+)
+
+// frameHeaderSize is the size of the frame type, the payload length and the checksum.
+const frameHeaderSize = 9
+
+var frameChecksumTable = crc32.MakeTable(crc32.Castagnoli)
+
+// appendFrame appends a frame with the payload to buf. The checksum covers the type and the payload.
+func appendFrame(buf []byte, frameType byte, payload []byte) []byte {
+	checksum := crc32.Update(crc32.Checksum([]byte{frameType}, frameChecksumTable), frameChecksumTable, payload)
+	buf = append(buf, frameType)
+	buf = binary.LittleEndian.AppendUint32(buf, uint32(len(payload)))
+	buf = binary.LittleEndian.AppendUint32(buf, checksum)
+	return append(buf, payload...)
+}
+
+// readFrames calls onFrame with each frame in data, in order. It stops at a final frame that is incomplete or fails its
+// checksum, as may be left at the end of a file by a crash, and returns the length of the frames before it. A frame
+// that fails its checksum before the end cannot have been torn by a crash, so the data is corrupt.
+func readFrames(data []byte, onFrame func(frameType byte, payload []byte) error) (int, error) {
+	offset := 0
+	for len(data)-offset >= frameHeaderSize {
+		frameType := data[offset]
+		length := int(binary.LittleEndian.Uint32(data[offset+1:]))
+		checksum := binary.LittleEndian.Uint32(data[offset+5:])
+		end := offset + frameHeaderSize + length
+		if length > len(data)-offset-frameHeaderSize {
+			break
+		}
+		payload := data[offset+frameHeaderSize : end]
+		if crc32.Update(crc32.Checksum([]byte{frameType}, frameChecksumTable), frameChecksumTable, payload) != checksum {
+			if end < len(data) {
+				return offset, errCorruptNativeHistory
+			}
+			break
+		}
+		err := onFrame(frameType, payload)
+		if err != nil {
+			return offset, err
+		}
+		offset = end
+	}
+	return offset, nil
+}
+
+// encodeTombstone encodes the range of a tombstone frame. The end is exclusive.
+func encodeTombstone(start int64, end int64) []byte {
+	payload := binary.AppendVarint(nil, start)
+	return binary.AppendVarint(payload, end)
+}
+
+func decodeTombstone(payload []byte) (start int64, end int64, err error) {
+	start, n := binary.Varint(payload)
+	if n <= 0 {
+		return 0, 0, errCorruptNativeHistory
+	}
+	end, m := binary.Varint(payload[n:])
+	if m <= 0 {
+		return 0, 0, errCorruptNativeHistory
+	}
+	return start, end, nil
+}
+
+// encodeWrite encodes a value written to a point, for the write-ahead log.
+func encodeWrite(pointId uuid.UUID, point nativePoint) []byte {
+	payload := append([]byte{}, pointId[:]...)
+	payload = binary.AppendVarint(payload, point.ts)
+	if point.value == nil {
+		return append(payload, 0)
+	}
+	payload = append(payload, 1)
+	return binary.LittleEndian.AppendUint64(payload, math.Float64bits(*point.value))
+}
+
+func decodeWrite(payload []byte) (uuid.UUID, nativePoint, error) {
+	if len(payload) < len(uuid.UUID{}) {
+		return uuid.UUID{}, nativePoint{}, errCorruptNativeHistory
+	}
+	pointId := uuid.UUID(payload[:16])
+	ts, n := binary.Varint(payload[16:])
+	if n <= 0 || len(payload) < 16+n+1 {
+		return uuid.UUID{}, nativePoint{}, errCorruptNativeHistory
+	}
+	rest := payload[16+n:]
+	point := nativePoint{ts: ts}
+	if rest[0] == 1 {
+		if len(rest) < 9 {
+			return uuid.UUID{}, nativePoint{}, errCorruptNativeHistory
+		}
+		value := math.Float64frombits(binary.LittleEndian.Uint64(rest[1:]))
+		point.value = &value
+	}
+	return pointId, point, nil
+}
+
+// blockHasNulls is a block header flag, set if any values in the block are null. Each value is then preceded by a bit
+// that is set if it is null.
+const blockHasNulls byte = 1
+
+// encodeBlock compresses points, which must be sorted by time with no duplicates.
+func encodeBlock(points []nativePoint) []byte {
+	var flags byte
+	for _, point := range points {
+		if point.value == nil {
+			flags |= blockHasNulls
+		}
+	}
+	header := binary.AppendUvarint(nil, uint64(len(points)))
+	if len(points) == 0 {
+		return header
+	}
+	header = binary.AppendVarint(header, points[0].ts)
+	header = append(header, flags)
+
+	writer := bitWriter{bytes: header}
+	// Timestamps
+	previousTs := points[0].ts
+	var previousDelta int64
+	for _, point := range points[1:] {
+		delta := point.ts - previousTs
+		writer.writeDeltaOfDelta(delta - previousDelta)
+		previousTs = point.ts
+		previousDelta = delta
+	}
+	// Values
+	var previous uint64
+	started := false
+	// leading and trailing are the zero bits around the meaningful bits of the last XOR that set them. -1 if none.
+	leading, trailing := -1, -1
+	for _, point := range points {
+		if flags&blockHasNulls != 0 {
+			writer.writeBit(point.value == nil)
+		}
+		if point.value == nil {
+			continue
+		}
+		value := math.Float64bits(*point.value)
+		if !started {
+			writer.writeBits(value, 64)
+			previous = value
+			started = true
+			continue
+		}
+		xor := value ^ previous
+		previous = value
+		if xor == 0 {
+			writer.writeBit(false)
+			continue
+		}
+		writer.writeBit(true)
+		xorLeading := bits.LeadingZeros64(xor)
+		xorTrailing := bits.TrailingZeros64(xor)
+		// The leading zeros are written in 5 bits
+		if xorLeading > 31 {
+			xorLeading = 31
+		}
+		if leading >= 0 && xorLeading >= leading && xorTrailing >= trailing {
+			// The meaningful bits fit in the previous window
+			writer.writeBit(false)
+			writer.writeBits(xor>>trailing, 64-leading-trailing)
+			continue
+		}
+		leading, trailing = xorLeading, xorTrailing
+		significant := 64 - leading - trailing
+		writer.writeBit(true)
+		writer.writeBits(uint64(leading), 5)
+		// 64 significant bits cannot occur with a leading zero, so it is written as 0
+		writer.writeBits(uint64(significant&63), 6)
+		writer.writeBits(xor>>trailing, significant)
+	}
+	return writer.bytes
+}
+
+// decodeBlock decompresses the points of a block.
+func decodeBlock(block []byte) ([]nativePoint, error) {
+	count, n := binary.Uvarint(block)
+	if n <= 0 {
+		return nil, errCorruptNativeHistory
+	}
+	if count == 0 {
+		return []nativePoint{}, nil
+	}
+	// Each point takes at least a bit, so larger counts are corrupt, and must not be allocated.
+	if count > uint64(len(block))*8 {
+		return nil, errCorruptNativeHistory
+	}
+	firstTs, m := binary.Varint(block[n:])
+	if m <= 0 || len(block) < n+m+1 {
+		return nil, errCorruptNativeHistory
+	}
+	flags := block[n+m]
+	reader := bitReader{bytes: block[n+m+1:]}
+
+	points := make([]nativePoint, count)
+	points[0].ts = firstTs
+	var delta int64
+	for i := 1; i < len(points); i++ {
+		deltaOfDelta, err := reader.readDeltaOfDelta()
+		if err != nil {
+			return nil, err
+		}
+		delta += deltaOfDelta
+		points[i].ts = points[i-1].ts + delta
+	}
+
+	var previous uint64
+	started := false
+	leading, trailing := 0, 0
+	for i := range points {
+		if flags&blockHasNulls != 0 {
+			isNull, err := reader.readBit()
+			if err != nil {
+				return nil, err
+			}
+			if isNull {
+				continue
+			}
+		}
+		if !started {
+			value, err := reader.readBits(64)
+			if err != nil {
+				return nil, err
+			}
+			previous = value
+			started = true
+		} else {
+			changed, err := reader.readBit()
+			if err != nil {
+				return nil, err
+			}
+			if changed {
+				newWindow, err := reader.readBit()
+				if err != nil {
+					return nil, err
+				}
+				if newWindow {
+					leadingBits, err := reader.readBits(5)
+					if err != nil {
+						return nil, err
+					}
+					significantBits, err := reader.readBits(6)
+					if err != nil {
+						return nil, err
+					}
+					if significantBits == 0 {
+						significantBits = 64
+					}
+					leading = int(leadingBits)
+					trailing = 64 - leading - int(significantBits)
+					if trailing < 0 {
+						return nil, errCorruptNativeHistory
+					}
+				}
+				xor, err := reader.readBits(64 - leading - trailing)
+				if err != nil {
+					return nil, err
+				}
+				previous ^= xor << trailing
+			}
+		}
+		value := math.Float64frombits(previous)
+		points[i].value = &value
+	}
+	return points, nil
+}
+
+// deltaOfDeltaBuckets are the sizes that deltas of deltas are written in, after a prefix of as many 1 bits as their
+// index and a 0 bit, except for the last. A delta of delta of zero is written as a single 0 bit. Values are zigzag
+// encoded, so that small negative values are small.
+var deltaOfDeltaBuckets = []int{7, 9, 12, 32, 64}
+
+func (w *bitWriter) writeDeltaOfDelta(deltaOfDelta int64) {
+	if deltaOfDelta == 0 {
+		w.writeBit(false)
+		return
+	}
+	zigzag := uint64(deltaOfDelta<<1) ^ uint64(deltaOfDelta>>63)
+	for i, size := range deltaOfDeltaBuckets {
+		if size == 64 || zigzag < 1<<size {
+			w.writeBit(true)
+			w.writeBits(1<<i-1, i)
+			if i < len(deltaOfDeltaBuckets)-1 {
+				w.writeBit(false)
+			}
+			w.writeBits(zigzag, size)
+			return
+		}
+	}
+}
+
+func (r *bitReader) readDeltaOfDelta() (int64, error) {
+	bucket := 0
+	for {
+		bit, err := r.readBit()
+		if err != nil {
+			return 0, err
+		}
+		if !bit {
+			break
+		}
+		bucket++
+		if bucket == len(deltaOfDeltaBuckets) {
+			break
+		}
+	}
+	if bucket == 0 {
+		return 0, nil
+	}
+	zigzag, err := r.readBits(deltaOfDeltaBuckets[bucket-1])
+	if err != nil {
+		return 0, err
+	}
+	return int64(zigzag>>1) ^ -int64(zigzag&1), nil
+}
+
+// bitWriter appends bits to bytes, most significant first.
+type bitWriter struct {
+	bytes []byte
+	// free is the number of unused bits in the last byte.
+	free int
+}
+
+func (w *bitWriter) writeBit(bit bool) {
+	var value uint64
+	if bit {
+		value = 1
+	}
+	w.writeBits(value, 1)
+}
+
+// writeBits writes the lowest count bits of value.
+func (w *bitWriter) writeBits(value uint64, count int) {
+	for count > 0 {
+		if w.free == 0 {
+			w.bytes = append(w.bytes, 0)
+			w.free = 8
+		}
+		n := min(count, w.free)
+		chunk := (value >> (count - n)) & (1<<n - 1)
+		w.free -= n
+		w.bytes[len(w.bytes)-1] |= byte(chunk << w.free)
+		count -= n
+	}
+}
+
+// bitReader reads bits written by a bitWriter.
+type bitReader struct {
+	bytes []byte
+	// position is the index of the next bit.
+	position int
+}
+
+func (r *bitReader) readBit() (bool, error) {
+	value, err := r.readBits(1)
+	return value == 1, err
+}
+
+func (r *bitReader) readBits(count int) (uint64, error) {
+	if count > len(r.bytes)*8-r.position {
+		return 0, errCorruptNativeHistory
+	}
+	var result uint64
+	for count > 0 {
+		offset := r.position % 8
+		n := min(count, 8-offset)
+		chunk := uint64(r.bytes[r.position/8]>>(8-offset-n)) & (1<<n - 1)
+		result = result<<n | chunk
+		r.position += n
+		count -= n
+	}
+	return result, nil
+}
@@ -0,0 +1,678 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io/fs"
+	"log"
+	"maps"
+	"math"
+	"os"
+	"path/filepath"
+	"slices"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/google/uuid"
+)
+
+// nativeHistoryStore stores point historical values in compressed files on local disk, so that no database server is
+// needed.
+//
+// Each point has a directory of segments, which are files that each hold a day of values. Segments are append-only:
+// values are appended in blocks, and deletions in tombstones, and later frames take precedence over earlier ones. Once
+// a segment has enough frames, it is compacted into a single block.
+//
+// Writes are appended to a write-ahead log, and synced, before they return. Concurrent writes are committed together,
+// with one sync per batch. They are buffered in memory until the log is large enough, and then written to the
+// segments as one block per point and day. If the server crashes, the log is replayed when the store is next opened.
+type nativeHistoryStore struct {
+	dir string
+	// maxWALSize is the size the write-ahead log may reach before the buffered values are written to segments.
+	maxWALSize int64
+	// compactFrames is the number of frames a segment may have before it is compacted.
+	compactFrames int
+
+	// mux is held for reading to read segments or commit writes, and for writing to change segments.
+	mux sync.RWMutex
+	wal *os.File
+	// walSize is the size of the valid frames in the write-ahead log.
+	walSize int64
+	// headMux guards heads while mux is only held for reading.
+	headMux sync.Mutex
+	// heads are the values written since they were last written to segments, by point and time.
+	heads map[uuid.UUID]map[int64]*float64
+	// segments are the segments that have been appended to since the store was opened, by path.
+	segments map[string]nativeSegment
+
+	// commitMux is held while a batch is committed to the write-ahead log, so that one batch is committed at a time.
+	commitMux sync.Mutex
+	// pendingMux guards pending.
+	pendingMux sync.Mutex
+	// pending is the batch that writes join until it is committed.
+	pending *nativeBatch
+}
+
+// nativeBatch is a batch of writes that are committed to the write-ahead log together.
+type nativeBatch struct {
+	frames []byte
+	writes []nativeWrite
+	// done is closed once the batch is committed, and err is set.
+	done chan struct{}
+	err  error
+}
+
+type nativeWrite struct {
+	pointId uuid.UUID
+	point   nativePoint
+}
+
+type nativeSegment struct {
+	frames int
+	size   int64
+}
+
+const (
+	nativeWALFile          = "wal.log"
+	nativeSegmentExtension = ".seg"
+	// nativeSegmentDuration is the time covered by each segment. Segments are named by the UTC date they start on.
+	nativeSegmentDuration = 24 * time.Hour
+	nativeSegmentLayout   = "2006-01-02"
+)
+
+// newNativeHistoryStore opens the store in the directory, creating it if needed, and replays its write-ahead log.
+func newNativeHistoryStore(dir string) (*nativeHistoryStore, error) {
+	err := os.MkdirAll(dir, 0o755)
+	if err != nil {
+		return nil, err
+	}
+	wal, err := os.OpenFile(filepath.Join(dir, nativeWALFile), os.O_RDWR|os.O_CREATE|os.O_APPEND, 0o644)
+	if err != nil {
+		return nil, err
+	}
+	store := &nativeHistoryStore{
+		dir:           dir,
+		maxWALSize:    4 << 20, // 4 MiB
+		compactFrames: 16,
+		wal:           wal,
+		heads:         map[uuid.UUID]map[int64]*float64{},
+		segments:      map[string]nativeSegment{},
+	}
+	err = store.replayWAL()
+	if err != nil {
+		wal.Close()
+		return nil, err
+	}
+	return store, nil
+}
+
+// replayWAL buffers the values in the write-ahead log, and removes any frame torn by a crash from its end.
+func (s *nativeHistoryStore) replayWAL() error {
+	data, err := os.ReadFile(s.wal.Name())
+	if err != nil {
+		return err
+	}
+	valid, err := readFrames(data, func(frameType byte, payload []byte) error {
+		if frameType != frameWrite {
+			return errCorruptNativeHistory
+		}
+		pointId, point, err := decodeWrite(payload)
+		if err != nil {
+			return err
+		}
+		s.buffer(pointId, point)
+		return nil
+	})
+	if err != nil {
+		return fmt.Errorf("cannot replay %s: %w", s.wal.Name(), err)
+	}
+	if valid < len(data) {
+		err = s.wal.Truncate(int64(valid))
+		if err != nil {
+			return err
+		}
+	}
+	s.walSize = int64(valid)
+	return nil
+}
+
+func (s *nativeHistoryStore) ping(ctx context.Context) error {
+	s.mux.RLock()
+	defer s.mux.RUnlock()
+	if s.wal == nil {
+		return errors.New("native history store is closed")
+	}
+	_, err := os.Stat(s.dir)
+	return err
+}
+
+func (s *nativeHistoryStore) readHistory(
+	pointId uuid.UUID,
+	start *time.Time,
+	end *time.Time,
+) ([]hisItem, error) {
+	s.mux.RLock()
+	defer s.mux.RUnlock()
+
+	startTs, endTs := nativeRange(start, end)
+	values := map[int64]*float64{}
+	paths, err := s.segmentPaths(pointId, startTs, endTs)
+	if err != nil {
+		return []hisItem{}, err
+	}
+	// Each segment is replayed on its own, so that its tombstones cannot remove values from others
+	for _, path := range paths {
+		segmentValues := map[int64]*float64{}
+		_, _, err = readSegment(path, segmentValues)
+		if err != nil {
+			return []hisItem{}, err
+		}
+		for ts, value := range segmentValues {
+			values[ts] = value
+		}
+	}
+	// Buffered values are newer than all segments
+	for ts, value := range s.head(pointId) {
+		values[ts] = value
+	}
+
+	points := sortedNativePoints(values, startTs, endTs)
+	result := make([]hisItem, 0, len(points))
+	for _, point := range points {
+		ts := time.Unix(0, point.ts).UTC()
+		result = append(result, hisItem{Ts: &ts, Value: point.value})
+	}
+	return result, nil
+}
+
+// readLatestHistory reads the point's segments from the newest, and stops at the first with values, since older
+// segments only hold earlier ones.
+func (s *nativeHistoryStore) readLatestHistory(pointId uuid.UUID) (*hisItem, error) {
+	s.mux.RLock()
+	defer s.mux.RUnlock()
+
+	startTs, endTs := nativeRange(nil, nil)
+	paths, err := s.segmentPaths(pointId, startTs, endTs)
+	if err != nil {
+		return nil, err
+	}
+	heads := s.head(pointId)
+	var latest *nativePoint
+	if sorted := sortedNativePoints(heads, startTs, endTs); len(sorted) > 0 {
+		latest = &sorted[len(sorted)-1]
+	}
+	for i := len(paths) - 1; i >= 0; i-- {
+		segmentStart, _ := nativeSegmentStart(paths[i])
+		segmentEnd := segmentStart + int64(nativeSegmentDuration)
+		if latest != nil && latest.ts >= segmentEnd {
+			break
+		}
+		values := map[int64]*float64{}
+		_, _, err = readSegment(paths[i], values)
+		if err != nil {
+			return nil, err
+		}
+		// Buffered values are newer than all segments
+		for ts, value := range heads {
+			values[ts] = value
+		}
+		if sorted := sortedNativePoints(values, segmentStart, segmentEnd); len(sorted) > 0 {
+			latest = &sorted[len(sorted)-1]
+			break
+		}
+	}
+	if latest == nil {
+		return nil, nil
+	}
+	ts := time.Unix(0, latest.ts).UTC()
+	return &hisItem{Ts: &ts, Value: latest.value}, nil
+}
+
+func (s *nativeHistoryStore) writeHistory(
+	pointId uuid.UUID,
+	hisItem hisItem,
+) error {
+	if hisItem.Ts == nil {
+		return errors.New("history must have a timestamp")
+	}
+	point := nativePoint{ts: hisItem.Ts.UnixNano()}
+	if hisItem.Value != nil {
+		value := *hisItem.Value
+		point.value = &value
+	}
+
+	// The first write to join a batch commits it, once the previous batch is committed. Later writes wait for it.
+	s.pendingMux.Lock()
+	batch := s.pending
+	leader := batch == nil
+	if leader {
+		batch = &nativeBatch{done: make(chan struct{})}
+		s.pending = batch
+	}
+	batch.frames = appendFrame(batch.frames, frameWrite, encodeWrite(pointId, point))
+	batch.writes = append(batch.writes, nativeWrite{pointId: pointId, point: point})
+	s.pendingMux.Unlock()
+	if !leader {
+		<-batch.done
+		return batch.err
+	}
+
+	s.commitMux.Lock()
+	s.pendingMux.Lock()
+	s.pending = nil
+	s.pendingMux.Unlock()
+	var shouldFlush bool
+	shouldFlush, batch.err = s.commit(batch)
+	s.commitMux.Unlock()
+	close(batch.done)
+
+	// The values are already in the write-ahead log, so a failed flush does not fail the write. It is tried again
+	// with the next batch.
+	if shouldFlush {
+		s.mux.Lock()
+		if s.wal != nil && s.walSize >= s.maxWALSize {
+			err := s.flush()
+			if err != nil {
+				log.Printf("Unable to flush native history: %s", err)
+			}
+		}
+		s.mux.Unlock()
+	}
+	return batch.err
+}
+
+// commit appends a batch to the write-ahead log with a single sync, and buffers its values. It returns whether the log
+// is large enough to flush. commitMux must be held.
+func (s *nativeHistoryStore) commit(batch *nativeBatch) (bool, error) {
+	// Reads may continue while the log is synced, but flushes may not, or they could lose the batch
+	s.mux.RLock()
+	defer s.mux.RUnlock()
+	if s.wal == nil {
+		return false, errors.New("native history store is closed")
+	}
+
+	_, err := s.wal.Write(batch.frames)
+	if err == nil {
+		err = s.wal.Sync()
+	}
+	if err != nil {
+		// Remove any partial frame, so that later frames can be replayed
+		s.wal.Truncate(s.walSize)
+		return false, err
+	}
+	s.walSize += int64(len(batch.frames))
+	s.headMux.Lock()
+	for _, write := range batch.writes {
+		s.buffer(write.pointId, write.point)
+	}
+	s.headMux.Unlock()
+	return s.walSize >= s.maxWALSize, nil
+}
+
+func (s *nativeHistoryStore) deleteHistory(
+	pointId uuid.UUID,
+	start *time.Time,
+	end *time.Time,
+) error {
+	s.mux.Lock()
+	defer s.mux.Unlock()
+	if s.wal == nil {
+		return errors.New("native history store is closed")
+	}
+
+	// The write-ahead log must not contain values that were written before the tombstones, or they would be
+	// written after them when it is replayed.
+	err := s.flush()
+	if err != nil {
+		return err
+	}
+
+	startTs, endTs := nativeRange(start, end)
+	paths, err := s.segmentPaths(pointId, startTs, endTs)
+	if err != nil {
+		return err
+	}
+	for _, path := range paths {
+		segmentStart, _ := nativeSegmentStart(path)
+		segmentEnd := segmentStart + int64(nativeSegmentDuration)
+		if startTs <= segmentStart && endTs >= segmentEnd {
+			err = os.Remove(path)
+			delete(s.segments, path)
+		} else {
+			err = s.appendSegment(path, appendFrame(nil, frameTombstone, encodeTombstone(startTs, endTs)))
+		}
+		if err != nil {
+			return err
+		}
+	}
+
+	pointDir := s.pointDir(pointId)
+	remaining, err := os.ReadDir(pointDir)
+	if errors.Is(err, fs.ErrNotExist) {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	if len(remaining) == 0 {
+		err = os.Remove(pointDir)
+		if err != nil {
+			return err
+		}
+		return syncDir(s.dir)
+	}
+	return syncDir(pointDir)
+}
+
+// close writes the buffered values to segments and closes the write-ahead log.
+func (s *nativeHistoryStore) close() error {
+	s.mux.Lock()
+	defer s.mux.Unlock()
+	if s.wal == nil {
+		return nil
+	}
+	err := s.flush()
+	if err != nil {
+		return err
+	}
+	err = s.wal.Close()
+	s.wal = nil
+	return err
+}
+
+// head returns a copy of the point's buffered values.
+func (s *nativeHistoryStore) head(pointId uuid.UUID) map[int64]*float64 {
+	s.headMux.Lock()
+	defer s.headMux.Unlock()
+	return maps.Clone(s.heads[pointId])
+}
+
+// buffer buffers a value until it is flushed. headMux must be held, unless mux is held for writing.
+func (s *nativeHistoryStore) buffer(pointId uuid.UUID, point nativePoint) {
+	head, ok := s.heads[pointId]
+	if !ok {
+		head = map[int64]*float64{}
+		s.heads[pointId] = head
+	}
+	head[point.ts] = point.value
+}
+
+// flush writes the buffered values to segments, and then empties the write-ahead log. If it fails, the values remain
+// buffered and logged, so it can be retried. The mutex must be held for writing.
+func (s *nativeHistoryStore) flush() error {
+	for pointId, head := range s.heads {
+		bySegment := map[string]map[int64]*float64{}
+		for ts, value := range head {
+			path := s.segmentPath(pointId, ts)
+			if bySegment[path] == nil {
+				bySegment[path] = map[int64]*float64{}
+			}
+			bySegment[path][ts] = value
+		}
+		for path, values := range bySegment {
+			block := encodeBlock(sortedNativePoints(values, math.MinInt64, math.MaxInt64))
+			err := s.appendSegment(path, appendFrame(nil, frameBlock, block))
+			if err != nil {
+				return err
+			}
+		}
+		delete(s.heads, pointId)
+	}
+
+	err := s.wal.Truncate(0)
+	if err != nil {
+		return err
+	}
+	err = s.wal.Sync()
+	if err != nil {
+		return err
+	}
+	s.walSize = 0
+	return nil
+}
+
+// appendSegment appends frames to a segment and syncs it, creating it if needed. If the segment has not been appended
+// to since the store was opened, any frame torn by a crash is first removed from its end. The mutex must be held for writing.
+func (s *nativeHistoryStore) appendSegment(path string, frames []byte) error {
+	segment, ok := s.segments[path]
+	if !ok {
+		frameCount, size, err := readSegment(path, map[int64]*float64{})
+		if errors.Is(err, fs.ErrNotExist) {
+			err = s.createSegment(path)
+		}
+		if err != nil {
+			return err
+		}
+		segment = nativeSegment{frames: frameCount, size: size}
+	}
+
+	file, err := os.OpenFile(path, os.O_WRONLY, 0o644)
+	if err != nil {
+		return err
+	}
+	defer file.Close()
+	// Torn frames are overwritten. Files are not opened to append, so that this is the case.
+	_, err = file.WriteAt(frames, segment.size)
+	if err == nil {
+		err = file.Truncate(segment.size + int64(len(frames)))
+	}
+	if err == nil {
+		err = file.Sync()
+	}
+	if err != nil {
+		delete(s.segments, path)
+		return err
+	}
+	segment.frames++
+	segment.size += int64(len(frames))
+	s.segments[path] = segment
+
+	if segment.frames >= s.compactFrames {
+		return s.compactSegment(path)
+	}
+	return nil
+}
+
+// createSegment creates an empty segment, and its point directory if needed, ensuring that they are not lost in a
+// crash.
+func (s *nativeHistoryStore) createSegment(path string) error {
+	pointDir := filepath.Dir(path)
+	_, err := os.Stat(pointDir)
+	if errors.Is(err, fs.ErrNotExist) {
+		err = os.Mkdir(pointDir, 0o755)
+		if err != nil {
+			return err
+		}
+		err = syncDir(s.dir)
+	}
+	if err != nil {
+		return err
+	}
+	file, err := os.OpenFile(path, os.O_WRONLY|os.O_CREATE|os.O_EXCL, 0o644)
+	if err != nil {
+		return err
+	}
+	err = file.Close()
+	if err != nil {
+		return err
+	}
+	return syncDir(pointDir)
+}
+
+// compactSegment rewrites a segment as a single block. The new segment is written to a temporary file, which then
+// replaces it, so that a crash leaves one or the other. The mutex must be held for writing.
+func (s *nativeHistoryStore) compactSegment(path string) error {
+	values := map[int64]*float64{}
+	_, _, err := readSegment(path, values)
+	if err != nil {
+		return err
+	}
+	delete(s.segments, path)
+	if len(values) == 0 {
+		err = os.Remove(path)
+		if err != nil {
+			return err
+		}
+		return syncDir(filepath.Dir(path))
+	}
+
+	frame := appendFrame(nil, frameBlock, encodeBlock(sortedNativePoints(values, math.MinInt64, math.MaxInt64)))
+	temporary := path + ".tmp"
+	err = os.WriteFile(temporary, frame, 0o644)
+	if err != nil {
+		return err
+	}
+	file, err := os.Open(temporary)
+	if err != nil {
+		return err
+	}
+	err = file.Sync()
+	file.Close()
+	if err != nil {
+		return err
+	}
+	err = os.Rename(temporary, path)
+	if err != nil {
+		return err
+	}
+	s.segments[path] = nativeSegment{frames: 1, size: int64(len(frame))}
+	return syncDir(filepath.Dir(path))
+}
+
+// readSegment applies the frames of a segment to values in order, and returns the number and size of its valid
+// frames. Tombstones are clipped to the segment's day, since they hold the whole range that was deleted.
+func readSegment(path string, values map[int64]*float64) (int, int64, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return 0, 0, err
+	}
+	segmentStart, ok := nativeSegmentStart(path)
+	if !ok {
+		return 0, 0, fmt.Errorf("%s is not a segment", path)
+	}
+	segmentEnd := segmentStart + int64(nativeSegmentDuration)
+	frames := 0
+	valid, err := readFrames(data, func(frameType byte, payload []byte) error {
+		frames++
+		switch frameType {
+		case frameBlock:
+			points, err := decodeBlock(payload)
+			if err != nil {
+				return err
+			}
+			for _, point := range points {
+				values[point.ts] = point.value
+			}
+		case frameTombstone:
+			start, end, err := decodeTombstone(payload)
+			if err != nil {
+				return err
+			}
+			start, end = max(start, segmentStart), min(end, segmentEnd)
+			for ts := range values {
+				if ts >= start && ts < end {
+					delete(values, ts)
+				}
+			}
+		default:
+			return errCorruptNativeHistory
+		}
+		return nil
+	})
+	if err != nil {
+		return 0, 0, fmt.Errorf("cannot read %s: %w", path, err)
+	}
+	return frames, int64(valid), nil
+}
+
+func (s *nativeHistoryStore) pointDir(pointId uuid.UUID) string {
+	return filepath.Join(s.dir, pointId.String())
+}
+
+// segmentPath returns the path of the segment that holds the time, in Unix nanoseconds.
+func (s *nativeHistoryStore) segmentPath(pointId uuid.UUID, ts int64) string {
+	segmentStart := time.Unix(0, ts).UTC().Truncate(nativeSegmentDuration)
+	return filepath.Join(s.pointDir(pointId), segmentStart.Format(nativeSegmentLayout)+nativeSegmentExtension)
+}
+
+// segmentPaths returns the paths of the point's segments that overlap the range, in Unix nanoseconds.
+func (s *nativeHistoryStore) segmentPaths(pointId uuid.UUID, start int64, end int64) ([]string, error) {
+	entries, err := os.ReadDir(s.pointDir(pointId))
+	if errors.Is(err, fs.ErrNotExist) {
+		return []string{}, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	result := []string{}
+	for _, entry := range entries {
+		path := filepath.Join(s.pointDir(pointId), entry.Name())
+		segmentStart, ok := nativeSegmentStart(path)
+		if !ok {
+			continue
+		}
+		if segmentStart < end && segmentStart+int64(nativeSegmentDuration) > start {
+			result = append(result, path)
+		}
+	}
+	return result, nil
+}
+
+// nativeSegmentStart returns the start of the segment at the path, in Unix nanoseconds. ok is false if the path is
+// not a segment, such as a temporary file left by a crash during compaction.
+func nativeSegmentStart(path string) (int64, bool) {
+	name, ok := strings.CutSuffix(filepath.Base(path), nativeSegmentExtension)
+	if !ok {
+		return 0, false
+	}
+	start, err := time.Parse(nativeSegmentLayout, name)
+	if err != nil {
+		return 0, false
+	}
+	return start.UnixNano(), true
+}
+
+// nativeRange converts an optional range to Unix nanoseconds, with unbounded ends at the limits.
+func nativeRange(start *time.Time, end *time.Time) (int64, int64) {
+	startTs := int64(math.MinInt64)
+	if start != nil {
+		startTs = start.UnixNano()
+	}
+	endTs := int64(math.MaxInt64)
+	if end != nil {
+		endTs = end.UnixNano()
+	}
+	return startTs, endTs
+}
+
+// sortedNativePoints returns the values within the range, sorted by time.
+func sortedNativePoints(values map[int64]*float64, start int64, end int64) []nativePoint {
+	result := make([]nativePoint, 0, len(values))
+	for ts, value := range values {
+		if ts >= start && ts < end {
+			result = append(result, nativePoint{ts: ts, value: value})
+		}
+	}
+	slices.SortFunc(result, func(a nativePoint, b nativePoint) int {
+		if a.ts < b.ts {
+			return -1
+		}
+		if a.ts > b.ts {
+			return 1
+		}
+		return 0
+	})
+	return result
+}
+
+// syncDir syncs a directory, so that the files created in or removed from it are not lost in a crash.
+func syncDir(dir string) error {
+	file, err := os.Open(dir)
+	if err != nil {
+		return err
+	}
+	defer file.Close()
+	return file.Sync()
+}
@@ -0,0 +1,265 @@
+package main
+
+import (
+	"math"
+	"math/rand"
+	"os"
+	"path/filepath"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/google/uuid"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestNativeHistoryEncoding(t *testing.T) {
+	random := rand.New(rand.NewSource(1))
+	ts := time.Date(2024, 1, 1, 0, 0, 0, 0, time.UTC).UnixNano()
+	points := []nativePoint{}
+	value := 20.0
+	for i := 0; i < 1000; i++ {
+		// Mostly regular timestamps, with some jitter and gaps
+		switch random.Intn(10) {
+		case 0:
+			ts += int64(random.Intn(1e9))
+		case 1:
+			ts += int64(time.Hour)
+		default:
+			ts += int64(time.Minute)
+		}
+		switch random.Intn(10) {
+		case 0:
+			points = append(points, nativePoint{ts: ts})
+			continue
+		case 1:
+			value = random.NormFloat64() * 1e6
+		case 2:
+			value = math.NaN()
+		case 3:
+			value = math.Inf(-1)
+		default:
+			value = math.Round(value*10+random.NormFloat64()) / 10
+		}
+		v := value
+		points = append(points, nativePoint{ts: ts, value: &v})
+	}
+
+	for _, expected := range [][]nativePoint{points, points[:1], {}} {
+		block := encodeBlock(expected)
+		actual, err := decodeBlock(block)
+		assert.Nil(t, err)
+		assert.Len(t, actual, len(expected))
+		for i := range expected {
+			assert.Equal(t, expected[i].ts, actual[i].ts)
+			if expected[i].value == nil {
+				assert.Nil(t, actual[i].value)
+			} else {
+				assert.Equal(t, math.Float64bits(*expected[i].value), math.Float64bits(*actual[i].value))
+			}
+		}
+	}
+	// Regular timestamps and slowly changing values compress to a few bytes per point, from 16 uncompressed
+	regular := []nativePoint{}
+	for i := 0; i < 1000; i++ {
+		v := float64(20 + i/100)
+		regular = append(regular, nativePoint{ts: ts + int64(i)*int64(time.Minute), value: &v})
+	}
+	assert.Less(t, len(encodeBlock(regular)), len(regular)/2)
+
+	_, err := decodeBlock(encodeBlock(points)[:100])
+	assert.ErrorIs(t, err, errCorruptNativeHistory)
+
+	// Only the final frame may be torn
+	frames := appendFrame(nil, frameWrite, []byte("first"))
+	frames = appendFrame(frames, frameWrite, []byte("second"))
+	countFrames := func(data []byte) (int, int, error) {
+		count := 0
+		valid, err := readFrames(data, func(frameType byte, payload []byte) error {
+			count++
+			return nil
+		})
+		return count, valid, err
+	}
+	torn := append([]byte{}, frames...)
+	torn[len(torn)-1] ^= 1
+	count, valid, err := countFrames(torn)
+	assert.Nil(t, err)
+	assert.Equal(t, 1, count)
+	assert.Equal(t, frameHeaderSize+len("first"), valid)
+	corrupt := append([]byte{}, frames...)
+	corrupt[frameHeaderSize] ^= 1
+	_, _, err = countFrames(corrupt)
+	assert.ErrorIs(t, err, errCorruptNativeHistory)
+}
+
+func TestNativeHistoryStore(t *testing.T) {
+	dir := t.TempDir()
+	store, err := newNativeHistoryStore(dir)
+	assert.Nil(t, err)
+	pointId := uuid.New()
+	otherId := uuid.New()
+
+	start := time.Date(2024, 1, 1, 22, 0, 0, 0, time.UTC)
+	at := func(minutes int) *time.Time {
+		ts := start.Add(time.Duration(minutes) * time.Minute)
+		return &ts
+	}
+	// Values span two segments
+	for i := 0; i < 240; i++ {
+		err = store.writeHistory(pointId, hisItem{Ts: at(i), Value: f(float64(i))})
+		assert.Nil(t, err)
+	}
+	err = store.writeHistory(otherId, hisItem{Ts: at(0), Value: f(-1)})
+	assert.Nil(t, err)
+	// Writing again replaces the value, which may be null
+	err = store.writeHistory(pointId, hisItem{Ts: at(10), Value: nil})
+	assert.Nil(t, err)
+
+	assertHistory := func(store historyStore, from int, to int, expected map[int]*float64) {
+		history, err := store.readHistory(pointId, at(from), at(to))
+		assert.Nil(t, err)
+		assert.Len(t, history, len(expected))
+		for _, item := range history {
+			minutes := int(item.Ts.Sub(start) / time.Minute)
+			assert.Contains(t, expected, minutes)
+			assert.Equal(t, expected[minutes], item.Value)
+		}
+	}
+	assertHistory(store, 8, 12, map[int]*float64{8: f(8), 9: f(9), 10: nil, 11: f(11)})
+
+	// Values survive a crash, by replaying the write-ahead log, and a restart
+	crashed, err := newNativeHistoryStore(dir)
+	assert.Nil(t, err)
+	assertHistory(crashed, 119, 121, map[int]*float64{119: f(119), 120: f(120)})
+	err = crashed.close()
+	assert.Nil(t, err)
+	restarted, err := newNativeHistoryStore(dir)
+	assert.Nil(t, err)
+	assertHistory(restarted, 119, 121, map[int]*float64{119: f(119), 120: f(120)})
+	entries, err := os.ReadDir(filepath.Join(dir, pointId.String()))
+	assert.Nil(t, err)
+	assert.Len(t, entries, 2)
+
+	// The latest value is found in the newest segment, or in buffered values in a later one
+	latest, err := restarted.readLatestHistory(pointId)
+	assert.Nil(t, err)
+	assert.Equal(t, f(239), latest.Value)
+	err = restarted.writeHistory(pointId, hisItem{Ts: at(48 * 60), Value: f(2880)})
+	assert.Nil(t, err)
+	latest, err = restarted.readLatestHistory(pointId)
+	assert.Nil(t, err)
+	assert.Equal(t, f(2880), latest.Value)
+	err = restarted.deleteHistory(pointId, at(48*60), nil)
+	assert.Nil(t, err)
+
+	// Deleting a range spanning segments keeps the values around it
+	err = restarted.deleteHistory(pointId, at(100), at(150))
+	assert.Nil(t, err)
+	assertHistory(restarted, 99, 151, map[int]*float64{99: f(99), 150: f(150)})
+	history, err := restarted.readHistory(pointId, nil, nil)
+	assert.Nil(t, err)
+	assert.Len(t, history, 190)
+
+	// Deleting all removes the point's segments, but not other points'
+	err = restarted.deleteHistory(pointId, nil, nil)
+	assert.Nil(t, err)
+	history, err = restarted.readHistory(pointId, nil, nil)
+	assert.Nil(t, err)
+	assert.Len(t, history, 0)
+	_, err = os.Stat(filepath.Join(dir, pointId.String()))
+	assert.True(t, os.IsNotExist(err))
+	history, err = restarted.readHistory(otherId, nil, nil)
+	assert.Nil(t, err)
+	assert.Len(t, history, 1)
+}
+
+func TestNativeHistoryStoreCrashSafety(t *testing.T) {
+	dir := t.TempDir()
+	store, err := newNativeHistoryStore(dir)
+	assert.Nil(t, err)
+	// Write each value to segments, and compact them often
+	store.maxWALSize = 1
+	store.compactFrames = 3
+	pointId := uuid.New()
+	start := time.Date(2024, 1, 1, 0, 0, 0, 0, time.UTC)
+	for i := 0; i < 10; i++ {
+		ts := start.Add(time.Duration(i) * time.Second)
+		err = store.writeHistory(pointId, hisItem{Ts: &ts, Value: f(float64(i))})
+		assert.Nil(t, err)
+	}
+	store.maxWALSize = 1 << 20
+	ts := start.Add(time.Minute)
+	err = store.writeHistory(pointId, hisItem{Ts: &ts, Value: f(60)})
+	assert.Nil(t, err)
+
+	// Frames torn by a crash are ignored
+	segment := filepath.Join(dir, pointId.String(), "2024-01-01.seg")
+	for _, path := range []string{segment, filepath.Join(dir, nativeWALFile)} {
+		file, err := os.OpenFile(path, os.O_WRONLY|os.O_APPEND, 0o644)
+		assert.Nil(t, err)
+		_, err = file.Write(appendFrame(nil, frameBlock, encodeBlock([]nativePoint{{ts: 0}}))[:12])
+		assert.Nil(t, err)
+		file.Close()
+	}
+
+	reopened, err := newNativeHistoryStore(dir)
+	assert.Nil(t, err)
+	history, err := reopened.readHistory(pointId, nil, nil)
+	assert.Nil(t, err)
+	assert.Len(t, history, 11)
+	assert.Equal(t, 60.0, *history[10].Value)
+
+	// Appending after a torn frame overwrites it
+	err = reopened.close()
+	assert.Nil(t, err)
+	reopened, err = newNativeHistoryStore(dir)
+	assert.Nil(t, err)
+	history, err = reopened.readHistory(pointId, nil, nil)
+	assert.Nil(t, err)
+	assert.Len(t, history, 11)
+}
+
+func TestNativeHistoryStoreConcurrentWrites(t *testing.T) {
+	dir := t.TempDir()
+	store, err := newNativeHistoryStore(dir)
+	assert.Nil(t, err)
+	// Flush during the writes, so that reads and flushes overlap commits
+	store.maxWALSize = 1 << 10
+	pointId := uuid.New()
+	start := time.Date(2024, 1, 1, 0, 0, 0, 0, time.UTC)
+	var wg sync.WaitGroup
+	for i := 0; i < 100; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			ts := start.Add(time.Duration(i) * time.Second)
+			err := store.writeHistory(pointId, hisItem{Ts: &ts, Value: f(float64(i))})
+			assert.Nil(t, err)
+			_, err = store.readHistory(pointId, nil, &ts)
+			assert.Nil(t, err)
+		}()
+	}
+	wg.Wait()
+	history, err := store.readHistory(pointId, nil, nil)
+	assert.Nil(t, err)
+	assert.Len(t, history, 100)
+
+	// Every committed write survives a restart
+	err = store.close()
+	assert.Nil(t, err)
+	reopened, err := newNativeHistoryStore(dir)
+	assert.Nil(t, err)
+	defer reopened.close()
+	history, err = reopened.readHistory(pointId, nil, nil)
+	assert.Nil(t, err)
+	assert.Len(t, history, 100)
+	for i, item := range history {
+		assert.Equal(t, float64(i), *item.Value)
+	}
+
+	// Writes after closing fail rather than wait
+	ts := start.Add(time.Hour)
+	err = store.writeHistory(pointId, hisItem{Ts: &ts, Value: f(1)})
+	assert.NotNil(t, err)
+}
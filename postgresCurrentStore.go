@@ -0,0 +1,225 @@
+package main
+
+import (
+	"context"
+	"log"
+	"sync"
+	"time"
+
+	"github.com/google/uuid"
+	"github.com/jackc/pgx/v5"
+	"gorm.io/gorm"
+	"gorm.io/gorm/clause"
+)
+
+// postgresCurrentStore stores point current values in an unlogged Postgres table, so that instances share them
+// without Redis. Unlogged tables skip the write-ahead log, which makes writes cheaper, at the cost of being emptied
+// after a database crash, which current values can tolerate.
+//
+// Each instance caches the values it reads. Every change is announced on a LISTEN/NOTIFY channel, and each instance
+// drops the changed point from its cache. Notifications may be missed while an instance is not listening, such as
+// while it reconnects, so values are then read from the table without being cached.
+type postgresCurrentStore struct {
+	db *gorm.DB
+	// dsn is used to open the connection that listens for notifications, which is kept apart from the pool.
+	dsn    string
+	cancel context.CancelFunc
+	done   chan struct{}
+
+	mux       sync.Mutex
+	listening bool
+	cache     map[uuid.UUID]current
+	// fetches are the reads from the table in progress, by point. A read is only cached if its point was not changed
+	// while it was read, which removes it from fetches.
+	fetches   map[uuid.UUID]uint64
+	lastFetch uint64
+}
+
+const (
+	// postgresCurrentChannel is the channel that changed points are notified on. The payload is the point ID.
+	postgresCurrentChannel = "timeseries_current"
+	// postgresCurrentRetryInterval is how long to wait before listening again when the connection is lost.
+	postgresCurrentRetryInterval = 5 * time.Second
+)
+
+// newPostgresCurrentStore creates the table if needed, and starts listening for changes. The DSN must connect to
+// the same database as db.
+func newPostgresCurrentStore(db *gorm.DB, dsn string) (*postgresCurrentStore, error) {
+	// GORM cannot create unlogged tables, so the table is created directly
+	err := db.Exec(`CREATE UNLOGGED TABLE IF NOT EXISTS "current" (
+		"pointId" uuid PRIMARY KEY,
+		"ts" timestamptz,
+		"value" double precision
+	)`).Error
+	if err != nil {
+		return nil, err
+	}
+	ctx, cancel := context.WithCancel(context.Background())
+	s := &postgresCurrentStore{
+		db:      db,
+		dsn:     dsn,
+		cancel:  cancel,
+		done:    make(chan struct{}),
+		cache:   map[uuid.UUID]current{},
+		fetches: map[uuid.UUID]uint64{},
+	}
+	go s.listen(ctx)
+	return s, nil
+}
+
+// close stops listening for changes. The database is not closed.
+func (s *postgresCurrentStore) close() {
+	s.cancel()
+	<-s.done
+}
+
+func (s *postgresCurrentStore) ping(ctx context.Context) error {
+	return pingGormDB(ctx, s.db)
+}
+
+func (s *postgresCurrentStore) getCurrent(id uuid.UUID) (current, error) {
+	s.mux.Lock()
+	if cached, ok := s.cache[id]; ok {
+		s.mux.Unlock()
+		return cached, nil
+	}
+	s.lastFetch++
+	fetch := s.lastFetch
+	s.fetches[id] = fetch
+	s.mux.Unlock()
+
+	var sqlResult []gormCurrent
+	err := s.db.Where(&gormCurrent{PointId: id}).Limit(1).Find(&sqlResult).Error
+	s.mux.Lock()
+	defer s.mux.Unlock()
+	if s.fetches[id] == fetch {
+		delete(s.fetches, id)
+	} else {
+		// The point changed while it was read, so the result may be stale
+		fetch = 0
+	}
+	if err != nil {
+		log.Printf("Cannot retrieve current: %s", err)
+		return current{}, err
+	}
+	result := current{}
+	if len(sqlResult) > 0 {
+		result = current{Ts: sqlResult[0].Ts, Value: sqlResult[0].Value}
+	}
+	if s.listening && fetch != 0 {
+		s.cache[id] = result
+	}
+	return result, nil
+}
+
+func (s *postgresCurrentStore) setCurrent(id uuid.UUID, input currentInput) error {
+	timestamp := time.Now()
+	err := s.db.Transaction(func(tx *gorm.DB) error {
+		err := tx.Clauses(clause.OnConflict{
+			Columns:   []clause.Column{{Name: "pointId"}},
+			DoUpdates: clause.AssignmentColumns([]string{"ts", "value"}),
+		}).Create(&gormCurrent{PointId: id, Ts: &timestamp, Value: input.Value}).Error
+		if err != nil {
+			return err
+		}
+		return notifyCurrentChanged(tx, id)
+	})
+	if err != nil {
+		log.Printf("Cannot store current: %s", err)
+		return err
+	}
+	// Invalidate now, rather than when the notification arrives, so that this instance reads its own writes
+	s.invalidate(id)
+	return nil
+}
+
+func (s *postgresCurrentStore) deleteCurrent(id uuid.UUID) error {
+	err := s.db.Transaction(func(tx *gorm.DB) error {
+		err := tx.Delete(&gormCurrent{}, "\"pointId\" = ?", id).Error
+		if err != nil {
+			return err
+		}
+		return notifyCurrentChanged(tx, id)
+	})
+	if err != nil {
+		log.Printf("Cannot delete current: %s", err)
+		return err
+	}
+	s.invalidate(id)
+	return nil
+}
+
+// notifyCurrentChanged notifies every instance that the point changed, once the transaction commits.
+func notifyCurrentChanged(tx *gorm.DB, id uuid.UUID) error {
+	return tx.Exec("SELECT pg_notify(?, ?)", postgresCurrentChannel, id.String()).Error
+}
+
+func (s *postgresCurrentStore) invalidate(id uuid.UUID) {
+	s.mux.Lock()
+	defer s.mux.Unlock()
+	delete(s.cache, id)
+	delete(s.fetches, id)
+}
+
+// setListening empties the cache, which may have missed notifications while the listening state changed.
+func (s *postgresCurrentStore) setListening(listening bool) {
+	s.mux.Lock()
+	defer s.mux.Unlock()
+	s.listening = listening
+	s.cache = map[uuid.UUID]current{}
+	s.fetches = map[uuid.UUID]uint64{}
+}
+
+// listen invalidates the points changed by any instance until the context is cancelled, reconnecting when the
+// connection is lost.
+func (s *postgresCurrentStore) listen(ctx context.Context) {
+	defer close(s.done)
+	for {
+		err := s.receiveNotifications(ctx)
+		s.setListening(false)
+		if ctx.Err() != nil {
+			return
+		}
+		log.Printf("Stopped listening for current changes, retrying in %s: %s", postgresCurrentRetryInterval, err)
+		select {
+		case <-ctx.Done():
+			return
+		case <-time.After(postgresCurrentRetryInterval):
+		}
+	}
+}
+
+func (s *postgresCurrentStore) receiveNotifications(ctx context.Context) error {
+	conn, err := pgx.Connect(ctx, s.dsn)
+	if err != nil {
+		return err
+	}
+	defer conn.Close(context.Background())
+	_, err = conn.Exec(ctx, "LISTEN "+postgresCurrentChannel)
+	if err != nil {
+		return err
+	}
+	s.setListening(true)
+	for {
+		notification, err := conn.WaitForNotification(ctx)
+		if err != nil {
+			return err
+		}
+		id, err := uuid.Parse(notification.Payload)
+		if err != nil {
+			log.Printf("Ignoring invalid current change notification: %q", notification.Payload)
+			continue
+		}
+		s.invalidate(id)
+	}
+}
+
+type gormCurrent struct {
+	PointId uuid.UUID  `gorm:"column:pointId;type:uuid;primaryKey"`
+	Ts      *time.Time `gorm:"column:ts"`
+	Value   *float64   `gorm:"column:value;type:double precision"`
+}
+
+func (gormCurrent) TableName() string {
+	return "current"
+}
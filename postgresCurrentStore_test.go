@@ -0,0 +1,59 @@
+package main
+
+import (
+	"os"
+	"testing"
+	"time"
+
+	"github.com/google/uuid"
+	"github.com/stretchr/testify/assert"
+	"gorm.io/driver/postgres"
+	"gorm.io/gorm"
+)
+
+// TestPostgresCurrentStore runs if TEST_POSTGRES_DSN is set.
+func TestPostgresCurrentStore(t *testing.T) {
+	dsn := os.Getenv("TEST_POSTGRES_DSN")
+	if dsn == "" {
+		t.Skip("TEST_POSTGRES_DSN is not set")
+	}
+	db, err := gorm.Open(postgres.Open(dsn), &gorm.Config{TranslateError: true})
+	assert.Nil(t, err)
+	// Two stores share values as two instances would
+	store, err := newPostgresCurrentStore(db, dsn)
+	assert.Nil(t, err)
+	defer store.close()
+	other, err := newPostgresCurrentStore(db, dsn)
+	assert.Nil(t, err)
+	defer other.close()
+	assert.Eventually(t, func() bool {
+		other.mux.Lock()
+		defer other.mux.Unlock()
+		return other.listening
+	}, 5*time.Second, 10*time.Millisecond)
+
+	pointId := uuid.New()
+	value, err := other.getCurrent(pointId)
+	assert.Nil(t, err)
+	assert.Nil(t, value.Value)
+
+	// A change made by one store is seen by the other, once it is notified
+	for _, v := range []float64{1, 2} {
+		err = store.setCurrent(pointId, currentInput{Value: f(v)})
+		assert.Nil(t, err)
+		value, err = store.getCurrent(pointId)
+		assert.Nil(t, err)
+		assert.Equal(t, v, *value.Value)
+		assert.Eventually(t, func() bool {
+			value, err := other.getCurrent(pointId)
+			return err == nil && value.Value != nil && *value.Value == v
+		}, 5*time.Second, 10*time.Millisecond)
+	}
+
+	err = store.deleteCurrent(pointId)
+	assert.Nil(t, err)
+	assert.Eventually(t, func() bool {
+		value, err := other.getCurrent(pointId)
+		return err == nil && value.Value == nil
+	}, 5*time.Second, 10*time.Millisecond)
+}
@@ -0,0 +1,142 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"log"
+	"net/http"
+	"regexp"
+
+	"github.com/google/uuid"
+	"gorm.io/gorm"
+)
+
+// problem is an RFC 7807 error response body. Code is a stable identifier of the kind of error, which clients can
+// rely on, unlike the human-readable title and detail.
+type problem struct {
+	Type      string `json:"type"`
+	Title     string `json:"title"`
+	Status    int    `json:"status"`
+	Code      string `json:"code"`
+	Detail    string `json:"detail,omitempty"`
+	RequestID string `json:"requestId,omitempty"`
+	// Errors describe each tag that failed validation, if the code is tag_validation_failed.
+	Errors []tagViolation `json:"errors,omitempty"`
+}
+
+// Error codes
+const (
+	// errorCodeInvalidID means that an ID in the path is malformed, so no resource can have it.
+	errorCodeInvalidID = "invalid_id"
+	// errorCodeNotFound means that the resource does not exist, or is outside the access policies of the request.
+	errorCodeNotFound = "not_found"
+	// errorCodeInvalidBody means that the request body cannot be decoded.
+	errorCodeInvalidBody = "invalid_body"
+	// errorCodeInvalidParameter means that a query parameter or header is malformed.
+	errorCodeInvalidParameter = "invalid_parameter"
+	// errorCodeInvalidValue means that the request is well-formed, but a value in it is not acceptable.
+	errorCodeInvalidValue = "invalid_value"
+	// errorCodeTagValidationFailed means that a rec does not conform to the tag definitions.
+	errorCodeTagValidationFailed = "tag_validation_failed"
+	// errorCodeUnsupportedMediaType means that the Content-Type of the request is not accepted.
+	errorCodeUnsupportedMediaType = "unsupported_media_type"
+	// errorCodeConflict means that the request conflicts with the current state, such as an existing name.
+	errorCodeConflict = "conflict"
+	// errorCodePreconditionFailed means that an If-Match header does not match the current version.
+	errorCodePreconditionFailed = "precondition_failed"
+	// errorCodeUnauthorized means that the request is not authenticated.
+	errorCodeUnauthorized = "unauthorized"
+	// errorCodeForbidden means that the request is authenticated, but not permitted.
+	errorCodeForbidden = "forbidden"
+	// errorCodeRateLimited means that too many requests or failed logins have been made. See Retry-After.
+	errorCodeRateLimited = "rate_limited"
+	// errorCodeInternal means that the server failed. The request ID can be used to find the cause in the logs.
+	errorCodeInternal = "internal"
+)
+
+// problemTypePrefix prefixes error codes to form problem types.
+const problemTypePrefix = "urn:timeseries-api:problem:"
+
+// writeProblem logs the detail with the request ID, and responds with it as a problem.
+func writeProblem(w http.ResponseWriter, r *http.Request, status int, code string, detail string) {
+	writeProblemBody(w, r, problem{Status: status, Code: code, Detail: detail})
+}
+
+// writeInternalError logs the error with the request ID, and responds with a problem that does not reveal it.
+func writeInternalError(w http.ResponseWriter, r *http.Request, message string, err error) {
+	log.Printf("[%s] %s: %s", requestID(r), message, err)
+	writeProblemBody(w, r, problem{
+		Status: http.StatusInternalServerError,
+		Code:   errorCodeInternal,
+		Detail: message,
+	})
+}
+
+// writeStoreError responds to an error from a store with the corresponding problem. Missing records map to 404,
+// existing names and duplicate keys to 409, version conflicts to 412, and invalid data to 422. Other errors are
+// internal.
+func writeStoreError(w http.ResponseWriter, r *http.Request, err error) {
+	switch {
+	case errors.Is(err, gorm.ErrRecordNotFound):
+		writeProblem(w, r, http.StatusNotFound, errorCodeNotFound, "Not found")
+	case errors.Is(err, errUserExists), errors.Is(err, errAPIKeyExists), errors.Is(err, gorm.ErrDuplicatedKey):
+		writeProblem(w, r, http.StatusConflict, errorCodeConflict, err.Error())
+	case errors.Is(err, errVersionConflict):
+		writeProblem(w, r, http.StatusPreconditionFailed, errorCodePreconditionFailed, err.Error())
+	case errors.Is(err, gorm.ErrInvalidData), errors.Is(err, gorm.ErrInvalidValue), errors.Is(err, gorm.ErrInvalidField):
+		writeProblem(w, r, http.StatusUnprocessableEntity, errorCodeInvalidValue, err.Error())
+	default:
+		writeInternalError(w, r, "Storage Error", err)
+	}
+}
+
+func writeProblemBody(w http.ResponseWriter, r *http.Request, problem problem) {
+	problem.Type = problemTypePrefix + problem.Code
+	problem.Title = http.StatusText(problem.Status)
+	problem.RequestID = requestID(r)
+	if problem.Status != http.StatusInternalServerError {
+		log.Printf("[%s] %d %s: %s", problem.RequestID, problem.Status, problem.Code, problem.Detail)
+	}
+
+	httpJson, err := json.Marshal(problem)
+	if err != nil {
+		log.Printf("[%s] Cannot encode problem JSON: %s", problem.RequestID, err)
+		w.WriteHeader(problem.Status)
+		return
+	}
+	w.Header().Set("Content-Type", "application/problem+json")
+	w.WriteHeader(problem.Status)
+	w.Write(httpJson)
+}
+
+type requestIDContextKeyType string
+
+const requestIDContextKey requestIDContextKeyType = "requestID"
+
+// requestIDHeader identifies requests in responses and logs.
+const requestIDHeader = "X-Request-ID"
+
+// validRequestID matches request IDs that may be accepted from clients or proxies. Others are replaced, so that
+// they cannot inject content into logs.
+var validRequestID = regexp.MustCompile(`^[A-Za-z0-9._:-]{1,128}$`)
+
+// requestIDMiddleware assigns each request an ID, which is returned in the X-Request-ID header and included in
+// logged errors. An ID given in the request header is kept, so that requests can be traced through proxies.
+func requestIDMiddleware(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		id := r.Header.Get(requestIDHeader)
+		if !validRequestID.MatchString(id) {
+			id = uuid.NewString()
+		}
+		w.Header().Set(requestIDHeader, id)
+		r = r.WithContext(context.WithValue(r.Context(), requestIDContextKey, id))
+		next.ServeHTTP(w, r)
+	})
+}
+
+// requestID returns the ID of the request, or an empty string if it was not assigned one.
+func requestID(r *http.Request) string {
+	id, _ := r.Context().Value(requestIDContextKey).(string)
+	return id
+}
@@ -0,0 +1,235 @@
+package main
+
+import (
+	"fmt"
+	"math"
+	"net"
+	"net/http"
+	"net/netip"
+	"slices"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// loginLimiter locks out keys, such as client IPs and usernames, after repeated authentication failures. Each
+// failure beyond maxFailures doubles the lockout, up to maxLockout. Failures are forgotten after a successful login,
+// or once maxLockout has passed without another.
+type loginLimiter struct {
+	maxFailures int
+	baseLockout time.Duration
+	maxLockout  time.Duration
+
+	mux      sync.Mutex
+	failures map[string]*loginFailures
+}
+
+type loginFailures struct {
+	count       int
+	lastFailure time.Time
+	lockedUntil time.Time
+}
+
+func newLoginLimiter(maxFailures int, baseLockout time.Duration, maxLockout time.Duration) *loginLimiter {
+	return &loginLimiter{
+		maxFailures: maxFailures,
+		baseLockout: baseLockout,
+		maxLockout:  maxLockout,
+		failures:    map[string]*loginFailures{},
+	}
+}
+
+// retryAfter returns how long until none of the keys are locked out. It is zero if none are.
+func (l *loginLimiter) retryAfter(keys ...string) time.Duration {
+	l.mux.Lock()
+	defer l.mux.Unlock()
+
+	var result time.Duration
+	now := time.Now()
+	for _, key := range keys {
+		failures, ok := l.failures[key]
+		if ok && failures.lockedUntil.Sub(now) > result {
+			result = failures.lockedUntil.Sub(now)
+		}
+	}
+	return result
+}
+
+// fail records an authentication failure for each of the keys.
+func (l *loginLimiter) fail(keys ...string) {
+	l.mux.Lock()
+	defer l.mux.Unlock()
+
+	now := time.Now()
+	for key, failures := range l.failures {
+		if now.Sub(failures.lastFailure) > l.maxLockout {
+			delete(l.failures, key)
+		}
+	}
+	for _, key := range keys {
+		failures, ok := l.failures[key]
+		if !ok {
+			failures = &loginFailures{}
+			l.failures[key] = failures
+		}
+		failures.count++
+		failures.lastFailure = now
+		if failures.count >= l.maxFailures {
+			lockout := l.maxLockout
+			doublings := failures.count - l.maxFailures
+			// Avoid overflowing the shift. Beyond this, the lockout is far past any sensible maximum.
+			if doublings < 32 && l.baseLockout<<doublings < l.maxLockout {
+				lockout = l.baseLockout << doublings
+			}
+			failures.lockedUntil = now.Add(lockout)
+		}
+	}
+}
+
+// succeed forgets the failures of the keys.
+func (l *loginLimiter) succeed(keys ...string) {
+	l.mux.Lock()
+	defer l.mux.Unlock()
+	for _, key := range keys {
+		delete(l.failures, key)
+	}
+}
+
+// requestLimiter limits the rate of requests per key, such as a username, using a token bucket for each. Keys may
+// make burst requests at once, and are then limited to rate requests per second.
+type requestLimiter struct {
+	rate  float64
+	burst int
+
+	mux        sync.Mutex
+	buckets    map[string]*tokenBucket
+	lastPruned time.Time
+}
+
+type tokenBucket struct {
+	tokens  float64
+	updated time.Time
+}
+
+func newRequestLimiter(rate float64, burst int) *requestLimiter {
+	return &requestLimiter{
+		rate:       rate,
+		burst:      burst,
+		buckets:    map[string]*tokenBucket{},
+		lastPruned: time.Now(),
+	}
+}
+
+// allow takes a token for the key. If none are available, it returns false and how long until one is.
+func (l *requestLimiter) allow(key string) (bool, time.Duration) {
+	l.mux.Lock()
+	defer l.mux.Unlock()
+
+	now := time.Now()
+	// Buckets that have been idle long enough to refill are the same as new ones, so they can be dropped.
+	refillDuration := time.Duration(float64(l.burst) / l.rate * float64(time.Second))
+	if now.Sub(l.lastPruned) > refillDuration {
+		for bucketKey, bucket := range l.buckets {
+			if now.Sub(bucket.updated) > refillDuration {
+				delete(l.buckets, bucketKey)
+			}
+		}
+		l.lastPruned = now
+	}
+
+	bucket, ok := l.buckets[key]
+	if !ok {
+		bucket = &tokenBucket{tokens: float64(l.burst), updated: now}
+		l.buckets[key] = bucket
+	}
+	bucket.tokens = math.Min(float64(l.burst), bucket.tokens+now.Sub(bucket.updated).Seconds()*l.rate)
+	bucket.updated = now
+	if bucket.tokens < 1 {
+		wait := (1 - bucket.tokens) / l.rate
+		return false, time.Duration(wait * float64(time.Second))
+	}
+	bucket.tokens--
+	return true, 0
+}
+
+// rateLimitMiddleware limits the rate of requests per authenticated username or API key. It must be within
+// authMiddleware.
+func rateLimitMiddleware(limiter *requestLimiter, next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		allowed, retryAfter := limiter.allow(requestUsername(r))
+		if !allowed {
+			writeRetryAfter(w, retryAfter)
+			writeProblem(w, r, http.StatusTooManyRequests, errorCodeRateLimited, fmt.Sprintf("Rate limit exceeded by %s", requestUsername(r)))
+			return
+		}
+		next.ServeHTTP(w, r)
+	})
+}
+
+// writeRetryAfter sets the Retry-After header to the duration, rounded up to whole seconds.
+func writeRetryAfter(w http.ResponseWriter, retryAfter time.Duration) {
+	seconds := int(math.Ceil(retryAfter.Seconds()))
+	if seconds < 1 {
+		seconds = 1
+	}
+	w.Header().Set("Retry-After", strconv.Itoa(seconds))
+}
+
+// clientIP returns the IP address of the client of the request. If the request comes from a trusted proxy, the
+// client is the last address in X-Forwarded-For that is not another trusted proxy, as earlier addresses may be
+// spoofed by the client.
+func clientIP(r *http.Request, trustedProxies []netip.Prefix) string {
+	host, _, err := net.SplitHostPort(r.RemoteAddr)
+	if err != nil {
+		host = r.RemoteAddr
+	}
+	isTrusted := func(address string) bool {
+		ip, err := netip.ParseAddr(address)
+		if err != nil {
+			return false
+		}
+		ip = ip.Unmap()
+		return slices.ContainsFunc(trustedProxies, func(prefix netip.Prefix) bool { return prefix.Contains(ip) })
+	}
+	if !isTrusted(host) {
+		return host
+	}
+	forwarded := strings.Split(strings.Join(r.Header.Values("X-Forwarded-For"), ","), ",")
+	for i := len(forwarded) - 1; i >= 0; i-- {
+		address := strings.TrimSpace(forwarded[i])
+		if address == "" {
+			continue
+		}
+		host = address
+		if !isTrusted(address) {
+			break
+		}
+	}
+	return host
+}
+
+// parseTrustedProxies parses a list of proxies like `10.0.0.0/8,192.168.1.10`, as IPs or CIDRs.
+func parseTrustedProxies(value string) ([]netip.Prefix, error) {
+	var result []netip.Prefix
+	if value == "" {
+		return result, nil
+	}
+	for _, entry := range strings.Split(value, ",") {
+		entry = strings.TrimSpace(entry)
+		if strings.Contains(entry, "/") {
+			prefix, err := netip.ParsePrefix(entry)
+			if err != nil {
+				return nil, fmt.Errorf("invalid proxy: %s", entry)
+			}
+			result = append(result, prefix.Masked())
+			continue
+		}
+		ip, err := netip.ParseAddr(entry)
+		if err != nil {
+			return nil, fmt.Errorf("invalid proxy: %s", entry)
+		}
+		result = append(result, netip.PrefixFrom(ip, ip.BitLen()))
+	}
+	return result, nil
+}
@@ -0,0 +1,127 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net/http"
+	"slices"
+
+	"github.com/google/uuid"
+	"gorm.io/gorm"
+)
+
+// recAccess decides which recs a request may access. Restricted access allows the recs matching any of the filters,
+// so with none, it allows no recs. The zero value is unrestricted.
+type recAccess struct {
+	isRestricted bool
+	filters      []recFilter
+}
+
+// newRecAccess returns the access granted by the policies. Without policies, access is unrestricted if
+// unrestrictedWithoutPolicies is set, and otherwise allows no recs.
+func newRecAccess(policies []accessPolicy, unrestrictedWithoutPolicies bool) (recAccess, error) {
+	access := recAccess{isRestricted: len(policies) > 0 || !unrestrictedWithoutPolicies}
+	for _, policy := range policies {
+		filter, err := parseRecFilter(policy.Filter)
+		if err != nil {
+			return recAccess{}, err
+		}
+		access.filters = append(access.filters, filter)
+	}
+	return access, nil
+}
+
+func (a recAccess) restricted() bool {
+	return a.isRestricted
+}
+
+// allows returns true if the rec matches any of the filters, or if access is unrestricted.
+func (a recAccess) allows(rec rec) bool {
+	if !a.restricted() {
+		return true
+	}
+	for _, filter := range a.filters {
+		if filter.matches(rec) {
+			return true
+		}
+	}
+	return false
+}
+
+// filterRecs returns the recs that are allowed.
+func (a recAccess) filterRecs(recs []rec) []rec {
+	if !a.restricted() {
+		return recs
+	}
+	result := []rec{}
+	for _, rec := range recs {
+		if a.allows(rec) {
+			result = append(result, rec)
+		}
+	}
+	return result
+}
+
+const recAccessContextKey authContextKey = "recAccess"
+
+// accessMiddleware records the rec access of the authenticated subject in the request context. Admins without
+// policies are unrestricted. Other subjects without policies are only unrestricted if allowWithoutPolicies is set, so
+// that a missing policy does not grant access to every rec. It must be wrapped by authMiddleware.
+func accessMiddleware(store accessPolicyStore, allowWithoutPolicies bool, next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		policies, err := store.readSubjectAccessPolicies(requestUsername(r))
+		if err != nil {
+			writeStoreError(w, r, err)
+			return
+		}
+		isAdmin := slices.Contains(requestScopes(r), scopeAdmin)
+		access, err := newRecAccess(policies, allowWithoutPolicies || isAdmin)
+		if err != nil {
+			writeInternalError(w, r, fmt.Sprintf("Invalid access policy for %s", requestUsername(r)), err)
+			return
+		}
+		next.ServeHTTP(w, r.WithContext(context.WithValue(r.Context(), recAccessContextKey, access)))
+	})
+}
+
+// requestRecAccess returns the rec access of the request. It is unrestricted if access policies are not in use.
+func requestRecAccess(r *http.Request) recAccess {
+	access, _ := r.Context().Value(recAccessContextKey).(recAccess)
+	return access
+}
+
+// checkRecWritable responds with 404 and returns false if the rec is in the trash, since data written for it would
+// be purged with it. Otherwise, it checks that the request may access the rec, as checkRecAccess does.
+func checkRecWritable(w http.ResponseWriter, r *http.Request, store recStore, id uuid.UUID) bool {
+	deleted, err := store.isRecDeleted(id)
+	if err != nil {
+		writeStoreError(w, r, err)
+		return false
+	}
+	if deleted {
+		writeProblem(w, r, http.StatusNotFound, errorCodeNotFound, "Rec not found")
+		return false
+	}
+	return checkRecAccess(w, r, store, id)
+}
+
+// checkRecAccess responds with 404 and returns false unless the request may access the rec. Inaccessible recs are
+// indistinguishable from missing ones, so that their IDs are not leaked. Unrestricted requests may access any ID,
+// whether or not there is a rec.
+func checkRecAccess(w http.ResponseWriter, r *http.Request, store recStore, id uuid.UUID) bool {
+	access := requestRecAccess(r)
+	if !access.restricted() {
+		return true
+	}
+	rec, err := store.readRec(id)
+	if errors.Is(err, gorm.ErrRecordNotFound) || (err == nil && !access.allows(*rec)) {
+		writeProblem(w, r, http.StatusNotFound, errorCodeNotFound, "Not found")
+		return false
+	}
+	if err != nil {
+		writeStoreError(w, r, err)
+		return false
+	}
+	return true
+}
@@ -1,30 +1,38 @@
 package main
 
 import (
+	"bytes"
 	"encoding/json"
-	"log"
+	"errors"
+	"fmt"
+	"mime"
 	"net/http"
+	"strconv"
+	"strings"
 
 	"github.com/google/uuid"
+	"gorm.io/gorm"
 )
 
 type recController struct {
-	store recStore
+	store         recStore
+	tagDefStore   tagDefStore
+	revisionStore revisionStore
+	deleter       recDeleter
 }
 
 // GET /recs
 func (recController recController) getRecs(w http.ResponseWriter, r *http.Request) {
 	recs, err := recController.store.readRecs(r.URL.Query().Get("tag"))
 	if err != nil {
-		log.Printf("SQL Error: %s", err)
-		w.WriteHeader(http.StatusInternalServerError)
+		writeStoreError(w, r, err)
 		return
 	}
+	recs = requestRecAccess(r).filterRecs(recs)
 
 	httpJson, err := json.Marshal(recs)
 	if err != nil {
-		log.Printf("Cannot encode response JSON: %s", err)
-		w.WriteHeader(http.StatusBadRequest)
+		writeInternalError(w, r, "Cannot encode response JSON", err)
 		return
 	}
 
@@ -38,49 +46,72 @@ func (recController recController) postRecs(w http.ResponseWriter, r *http.Reque
 	var rec rec
 	err := decoder.Decode(&rec)
 	if err != nil {
-		log.Printf("Cannot decode request JSON: %s", err)
-		w.WriteHeader(http.StatusBadRequest)
+		writeProblem(w, r, http.StatusBadRequest, errorCodeInvalidBody, fmt.Sprintf("Cannot decode request JSON: %s", err))
 		return
 	}
 
-	err = recController.store.createRec(rec)
+	if !requestRecAccess(r).allows(rec) {
+		writeProblem(w, r, http.StatusForbidden, errorCodeForbidden, fmt.Sprintf("Rec is outside the access policies of %s", requestUsername(r)))
+		return
+	}
+	if !recController.checkTags(w, r, rec) {
+		return
+	}
+
+	err = recController.store.createRec(rec, requestRecAudit(r))
+	if errors.Is(err, gorm.ErrDuplicatedKey) {
+		deleted, _ := recController.store.isRecDeleted(rec.ID)
+		if deleted {
+			writeProblem(w, r, http.StatusConflict, errorCodeConflict, fmt.Sprintf("Rec %s is in the trash, and must be restored or purged first", rec.ID))
+		} else {
+			writeProblem(w, r, http.StatusConflict, errorCodeConflict, fmt.Sprintf("Rec %s already exists", rec.ID))
+		}
+		return
+	}
 	if err != nil {
-		log.Printf("Storage Error: %s", err)
-		w.WriteHeader(http.StatusInternalServerError)
+		writeStoreError(w, r, err)
 		return
 	}
 
 	recJSON, err := json.Marshal(rec)
 	if err != nil {
-		log.Printf("Cannot encode response JSON")
-		w.WriteHeader(http.StatusBadRequest)
+		writeInternalError(w, r, "Cannot encode response JSON", err)
 		return
 	}
 
+	w.Header().Set("ETag", recETag(1))
 	w.WriteHeader(http.StatusOK)
 	w.Write(recJSON)
 }
 
 // GET /recs/:id
+// Responds with the rec version as an ETag. If-None-Match is supported, responding 304 if the rec is unchanged.
 func (recController recController) getRec(w http.ResponseWriter, r *http.Request) {
 	idString := r.PathValue("id")
 	id, err := uuid.Parse(idString)
 	if err != nil {
-		log.Printf("Invalid UUID: %s", idString)
-		w.WriteHeader(http.StatusNotFound)
+		writeProblem(w, r, http.StatusNotFound, errorCodeInvalidID, fmt.Sprintf("Invalid UUID: %s", idString))
 		return
 	}
 	rec, err := recController.store.readRec(id)
 	if err != nil {
-		log.Printf("Storage Error: %s", err)
-		w.WriteHeader(http.StatusInternalServerError)
+		writeStoreError(w, r, err)
+		return
+	}
+	if !requestRecAccess(r).allows(*rec) {
+		writeProblem(w, r, http.StatusNotFound, errorCodeNotFound, "Rec not found")
+		return
+	}
+
+	w.Header().Set("ETag", recETag(rec.Version))
+	if etagsMatch(r.Header.Get("If-None-Match"), rec.Version) {
+		w.WriteHeader(http.StatusNotModified)
 		return
 	}
 
 	httpJson, err := json.Marshal(rec)
 	if err != nil {
-		log.Printf("Cannot encode response JSON")
-		w.WriteHeader(http.StatusBadRequest)
+		writeInternalError(w, r, "Cannot encode response JSON", err)
 		return
 	}
 
@@ -89,12 +120,12 @@ func (recController recController) getRec(w http.ResponseWriter, r *http.Request
 }
 
 // PUT /recs/:id
+// If-Match is supported, responding 412 if the rec version does not match.
 func (recController recController) putRec(w http.ResponseWriter, r *http.Request) {
 	idString := r.PathValue("id")
 	id, err := uuid.Parse(idString)
 	if err != nil {
-		log.Printf("Invalid UUID: %s", idString)
-		w.WriteHeader(http.StatusNotFound)
+		writeProblem(w, r, http.StatusNotFound, errorCodeInvalidID, fmt.Sprintf("Invalid UUID: %s", idString))
 		return
 	}
 
@@ -102,36 +133,651 @@ func (recController recController) putRec(w http.ResponseWriter, r *http.Request
 	var rec rec
 	err = decoder.Decode(&rec)
 	if err != nil {
-		log.Printf("Cannot decode request JSON: %s", err)
-		w.WriteHeader(http.StatusBadRequest)
+		writeProblem(w, r, http.StatusBadRequest, errorCodeInvalidBody, fmt.Sprintf("Cannot decode request JSON: %s", err))
+		return
+	}
+	rec.Version, err = parseIfMatch(r.Header.Get("If-Match"))
+	if err != nil {
+		writeProblem(w, r, http.StatusPreconditionFailed, errorCodePreconditionFailed, fmt.Sprintf("Invalid If-Match: %s", err))
+		return
+	}
+
+	existing, err := recController.store.readRec(id)
+	if err != nil {
+		writeStoreError(w, r, err)
+		return
+	}
+	access := requestRecAccess(r)
+	if !access.allows(*existing) {
+		writeProblem(w, r, http.StatusNotFound, errorCodeNotFound, "Rec not found")
+		return
+	}
+	if rec.Version != 0 && rec.Version != existing.Version {
+		writeProblem(w, r, http.StatusPreconditionFailed, errorCodePreconditionFailed, "The rec version does not match")
+		return
+	}
+	merged := applyRecUpdate(*existing, rec)
+	if !access.allows(merged) {
+		writeProblem(w, r, http.StatusForbidden, errorCodeForbidden, fmt.Sprintf("Rec is outside the access policies of %s", requestUsername(r)))
+		return
+	}
+	if !recController.checkTags(w, r, merged) {
+		return
+	}
+
+	err = recController.store.updateRec(id, rec, requestRecAudit(r))
+	if errors.Is(err, errVersionConflict) {
+		writeProblem(w, r, http.StatusPreconditionFailed, errorCodePreconditionFailed, "The rec version does not match")
 		return
 	}
-	err = recController.store.updateRec(id, rec)
 	if err != nil {
-		log.Printf("Storage Error: %s", id)
-		w.WriteHeader(http.StatusBadRequest)
+		writeStoreError(w, r, err)
+		return
+	}
+	updated, err := recController.store.readRec(id)
+	if err != nil {
+		writeStoreError(w, r, err)
 		return
 	}
 
+	w.Header().Set("ETag", recETag(updated.Version))
 	w.WriteHeader(http.StatusOK)
 }
 
+// PATCH /recs/:id
+// Accepts a JSON Merge Patch (application/merge-patch+json) or a JSON Patch (application/json-patch+json) of the
+// rec JSON. Unlike PUT, fields and tags may be removed. If-Match is supported, responding 412 if the rec version
+// does not match.
+func (recController recController) patchRec(w http.ResponseWriter, r *http.Request) {
+	idString := r.PathValue("id")
+	id, err := uuid.Parse(idString)
+	if err != nil {
+		writeProblem(w, r, http.StatusNotFound, errorCodeInvalidID, fmt.Sprintf("Invalid UUID: %s", idString))
+		return
+	}
+	version, err := parseIfMatch(r.Header.Get("If-Match"))
+	if err != nil {
+		writeProblem(w, r, http.StatusPreconditionFailed, errorCodePreconditionFailed, fmt.Sprintf("Invalid If-Match: %s", err))
+		return
+	}
+
+	existing, err := recController.store.readRec(id)
+	if err != nil {
+		writeStoreError(w, r, err)
+		return
+	}
+	access := requestRecAccess(r)
+	if !access.allows(*existing) {
+		writeProblem(w, r, http.StatusNotFound, errorCodeNotFound, "Rec not found")
+		return
+	}
+	if version != 0 && version != existing.Version {
+		writeProblem(w, r, http.StatusPreconditionFailed, errorCodePreconditionFailed, "The rec version does not match")
+		return
+	}
+
+	existingJson, err := json.Marshal(existing)
+	if err != nil {
+		writeInternalError(w, r, "Cannot encode rec JSON", err)
+		return
+	}
+	var document interface{}
+	err = json.Unmarshal(existingJson, &document)
+	if err != nil {
+		writeInternalError(w, r, "Cannot decode rec JSON", err)
+		return
+	}
+
+	mediaType, _, _ := mime.ParseMediaType(r.Header.Get("Content-Type"))
+	switch mediaType {
+	case "application/merge-patch+json":
+		var patch interface{}
+		err = json.NewDecoder(r.Body).Decode(&patch)
+		if err != nil {
+			writeProblem(w, r, http.StatusBadRequest, errorCodeInvalidBody, fmt.Sprintf("Cannot decode request JSON: %s", err))
+			return
+		}
+		document = applyMergePatch(document, patch)
+	case "application/json-patch+json":
+		var operations []jsonPatchOperation
+		err = json.NewDecoder(r.Body).Decode(&operations)
+		if err != nil {
+			writeProblem(w, r, http.StatusBadRequest, errorCodeInvalidBody, fmt.Sprintf("Cannot decode request JSON: %s", err))
+			return
+		}
+		document, err = applyJSONPatch(document, operations)
+		if err != nil {
+			writeProblem(w, r, http.StatusUnprocessableEntity, errorCodeInvalidValue, fmt.Sprintf("Cannot apply patch: %s", err))
+			return
+		}
+	default:
+		writeProblem(w, r, http.StatusUnsupportedMediaType, errorCodeUnsupportedMediaType, fmt.Sprintf("Unsupported patch type: %s", mediaType))
+		return
+	}
+
+	patchedJson, err := json.Marshal(document)
+	if err != nil {
+		writeInternalError(w, r, "Cannot encode patched JSON", err)
+		return
+	}
+	var patched rec
+	err = json.Unmarshal(patchedJson, &patched)
+	if err != nil {
+		writeProblem(w, r, http.StatusUnprocessableEntity, errorCodeInvalidValue, fmt.Sprintf("Patched rec is invalid: %s", err))
+		return
+	}
+	if patched.ID != id {
+		writeProblem(w, r, http.StatusUnprocessableEntity, errorCodeInvalidValue, "Patch cannot change the rec ID")
+		return
+	}
+	if !access.allows(patched) {
+		writeProblem(w, r, http.StatusForbidden, errorCodeForbidden, fmt.Sprintf("Rec is outside the access policies of %s", requestUsername(r)))
+		return
+	}
+	if !recController.checkTags(w, r, patched) {
+		return
+	}
+
+	// Replace against the version we read, so concurrent changes are not lost.
+	patched.Version = existing.Version
+	err = recController.store.replaceRec(patched, requestRecAudit(r))
+	if errors.Is(err, errVersionConflict) {
+		if version != 0 {
+			writeProblem(w, r, http.StatusPreconditionFailed, errorCodePreconditionFailed, "The rec version does not match")
+		} else {
+			writeProblem(w, r, http.StatusConflict, errorCodeConflict, "The rec was changed concurrently")
+		}
+		return
+	}
+	if err != nil {
+		writeStoreError(w, r, err)
+		return
+	}
+	updated, err := recController.store.readRec(id)
+	if err != nil {
+		writeStoreError(w, r, err)
+		return
+	}
+
+	httpJson, err := json.Marshal(updated)
+	if err != nil {
+		writeInternalError(w, r, "Cannot encode response JSON", err)
+		return
+	}
+
+	w.Header().Set("ETag", recETag(updated.Version))
+	w.WriteHeader(http.StatusOK)
+	w.Write(httpJson)
+}
+
 // DELETE /recs/:id
+// Deletes the rec along with its history and current value. If trash retention is configured, the rec and its
+// history are kept in the trash until they expire. If-Match is supported, responding 412 if the rec version does
+// not match.
 func (recController recController) deleteRec(w http.ResponseWriter, r *http.Request) {
 	idString := r.PathValue("id")
 	id, err := uuid.Parse(idString)
 	if err != nil {
-		log.Printf("Invalid UUID: %s", idString)
-		w.WriteHeader(http.StatusNotFound)
+		writeProblem(w, r, http.StatusNotFound, errorCodeInvalidID, fmt.Sprintf("Invalid UUID: %s", idString))
+		return
+	}
+
+	version, err := parseIfMatch(r.Header.Get("If-Match"))
+	if err != nil {
+		writeProblem(w, r, http.StatusPreconditionFailed, errorCodePreconditionFailed, fmt.Sprintf("Invalid If-Match: %s", err))
+		return
+	}
+
+	if !checkRecAccess(w, r, recController.store, id) {
+		return
+	}
+	err = recController.deleter.delete(id, version, requestRecAudit(r))
+	if errors.Is(err, errVersionConflict) {
+		writeProblem(w, r, http.StatusPreconditionFailed, errorCodePreconditionFailed, "The rec version does not match")
+		return
+	}
+	if err != nil {
+		writeStoreError(w, r, err)
+		return
+	}
+
+	w.WriteHeader(http.StatusOK)
+}
+
+// GET /trash
+func (recController recController) getTrash(w http.ResponseWriter, r *http.Request) {
+	recs, err := recController.store.readDeletedRecs()
+	if err != nil {
+		writeStoreError(w, r, err)
+		return
+	}
+	recs = requestRecAccess(r).filterRecs(recs)
+
+	httpJson, err := json.Marshal(recs)
+	if err != nil {
+		writeInternalError(w, r, "Cannot encode response JSON", err)
+		return
+	}
+
+	w.WriteHeader(http.StatusOK)
+	w.Write(httpJson)
+}
+
+// POST /trash/:id/restore
+func (recController recController) postTrashRestore(w http.ResponseWriter, r *http.Request) {
+	idString := r.PathValue("id")
+	id, err := uuid.Parse(idString)
+	if err != nil {
+		writeProblem(w, r, http.StatusNotFound, errorCodeInvalidID, fmt.Sprintf("Invalid UUID: %s", idString))
+		return
+	}
+
+	if !recController.checkTrashAccess(w, r, id) {
+		return
+	}
+	err = recController.deleter.undelete(id, requestRecAudit(r))
+	if errors.Is(err, gorm.ErrRecordNotFound) {
+		writeProblem(w, r, http.StatusNotFound, errorCodeNotFound, "Rec not found in the trash")
+		return
+	}
+	if err != nil {
+		writeStoreError(w, r, err)
+		return
+	}
+	restored, err := recController.store.readRec(id)
+	if err != nil {
+		writeStoreError(w, r, err)
+		return
+	}
+
+	httpJson, err := json.Marshal(restored)
+	if err != nil {
+		writeInternalError(w, r, "Cannot encode response JSON", err)
+		return
+	}
+
+	w.WriteHeader(http.StatusOK)
+	w.Write(httpJson)
+}
+
+// DELETE /trash/:id
+// Permanently removes a rec in the trash, along with its history.
+func (recController recController) deleteTrash(w http.ResponseWriter, r *http.Request) {
+	idString := r.PathValue("id")
+	id, err := uuid.Parse(idString)
+	if err != nil {
+		writeProblem(w, r, http.StatusNotFound, errorCodeInvalidID, fmt.Sprintf("Invalid UUID: %s", idString))
+		return
+	}
+
+	deleted, err := recController.store.readDeletedRecs()
+	if err != nil {
+		writeStoreError(w, r, err)
+		return
+	}
+	inTrash := false
+	for _, rec := range requestRecAccess(r).filterRecs(deleted) {
+		if rec.ID == id {
+			inTrash = true
+		}
+	}
+	if !inTrash {
+		writeProblem(w, r, http.StatusNotFound, errorCodeNotFound, "Rec not found")
 		return
 	}
 
-	err = recController.store.deleteRec(id)
+	err = recController.deleter.purge(id)
 	if err != nil {
-		log.Printf("Unable to delete: %s", err)
-		w.WriteHeader(http.StatusBadRequest)
+		writeInternalError(w, r, "Unable to purge", err)
 		return
 	}
 
 	w.WriteHeader(http.StatusOK)
 }
+
+// POST /recs/bulk?dryRun=true
+// Accepts a JSON array of recs, or CSV when the Content-Type is text/csv. Recs are created or replaced in a
+// single transaction, and nothing is written if any rec is rejected, in which case only the rejections are reported.
+// Recs without an ID are assigned one.
+func (recController recController) postRecsBulk(w http.ResponseWriter, r *http.Request) {
+	dryRun := r.URL.Query().Get("dryRun") == "true"
+	result := newBulkResult(dryRun)
+
+	var rows []recCsvRow
+	mediaType, _, _ := mime.ParseMediaType(r.Header.Get("Content-Type"))
+	if mediaType == "text/csv" {
+		var err error
+		rows, err = readRecsCsv(r.Body)
+		if err != nil {
+			writeProblem(w, r, http.StatusBadRequest, errorCodeInvalidBody, fmt.Sprintf("Cannot decode request CSV: %s", err))
+			return
+		}
+	} else {
+		var recs []rec
+		err := json.NewDecoder(r.Body).Decode(&recs)
+		if err != nil {
+			writeProblem(w, r, http.StatusBadRequest, errorCodeInvalidBody, fmt.Sprintf("Cannot decode request JSON: %s", err))
+			return
+		}
+		for _, rec := range recs {
+			rows = append(rows, recCsvRow{rec: rec})
+		}
+	}
+
+	tagDefs, err := recController.tagDefStore.readTagDefs()
+	if err != nil {
+		writeStoreError(w, r, err)
+		return
+	}
+
+	// Restricted requests may only create recs they can access, and only replace recs they could access,
+	// including those in the trash. Both are reported alike so that the existence of other recs is not leaked.
+	access := requestRecAccess(r)
+	inaccessibleIDs := map[uuid.UUID]bool{}
+	if access.restricted() {
+		allRecs, err := recController.store.readRecs("")
+		if err != nil {
+			writeStoreError(w, r, err)
+			return
+		}
+		deletedRecs, err := recController.store.readDeletedRecs()
+		if err != nil {
+			writeStoreError(w, r, err)
+			return
+		}
+		for _, existing := range append(allRecs, deletedRecs...) {
+			if !access.allows(existing) {
+				inaccessibleIDs[existing.ID] = true
+			}
+		}
+	}
+
+	toUpsert := []rec{}
+	seenIDs := map[uuid.UUID]bool{}
+	for index, row := range rows {
+		if row.err != nil {
+			result.Rejected = append(result.Rejected, bulkRejection{Index: index, Reason: row.err.Error()})
+			continue
+		}
+		rec := row.rec
+		// A dry run does not invent the IDs of new recs, since the import would create them with others
+		newID := rec.ID == uuid.Nil
+		if newID && !dryRun {
+			rec.ID = uuid.New()
+		}
+		var id *uuid.UUID
+		if rec.ID != uuid.Nil {
+			id = &rec.ID
+		}
+		if id != nil {
+			if seenIDs[rec.ID] {
+				result.Rejected = append(result.Rejected, bulkRejection{Index: index, ID: id, Reason: "duplicate id"})
+				continue
+			}
+			seenIDs[rec.ID] = true
+		}
+		if inaccessibleIDs[rec.ID] || !access.allows(rec) {
+			result.Rejected = append(result.Rejected, bulkRejection{Index: index, ID: id, Reason: "access denied"})
+			continue
+		}
+		violations := validateRecTags(rec, tagDefs)
+		if len(violations) > 0 {
+			result.Rejected = append(result.Rejected, bulkRejection{
+				Index:  index,
+				ID:     id,
+				Reason: "tag validation failed",
+				Errors: violations,
+			})
+			continue
+		}
+		if id == nil {
+			result.CreatedNew = append(result.CreatedNew, index)
+			continue
+		}
+		toUpsert = append(toUpsert, rec)
+	}
+
+	// Nothing is written if any rec is rejected, so only the rejections are reported, unless planning a dry run
+	rejected := len(result.Rejected) > 0 && !dryRun
+	if !rejected {
+		upsertResult, err := recController.store.upsertRecs(toUpsert, dryRun, requestRecAudit(r))
+		if err != nil {
+			writeStoreError(w, r, err)
+			return
+		}
+		result.Created = upsertResult.Created
+		result.Updated = upsertResult.Updated
+	}
+
+	httpJson, err := json.Marshal(result)
+	if err != nil {
+		writeInternalError(w, r, "Cannot encode response JSON", err)
+		return
+	}
+
+	if rejected {
+		w.WriteHeader(http.StatusUnprocessableEntity)
+	} else {
+		w.WriteHeader(http.StatusOK)
+	}
+	w.Write(httpJson)
+}
+
+// GET /recs/export?format=csv
+// Exports all recs as a JSON array, or as CSV if the format is csv.
+func (recController recController) getRecsExport(w http.ResponseWriter, r *http.Request) {
+	recs, err := recController.store.readRecs("")
+	if err != nil {
+		writeStoreError(w, r, err)
+		return
+	}
+	recs = requestRecAccess(r).filterRecs(recs)
+
+	var body bytes.Buffer
+	if r.URL.Query().Get("format") == "csv" {
+		err = writeRecsCsv(&body, recs)
+		if err != nil {
+			writeInternalError(w, r, "Cannot encode response CSV", err)
+			return
+		}
+		w.Header().Set("Content-Type", "text/csv")
+	} else {
+		err = json.NewEncoder(&body).Encode(recs)
+		if err != nil {
+			writeInternalError(w, r, "Cannot encode response JSON", err)
+			return
+		}
+		w.Header().Set("Content-Type", "application/json")
+	}
+
+	w.WriteHeader(http.StatusOK)
+	w.Write(body.Bytes())
+}
+
+// GET /recs/:id/revisions
+func (recController recController) getRevisions(w http.ResponseWriter, r *http.Request) {
+	idString := r.PathValue("id")
+	id, err := uuid.Parse(idString)
+	if err != nil {
+		writeProblem(w, r, http.StatusNotFound, errorCodeInvalidID, fmt.Sprintf("Invalid UUID: %s", idString))
+		return
+	}
+
+	if !checkRecAccess(w, r, recController.store, id) {
+		return
+	}
+	revisions, err := recController.revisionStore.readRevisions(id)
+	if err != nil {
+		writeStoreError(w, r, err)
+		return
+	}
+
+	httpJson, err := json.Marshal(revisions)
+	if err != nil {
+		writeInternalError(w, r, "Cannot encode response JSON", err)
+		return
+	}
+
+	w.WriteHeader(http.StatusOK)
+	w.Write(httpJson)
+}
+
+// POST /recs/:id/revisions/:revision/restore
+// Restores the rec to how it was after the revision, recreating it if it has since been deleted.
+func (recController recController) postRevisionRestore(w http.ResponseWriter, r *http.Request) {
+	idString := r.PathValue("id")
+	id, err := uuid.Parse(idString)
+	if err != nil {
+		writeProblem(w, r, http.StatusNotFound, errorCodeInvalidID, fmt.Sprintf("Invalid UUID: %s", idString))
+		return
+	}
+	revisionString := r.PathValue("revision")
+	number, err := strconv.Atoi(revisionString)
+	if err != nil {
+		writeProblem(w, r, http.StatusNotFound, errorCodeInvalidID, fmt.Sprintf("Invalid revision: %s", revisionString))
+		return
+	}
+
+	revision, err := recController.revisionStore.readRevision(id, number)
+	if errors.Is(err, gorm.ErrRecordNotFound) {
+		writeProblem(w, r, http.StatusNotFound, errorCodeNotFound, "Revision not found")
+		return
+	}
+	if err != nil {
+		writeStoreError(w, r, err)
+		return
+	}
+	if revision.After == nil {
+		writeProblem(w, r, http.StatusConflict, errorCodeConflict, fmt.Sprintf("Cannot restore revision %d of %s, since it deleted the rec", number, id))
+		return
+	}
+	restored := *revision.After
+
+	existing, err := recController.store.readRec(id)
+	if errors.Is(err, gorm.ErrRecordNotFound) {
+		deleted, err := recController.store.isRecDeleted(id)
+		if err != nil {
+			writeStoreError(w, r, err)
+			return
+		}
+		// A rec in the trash is only brought back from the trash, so that it is restored as the trash restores recs
+		if deleted {
+			if !recController.checkTrashAccess(w, r, id) {
+				return
+			}
+			writeProblem(w, r, http.StatusConflict, errorCodeConflict, fmt.Sprintf("Rec %s is in the trash, and must be restored from it first", id))
+			return
+		}
+		// The rec has been purged since, so it is recreated
+		existing = nil
+	} else if err != nil {
+		writeStoreError(w, r, err)
+		return
+	}
+	access := requestRecAccess(r)
+	if (existing != nil && !access.allows(*existing)) || !access.allows(restored) {
+		writeProblem(w, r, http.StatusNotFound, errorCodeNotFound, "Rec not found")
+		return
+	}
+
+	if !recController.checkTags(w, r, restored) {
+		return
+	}
+	audit := requestRecAudit(r)
+	audit.Action = revisionActionRestore
+	_, err = recController.store.upsertRecs([]rec{restored}, false, audit)
+	if err != nil {
+		writeStoreError(w, r, err)
+		return
+	}
+	// The restored tags may subscribe the rec to a different topic
+	recController.deleter.refreshIngester()
+
+	httpJson, err := json.Marshal(restored)
+	if err != nil {
+		writeInternalError(w, r, "Cannot encode response JSON", err)
+		return
+	}
+
+	w.WriteHeader(http.StatusOK)
+	w.Write(httpJson)
+}
+
+// requestRecAudit returns the audit of the request, which records its changes as the request user.
+func requestRecAudit(r *http.Request) recAudit {
+	return recAudit{Username: requestUsername(r)}
+}
+
+// checkTrashAccess responds with 404 and returns false unless the request may access the rec in the trash.
+func (recController recController) checkTrashAccess(w http.ResponseWriter, r *http.Request, id uuid.UUID) bool {
+	access := requestRecAccess(r)
+	if !access.restricted() {
+		return true
+	}
+	deleted, err := recController.store.readDeletedRecs()
+	if err != nil {
+		writeStoreError(w, r, err)
+		return false
+	}
+	for _, rec := range deleted {
+		if rec.ID == id && access.allows(rec) {
+			return true
+		}
+	}
+	writeProblem(w, r, http.StatusNotFound, errorCodeNotFound, "Rec not found")
+	return false
+}
+
+// checkTags validates the rec against the tag definitions. If it is invalid, a problem listing the violations is
+// written to the response and false is returned.
+func (recController recController) checkTags(w http.ResponseWriter, r *http.Request, rec rec) bool {
+	tagDefs, err := recController.tagDefStore.readTagDefs()
+	if err != nil {
+		writeStoreError(w, r, err)
+		return false
+	}
+	violations := validateRecTags(rec, tagDefs)
+	if len(violations) == 0 {
+		return true
+	}
+
+	writeProblemBody(w, r, problem{
+		Status: http.StatusUnprocessableEntity,
+		Code:   errorCodeTagValidationFailed,
+		Detail: "The rec does not conform to the tag definitions",
+		Errors: violations,
+	})
+	return false
+}
+
+// recETag formats a rec version as a strong ETag.
+func recETag(version int64) string {
+	return fmt.Sprintf("\"%d\"", version)
+}
+
+// parseIfMatch returns the rec version required by an If-Match header, or zero if any version is acceptable.
+func parseIfMatch(header string) (int64, error) {
+	header = strings.TrimSpace(header)
+	if header == "" || header == "*" {
+		return 0, nil
+	}
+	if strings.Contains(header, ",") {
+		return 0, fmt.Errorf("multiple ETags are not supported: %s", header)
+	}
+	version, err := strconv.ParseInt(strings.Trim(header, "\""), 10, 64)
+	if err != nil || version <= 0 {
+		return 0, fmt.Errorf("not a rec ETag: %s", header)
+	}
+	return version, nil
+}
+
+// etagsMatch returns true if an If-None-Match header matches the rec version. Weak comparison is used.
+func etagsMatch(header string, version int64) bool {
+	for _, etag := range strings.Split(header, ",") {
+		etag = strings.TrimPrefix(strings.TrimSpace(etag), "W/")
+		if etag == "*" || etag == recETag(version) {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,165 @@
+package main
+
+import (
+	"bytes"
+	"encoding/csv"
+	"encoding/json"
+	"fmt"
+	"io"
+	"sort"
+
+	"github.com/google/uuid"
+	"gorm.io/datatypes"
+)
+
+// CSV rec format
+//
+// The first row is a header. The `id`, `dis` and `unit` columns map to the matching rec fields, and every
+// other column is a tag. Empty cells mean the tag is absent. Tag cells that are valid JSON (numbers, booleans,
+// quoted strings, objects, arrays) are decoded as JSON, and any other cell is taken as a literal string.
+
+// recCsvRow is a rec parsed from a CSV row. If the row is invalid, err describes why.
+type recCsvRow struct {
+	rec rec
+	err error
+}
+
+// readRecsCsv parses recs from CSV. Row-level problems are reported per row rather than failing the whole read.
+func readRecsCsv(reader io.Reader) ([]recCsvRow, error) {
+	csvReader := csv.NewReader(reader)
+	csvReader.FieldsPerRecord = -1
+	header, err := csvReader.Read()
+	if err != nil {
+		return nil, fmt.Errorf("cannot read CSV header: %w", err)
+	}
+
+	rows := []recCsvRow{}
+	for {
+		record, err := csvReader.Read()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return nil, fmt.Errorf("cannot read CSV: %w", err)
+		}
+		if len(record) != len(header) {
+			rows = append(rows, recCsvRow{
+				err: fmt.Errorf("expected %d columns, got %d", len(header), len(record)),
+			})
+			continue
+		}
+		rows = append(rows, parseRecCsvRecord(header, record))
+	}
+	return rows, nil
+}
+
+func parseRecCsvRecord(header []string, record []string) recCsvRow {
+	var result rec
+	tags := datatypes.JSONMap{}
+	for i, column := range header {
+		cell := record[i]
+		if cell == "" {
+			continue
+		}
+		switch column {
+		case "id":
+			id, err := uuid.Parse(cell)
+			if err != nil {
+				return recCsvRow{err: fmt.Errorf("invalid id: %s", cell)}
+			}
+			result.ID = id
+		case "dis":
+			dis := cell
+			result.Dis = &dis
+		case "unit":
+			unit := cell
+			result.Unit = &unit
+		default:
+			tags[column] = decodeCsvTagValue(cell)
+		}
+	}
+	result.Tags = tags
+	return recCsvRow{rec: result}
+}
+
+// writeRecsCsv writes recs as CSV, with a column for every tag used by any rec.
+func writeRecsCsv(writer io.Writer, recs []rec) error {
+	tagNameSet := map[string]bool{}
+	for _, rec := range recs {
+		for name := range rec.Tags {
+			tagNameSet[name] = true
+		}
+	}
+	tagNames := []string{}
+	for name := range tagNameSet {
+		tagNames = append(tagNames, name)
+	}
+	sort.Strings(tagNames)
+
+	csvWriter := csv.NewWriter(writer)
+	header := append([]string{"id", "dis", "unit"}, tagNames...)
+	err := csvWriter.Write(header)
+	if err != nil {
+		return err
+	}
+	for _, rec := range recs {
+		record := []string{rec.ID.String(), "", ""}
+		if rec.Dis != nil {
+			record[1] = *rec.Dis
+		}
+		if rec.Unit != nil {
+			record[2] = *rec.Unit
+		}
+		for _, name := range tagNames {
+			value, present := rec.Tags[name]
+			if !present {
+				record = append(record, "")
+				continue
+			}
+			cell, err := encodeCsvTagValue(value)
+			if err != nil {
+				return err
+			}
+			record = append(record, cell)
+		}
+		err = csvWriter.Write(record)
+		if err != nil {
+			return err
+		}
+	}
+	csvWriter.Flush()
+	return csvWriter.Error()
+}
+
+func decodeCsvTagValue(cell string) interface{} {
+	var value interface{}
+	decoder := json.NewDecoder(bytes.NewReader([]byte(cell)))
+	decoder.UseNumber()
+	err := decoder.Decode(&value)
+	if err != nil || decoder.More() {
+		return cell
+	}
+	if number, ok := value.(json.Number); ok {
+		float, err := number.Float64()
+		if err != nil {
+			return cell
+		}
+		return float
+	}
+	return value
+}
+
+// encodeCsvTagValue encodes a tag value so that decodeCsvTagValue will return it unchanged.
+// Strings are written literally unless they would be decoded as something else.
+func encodeCsvTagValue(value interface{}) (string, error) {
+	if str, ok := value.(string); ok && str != "" {
+		if decoded, ok := decodeCsvTagValue(str).(string); ok && decoded == str {
+			return str, nil
+		}
+	}
+	encoded, err := json.Marshal(value)
+	if err != nil {
+		return "", err
+	}
+	return string(encoded), nil
+}
@@ -0,0 +1,121 @@
+package main
+
+import (
+	"log"
+	"time"
+
+	"github.com/google/uuid"
+)
+
+// recDeleter coordinates deleting recs across the stores and the ingester, so that no orphaned history, current
+// values or subscriptions are left behind.
+//
+// Deleted recs are moved to the trash, where their history is kept so that they can be restored. They are purged
+// once they have been in the trash for longer than the retention period, or immediately if it is zero.
+type recDeleter struct {
+	recStore     recStore
+	historyStore historyStore
+	currentStore currentStore
+	// ingester is optional. If set, its subscriptions are refreshed when recs are deleted or restored.
+	ingester *ingester
+
+	trashRetention time.Duration
+}
+
+// delete moves the rec to the trash, or purges it if there is no trash retention. If the version is not zero,
+// the delete fails with errVersionConflict unless it matches the stored version.
+func (d recDeleter) delete(id uuid.UUID, version int64, audit recAudit) error {
+	err := d.recStore.deleteRec(id, version, audit)
+	if err != nil {
+		return err
+	}
+	// The rec is removed directly, so that its values stop even if the subscriptions cannot be refreshed
+	if d.ingester != nil {
+		d.ingester.removeRec(id)
+	}
+	d.refreshIngester()
+	// Current values are volatile, so there is no need to keep them for a restore.
+	err = d.currentStore.deleteCurrent(id)
+	if err != nil {
+		return err
+	}
+	if d.trashRetention == 0 {
+		return d.purge(id)
+	}
+	return nil
+}
+
+// undelete moves the rec out of the trash.
+func (d recDeleter) undelete(id uuid.UUID, audit recAudit) error {
+	err := d.recStore.undeleteRec(id, audit)
+	if err != nil {
+		return err
+	}
+	d.refreshIngester()
+	return nil
+}
+
+// purge permanently removes the rec and its history.
+func (d recDeleter) purge(id uuid.UUID) error {
+	// History goes first, so that a failure leaves the rec in the trash to be purged again.
+	err := d.historyStore.deleteHistory(id, nil, nil)
+	if err != nil {
+		return err
+	}
+	return d.recStore.purgeRec(id)
+}
+
+// purgeExpired purges every rec that was moved to the trash longer than the retention period before now.
+// It returns the number of recs purged.
+func (d recDeleter) purgeExpired(now time.Time) (int, error) {
+	deleted, err := d.recStore.readDeletedRecs()
+	if err != nil {
+		return 0, err
+	}
+	count := 0
+	for _, rec := range deleted {
+		if rec.DeletedAt == nil || rec.DeletedAt.Add(d.trashRetention).After(now) {
+			continue
+		}
+		err = d.purge(rec.ID)
+		if err != nil {
+			return count, err
+		}
+		count++
+	}
+	return count, nil
+}
+
+// runPurges purges expired recs at the interval until the stop channel is closed. It closes the done channel once a
+// purge in progress has finished.
+func (d recDeleter) runPurges(interval time.Duration, stop <-chan struct{}, done chan<- struct{}) {
+	defer close(done)
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-stop:
+			return
+		case now := <-ticker.C:
+			count, err := d.purgeExpired(now)
+			if err != nil {
+				log.Printf("Unable to purge trash: %s", err)
+			}
+			if count > 0 {
+				log.Printf("Purged %d recs from the trash", count)
+			}
+		}
+	}
+}
+
+func (d recDeleter) refreshIngester() {
+	if d.ingester == nil {
+		return
+	}
+	recs, err := d.recStore.readRecs("mqttTopic")
+	if err != nil {
+		log.Printf("Unable to refresh ingester subscriptions: %s", err)
+		return
+	}
+	d.ingester.refreshSubscriptions(recs)
+}
@@ -0,0 +1,105 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"strings"
+)
+
+// recFilter matches recs by their tags. It is parsed from expressions of conditions joined by `and`, where each
+// condition is one of:
+//
+//   - `name`: the rec has the tag
+//   - `name==value`: the rec has the tag with the value
+//   - `name!=value`: the rec does not have the tag with the value
+//
+// Values are JSON literals if they parse as one, such as `"siteA"`, `42` or `true`, and are otherwise taken as a
+// string, such as `@siteA`. As in tag validation, `dis` and `unit` are treated as tags.
+type recFilter struct {
+	conditions []recFilterCondition
+}
+
+type recFilterCondition struct {
+	name     string
+	operator string
+	value    interface{}
+}
+
+// Operators of recFilterCondition. An empty operator checks that the tag is present.
+const (
+	recFilterEquals    = "=="
+	recFilterNotEquals = "!="
+)
+
+func parseRecFilter(expression string) (recFilter, error) {
+	filter := recFilter{}
+	for _, part := range strings.Split(expression, " and ") {
+		part = strings.TrimSpace(part)
+		if part == "" {
+			return recFilter{}, fmt.Errorf("empty condition in filter: %s", expression)
+		}
+		condition := recFilterCondition{name: part}
+		for _, operator := range []string{recFilterEquals, recFilterNotEquals} {
+			name, valueString, found := strings.Cut(part, operator)
+			if !found {
+				continue
+			}
+			condition.name = strings.TrimSpace(name)
+			condition.operator = operator
+			valueString = strings.TrimSpace(valueString)
+			if valueString == "" {
+				return recFilter{}, fmt.Errorf("missing value in filter: %s", part)
+			}
+			err := json.Unmarshal([]byte(valueString), &condition.value)
+			if err != nil {
+				condition.value = valueString
+			}
+			break
+		}
+		if condition.name == "" || strings.ContainsAny(condition.name, " =!") {
+			return recFilter{}, fmt.Errorf("invalid condition in filter: %s", part)
+		}
+		filter.conditions = append(filter.conditions, condition)
+	}
+	return filter, nil
+}
+
+// matches returns true if the rec satisfies every condition of the filter.
+func (f recFilter) matches(rec rec) bool {
+	for _, condition := range f.conditions {
+		value, present := recTagValue(rec, condition.name)
+		switch condition.operator {
+		case recFilterEquals:
+			if !present || !jsonEqual(value, condition.value) {
+				return false
+			}
+		case recFilterNotEquals:
+			if present && jsonEqual(value, condition.value) {
+				return false
+			}
+		default:
+			if !present {
+				return false
+			}
+		}
+	}
+	return true
+}
+
+// recTagValue returns the value of the tag on the rec, and whether it is present.
+func recTagValue(rec rec, name string) (interface{}, bool) {
+	switch name {
+	case "dis":
+		if rec.Dis == nil {
+			return nil, false
+		}
+		return *rec.Dis, true
+	case "unit":
+		if rec.Unit == nil {
+			return nil, false
+		}
+		return *rec.Unit, true
+	}
+	value, present := rec.Tags[name]
+	return value, present
+}
@@ -0,0 +1,50 @@
+package main
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"gorm.io/datatypes"
+)
+
+func TestRecFilter(t *testing.T) {
+	rec := rec{
+		Dis: s("AHU-1 Discharge Temp"),
+		Tags: datatypes.JSONMap(map[string]interface{}{
+			"point":   true,
+			"siteRef": "@siteA",
+			"floor":   2,
+		}),
+	}
+	cases := []struct {
+		expression string
+		expected   bool
+	}{
+		{`point`, true},
+		{`equip`, false},
+		{`siteRef==@siteA`, true},
+		{`siteRef==@siteB`, false},
+		{`siteRef=="@siteA"`, true},
+		{`siteRef!=@siteB`, true},
+		{`equip!=@siteB`, true},
+		{`floor==2`, true},
+		{`floor=="2"`, false},
+		{`point==true`, true},
+		{`dis==AHU-1 Discharge Temp`, true},
+		{`unit`, false},
+		{`point and siteRef==@siteA`, true},
+		{`point and siteRef==@siteB`, false},
+	}
+	for _, c := range cases {
+		filter, err := parseRecFilter(c.expression)
+		assert.Nil(t, err, c.expression)
+		assert.Equal(t, c.expected, filter.matches(rec), c.expression)
+	}
+}
+
+func TestParseRecFilterInvalid(t *testing.T) {
+	for _, expression := range []string{``, `point and `, `==@siteA`, `site Ref==@siteA`, `siteRef==`} {
+		_, err := parseRecFilter(expression)
+		assert.NotNil(t, err, expression)
+	}
+}
@@ -1,17 +1,48 @@
 package main
 
 import (
+	"cmp"
+	"context"
+	"errors"
+	"slices"
+	"strings"
+	"sync"
+	"time"
+
 	"github.com/google/uuid"
 	"gorm.io/datatypes"
 	"gorm.io/gorm"
+	"gorm.io/gorm/clause"
 )
 
+// recStore is able to store point records. Every change is recorded as a revision of the rec, attributed to the
+// given recAudit, and fails if its revision cannot be stored.
 type recStore interface {
 	readRecs(string) ([]rec, error)
 	readRec(uuid.UUID) (*rec, error)
-	createRec(rec) error
-	updateRec(uuid.UUID, rec) error
-	deleteRec(uuid.UUID) error
+	// createRec stores a new rec. Its deletion time is ignored.
+	createRec(rec, recAudit) error
+	// updateRec applies the non-nil fields of the rec. If the rec version is set, the update fails with
+	// errVersionConflict unless it matches the stored version.
+	updateRec(uuid.UUID, rec, recAudit) error
+	// replaceRec sets every field of the stored rec, including nil ones. If the rec version is set, the replace
+	// fails with errVersionConflict unless it matches the stored version.
+	replaceRec(rec, recAudit) error
+	// deleteRec moves the rec to the trash, where it is hidden from all other reads. If the version is not zero,
+	// the delete fails with errVersionConflict unless it matches the stored version.
+	deleteRec(uuid.UUID, int64, recAudit) error
+	// upsertRecs creates or replaces all the recs in a single transaction. If dryRun is true, nothing is written.
+	// Their deletion times are ignored.
+	upsertRecs([]rec, bool, recAudit) (bulkResult, error)
+
+	// readDeletedRecs returns the recs in the trash, with their deletion times.
+	readDeletedRecs() ([]rec, error)
+	// isRecDeleted returns true if the rec is in the trash.
+	isRecDeleted(uuid.UUID) (bool, error)
+	// undeleteRec moves the rec out of the trash.
+	undeleteRec(uuid.UUID, recAudit) error
+	// purgeRec permanently removes the rec, whether or not it is in the trash.
+	purgeRec(uuid.UUID) error
 }
 
 type rec struct {
@@ -19,9 +50,377 @@ type rec struct {
 	Tags datatypes.JSONMap `json:"tags"`
 	Dis  *string           `json:"dis"`
 	Unit *string           `json:"unit"`
+	// Version starts at 1 and increments on every change. It is exposed to clients as an ETag.
+	Version int64 `json:"-"`
+	// DeletedAt is only set on recs in the trash.
+	DeletedAt *time.Time `json:"deletedAt,omitempty"`
+}
+
+// errVersionConflict is returned when a change is made against a version of a rec that is not the stored one.
+var errVersionConflict = errors.New("rec version conflict")
+
+// applyRecUpdate returns the existing rec with the non-nil fields of the update applied.
+func applyRecUpdate(existing rec, update rec) rec {
+	if update.Dis != nil {
+		existing.Dis = update.Dis
+	}
+	if update.Unit != nil {
+		existing.Unit = update.Unit
+	}
+	if update.Tags != nil {
+		existing.Tags = update.Tags
+	}
+	return existing
+}
+
+// bulkResult reports the outcome of a bulk rec import.
+type bulkResult struct {
+	DryRun  bool        `json:"dryRun"`
+	Created []uuid.UUID `json:"created"`
+	// CreatedNew are the indexes of the recs without IDs that a dry run would create, with new IDs.
+	CreatedNew []int           `json:"createdNew,omitempty"`
+	Updated    []uuid.UUID     `json:"updated"`
+	Rejected   []bulkRejection `json:"rejected"`
+}
+
+// bulkRejection describes an imported rec that could not be accepted.
+// Index is the zero-based position of the rec in the import.
+type bulkRejection struct {
+	Index  int            `json:"index"`
+	ID     *uuid.UUID     `json:"id,omitempty"`
+	Reason string         `json:"reason"`
+	Errors []tagViolation `json:"errors,omitempty"`
+}
+
+func newBulkResult(dryRun bool) bulkResult {
+	return bulkResult{
+		DryRun:   dryRun,
+		Created:  []uuid.UUID{},
+		Updated:  []uuid.UUID{},
+		Rejected: []bulkRejection{},
+	}
+}
+
+// inMemoryRecStore stores point records in a local in-memory map, with the same behaviour as gormRecStore. It also
+// stores their revisions, and serves as their revisionStore. These are not shared between instances, and are lost on
+// restart unless a snapshot file is set.
+type inMemoryRecStore struct {
+	mux *sync.RWMutex
+	// recs are all the stored recs, including those in the trash.
+	recs map[uuid.UUID]rec
+	// revisions are the revisions of each rec, in order. They are kept when the rec is purged, as in the database.
+	revisions map[uuid.UUID][]recRevision
+	// snapshotFile is optional. If set, the recs are loaded from it when the store is created, and saved to it on
+	// snapshot.
+	snapshotFile string
+}
+
+// inMemoryRecSnapshot is the content of an inMemoryRecStore snapshot file. Recs are snapshotted as their GORM
+// models, which keep the version.
+type inMemoryRecSnapshot struct {
+	Recs      map[uuid.UUID]gormRec       `json:"recs"`
+	Revisions map[uuid.UUID][]recRevision `json:"revisions"`
+}
+
+func newInMemoryRecStore(snapshotFile string) (inMemoryRecStore, error) {
+	s := inMemoryRecStore{
+		mux:          &sync.RWMutex{},
+		recs:         map[uuid.UUID]rec{},
+		revisions:    map[uuid.UUID][]recRevision{},
+		snapshotFile: snapshotFile,
+	}
+	if snapshotFile == "" {
+		return s, nil
+	}
+	snapshot := inMemoryRecSnapshot{}
+	err := readSnapshot(snapshotFile, &snapshot)
+	for id, gormRec := range snapshot.Recs {
+		s.recs[id] = gormRec.toRec()
+	}
+	for id, revisions := range snapshot.Revisions {
+		s.revisions[id] = revisions
+	}
+	return s, err
+}
+
+func (s inMemoryRecStore) readRecs(tag string) ([]rec, error) {
+	s.mux.RLock()
+	defer s.mux.RUnlock()
+	result := []rec{}
+	for _, stored := range s.recs {
+		if stored.DeletedAt != nil {
+			continue
+		}
+		if _, ok := stored.Tags[tag]; tag != "" && !ok {
+			continue
+		}
+		result = append(result, copyRec(stored))
+	}
+	// Recs without a dis are last, as in Postgres
+	slices.SortFunc(result, func(a rec, b rec) int {
+		switch {
+		case a.Dis == nil && b.Dis == nil:
+		case a.Dis == nil:
+			return 1
+		case b.Dis == nil:
+			return -1
+		case *a.Dis != *b.Dis:
+			return cmp.Compare(*a.Dis, *b.Dis)
+		}
+		return cmp.Compare(a.ID.String(), b.ID.String())
+	})
+	return result, nil
+}
+
+func (s inMemoryRecStore) readRec(id uuid.UUID) (*rec, error) {
+	s.mux.RLock()
+	defer s.mux.RUnlock()
+	stored, ok := s.recs[id]
+	if !ok || stored.DeletedAt != nil {
+		return nil, gorm.ErrRecordNotFound
+	}
+	result := copyRec(stored)
+	return &result, nil
+}
+
+func (s inMemoryRecStore) createRec(rec rec, audit recAudit) error {
+	s.mux.Lock()
+	defer s.mux.Unlock()
+	// IDs of recs in the trash are still taken
+	if _, ok := s.recs[rec.ID]; ok {
+		return gorm.ErrDuplicatedKey
+	}
+	rec.Version = 1
+	rec.DeletedAt = nil
+	s.recs[rec.ID] = copyRec(rec)
+	s.addRevision(audit.revision(rec.ID, revisionActionCreate, nil, &rec))
+	return nil
+}
+
+func (s inMemoryRecStore) updateRec(id uuid.UUID, update rec, audit recAudit) error {
+	s.mux.Lock()
+	defer s.mux.Unlock()
+	existing, ok := s.recs[id]
+	if !ok || existing.DeletedAt != nil {
+		return gorm.ErrRecordNotFound
+	}
+	if update.Version != 0 && update.Version != existing.Version {
+		return errVersionConflict
+	}
+	updated := applyRecUpdate(existing, update)
+	updated.Version = existing.Version + 1
+	s.recs[id] = copyRec(updated)
+	s.addRevision(audit.revision(id, revisionActionUpdate, &existing, &updated))
+	return nil
+}
+
+func (s inMemoryRecStore) replaceRec(rec rec, audit recAudit) error {
+	s.mux.Lock()
+	defer s.mux.Unlock()
+	existing, ok := s.recs[rec.ID]
+	if !ok || existing.DeletedAt != nil || (rec.Version != 0 && rec.Version != existing.Version) {
+		if rec.Version != 0 {
+			return errVersionConflict
+		}
+		return gorm.ErrRecordNotFound
+	}
+	rec.Version = existing.Version + 1
+	rec.DeletedAt = nil
+	s.recs[rec.ID] = copyRec(rec)
+	s.addRevision(audit.revision(rec.ID, revisionActionUpdate, &existing, &rec))
+	return nil
+}
+
+func (s inMemoryRecStore) deleteRec(id uuid.UUID, version int64, audit recAudit) error {
+	s.mux.Lock()
+	defer s.mux.Unlock()
+	existing, ok := s.recs[id]
+	if !ok || existing.DeletedAt != nil || (version != 0 && version != existing.Version) {
+		if version != 0 {
+			return errVersionConflict
+		}
+		return nil
+	}
+	deleted := existing
+	deletedAt := time.Now()
+	deleted.DeletedAt = &deletedAt
+	s.recs[id] = deleted
+	s.addRevision(audit.revision(id, revisionActionDelete, &existing, nil))
+	return nil
+}
+
+func (s inMemoryRecStore) upsertRecs(recs []rec, dryRun bool, audit recAudit) (bulkResult, error) {
+	s.mux.Lock()
+	defer s.mux.Unlock()
+	result := newBulkResult(dryRun)
+	// Later recs in the import see the earlier ones, as they would in a transaction
+	upserted := map[uuid.UUID]rec{}
+	revisions := []recRevision{}
+	for _, rec := range recs {
+		existing, ok := upserted[rec.ID]
+		if !ok {
+			existing, ok = s.recs[rec.ID]
+		}
+		rec.DeletedAt = nil
+		before := &existing
+		if ok {
+			// Recs in the trash are brought back, but count as created since they were not visible.
+			rec.Version = existing.Version + 1
+			if existing.DeletedAt != nil {
+				result.Created = append(result.Created, rec.ID)
+				before = nil
+			} else {
+				result.Updated = append(result.Updated, rec.ID)
+			}
+		} else {
+			result.Created = append(result.Created, rec.ID)
+			rec.Version = 1
+			before = nil
+		}
+		upserted[rec.ID] = copyRec(rec)
+		revisions = append(revisions, audit.revision(rec.ID, audit.upsertAction(before), before, &rec))
+	}
+	if !dryRun {
+		for id, rec := range upserted {
+			s.recs[id] = rec
+		}
+		for _, revision := range revisions {
+			s.addRevision(revision)
+		}
+	}
+	return result, nil
+}
+
+func (s inMemoryRecStore) readDeletedRecs() ([]rec, error) {
+	s.mux.RLock()
+	defer s.mux.RUnlock()
+	result := []rec{}
+	for _, stored := range s.recs {
+		if stored.DeletedAt != nil {
+			result = append(result, copyRec(stored))
+		}
+	}
+	slices.SortFunc(result, func(a rec, b rec) int {
+		return a.DeletedAt.Compare(*b.DeletedAt)
+	})
+	return result, nil
+}
+
+func (s inMemoryRecStore) isRecDeleted(id uuid.UUID) (bool, error) {
+	s.mux.RLock()
+	defer s.mux.RUnlock()
+	stored, ok := s.recs[id]
+	return ok && stored.DeletedAt != nil, nil
+}
+
+func (s inMemoryRecStore) undeleteRec(id uuid.UUID, audit recAudit) error {
+	s.mux.Lock()
+	defer s.mux.Unlock()
+	existing, ok := s.recs[id]
+	if !ok || existing.DeletedAt == nil {
+		return gorm.ErrRecordNotFound
+	}
+	existing.DeletedAt = nil
+	existing.Version++
+	s.recs[id] = existing
+	s.addRevision(audit.revision(id, revisionActionRestore, nil, &existing))
+	return nil
+}
+
+func (s inMemoryRecStore) purgeRec(id uuid.UUID) error {
+	s.mux.Lock()
+	defer s.mux.Unlock()
+	delete(s.recs, id)
+	return nil
+}
+
+// addRevision numbers and stores the revision after the latest one of its rec. The lock must be held.
+func (s inMemoryRecStore) addRevision(revision recRevision) {
+	revisions := s.revisions[revision.RecID]
+	revision.Revision = len(revisions) + 1
+	s.revisions[revision.RecID] = append(revisions, copyRevision(revision))
 }
 
-// gormHistoryStore stores point historical values in a GORM database.
+func (s inMemoryRecStore) readRevisions(id uuid.UUID) ([]recRevision, error) {
+	s.mux.RLock()
+	defer s.mux.RUnlock()
+	result := []recRevision{}
+	for _, revision := range s.revisions[id] {
+		result = append(result, copyRevision(revision))
+	}
+	return result, nil
+}
+
+func (s inMemoryRecStore) readRevision(id uuid.UUID, number int) (*recRevision, error) {
+	s.mux.RLock()
+	defer s.mux.RUnlock()
+	revisions := s.revisions[id]
+	if number < 1 || number > len(revisions) {
+		return nil, gorm.ErrRecordNotFound
+	}
+	result := copyRevision(revisions[number-1])
+	return &result, nil
+}
+
+// snapshot saves the recs and their revisions to the snapshot file, if set.
+func (s inMemoryRecStore) snapshot() error {
+	if s.snapshotFile == "" {
+		return nil
+	}
+	s.mux.RLock()
+	defer s.mux.RUnlock()
+	snapshot := inMemoryRecSnapshot{
+		Recs:      map[uuid.UUID]gormRec{},
+		Revisions: s.revisions,
+	}
+	for id, rec := range s.recs {
+		snapshot.Recs[id] = newGormRec(rec)
+	}
+	return writeSnapshot(s.snapshotFile, snapshot)
+}
+
+// copyRevision copies the revision and its recs, which are stored without versions or deletion times, as they are
+// in the database.
+func copyRevision(revision recRevision) recRevision {
+	copyRecPointer := func(r *rec) *rec {
+		if r == nil {
+			return nil
+		}
+		result := copyRec(*r)
+		result.Version = 0
+		result.DeletedAt = nil
+		return &result
+	}
+	revision.Before = copyRecPointer(revision.Before)
+	revision.After = copyRecPointer(revision.After)
+	revision.Changes = diffRecs(revision.Before, revision.After)
+	return revision
+}
+
+// copyRec copies the rec, so that callers cannot change stored recs through its tags and pointers. Tags are copied
+// through JSON, so that their values have the same types as those read from a database.
+func copyRec(r rec) rec {
+	result := r
+	tags, _ := r.Tags.Value()
+	result.Tags = datatypes.JSONMap{}
+	// The tags were encoded from a map, so they decode
+	result.Tags.Scan(tags)
+	if r.Dis != nil {
+		dis := *r.Dis
+		result.Dis = &dis
+	}
+	if r.Unit != nil {
+		unit := *r.Unit
+		result.Unit = &unit
+	}
+	if r.DeletedAt != nil {
+		deletedAt := *r.DeletedAt
+		result.DeletedAt = &deletedAt
+	}
+	return result
+}
+
+// gormRecStore stores point records in a GORM database.
 type gormRecStore struct {
 	db *gorm.DB
 }
@@ -30,13 +429,17 @@ func newGormRecStore(db *gorm.DB) gormRecStore {
 	return gormRecStore{db: db}
 }
 
+func (s gormRecStore) ping(ctx context.Context) error {
+	return pingGormDB(ctx, s.db)
+}
+
 func (s gormRecStore) readRecs(
 	tag string,
 ) ([]rec, error) {
 	var sqlResult []gormRec
 	db := s.db
 	if tag != "" {
-		db = db.Where(datatypes.JSONQuery("tags").HasKey(tag))
+		db = db.Where(hasTag{tag: tag})
 	}
 	err := db.Order("dis").Find(&sqlResult).Error
 	if err != nil {
@@ -45,7 +448,7 @@ func (s gormRecStore) readRecs(
 
 	result := []rec{}
 	for _, sqlRow := range sqlResult {
-		result = append(result, rec(sqlRow))
+		result = append(result, sqlRow.toRec())
 	}
 	return result, nil
 }
@@ -58,50 +461,280 @@ func (s gormRecStore) readRec(
 	if err != nil {
 		return nil, err
 	}
-	rec := rec(gormRec)
+	rec := gormRec.toRec()
 	return &rec, nil
 }
 
 func (s gormRecStore) createRec(
 	rec rec,
+	audit recAudit,
 ) error {
-	gormRec := gormRec(rec)
-	return s.db.Create(&gormRec).Error
+	return s.db.Transaction(func(tx *gorm.DB) error {
+		rec.DeletedAt = nil
+		gormRec := newGormRec(rec)
+		gormRec.Version = 1
+		err := tx.Create(&gormRec).Error
+		if err != nil {
+			return err
+		}
+		created := gormRec.toRec()
+		return createGormRevision(tx, audit.revision(rec.ID, revisionActionCreate, nil, &created))
+	})
 }
 
 func (s gormRecStore) updateRec(
 	id uuid.UUID,
-	rec rec,
+	update rec,
+	audit recAudit,
 ) error {
-	var gormRec gormRec
-	err := s.db.First(&gormRec, id).Error
+	var existing gormRec
+	err := s.db.First(&existing, id).Error
 	if err != nil {
 		return err
 	}
 
-	if rec.Dis != nil {
-		gormRec.Dis = rec.Dis
+	if update.Version != 0 && update.Version != existing.Version {
+		return errVersionConflict
+	}
+
+	// Replacing against the version we read detects changes made since.
+	return s.replaceRec(applyRecUpdate(existing.toRec(), update), audit)
+}
+
+func (s gormRecStore) replaceRec(rec rec, audit recAudit) error {
+	return s.db.Transaction(func(tx *gorm.DB) error {
+		var existing gormRec
+		err := tx.First(&existing, "id = ?", rec.ID).Error
+		if errors.Is(err, gorm.ErrRecordNotFound) && rec.Version != 0 {
+			return errVersionConflict
+		}
+		if err != nil {
+			return err
+		}
+		if rec.Version != 0 && rec.Version != existing.Version {
+			return errVersionConflict
+		}
+
+		// Conditioning on the version we read locks the rec, and ensures the revision has what it replaced
+		result := tx.Model(&gormRec{}).Where("id = ? AND version = ?", rec.ID, existing.Version).Updates(map[string]interface{}{
+			"tags":    rec.Tags,
+			"dis":     rec.Dis,
+			"unit":    rec.Unit,
+			"version": gorm.Expr("version + 1"),
+		})
+		if result.Error != nil {
+			return result.Error
+		}
+		if result.RowsAffected == 0 {
+			return errVersionConflict
+		}
+		before := existing.toRec()
+		after := rec
+		after.Version = existing.Version + 1
+		after.DeletedAt = nil
+		return createGormRevision(tx, audit.revision(rec.ID, revisionActionUpdate, &before, &after))
+	})
+}
+
+func (s gormRecStore) deleteRec(id uuid.UUID, version int64, audit recAudit) error {
+	return s.db.Transaction(func(tx *gorm.DB) error {
+		var existing []gormRec
+		err := tx.Where("id = ?", id).Limit(1).Find(&existing).Error
+		if err != nil {
+			return err
+		}
+		if len(existing) == 0 || (version != 0 && version != existing[0].Version) {
+			if version != 0 {
+				return errVersionConflict
+			}
+			// Deleting a missing rec is not an error, but there is nothing to record
+			return nil
+		}
+
+		result := tx.Where("id = ? AND version = ?", id, existing[0].Version).Delete(&gormRec{})
+		if result.Error != nil {
+			return result.Error
+		}
+		if result.RowsAffected == 0 {
+			if version != 0 {
+				return errVersionConflict
+			}
+			return nil
+		}
+		before := existing[0].toRec()
+		return createGormRevision(tx, audit.revision(id, revisionActionDelete, &before, nil))
+	})
+}
+
+func (s gormRecStore) upsertRecs(recs []rec, dryRun bool, audit recAudit) (bulkResult, error) {
+	result := newBulkResult(dryRun)
+	err := s.db.Transaction(func(tx *gorm.DB) error {
+		for _, upserted := range recs {
+			var existing []gormRec
+			err := tx.Unscoped().Where("id = ?", upserted.ID).Limit(1).Find(&existing).Error
+			if err != nil {
+				return err
+			}
+
+			upserted.DeletedAt = nil
+			gormRec := newGormRec(upserted)
+			var before *rec
+			if len(existing) > 0 {
+				// Recs in the trash are brought back, but count as created since they were not visible.
+				gormRec.Version = existing[0].Version + 1
+				if existing[0].DeletedAt.Valid {
+					result.Created = append(result.Created, upserted.ID)
+				} else {
+					result.Updated = append(result.Updated, upserted.ID)
+					existingRec := existing[0].toRec()
+					before = &existingRec
+				}
+				if !dryRun {
+					err = tx.Unscoped().Save(&gormRec).Error
+				}
+			} else {
+				result.Created = append(result.Created, upserted.ID)
+				gormRec.Version = 1
+				if !dryRun {
+					err = tx.Create(&gormRec).Error
+				}
+			}
+			if err != nil {
+				return err
+			}
+			if !dryRun {
+				after := gormRec.toRec()
+				err = createGormRevision(tx, audit.revision(upserted.ID, audit.upsertAction(before), before, &after))
+				if err != nil {
+					return err
+				}
+			}
+		}
+		return nil
+	})
+	if err != nil {
+		return newBulkResult(dryRun), err
 	}
-	if rec.Unit != nil {
-		gormRec.Unit = rec.Unit
+	return result, nil
+}
+
+func (s gormRecStore) readDeletedRecs() ([]rec, error) {
+	var sqlResult []gormRec
+	err := s.db.Unscoped().Where("deleted_at IS NOT NULL").Order("deleted_at").Find(&sqlResult).Error
+	if err != nil {
+		return []rec{}, err
 	}
-	if rec.Tags != nil {
-		gormRec.Tags = rec.Tags
+
+	result := []rec{}
+	for _, sqlRow := range sqlResult {
+		result = append(result, sqlRow.toRec())
 	}
-	return s.db.Save(&gormRec).Error
+	return result, nil
+}
+
+func (s gormRecStore) isRecDeleted(id uuid.UUID) (bool, error) {
+	var count int64
+	err := s.db.Unscoped().Model(&gormRec{}).Where("id = ? AND deleted_at IS NOT NULL", id).Count(&count).Error
+	return count > 0, err
 }
 
-func (s gormRecStore) deleteRec(id uuid.UUID) error {
-	return s.db.Delete(&gormRec{}, id).Error
+func (s gormRecStore) undeleteRec(id uuid.UUID, audit recAudit) error {
+	return s.db.Transaction(func(tx *gorm.DB) error {
+		result := tx.Unscoped().Model(&gormRec{}).
+			Where("id = ? AND deleted_at IS NOT NULL", id).
+			Updates(map[string]interface{}{
+				"deleted_at": nil,
+				"version":    gorm.Expr("version + 1"),
+			})
+		if result.Error != nil {
+			return result.Error
+		}
+		if result.RowsAffected == 0 {
+			return gorm.ErrRecordNotFound
+		}
+		var restored gormRec
+		err := tx.First(&restored, "id = ?", id).Error
+		if err != nil {
+			return err
+		}
+		after := restored.toRec()
+		return createGormRevision(tx, audit.revision(id, revisionActionRestore, nil, &after))
+	})
+}
+
+func (s gormRecStore) purgeRec(id uuid.UUID) error {
+	return s.db.Unscoped().Delete(&gormRec{}, "id = ?", id).Error
+}
+
+// hasTag is a condition matching recs that have the tag, whatever its value. On SQLite and MySQL,
+// datatypes.JSONQuery does not match tags whose value is null, and reads dots in tag names as nested keys, so the tag
+// is quoted in the JSON path and its existence is checked directly.
+type hasTag struct {
+	tag string
+}
+
+func (h hasTag) Build(builder clause.Builder) {
+	stmt, ok := builder.(*gorm.Statement)
+	if !ok {
+		return
+	}
+	path := `$."` + strings.ReplaceAll(h.tag, `"`, `\"`) + `"`
+	switch stmt.Dialector.Name() {
+	case "sqlite":
+		builder.WriteString("json_type(")
+		builder.WriteQuoted("tags")
+		builder.WriteString(", ")
+		builder.AddVar(stmt, path)
+		builder.WriteString(") IS NOT NULL")
+	case "mysql":
+		builder.WriteString("JSON_CONTAINS_PATH(")
+		builder.WriteQuoted("tags")
+		builder.WriteString(", 'one', ")
+		builder.AddVar(stmt, path)
+		builder.WriteString(")")
+	default:
+		datatypes.JSONQuery("tags").HasKey(h.tag).Build(builder)
+	}
 }
 
 type gormRec struct {
-	ID   uuid.UUID         `gorm:"column:id;type:uuid;primaryKey:rec_pkey"`
-	Tags datatypes.JSONMap `gorm:"type:json"`
-	Dis  *string
-	Unit *string
+	ID        uuid.UUID         `gorm:"column:id;type:uuid;primaryKey:rec_pkey"`
+	Tags      datatypes.JSONMap `gorm:"type:json"`
+	Dis       *string
+	Unit      *string
+	Version   int64          `gorm:"not null;default:1"`
+	DeletedAt gorm.DeletedAt `gorm:"index"`
 }
 
 func (r gormRec) TableName() string {
 	return "rec"
 }
+
+func newGormRec(rec rec) gormRec {
+	result := gormRec{
+		ID:      rec.ID,
+		Tags:    rec.Tags,
+		Dis:     rec.Dis,
+		Unit:    rec.Unit,
+		Version: rec.Version,
+	}
+	if rec.DeletedAt != nil {
+		result.DeletedAt = gorm.DeletedAt{Time: *rec.DeletedAt, Valid: true}
+	}
+	return result
+}
+
+func (r gormRec) toRec() rec {
+	result := rec{
+		ID:      r.ID,
+		Tags:    r.Tags,
+		Dis:     r.Dis,
+		Unit:    r.Unit,
+		Version: r.Version,
+	}
+	if r.DeletedAt.Valid {
+		deletedAt := r.DeletedAt.Time
+		result.DeletedAt = &deletedAt
+	}
+	return result
+}
@@ -0,0 +1,263 @@
+package main
+
+import (
+	"path/filepath"
+	"testing"
+
+	"github.com/google/uuid"
+	"github.com/stretchr/testify/assert"
+	"gorm.io/datatypes"
+	"gorm.io/gorm"
+)
+
+// TestRecStores runs the same behaviour against every rec store implementation.
+func TestRecStores(t *testing.T) {
+	stores := map[string]func(t *testing.T) (recStore, revisionStore){
+		"memory": func(t *testing.T) (recStore, revisionStore) {
+			store, err := newInMemoryRecStore("")
+			assert.Nil(t, err)
+			return store, store
+		},
+	}
+	for name, db := range testDatabases(t) {
+		stores[name] = func(t *testing.T) (recStore, revisionStore) {
+			err := db.Unscoped().Where("1 = 1").Delete(&gormRec{}).Error
+			assert.Nil(t, err)
+			err = db.Where("1 = 1").Delete(&gormRecRevision{}).Error
+			assert.Nil(t, err)
+			return newGormRecStore(db), newGormRevisionStore(db)
+		}
+	}
+	for name, newStore := range stores {
+		t.Run(name, func(t *testing.T) {
+			store, revisions := newStore(t)
+			testRecStore(t, store, revisions)
+		})
+	}
+}
+
+// testRecStore tests the rec store, and that its changes are recorded in the revision store.
+func testRecStore(t *testing.T, store recStore, revisions revisionStore) {
+	audit := recAudit{Username: "test"}
+	ahu := rec{ID: uuid.New(), Tags: datatypes.JSONMap{"equip": true, "site": "a"}, Dis: s("AHU")}
+	boiler := rec{ID: uuid.New(), Tags: datatypes.JSONMap{"equip": true}, Dis: s("Boiler"), Unit: s("kW")}
+	chiller := rec{ID: uuid.New(), Tags: datatypes.JSONMap{"point": true}, Dis: s("Chiller")}
+
+	// Recs start at version 1, and their IDs are unique
+	for _, rec := range []rec{chiller, ahu, boiler} {
+		err := store.createRec(rec, audit)
+		assert.Nil(t, err)
+	}
+	err := store.createRec(ahu, audit)
+	assert.ErrorIs(t, err, gorm.ErrDuplicatedKey)
+	read, err := store.readRec(boiler.ID)
+	assert.Nil(t, err)
+	assert.Equal(t, boiler.Tags, read.Tags)
+	assert.Equal(t, "kW", *read.Unit)
+	assert.Equal(t, int64(1), read.Version)
+	assert.Nil(t, read.DeletedAt)
+	_, err = store.readRec(uuid.New())
+	assert.ErrorIs(t, err, gorm.ErrRecordNotFound)
+
+	// Recs are read in dis order, and filtered by tag
+	assertRecs := func(tag string, expected ...rec) {
+		recs, err := store.readRecs(tag)
+		assert.Nil(t, err)
+		assert.NotNil(t, recs)
+		ids := []uuid.UUID{}
+		for _, rec := range recs {
+			ids = append(ids, rec.ID)
+		}
+		expectedIds := []uuid.UUID{}
+		for _, rec := range expected {
+			expectedIds = append(expectedIds, rec.ID)
+		}
+		assert.Equal(t, expectedIds, ids)
+	}
+	assertRecs("", ahu, boiler, chiller)
+	assertRecs("equip", ahu, boiler)
+	assertRecs("missing")
+
+	// Updates apply the set fields, against the current version if given
+	err = store.updateRec(ahu.ID, rec{Unit: s("°C"), Version: 1}, audit)
+	assert.Nil(t, err)
+	err = store.updateRec(ahu.ID, rec{Unit: s("°F"), Version: 1}, audit)
+	assert.ErrorIs(t, err, errVersionConflict)
+	err = store.updateRec(uuid.New(), rec{Unit: s("°F")}, audit)
+	assert.ErrorIs(t, err, gorm.ErrRecordNotFound)
+	read, err = store.readRec(ahu.ID)
+	assert.Nil(t, err)
+	assert.Equal(t, "AHU", *read.Dis)
+	assert.Equal(t, "°C", *read.Unit)
+	assert.Equal(t, int64(2), read.Version)
+
+	// Replaces set every field
+	err = store.replaceRec(rec{ID: ahu.ID, Tags: datatypes.JSONMap{"equip": true}, Dis: s("AHU-1"), Version: 2}, audit)
+	assert.Nil(t, err)
+	err = store.replaceRec(rec{ID: ahu.ID, Dis: s("AHU-2"), Version: 2}, audit)
+	assert.ErrorIs(t, err, errVersionConflict)
+	err = store.replaceRec(rec{ID: uuid.New(), Dis: s("Missing")}, audit)
+	assert.ErrorIs(t, err, gorm.ErrRecordNotFound)
+	read, err = store.readRec(ahu.ID)
+	assert.Nil(t, err)
+	assert.Equal(t, datatypes.JSONMap{"equip": true}, read.Tags)
+	assert.Equal(t, "AHU-1", *read.Dis)
+	assert.Nil(t, read.Unit)
+	assert.Equal(t, int64(3), read.Version)
+
+	// Deleted recs are moved to the trash, hidden from other reads, and keep their IDs
+	err = store.deleteRec(boiler.ID, 2, audit)
+	assert.ErrorIs(t, err, errVersionConflict)
+	err = store.deleteRec(boiler.ID, 1, audit)
+	assert.Nil(t, err)
+	err = store.deleteRec(chiller.ID, 0, audit)
+	assert.Nil(t, err)
+	err = store.deleteRec(uuid.New(), 0, audit)
+	assert.Nil(t, err)
+	_, err = store.readRec(boiler.ID)
+	assert.ErrorIs(t, err, gorm.ErrRecordNotFound)
+	assertRecs("", ahu)
+	err = store.updateRec(boiler.ID, rec{Unit: s("W")}, audit)
+	assert.ErrorIs(t, err, gorm.ErrRecordNotFound)
+	err = store.createRec(boiler, audit)
+	assert.ErrorIs(t, err, gorm.ErrDuplicatedKey)
+	isDeleted, err := store.isRecDeleted(boiler.ID)
+	assert.Nil(t, err)
+	assert.True(t, isDeleted)
+	isDeleted, err = store.isRecDeleted(ahu.ID)
+	assert.Nil(t, err)
+	assert.False(t, isDeleted)
+	deleted, err := store.readDeletedRecs()
+	assert.Nil(t, err)
+	assert.Len(t, deleted, 2)
+	for _, rec := range deleted {
+		assert.NotNil(t, rec.DeletedAt)
+	}
+
+	// Undeleting brings the rec back, only from the trash
+	err = store.undeleteRec(chiller.ID, audit)
+	assert.Nil(t, err)
+	err = store.undeleteRec(chiller.ID, audit)
+	assert.ErrorIs(t, err, gorm.ErrRecordNotFound)
+	read, err = store.readRec(chiller.ID)
+	assert.Nil(t, err)
+	assert.Nil(t, read.DeletedAt)
+	assert.Equal(t, int64(2), read.Version)
+
+	// Upserts create new recs and replace existing ones. Recs in the trash are brought back, and count as created.
+	damper := rec{ID: uuid.New(), Tags: datatypes.JSONMap{"point": true}, Dis: s("Damper")}
+	imported := []rec{damper, {ID: ahu.ID, Dis: s("AHU-2")}, boiler}
+	result, err := store.upsertRecs(imported, true, audit)
+	assert.Nil(t, err)
+	assert.True(t, result.DryRun)
+	assert.ElementsMatch(t, []uuid.UUID{damper.ID, boiler.ID}, result.Created)
+	assert.Equal(t, []uuid.UUID{ahu.ID}, result.Updated)
+	assertRecs("", ahu, chiller)
+	result, err = store.upsertRecs(imported, false, audit)
+	assert.Nil(t, err)
+	assert.False(t, result.DryRun)
+	assert.ElementsMatch(t, []uuid.UUID{damper.ID, boiler.ID}, result.Created)
+	assert.Equal(t, []uuid.UUID{ahu.ID}, result.Updated)
+	assertRecs("", ahu, boiler, chiller, damper)
+	read, err = store.readRec(ahu.ID)
+	assert.Nil(t, err)
+	assert.Equal(t, "AHU-2", *read.Dis)
+	assert.Equal(t, int64(4), read.Version)
+	read, err = store.readRec(boiler.ID)
+	assert.Nil(t, err)
+	assert.Equal(t, int64(2), read.Version)
+	read, err = store.readRec(damper.ID)
+	assert.Nil(t, err)
+	assert.Equal(t, int64(1), read.Version)
+
+	// Purging removes the rec, from the trash or not
+	err = store.deleteRec(damper.ID, 0, audit)
+	assert.Nil(t, err)
+	err = store.purgeRec(damper.ID)
+	assert.Nil(t, err)
+	err = store.purgeRec(chiller.ID)
+	assert.Nil(t, err)
+	deleted, err = store.readDeletedRecs()
+	assert.Nil(t, err)
+	assert.Len(t, deleted, 0)
+	assertRecs("", ahu, boiler)
+	err = store.createRec(damper, audit)
+	assert.Nil(t, err)
+
+	// Every change is recorded, including the fields before and after, but failed changes are not
+	assertRevisions := func(id uuid.UUID, actions ...string) []recRevision {
+		read, err := revisions.readRevisions(id)
+		assert.Nil(t, err)
+		recorded := []string{}
+		for i, revision := range read {
+			assert.Equal(t, i+1, revision.Revision)
+			assert.Equal(t, "test", revision.Username)
+			recorded = append(recorded, revision.Action)
+		}
+		assert.Equal(t, actions, recorded)
+		return read
+	}
+	ahuRevisions := assertRevisions(ahu.ID, revisionActionCreate, revisionActionUpdate, revisionActionUpdate, revisionActionUpdate)
+	assert.Nil(t, ahuRevisions[0].Before)
+	assert.Equal(t, "AHU-1", *ahuRevisions[3].Before.Dis)
+	assert.Equal(t, "AHU-2", *ahuRevisions[3].After.Dis)
+	assert.Equal(t, []recChange{{Field: "dis", Before: "AHU-1", After: "AHU-2"}, {Field: "tags.equip", Before: true}}, ahuRevisions[3].Changes)
+	assertRevisions(boiler.ID, revisionActionCreate, revisionActionDelete, revisionActionCreate)
+	assertRevisions(chiller.ID, revisionActionCreate, revisionActionDelete, revisionActionRestore)
+	assertRevisions(damper.ID, revisionActionCreate, revisionActionDelete, revisionActionCreate)
+	revision, err := revisions.readRevision(boiler.ID, 2)
+	assert.Nil(t, err)
+	assert.Equal(t, "Boiler", *revision.Before.Dis)
+	assert.Nil(t, revision.After)
+	_, err = revisions.readRevision(boiler.ID, 4)
+	assert.ErrorIs(t, err, gorm.ErrRecordNotFound)
+
+	// Upserts may record another action, such as a restore
+	audit.Action = revisionActionRestore
+	_, err = store.upsertRecs([]rec{{ID: ahu.ID, Dis: s("AHU-1")}}, false, audit)
+	assert.Nil(t, err)
+	assertRevisions(ahu.ID, revisionActionCreate, revisionActionUpdate, revisionActionUpdate, revisionActionUpdate, revisionActionRestore)
+}
+
+func TestInMemoryRecStoreSnapshot(t *testing.T) {
+	snapshotFile := filepath.Join(t.TempDir(), "recs.json")
+	store, err := newInMemoryRecStore(snapshotFile)
+	assert.Nil(t, err)
+	audit := recAudit{}
+	point := rec{ID: uuid.New(), Tags: datatypes.JSONMap{"point": true, "precision": 2}, Dis: s("Point")}
+	deleted := rec{ID: uuid.New(), Tags: datatypes.JSONMap{}, Dis: s("Deleted")}
+	for _, rec := range []rec{point, deleted} {
+		err = store.createRec(rec, audit)
+		assert.Nil(t, err)
+	}
+	err = store.updateRec(point.ID, rec{Unit: s("kW")}, audit)
+	assert.Nil(t, err)
+	err = store.deleteRec(deleted.ID, 0, audit)
+	assert.Nil(t, err)
+
+	// Changing a written or read rec does not change the stored one
+	point.Tags["point"] = false
+	read, err := store.readRec(point.ID)
+	assert.Nil(t, err)
+	read.Tags["point"] = false
+	*read.Dis = "Changed"
+
+	err = store.snapshot()
+	assert.Nil(t, err)
+	restored, err := newInMemoryRecStore(snapshotFile)
+	assert.Nil(t, err)
+	read, err = restored.readRec(point.ID)
+	assert.Nil(t, err)
+	assert.Equal(t, true, read.Tags["point"])
+	assert.Equal(t, "Point", *read.Dis)
+	assert.Equal(t, "kW", *read.Unit)
+	assert.Equal(t, int64(2), read.Version)
+	deletedRecs, err := restored.readDeletedRecs()
+	assert.Nil(t, err)
+	assert.Len(t, deletedRecs, 1)
+	assert.Equal(t, deleted.ID, deletedRecs[0].ID)
+	revisions, err := restored.readRevisions(point.ID)
+	assert.Nil(t, err)
+	assert.Len(t, revisions, 2)
+	assert.Equal(t, "kW", *revisions[1].After.Unit)
+}
@@ -0,0 +1,122 @@
+package main
+
+import (
+	"time"
+
+	"github.com/google/uuid"
+	"gorm.io/gorm"
+)
+
+// refreshTokenStore is able to store refresh tokens. Only the hashes of the secrets are stored.
+type refreshTokenStore interface {
+	createRefreshToken(refreshToken, string) error
+	// readRefreshTokenByHash returns the token with the secret hash, whether or not it is usable.
+	readRefreshTokenByHash(string) (*refreshToken, error)
+	// useRefreshToken marks the token as used, returning false if it already was.
+	useRefreshToken(uuid.UUID, time.Time) (bool, error)
+	// revokeRefreshTokenFamily revokes the token and every token it was rotated from or into.
+	revokeRefreshTokenFamily(uuid.UUID, time.Time) error
+	// revokeUserRefreshTokens revokes every token of the user.
+	revokeUserRefreshTokens(string, time.Time) error
+}
+
+// refreshToken can be exchanged once for a new access token and refresh token. Tokens that descend from the same
+// login share a family, so that they can be revoked together.
+type refreshToken struct {
+	ID        uuid.UUID
+	FamilyID  uuid.UUID
+	Username  string
+	Role      string
+	CreatedAt time.Time
+	ExpiresAt time.Time
+	UsedAt    *time.Time
+	RevokedAt *time.Time
+}
+
+// refreshTokenInput is the body used to refresh or revoke a refresh token.
+type refreshTokenInput struct {
+	RefreshToken string `json:"refreshToken"`
+}
+
+// gormRefreshTokenStore stores refresh tokens in a GORM database.
+type gormRefreshTokenStore struct {
+	db *gorm.DB
+}
+
+func newGormRefreshTokenStore(db *gorm.DB) gormRefreshTokenStore {
+	return gormRefreshTokenStore{db: db}
+}
+
+func (s gormRefreshTokenStore) createRefreshToken(token refreshToken, hash string) error {
+	return s.db.Create(&gormRefreshToken{
+		ID:        token.ID,
+		FamilyID:  token.FamilyID,
+		Hash:      hash,
+		Username:  token.Username,
+		Role:      token.Role,
+		CreatedAt: token.CreatedAt,
+		ExpiresAt: token.ExpiresAt,
+	}).Error
+}
+
+func (s gormRefreshTokenStore) readRefreshTokenByHash(hash string) (*refreshToken, error) {
+	var gormRefreshToken gormRefreshToken
+	err := s.db.First(&gormRefreshToken, "hash = ?", hash).Error
+	if err != nil {
+		return nil, err
+	}
+	token := gormRefreshToken.toRefreshToken()
+	return &token, nil
+}
+
+func (s gormRefreshTokenStore) useRefreshToken(id uuid.UUID, usedAt time.Time) (bool, error) {
+	// Conditioning on used_at makes concurrent uses of the same token fail.
+	result := s.db.Model(&gormRefreshToken{}).
+		Where("id = ? AND used_at IS NULL", id).
+		Update("used_at", usedAt)
+	if result.Error != nil {
+		return false, result.Error
+	}
+	return result.RowsAffected > 0, nil
+}
+
+func (s gormRefreshTokenStore) revokeRefreshTokenFamily(familyID uuid.UUID, revokedAt time.Time) error {
+	return s.db.Model(&gormRefreshToken{}).
+		Where("family_id = ? AND revoked_at IS NULL", familyID).
+		Update("revoked_at", revokedAt).Error
+}
+
+func (s gormRefreshTokenStore) revokeUserRefreshTokens(username string, revokedAt time.Time) error {
+	return s.db.Model(&gormRefreshToken{}).
+		Where("username = ? AND revoked_at IS NULL", username).
+		Update("revoked_at", revokedAt).Error
+}
+
+type gormRefreshToken struct {
+	ID        uuid.UUID `gorm:"column:id;type:uuid;primaryKey"`
+	FamilyID  uuid.UUID `gorm:"type:uuid;not null;index"`
+	Hash      string    `gorm:"not null;uniqueIndex"`
+	Username  string    `gorm:"not null"`
+	Role      string
+	CreatedAt time.Time
+	ExpiresAt time.Time
+	UsedAt    *time.Time
+	RevokedAt *time.Time
+}
+
+func (gormRefreshToken) TableName() string {
+	return "refresh_token"
+}
+
+func (t gormRefreshToken) toRefreshToken() refreshToken {
+	return refreshToken{
+		ID:        t.ID,
+		FamilyID:  t.FamilyID,
+		Username:  t.Username,
+		Role:      t.Role,
+		CreatedAt: t.CreatedAt,
+		ExpiresAt: t.ExpiresAt,
+		UsedAt:    t.UsedAt,
+		RevokedAt: t.RevokedAt,
+	}
+}
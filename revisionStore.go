@@ -0,0 +1,239 @@
+package main
+
+import (
+	"encoding/json"
+	"reflect"
+	"sort"
+	"time"
+
+	"github.com/google/uuid"
+	"gorm.io/datatypes"
+	"gorm.io/gorm"
+)
+
+// revisionStore is able to read the change history of recs. Revisions are written by the rec store, alongside the
+// changes they record, so that a change is never made without its revision.
+type revisionStore interface {
+	readRevisions(uuid.UUID) ([]recRevision, error)
+	readRevision(uuid.UUID, int) (*recRevision, error)
+}
+
+// Actions that a revision may record.
+const (
+	revisionActionCreate  = "create"
+	revisionActionUpdate  = "update"
+	revisionActionDelete  = "delete"
+	revisionActionRestore = "restore"
+)
+
+// recRevision records a single change to a rec. Before is nil for creations, and After is nil for deletions.
+type recRevision struct {
+	RecID    uuid.UUID   `json:"recId"`
+	Revision int         `json:"revision"`
+	Action   string      `json:"action"`
+	Username string      `json:"username"`
+	Ts       time.Time   `json:"ts"`
+	Before   *rec        `json:"before"`
+	After    *rec        `json:"after"`
+	Changes  []recChange `json:"changes"`
+}
+
+// recAudit identifies the request changing recs, so that the rec store can record its revisions.
+type recAudit struct {
+	Username string
+	// Action overrides the action recorded by upsertRecs, which otherwise records creations and updates.
+	Action string
+}
+
+// revision returns the revision recording a change to the rec made now.
+func (a recAudit) revision(id uuid.UUID, action string, before *rec, after *rec) recRevision {
+	return recRevision{
+		RecID:    id,
+		Action:   action,
+		Username: a.Username,
+		Ts:       time.Now(),
+		Before:   before,
+		After:    after,
+	}
+}
+
+// upsertAction returns the action recorded for an upsert of a rec, which had the before fields if it was visible.
+func (a recAudit) upsertAction(before *rec) string {
+	if a.Action != "" {
+		return a.Action
+	}
+	if before == nil {
+		return revisionActionCreate
+	}
+	return revisionActionUpdate
+}
+
+// recChange is a single field difference between two versions of a rec. Tag fields are named `tags.<name>`.
+type recChange struct {
+	Field  string      `json:"field"`
+	Before interface{} `json:"before"`
+	After  interface{} `json:"after"`
+}
+
+// diffRecs returns the field differences between two versions of a rec, in field name order.
+// A nil rec is treated as having no fields.
+func diffRecs(before *rec, after *rec) []recChange {
+	fields := func(r *rec) map[string]interface{} {
+		result := map[string]interface{}{}
+		if r == nil {
+			return result
+		}
+		if r.Dis != nil {
+			result["dis"] = *r.Dis
+		}
+		if r.Unit != nil {
+			result["unit"] = *r.Unit
+		}
+		for name, value := range r.Tags {
+			result["tags."+name] = value
+		}
+		return result
+	}
+	beforeFields := fields(before)
+	afterFields := fields(after)
+
+	names := map[string]bool{}
+	for name := range beforeFields {
+		names[name] = true
+	}
+	for name := range afterFields {
+		names[name] = true
+	}
+
+	changes := []recChange{}
+	for name := range names {
+		beforeValue := beforeFields[name]
+		afterValue := afterFields[name]
+		if !jsonEqual(beforeValue, afterValue) {
+			changes = append(changes, recChange{Field: name, Before: beforeValue, After: afterValue})
+		}
+	}
+	sort.Slice(changes, func(i, j int) bool {
+		return changes[i].Field < changes[j].Field
+	})
+	return changes
+}
+
+// jsonEqual compares values by their JSON encoding, so that numbers match regardless of how they were decoded.
+func jsonEqual(a interface{}, b interface{}) bool {
+	aJson, aErr := json.Marshal(a)
+	bJson, bErr := json.Marshal(b)
+	if aErr != nil || bErr != nil {
+		return reflect.DeepEqual(a, b)
+	}
+	return string(aJson) == string(bJson)
+}
+
+// gormRevisionStore stores rec revisions in a GORM database.
+type gormRevisionStore struct {
+	db *gorm.DB
+}
+
+func newGormRevisionStore(db *gorm.DB) gormRevisionStore {
+	return gormRevisionStore{db: db}
+}
+
+func (s gormRevisionStore) readRevisions(recID uuid.UUID) ([]recRevision, error) {
+	var sqlResult []gormRecRevision
+	err := s.db.Where("rec_id = ?", recID).Order("revision").Find(&sqlResult).Error
+	if err != nil {
+		return []recRevision{}, err
+	}
+
+	result := []recRevision{}
+	for _, sqlRow := range sqlResult {
+		revision, err := sqlRow.toRevision()
+		if err != nil {
+			return []recRevision{}, err
+		}
+		result = append(result, revision)
+	}
+	return result, nil
+}
+
+func (s gormRevisionStore) readRevision(recID uuid.UUID, number int) (*recRevision, error) {
+	var gormRecRevision gormRecRevision
+	err := s.db.First(&gormRecRevision, "rec_id = ? AND revision = ?", recID, number).Error
+	if err != nil {
+		return nil, err
+	}
+	revision, err := gormRecRevision.toRevision()
+	if err != nil {
+		return nil, err
+	}
+	return &revision, nil
+}
+
+// createGormRevision stores the revision in the transaction of the change it records, numbering it after the latest
+// revision of the same rec. The change must lock the rec first, so that concurrent changes to it are numbered in turn.
+func createGormRevision(tx *gorm.DB, revision recRevision) error {
+	before, err := json.Marshal(revision.Before)
+	if err != nil {
+		return err
+	}
+	after, err := json.Marshal(revision.After)
+	if err != nil {
+		return err
+	}
+
+	var latest *int
+	err = tx.Model(&gormRecRevision{}).
+		Where("rec_id = ?", revision.RecID).
+		Select("MAX(revision)").
+		Scan(&latest).Error
+	if err != nil {
+		return err
+	}
+	number := 1
+	if latest != nil {
+		number = *latest + 1
+	}
+	return tx.Create(&gormRecRevision{
+		RecID:    revision.RecID,
+		Revision: number,
+		Action:   revision.Action,
+		Username: revision.Username,
+		Ts:       revision.Ts,
+		Before:   datatypes.JSON(before),
+		After:    datatypes.JSON(after),
+	}).Error
+}
+
+type gormRecRevision struct {
+	RecID    uuid.UUID `gorm:"column:rec_id;type:uuid;primaryKey"`
+	Revision int       `gorm:"primaryKey;autoIncrement:false"`
+	Action   string
+	Username string
+	Ts       time.Time
+	Before   datatypes.JSON `gorm:"type:json"`
+	After    datatypes.JSON `gorm:"type:json"`
+}
+
+func (gormRecRevision) TableName() string {
+	return "rec_revision"
+}
+
+func (r gormRecRevision) toRevision() (recRevision, error) {
+	revision := recRevision{
+		RecID:    r.RecID,
+		Revision: r.Revision,
+		Action:   r.Action,
+		Username: r.Username,
+		Ts:       r.Ts,
+	}
+	err := json.Unmarshal(r.Before, &revision.Before)
+	if err != nil {
+		return recRevision{}, err
+	}
+	err = json.Unmarshal(r.After, &revision.After)
+	if err != nil {
+		return recRevision{}, err
+	}
+	revision.Changes = diffRecs(revision.Before, revision.After)
+	return revision, nil
+}
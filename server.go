@@ -2,6 +2,9 @@ package main
 
 import (
 	"net/http"
+	"net/netip"
+	"sync/atomic"
+	"time"
 
 	"go.opentelemetry.io/contrib/instrumentation/net/http/otelhttp"
 )
@@ -9,14 +12,52 @@ import (
 type ServerConfig struct {
 	// Auth
 	authenticator        authenticator
-	apiKey               string
 	jwtSecret            string
 	tokenDurationSeconds int
+	// externalTokenVerifier is optional. If set, JWTs from an external identity provider are accepted.
+	externalTokenVerifier *externalTokenVerifier
+	// tokenDenylist stores the IDs of JWTs that have been revoked by logging out.
+	tokenDenylist tokenDenylist
+	// refreshTokenStore is optional. If set, refresh tokens are issued with access tokens.
+	refreshTokenStore    refreshTokenStore
+	refreshTokenDuration time.Duration
+	// loginLimiter is optional. If set, clients and usernames are locked out after repeated failed logins.
+	loginLimiter *loginLimiter
+	// trustedProxies are the proxies whose X-Forwarded-For header is used for the client IP of logins.
+	trustedProxies []netip.Prefix
+	// requestLimiter is optional. If set, it limits the request rate of each user and API key.
+	requestLimiter *requestLimiter
+	// clientCertificateRoles maps the common names of verified TLS client certificates to roles. Certificates that
+	// are not mapped are not accepted.
+	clientCertificateRoles map[string]string
 
 	// Stores
-	historyStore historyStore
-	recStore     recStore
-	currentStore currentStore
+	historyStore  historyStore
+	recStore      recStore
+	currentStore  currentStore
+	tagDefStore   tagDefStore
+	revisionStore revisionStore
+	// userStore is optional. If set, admins can manage users.
+	userStore userStore
+	// apiKeyStore is optional. If set, requests may authenticate with API keys, and admins can manage them.
+	apiKeyStore apiKeyStore
+	// accessPolicyStore is optional. If set, admins can restrict the recs that users and API keys may access.
+	accessPolicyStore accessPolicyStore
+	// allowWithoutAccessPolicies is whether users and API keys without access policies may access every rec. If not,
+	// they may access none, unless they are admins.
+	allowWithoutAccessPolicies bool
+
+	// Deletion
+	// ingester is optional. If set, its subscriptions are refreshed when recs are deleted.
+	ingester *ingester
+	// trashRetention is how long deleted recs are kept before being purged. If zero, they are purged immediately.
+	trashRetention time.Duration
+
+	// Health
+	// dependencies are pinged by the health endpoints, in addition to the stores that support it.
+	dependencies map[string]pinger
+	// shuttingDown is optional. If set, readiness fails once it is true.
+	shuttingDown *atomic.Bool
 }
 
 func NewServer(serverConfig ServerConfig) (http.Handler, error) {
@@ -28,37 +69,133 @@ func NewServer(serverConfig ServerConfig) (http.Handler, error) {
 		jwtSecret:            serverConfig.jwtSecret,
 		tokenDurationSeconds: serverConfig.tokenDurationSeconds,
 		authenticator:        serverConfig.authenticator,
+		refreshTokenStore:    serverConfig.refreshTokenStore,
+		refreshTokenDuration: serverConfig.refreshTokenDuration,
+		userStore:            serverConfig.userStore,
+		denylist:             serverConfig.tokenDenylist,
+		loginLimiter:         serverConfig.loginLimiter,
+		trustedProxies:       serverConfig.trustedProxies,
+	}
+	hisController := hisController{store: serverConfig.historyStore, recStore: serverConfig.recStore}
+	recController := recController{
+		store:         serverConfig.recStore,
+		tagDefStore:   serverConfig.tagDefStore,
+		revisionStore: serverConfig.revisionStore,
+		deleter: recDeleter{
+			recStore:       serverConfig.recStore,
+			historyStore:   serverConfig.historyStore,
+			currentStore:   serverConfig.currentStore,
+			ingester:       serverConfig.ingester,
+			trashRetention: serverConfig.trashRetention,
+		},
+	}
+	tagDefController := tagDefController{store: serverConfig.tagDefStore}
+	currentController := currentController{store: serverConfig.currentStore, recStore: serverConfig.recStore}
+	userController := userController{store: serverConfig.userStore, refreshTokenStore: serverConfig.refreshTokenStore}
+	accessPolicyController := accessPolicyController{store: serverConfig.accessPolicyStore}
+	apiKeyController := apiKeyController{store: serverConfig.apiKeyStore}
+	healthController := healthController{
+		dependencies: map[string]pinger{},
+		timeout:      2 * time.Second,
+		shuttingDown: serverConfig.shuttingDown,
+	}
+	for name, store := range map[string]any{
+		"historyStore": serverConfig.historyStore,
+		"recStore":     serverConfig.recStore,
+		"currentStore": serverConfig.currentStore,
+	} {
+		if pinger, ok := store.(pinger); ok {
+			healthController.dependencies[name] = pinger
+		}
+	}
+	for name, pinger := range serverConfig.dependencies {
+		healthController.dependencies[name] = pinger
 	}
-	hisController := hisController{store: serverConfig.historyStore}
-	recController := recController{store: serverConfig.recStore}
-	currentController := currentController{store: serverConfig.currentStore}
 
 	// handleFunc is a replacement for mux.HandleFunc that adds route data to the metrics.
 	handleFunc := func(mux *http.ServeMux, pattern string, handlerFunc func(http.ResponseWriter, *http.Request)) {
 		handler := otelhttp.WithRouteTag(pattern, http.HandlerFunc(handlerFunc))
 		mux.Handle(pattern, handler)
 	}
+	// handleFuncWithScope is like handleFunc, but responds with 403 unless the request has the scope.
+	handleFuncWithScope := func(mux *http.ServeMux, pattern string, scope string, handlerFunc func(http.ResponseWriter, *http.Request)) {
+		handleFunc(mux, pattern, requireScope(scope, handlerFunc))
+	}
 
+	handleFunc(server, "GET /healthz", healthController.getHealthz)
+	handleFunc(server, "GET /readyz", healthController.getReadyz)
 	handleFunc(server, "GET /api/auth/token", authController.getAuthToken)
-	handleFunc(tokenAuth, "GET /api/recs", recController.getRecs)
-	handleFunc(tokenAuth, "POST /api/recs", recController.postRecs)
-	handleFunc(tokenAuth, "GET /api/recs/{id}", recController.getRec)
-	handleFunc(tokenAuth, "PUT /api/recs/{id}", recController.putRec)
-	handleFunc(tokenAuth, "DELETE /api/recs/{id}", recController.deleteRec)
-	handleFunc(tokenAuth, "GET /api/recs/{pointId}/history", hisController.getHis)
-	handleFunc(tokenAuth, "POST /api/recs/{pointId}/history", hisController.postHis)
-	handleFunc(tokenAuth, "DELETE /api/recs/{pointId}/history", hisController.deleteHis)
-	handleFunc(tokenAuth, "GET /api/recs/{pointId}/current", currentController.getCurrent)
-	handleFunc(tokenAuth, "POST /api/recs/{pointId}/current", currentController.postCurrent)
-	server.Handle("/api/his/", authMiddleware(serverConfig.jwtSecret, serverConfig.apiKey, tokenAuth))
-	server.Handle("/api/recs", authMiddleware(serverConfig.jwtSecret, serverConfig.apiKey, tokenAuth))
-	server.Handle("/api/recs/", authMiddleware(serverConfig.jwtSecret, serverConfig.apiKey, tokenAuth))
+	if serverConfig.refreshTokenStore != nil {
+		handleFunc(server, "POST /api/auth/refresh", authController.postAuthRefresh)
+	}
+	handleFunc(tokenAuth, "POST /api/auth/logout", authController.postAuthLogout)
+	handleFuncWithScope(tokenAuth, "GET /api/recs", scopeRead, recController.getRecs)
+	handleFuncWithScope(tokenAuth, "POST /api/recs", scopeWrite, recController.postRecs)
+	handleFuncWithScope(tokenAuth, "POST /api/recs/bulk", scopeWrite, recController.postRecsBulk)
+	handleFuncWithScope(tokenAuth, "GET /api/recs/export", scopeRead, recController.getRecsExport)
+	handleFuncWithScope(tokenAuth, "GET /api/recs/{id}", scopeRead, recController.getRec)
+	handleFuncWithScope(tokenAuth, "PUT /api/recs/{id}", scopeWrite, recController.putRec)
+	handleFuncWithScope(tokenAuth, "PATCH /api/recs/{id}", scopeWrite, recController.patchRec)
+	handleFuncWithScope(tokenAuth, "DELETE /api/recs/{id}", scopeDelete, recController.deleteRec)
+	handleFuncWithScope(tokenAuth, "GET /api/recs/{id}/revisions", scopeRead, recController.getRevisions)
+	handleFuncWithScope(tokenAuth, "POST /api/recs/{id}/revisions/{revision}/restore", scopeWrite, recController.postRevisionRestore)
+	handleFuncWithScope(tokenAuth, "GET /api/recs/{pointId}/history", scopeRead, hisController.getHis)
+	handleFuncWithScope(tokenAuth, "POST /api/recs/{pointId}/history", scopeWrite, hisController.postHis)
+	handleFuncWithScope(tokenAuth, "DELETE /api/recs/{pointId}/history", scopeDelete, hisController.deleteHis)
+	handleFuncWithScope(tokenAuth, "GET /api/recs/{pointId}/current", scopeRead, currentController.getCurrent)
+	handleFuncWithScope(tokenAuth, "POST /api/recs/{pointId}/current", scopeWrite, currentController.postCurrent)
+	handleFuncWithScope(tokenAuth, "GET /api/trash", scopeRead, recController.getTrash)
+	handleFuncWithScope(tokenAuth, "POST /api/trash/{id}/restore", scopeWrite, recController.postTrashRestore)
+	handleFuncWithScope(tokenAuth, "DELETE /api/trash/{id}", scopeDelete, recController.deleteTrash)
+	handleFuncWithScope(tokenAuth, "GET /api/tags", scopeRead, tagDefController.getTagDefs)
+	handleFuncWithScope(tokenAuth, "GET /api/tags/{name}", scopeRead, tagDefController.getTagDef)
+	handleFuncWithScope(tokenAuth, "PUT /api/tags/{name}", scopeAdmin, tagDefController.putTagDef)
+	handleFuncWithScope(tokenAuth, "DELETE /api/tags/{name}", scopeAdmin, tagDefController.deleteTagDef)
+	if serverConfig.userStore != nil {
+		handleFuncWithScope(tokenAuth, "GET /api/users", scopeAdmin, userController.getUsers)
+		handleFuncWithScope(tokenAuth, "POST /api/users", scopeAdmin, userController.postUsers)
+		handleFuncWithScope(tokenAuth, "PUT /api/users/{username}/password", scopeAdmin, userController.putUserPassword)
+		handleFuncWithScope(tokenAuth, "POST /api/users/{username}/disable", scopeAdmin, userController.postUserDisable)
+		handleFuncWithScope(tokenAuth, "POST /api/users/{username}/enable", scopeAdmin, userController.postUserEnable)
+	}
+	if serverConfig.accessPolicyStore != nil {
+		handleFuncWithScope(tokenAuth, "GET /api/policies", scopeAdmin, accessPolicyController.getAccessPolicies)
+		handleFuncWithScope(tokenAuth, "POST /api/policies", scopeAdmin, accessPolicyController.postAccessPolicies)
+		handleFuncWithScope(tokenAuth, "DELETE /api/policies/{id}", scopeAdmin, accessPolicyController.deleteAccessPolicy)
+	}
+	if serverConfig.apiKeyStore != nil {
+		handleFuncWithScope(tokenAuth, "GET /api/apikeys", scopeAdmin, apiKeyController.getAPIKeys)
+		handleFuncWithScope(tokenAuth, "POST /api/apikeys", scopeAdmin, apiKeyController.postAPIKeys)
+		handleFuncWithScope(tokenAuth, "DELETE /api/apikeys/{id}", scopeAdmin, apiKeyController.deleteAPIKey)
+	}
+	var accessHandler http.Handler = tokenAuth
+	if serverConfig.accessPolicyStore != nil {
+		accessHandler = accessMiddleware(serverConfig.accessPolicyStore, serverConfig.allowWithoutAccessPolicies, tokenAuth)
+	}
+	if serverConfig.requestLimiter != nil {
+		accessHandler = rateLimitMiddleware(serverConfig.requestLimiter, accessHandler)
+	}
+	tokenAuthHandler := authMiddleware(serverConfig.jwtSecret, serverConfig.externalTokenVerifier, serverConfig.tokenDenylist, serverConfig.userStore, serverConfig.apiKeyStore, serverConfig.clientCertificateRoles, accessHandler)
+	server.Handle("/api/auth/logout", tokenAuthHandler)
+	server.Handle("/api/his/", tokenAuthHandler)
+	server.Handle("/api/recs", tokenAuthHandler)
+	server.Handle("/api/recs/", tokenAuthHandler)
+	server.Handle("/api/trash", tokenAuthHandler)
+	server.Handle("/api/trash/", tokenAuthHandler)
+	server.Handle("/api/tags", tokenAuthHandler)
+	server.Handle("/api/tags/", tokenAuthHandler)
+	server.Handle("/api/users", tokenAuthHandler)
+	server.Handle("/api/users/", tokenAuthHandler)
+	server.Handle("/api/policies", tokenAuthHandler)
+	server.Handle("/api/policies/", tokenAuthHandler)
+	server.Handle("/api/apikeys", tokenAuthHandler)
+	server.Handle("/api/apikeys/", tokenAuthHandler)
 
 	// Catch all others with public files. Not found fallback is app index for browser router.
 	server.Handle("/app/", fileServerWithFallback(http.Dir("./public"), "./public/app/index.html"))
 
 	// Observability
-	observed := otelhttp.NewHandler(server, "/")
+	observed := otelhttp.NewHandler(requestIDMiddleware(server), "/")
 
 	return observed, nil
 }
@@ -2,13 +2,28 @@ package main
 
 import (
 	"bytes"
+	"context"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/base64"
 	"encoding/json"
+	"encoding/pem"
+	"errors"
 	"fmt"
+	"math/big"
 	"net/http"
 	"net/http/httptest"
+	"os"
+	"sync/atomic"
 	"testing"
 	"time"
 
+	"github.com/golang-jwt/jwt/v5"
 	"github.com/google/uuid"
 	"github.com/stretchr/testify/assert"
 	"github.com/stretchr/testify/suite"
@@ -20,6 +35,7 @@ import (
 type ServerTestSuite struct {
 	suite.Suite
 	server http.Handler
+	config ServerConfig
 	db     *gorm.DB
 }
 
@@ -28,9 +44,9 @@ func TestServerTestSuite(t *testing.T) {
 }
 
 func (suite *ServerTestSuite) SetupTest() {
-	db, err := gorm.Open(sqlite.Open(":memory:"), &gorm.Config{})
+	db, err := gorm.Open(sqlite.Open(":memory:"), &gorm.Config{TranslateError: true})
 	assert.Nil(suite.T(), err)
-	err = db.AutoMigrate(&gormHis{}, &gormRec{})
+	err = db.AutoMigrate(&gormHis{}, &gormRec{}, &gormTagDef{}, &gormRecRevision{}, &gormUser{}, &gormAccessPolicy{}, &gormAPIKey{}, &gormRefreshToken{}, &gormDeniedToken{})
 	assert.Nil(suite.T(), err)
 
 	authenticator := singleUserAuthenticator{
@@ -39,21 +55,37 @@ func (suite *ServerTestSuite) SetupTest() {
 	}
 	historyStore := newGormHistoryStore(db)
 	recStore := newGormRecStore(db)
-	currentStore := newInMemoryCurrentStore()
+	currentStore, err := newInMemoryCurrentStore("")
+	assert.Nil(suite.T(), err)
+	tagDefStore := newGormTagDefStore(db)
+	revisionStore := newGormRevisionStore(db)
+	accessPolicyStore := newGormAccessPolicyStore(db)
+	apiKeyStore := newGormAPIKeyStore(db)
+	err = seedAPIKey(apiKeyStore, "default", "valid", roleScopes[roleWriter])
+	assert.Nil(suite.T(), err)
 
-	server, err := NewServer(ServerConfig{
+	config := ServerConfig{
 		authenticator:        authenticator,
 		jwtSecret:            "aaa",
 		tokenDurationSeconds: 60,
-		apiKey:               "valid",
-
-		historyStore: historyStore,
-		recStore:     recStore,
-		currentStore: currentStore,
-	})
+		tokenDenylist:        newInMemoryTokenDenylist(),
+		refreshTokenStore:    newGormRefreshTokenStore(db),
+		refreshTokenDuration: time.Hour,
+
+		historyStore:  historyStore,
+		recStore:      recStore,
+		currentStore:  currentStore,
+		tagDefStore:   tagDefStore,
+		revisionStore: revisionStore,
+
+		apiKeyStore:       apiKeyStore,
+		accessPolicyStore: accessPolicyStore,
+	}
+	server, err := NewServer(config)
 	assert.Nil(suite.T(), err)
 
 	suite.server = server
+	suite.config = config
 	suite.db = db
 }
 
@@ -279,10 +311,11 @@ func (suite *ServerTestSuite) TestPostRecs() {
 		gormRecs,
 		[]gormRec{
 			{
-				ID:   id1,
-				Dis:  s("rec1"),
-				Tags: datatypes.JSONMap(map[string]interface{}{"tag": "value1"}),
-				Unit: s("kW"),
+				ID:      id1,
+				Dis:     s("rec1"),
+				Tags:    datatypes.JSONMap(map[string]interface{}{"tag": "value1"}),
+				Unit:    s("kW"),
+				Version: 1,
 			},
 		},
 	)
@@ -397,10 +430,11 @@ func (suite *ServerTestSuite) TestPutRec() {
 		suite.T(),
 		updatedRec,
 		gormRec{
-			ID:   id,
-			Dis:  s("rec updated"),
-			Tags: datatypes.JSONMap(map[string]interface{}{"tag": "value1"}),
-			Unit: s("lb"),
+			ID:      id,
+			Dis:     s("rec updated"),
+			Tags:    datatypes.JSONMap(map[string]interface{}{"tag": "value1"}),
+			Unit:    s("lb"),
+			Version: 2,
 		},
 	)
 }
@@ -450,13 +484,1183 @@ func (suite *ServerTestSuite) TestCurrent() {
 	assert.Equal(suite.T(), 123.456, *current.Value)
 }
 
+func (suite *ServerTestSuite) TestPostRecsBulk() {
+	existingId, _ := uuid.Parse("1b4e32c7-61b5-4b38-a1cd-023c25f9965c")
+	newId, _ := uuid.Parse("5ba26f95-e1ef-4867-a86b-a866cb174f06")
+	suite.db.Create(&gormRec{
+		ID:   existingId,
+		Dis:  s("rec"),
+		Tags: datatypes.JSONMap(map[string]interface{}{"tag": "value"}),
+	})
+
+	authToken := suite.getAuthToken()
+
+	// Deletion times are ignored, so that imports cannot move recs to the trash
+	deletedAt := time.Now()
+	recs := []rec{
+		{ID: existingId, Dis: s("rec updated"), Tags: datatypes.JSONMap(map[string]interface{}{"tag": "value1"})},
+		{ID: newId, Dis: s("rec new"), Tags: datatypes.JSONMap(map[string]interface{}{"tag": "value2"}), DeletedAt: &deletedAt},
+	}
+	body, _ := json.Marshal(recs)
+	response := suite.request(http.MethodPost, "/api/recs/bulk", authToken, "application/json", body)
+	assert.Equal(suite.T(), http.StatusOK, response.Code)
+
+	var result bulkResult
+	assert.Nil(suite.T(), json.Unmarshal(response.Body.Bytes(), &result))
+	assert.Equal(suite.T(), []uuid.UUID{newId}, result.Created)
+	assert.Equal(suite.T(), []uuid.UUID{existingId}, result.Updated)
+	assert.Empty(suite.T(), result.Rejected)
+
+	var gormRecs []gormRec
+	suite.db.Order("dis").Find(&gormRecs)
+	assert.Equal(
+		suite.T(),
+		[]gormRec{
+			{ID: newId, Dis: s("rec new"), Tags: datatypes.JSONMap(map[string]interface{}{"tag": "value2"}), Version: 1},
+			{ID: existingId, Dis: s("rec updated"), Tags: datatypes.JSONMap(map[string]interface{}{"tag": "value1"}), Version: 2},
+		},
+		gormRecs,
+	)
+}
+
+func (suite *ServerTestSuite) TestPostRecsBulkCsvDryRun() {
+	authToken := suite.getAuthToken()
+
+	body := []byte("id,dis,unit,point,mqttTopic,precision\n" +
+		"1b4e32c7-61b5-4b38-a1cd-023c25f9965c,rec1,kW,true,a/b,2\n" +
+		",rec2,,true,c/d,\n" +
+		"not-a-uuid,rec3,,,,\n")
+	response := suite.request(http.MethodPost, "/api/recs/bulk?dryRun=true", authToken, "text/csv", body)
+	assert.Equal(suite.T(), http.StatusOK, response.Code)
+
+	var result bulkResult
+	assert.Nil(suite.T(), json.Unmarshal(response.Body.Bytes(), &result))
+	assert.True(suite.T(), result.DryRun)
+	// The rec without an ID is reported by its position, since its ID is only assigned when it is created
+	id, _ := uuid.Parse("1b4e32c7-61b5-4b38-a1cd-023c25f9965c")
+	assert.Equal(suite.T(), []uuid.UUID{id}, result.Created)
+	assert.Equal(suite.T(), []int{1}, result.CreatedNew)
+	assert.Equal(suite.T(), 1, len(result.Rejected))
+	assert.Equal(suite.T(), 2, result.Rejected[0].Index)
+
+	var count int64
+	suite.db.Model(&gormRec{}).Count(&count)
+	assert.Equal(suite.T(), int64(0), count)
+}
+
+func (suite *ServerTestSuite) TestPostRecsBulkRejected() {
+	id, _ := uuid.Parse("1b4e32c7-61b5-4b38-a1cd-023c25f9965c")
+	authToken := suite.getAuthToken()
+
+	recs := []rec{
+		{ID: id, Dis: s("rec1")},
+		{ID: id, Dis: s("rec1 again")},
+	}
+	body, _ := json.Marshal(recs)
+	response := suite.request(http.MethodPost, "/api/recs/bulk", authToken, "application/json", body)
+	assert.Equal(suite.T(), http.StatusUnprocessableEntity, response.Code)
+
+	// Only the rejections are reported, since nothing was written
+	var result bulkResult
+	assert.Nil(suite.T(), json.Unmarshal(response.Body.Bytes(), &result))
+	assert.Empty(suite.T(), result.Created)
+	assert.Empty(suite.T(), result.Updated)
+	assert.Equal(suite.T(), 1, len(result.Rejected))
+
+	var count int64
+	suite.db.Model(&gormRec{}).Count(&count)
+	assert.Equal(suite.T(), int64(0), count)
+}
+
+func (suite *ServerTestSuite) TestGetRecsExportCsv() {
+	id, _ := uuid.Parse("1b4e32c7-61b5-4b38-a1cd-023c25f9965c")
+	suite.db.Create(&gormRec{
+		ID:   id,
+		Dis:  s("rec"),
+		Tags: datatypes.JSONMap(map[string]interface{}{"mqttTopic": "a/b", "precision": 2.0, "code": "42"}),
+		Unit: s("kW"),
+	})
+
+	authToken := suite.getAuthToken()
+	response := suite.request(http.MethodGet, "/api/recs/export?format=csv", authToken, "", nil)
+	assert.Equal(suite.T(), http.StatusOK, response.Code)
+	assert.Equal(
+		suite.T(),
+		"id,dis,unit,code,mqttTopic,precision\n"+
+			"1b4e32c7-61b5-4b38-a1cd-023c25f9965c,rec,kW,\"\"\"42\"\"\",a/b,2\n",
+		response.Body.String(),
+	)
+
+	// Re-importing the export is a no-op update
+	response = suite.request(http.MethodPost, "/api/recs/bulk", authToken, "text/csv", response.Body.Bytes())
+	assert.Equal(suite.T(), http.StatusOK, response.Code)
+	var importedRec gormRec
+	suite.db.First(&importedRec, "id = ?", id)
+	importedTags, _ := json.Marshal(importedRec.Tags)
+	assert.JSONEq(suite.T(), `{"mqttTopic": "a/b", "precision": 2, "code": "42"}`, string(importedTags))
+}
+
+func (suite *ServerTestSuite) TestTagDefs() {
+	authToken := suite.getAuthToken()
+
+	pointDef := tagDef{Name: "point", Type: tagTypeMarker, Requires: []string{"kind", "unit"}}
+	suite.put("/api/tags/point", authToken, pointDef)
+	kindDef := tagDef{Name: "kind", Type: tagTypeString, Allowed: []interface{}{"Number", "Bool"}}
+	suite.put("/api/tags/kind", authToken, kindDef)
+
+	var tagDefs []tagDef
+	suite.get("/api/tags", authToken, &tagDefs)
+	assert.Equal(suite.T(), []string{"kind", "point"}, []string{tagDefs[0].Name, tagDefs[1].Name})
+
+	var readDef tagDef
+	suite.get("/api/tags/point", authToken, &readDef)
+	assert.Equal(suite.T(), pointDef, readDef)
+
+	suite.delete("/api/tags/point", authToken)
+	response := suite.request(http.MethodGet, "/api/tags/point", authToken, "", nil)
+	assert.Equal(suite.T(), http.StatusNotFound, response.Code)
+}
+
+func (suite *ServerTestSuite) TestPutTagDefInvalid() {
+	authToken := suite.getAuthToken()
+
+	body, _ := json.Marshal(tagDef{Type: tagTypeNumber, Allowed: []interface{}{"a"}})
+	response := suite.request(http.MethodPut, "/api/tags/precision", authToken, "application/json", body)
+	assert.Equal(suite.T(), http.StatusBadRequest, response.Code)
+}
+
+func (suite *ServerTestSuite) TestPostRecsTagValidation() {
+	suite.db.Create(&[]gormTagDef{
+		{Name: "point", Type: tagTypeMarker, Requires: []string{"kind", "unit"}},
+		{Name: "kind", Type: tagTypeString, Allowed: []interface{}{"Number", "Bool"}},
+		{Name: "mqttTopic", Type: tagTypeString},
+	})
+	authToken := suite.getAuthToken()
+
+	invalid, _ := json.Marshal(rec{
+		ID:   uuid.New(),
+		Tags: datatypes.JSONMap(map[string]interface{}{"point": true, "kind": "Str", "mqttTopic": 42}),
+	})
+	response := suite.request(http.MethodPost, "/api/recs", authToken, "application/json", invalid)
+	assert.Equal(suite.T(), http.StatusUnprocessableEntity, response.Code)
+	var validationError problem
+	assert.Nil(suite.T(), json.Unmarshal(response.Body.Bytes(), &validationError))
+	assert.Equal(suite.T(), errorCodeTagValidationFailed, validationError.Code)
+	assert.Equal(
+		suite.T(),
+		[]tagViolation{
+			{Tag: "kind", Message: "must be one of [Number Bool]"},
+			{Tag: "mqttTopic", Message: "must be a string"},
+			{Tag: "unit", Message: "is required by point"},
+		},
+		validationError.Errors,
+	)
+
+	valid := rec{
+		ID:   uuid.New(),
+		Tags: datatypes.JSONMap(map[string]interface{}{"point": true, "kind": "Number", "mqttTopic": "a/b"}),
+		Unit: s("kW"),
+	}
+	suite.post("/api/recs", authToken, valid)
+
+	// Removing the unit from the existing rec is rejected
+	update, _ := json.Marshal(rec{Tags: datatypes.JSONMap(map[string]interface{}{"point": true})})
+	response = suite.request(http.MethodPut, fmt.Sprintf("/api/recs/%s", valid.ID), authToken, "application/json", update)
+	assert.Equal(suite.T(), http.StatusUnprocessableEntity, response.Code)
+}
+
+func (suite *ServerTestSuite) TestRevisions() {
+	id, _ := uuid.Parse("1b4e32c7-61b5-4b38-a1cd-023c25f9965c")
+	authToken := suite.getAuthToken()
+
+	suite.post("/api/recs", authToken, rec{
+		ID:   id,
+		Dis:  s("rec"),
+		Tags: datatypes.JSONMap(map[string]interface{}{"tag": "value"}),
+	})
+	suite.put(fmt.Sprintf("/api/recs/%s", id), authToken, rec{
+		Tags: datatypes.JSONMap(map[string]interface{}{"tag": "value1", "other": true}),
+	})
+	suite.delete(fmt.Sprintf("/api/recs/%s", id), authToken)
+
+	var revisions []recRevision
+	suite.get(fmt.Sprintf("/api/recs/%s/revisions", id), authToken, &revisions)
+	assert.Equal(suite.T(), 3, len(revisions))
+	assert.Equal(
+		suite.T(),
+		[]string{revisionActionCreate, revisionActionUpdate, revisionActionDelete},
+		[]string{revisions[0].Action, revisions[1].Action, revisions[2].Action},
+	)
+	assert.Equal(suite.T(), "test", revisions[1].Username)
+	assert.Equal(
+		suite.T(),
+		[]recChange{
+			{Field: "tags.other", Before: nil, After: true},
+			{Field: "tags.tag", Before: "value", After: "value1"},
+		},
+		revisions[1].Changes,
+	)
+
+	// Restoring the update revision recreates the rec
+	response := suite.request(http.MethodPost, fmt.Sprintf("/api/recs/%s/revisions/2/restore", id), authToken, "", nil)
+	assert.Equal(suite.T(), http.StatusOK, response.Code)
+	var restored gormRec
+	suite.db.First(&restored, "id = ?", id)
+	assert.Equal(suite.T(), s("rec"), restored.Dis)
+	restoredTags, _ := json.Marshal(restored.Tags)
+	assert.JSONEq(suite.T(), `{"tag": "value1", "other": true}`, string(restoredTags))
+
+	suite.get(fmt.Sprintf("/api/recs/%s/revisions", id), authToken, &revisions)
+	assert.Equal(suite.T(), 4, len(revisions))
+	assert.Equal(suite.T(), revisionActionRestore, revisions[3].Action)
+
+	// The delete revision cannot be restored
+	response = suite.request(http.MethodPost, fmt.Sprintf("/api/recs/%s/revisions/3/restore", id), authToken, "", nil)
+	assert.Equal(suite.T(), http.StatusConflict, response.Code)
+
+	// Changes fail, and are not made, if their revisions cannot be recorded
+	assert.Nil(suite.T(), suite.db.Migrator().DropTable(&gormRecRevision{}))
+	body, _ := json.Marshal(rec{Dis: s("unrecorded")})
+	response = suite.request(http.MethodPut, fmt.Sprintf("/api/recs/%s", id), authToken, "", body)
+	assert.Equal(suite.T(), http.StatusInternalServerError, response.Code)
+	suite.db.First(&restored, "id = ?", id)
+	assert.Equal(suite.T(), s("rec"), restored.Dis)
+}
+
+func (suite *ServerTestSuite) TestRecETags() {
+	id, _ := uuid.Parse("1b4e32c7-61b5-4b38-a1cd-023c25f9965c")
+	suite.db.Create(&gormRec{
+		ID:   id,
+		Dis:  s("rec"),
+		Tags: datatypes.JSONMap(map[string]interface{}{"tag": "value"}),
+	})
+	route := fmt.Sprintf("/api/recs/%s", id)
+	authToken := suite.getAuthToken()
+
+	response := suite.request(http.MethodGet, route, authToken, "", nil)
+	assert.Equal(suite.T(), http.StatusOK, response.Code)
+	etag := response.Header().Get("ETag")
+	assert.Equal(suite.T(), `"1"`, etag)
+
+	// Unchanged recs are not resent
+	request, _ := http.NewRequest(http.MethodGet, route, nil)
+	request.Header.Add("Authorization", fmt.Sprintf("Bearer %s", authToken))
+	request.Header.Set("If-None-Match", etag)
+	response = httptest.NewRecorder()
+	suite.server.ServeHTTP(response, request)
+	assert.Equal(suite.T(), http.StatusNotModified, response.Code)
+	assert.Equal(suite.T(), 0, response.Body.Len())
+
+	// The first update with the ETag succeeds, and the second conflicts
+	body, _ := json.Marshal(rec{Dis: s("rec updated")})
+	for _, expectedCode := range []int{http.StatusOK, http.StatusPreconditionFailed} {
+		request, _ = http.NewRequest(http.MethodPut, route, bytes.NewReader(body))
+		request.Header.Add("Authorization", fmt.Sprintf("Bearer %s", authToken))
+		request.Header.Set("If-Match", etag)
+		response = httptest.NewRecorder()
+		suite.server.ServeHTTP(response, request)
+		assert.Equal(suite.T(), expectedCode, response.Code)
+	}
+
+	// Deleting with a stale ETag conflicts
+	request, _ = http.NewRequest(http.MethodDelete, route, nil)
+	request.Header.Add("Authorization", fmt.Sprintf("Bearer %s", authToken))
+	request.Header.Set("If-Match", etag)
+	response = httptest.NewRecorder()
+	suite.server.ServeHTTP(response, request)
+	assert.Equal(suite.T(), http.StatusPreconditionFailed, response.Code)
+
+	request.Header.Set("If-Match", `"2"`)
+	response = httptest.NewRecorder()
+	suite.server.ServeHTTP(response, request)
+	assert.Equal(suite.T(), http.StatusOK, response.Code)
+}
+
+func (suite *ServerTestSuite) TestPatchRecMergePatch() {
+	id, _ := uuid.Parse("1b4e32c7-61b5-4b38-a1cd-023c25f9965c")
+	suite.db.Create(&gormRec{
+		ID:   id,
+		Dis:  s("rec"),
+		Tags: datatypes.JSONMap(map[string]interface{}{"tag": "value", "other": "value"}),
+		Unit: s("kW"),
+	})
+	authToken := suite.getAuthToken()
+
+	patch := []byte(`{"unit": null, "tags": {"other": null, "new": 1}}`)
+	response := suite.request(http.MethodPatch, fmt.Sprintf("/api/recs/%s", id), authToken, "application/merge-patch+json", patch)
+	assert.Equal(suite.T(), http.StatusOK, response.Code)
+	assert.Equal(suite.T(), `"2"`, response.Header().Get("ETag"))
+
+	var patched gormRec
+	suite.db.First(&patched, "id = ?", id)
+	assert.Equal(suite.T(), s("rec"), patched.Dis)
+	assert.Nil(suite.T(), patched.Unit)
+	patchedTags, _ := json.Marshal(patched.Tags)
+	assert.JSONEq(suite.T(), `{"tag": "value", "new": 1}`, string(patchedTags))
+}
+
+func (suite *ServerTestSuite) TestPatchRecJSONPatch() {
+	id, _ := uuid.Parse("1b4e32c7-61b5-4b38-a1cd-023c25f9965c")
+	suite.db.Create(&gormRec{
+		ID:   id,
+		Dis:  s("rec"),
+		Tags: datatypes.JSONMap(map[string]interface{}{"tag": "value", "other": "value"}),
+	})
+	route := fmt.Sprintf("/api/recs/%s", id)
+	authToken := suite.getAuthToken()
+
+	// A failed test leaves the rec unchanged
+	patch := []byte(`[{"op": "remove", "path": "/tags/other"}, {"op": "test", "path": "/dis", "value": "wrong"}]`)
+	response := suite.request(http.MethodPatch, route, authToken, "application/json-patch+json", patch)
+	assert.Equal(suite.T(), http.StatusUnprocessableEntity, response.Code)
+
+	patch = []byte(`[{"op": "remove", "path": "/tags/other"}, {"op": "replace", "path": "/dis", "value": "renamed"}]`)
+	response = suite.request(http.MethodPatch, route, authToken, "application/json-patch+json", patch)
+	assert.Equal(suite.T(), http.StatusOK, response.Code)
+
+	var patched gormRec
+	suite.db.First(&patched, "id = ?", id)
+	assert.Equal(suite.T(), s("renamed"), patched.Dis)
+	assert.Equal(suite.T(), int64(2), patched.Version)
+	patchedTags, _ := json.Marshal(patched.Tags)
+	assert.JSONEq(suite.T(), `{"tag": "value"}`, string(patchedTags))
+
+	// The ID cannot be changed
+	patch = []byte(`[{"op": "replace", "path": "/id", "value": "5ba26f95-e1ef-4867-a86b-a866cb174f06"}]`)
+	response = suite.request(http.MethodPatch, route, authToken, "application/json-patch+json", patch)
+	assert.Equal(suite.T(), http.StatusUnprocessableEntity, response.Code)
+
+	response = suite.request(http.MethodPatch, route, authToken, "application/json", patch)
+	assert.Equal(suite.T(), http.StatusUnsupportedMediaType, response.Code)
+}
+
+func (suite *ServerTestSuite) TestDeleteRecCascade() {
+	id, _ := uuid.Parse("1b4e32c7-61b5-4b38-a1cd-023c25f9965c")
+	suite.db.Create(&gormRec{ID: id, Dis: s("rec")})
+	now := time.Now()
+	suite.db.Create(&gormHis{PointId: id, Ts: &now, Value: f(1.0)})
+	authToken := suite.getAuthToken()
+	suite.post(fmt.Sprintf("/api/recs/%s/current", id), authToken, currentInput{Value: f(1.0)})
+
+	suite.delete(fmt.Sprintf("/api/recs/%s", id), authToken)
+
+	var recCount int64
+	suite.db.Unscoped().Model(&gormRec{}).Where("id = ?", id).Count(&recCount)
+	assert.Equal(suite.T(), int64(0), recCount)
+	var hisCount int64
+	suite.db.Model(&gormHis{}).Where(&gormHis{PointId: id}).Count(&hisCount)
+	assert.Equal(suite.T(), int64(0), hisCount)
+	var current current
+	suite.get(fmt.Sprintf("/api/recs/%s/current", id), authToken, &current)
+	assert.Nil(suite.T(), current.Value)
+}
+
+func (suite *ServerTestSuite) TestDeleteRecTrash() {
+	valueEmitter := mockValueEmitter{}
+	ingester := newIngester(suite.config.currentStore, &valueEmitter)
+	config := suite.config
+	config.ingester = &ingester
+	config.trashRetention = 24 * time.Hour
+	server, err := NewServer(config)
+	assert.Nil(suite.T(), err)
+	suite.server = server
+
+	id, _ := uuid.Parse("1b4e32c7-61b5-4b38-a1cd-023c25f9965c")
+	suite.db.Create(&gormRec{ID: id, Dis: s("rec"), Tags: datatypes.JSONMap(map[string]interface{}{"mqttTopic": "test"})})
+	now := time.Now()
+	suite.db.Create(&gormHis{PointId: id, Ts: &now, Value: f(1.0)})
+	recs, _ := config.recStore.readRecs("mqttTopic")
+	ingester.refreshSubscriptions(recs)
+	assert.True(suite.T(), ingester.topics["test"][id])
+
+	authToken := suite.getAuthToken()
+	suite.delete(fmt.Sprintf("/api/recs/%s", id), authToken)
+
+	// The rec is hidden and unsubscribed, but its history is kept
+	response := suite.request(http.MethodGet, "/api/recs", authToken, "", nil)
+	assert.JSONEq(suite.T(), "[]", response.Body.String())
+	assert.False(suite.T(), ingester.topics["test"][id])
+	var trash []rec
+	suite.get("/api/trash", authToken, &trash)
+	assert.Equal(suite.T(), 1, len(trash))
+	assert.NotNil(suite.T(), trash[0].DeletedAt)
+	var hisCount int64
+	suite.db.Model(&gormHis{}).Where(&gormHis{PointId: id}).Count(&hisCount)
+	assert.Equal(suite.T(), int64(1), hisCount)
+
+	// Values cannot be written to the rec, and its ID cannot be reused, while it is in the trash
+	hisBody, _ := json.Marshal(hisItem{Ts: &now, Value: f(2.0)})
+	response = suite.request(http.MethodPost, fmt.Sprintf("/api/recs/%s/history", id), authToken, "", hisBody)
+	assert.Equal(suite.T(), http.StatusNotFound, response.Code)
+	currentBody, _ := json.Marshal(currentInput{Value: f(2.0)})
+	response = suite.request(http.MethodPost, fmt.Sprintf("/api/recs/%s/current", id), authToken, "", currentBody)
+	assert.Equal(suite.T(), http.StatusNotFound, response.Code)
+	recBody, _ := json.Marshal(rec{ID: id, Dis: s("again")})
+	response = suite.request(http.MethodPost, "/api/recs", authToken, "", recBody)
+	assert.Equal(suite.T(), http.StatusConflict, response.Code)
+	assert.Contains(suite.T(), response.Body.String(), "is in the trash")
+
+	// Restoring resubscribes
+	response = suite.request(http.MethodPost, fmt.Sprintf("/api/trash/%s/restore", id), authToken, "", nil)
+	assert.Equal(suite.T(), http.StatusOK, response.Code)
+	assert.True(suite.T(), ingester.topics["test"][id])
+	var restored rec
+	suite.get(fmt.Sprintf("/api/recs/%s", id), authToken, &restored)
+	assert.Equal(suite.T(), s("rec"), restored.Dis)
+
+	// Revisions are not restored over the trash, which the rec must be restored from first
+	suite.delete(fmt.Sprintf("/api/recs/%s", id), authToken)
+	var revisions []recRevision
+	suite.get(fmt.Sprintf("/api/recs/%s/revisions", id), authToken, &revisions)
+	restoreRoute := ""
+	for _, revision := range revisions {
+		if revision.After != nil {
+			restoreRoute = fmt.Sprintf("/api/recs/%s/revisions/%d/restore", id, revision.Revision)
+		}
+	}
+	response = suite.request(http.MethodPost, restoreRoute, authToken, "", nil)
+	assert.Equal(suite.T(), http.StatusConflict, response.Code)
+	assert.False(suite.T(), ingester.topics["test"][id])
+
+	// Purging only happens after the retention period
+	deleter := recDeleter{
+		recStore:       config.recStore,
+		historyStore:   config.historyStore,
+		currentStore:   config.currentStore,
+		trashRetention: config.trashRetention,
+	}
+	count, err := deleter.purgeExpired(time.Now())
+	assert.Nil(suite.T(), err)
+	assert.Equal(suite.T(), 0, count)
+	count, err = deleter.purgeExpired(time.Now().Add(25 * time.Hour))
+	assert.Nil(suite.T(), err)
+	assert.Equal(suite.T(), 1, count)
+
+	var recCount int64
+	suite.db.Unscoped().Model(&gormRec{}).Where("id = ?", id).Count(&recCount)
+	assert.Equal(suite.T(), int64(0), recCount)
+	suite.db.Model(&gormHis{}).Where(&gormHis{PointId: id}).Count(&hisCount)
+	assert.Equal(suite.T(), int64(0), hisCount)
+
+	// Once purged, restoring a revision recreates the rec and resubscribes it
+	response = suite.request(http.MethodPost, restoreRoute, authToken, "", nil)
+	assert.Equal(suite.T(), http.StatusOK, response.Code)
+	assert.True(suite.T(), ingester.topics["test"][id])
+}
+
+func (suite *ServerTestSuite) TestUsers() {
+	userStore := newGormUserStore(suite.db)
+	assert.Nil(suite.T(), bootstrapAdmin(userStore, "admin", "adminPassword"))
+	config := suite.config
+	config.authenticator = newGormUserAuthenticator(suite.db)
+	config.userStore = userStore
+	server, err := NewServer(config)
+	assert.Nil(suite.T(), err)
+	suite.server = server
+
+	// Bootstrapping only happens on an empty store
+	assert.Nil(suite.T(), bootstrapAdmin(userStore, "other", "otherPassword"))
+	adminToken := suite.getAuthTokenFor("admin", "adminPassword")
+
+	suite.post("/api/users", adminToken, userInput{Username: "viewer", Password: "viewerPassword"})
+	body, _ := json.Marshal(userInput{Username: "viewer", Password: "again"})
+	response := suite.request(http.MethodPost, "/api/users", adminToken, "", body)
+	assert.Equal(suite.T(), http.StatusConflict, response.Code)
+	// Usernames cannot be mistaken for the policy subjects of API keys
+	body, _ = json.Marshal(userInput{Username: "apiKey:default", Password: "password"})
+	response = suite.request(http.MethodPost, "/api/users", adminToken, "", body)
+	assert.Equal(suite.T(), http.StatusBadRequest, response.Code)
+
+	var users []user
+	suite.get("/api/users", adminToken, &users)
+	assert.Equal(suite.T(), 2, len(users))
+	assert.Equal(suite.T(), "admin", users[0].Username)
+	assert.Equal(suite.T(), roleAdmin, users[0].Role)
+	assert.Equal(suite.T(), "viewer", users[1].Username)
+	assert.Equal(suite.T(), roleViewer, users[1].Role)
+
+	// Non-admins cannot manage users
+	viewerToken := suite.getAuthTokenFor("viewer", "viewerPassword")
+	response = suite.request(http.MethodGet, "/api/users", viewerToken, "", nil)
+	assert.Equal(suite.T(), http.StatusForbidden, response.Code)
+	response = suite.request(http.MethodGet, "/api/recs", viewerToken, "", nil)
+	assert.Equal(suite.T(), http.StatusOK, response.Code)
+
+	// Disabled users cannot log in, and lose the tokens they have
+	request, _ := http.NewRequest(http.MethodGet, "/api/auth/token", nil)
+	request.SetBasicAuth("viewer", "viewerPassword")
+	response = httptest.NewRecorder()
+	suite.server.ServeHTTP(response, request)
+	var login clientToken
+	assert.Nil(suite.T(), json.Unmarshal(response.Body.Bytes(), &login))
+	suite.post("/api/users/viewer/disable", adminToken, nil)
+	request, _ = http.NewRequest(http.MethodGet, "/api/auth/token", nil)
+	request.SetBasicAuth("viewer", "viewerPassword")
+	response = httptest.NewRecorder()
+	suite.server.ServeHTTP(response, request)
+	assert.Equal(suite.T(), http.StatusForbidden, response.Code)
+	response = suite.request(http.MethodGet, "/api/recs", viewerToken, "", nil)
+	assert.Equal(suite.T(), http.StatusUnauthorized, response.Code)
+	suite.post("/api/users/viewer/enable", adminToken, nil)
+	refreshBody, _ := json.Marshal(refreshTokenInput{RefreshToken: login.RefreshToken})
+	response = suite.request(http.MethodPost, "/api/auth/refresh", "", "", refreshBody)
+	assert.Equal(suite.T(), http.StatusUnauthorized, response.Code)
+	response = suite.request(http.MethodGet, "/api/recs", viewerToken, "", nil)
+	assert.Equal(suite.T(), http.StatusOK, response.Code)
+
+	// Reset passwords replace the old ones
+	suite.put("/api/users/viewer/password", adminToken, passwordInput{Password: "newPassword"})
+	request, _ = http.NewRequest(http.MethodGet, "/api/auth/token", nil)
+	request.SetBasicAuth("viewer", "viewerPassword")
+	response = httptest.NewRecorder()
+	suite.server.ServeHTTP(response, request)
+	assert.Equal(suite.T(), http.StatusForbidden, response.Code)
+	suite.getAuthTokenFor("viewer", "newPassword")
+
+	var gormUser gormUser
+	suite.db.First(&gormUser, "username = ?", "viewer")
+	assert.NotEqual(suite.T(), "newPassword", gormUser.PasswordHash)
+
+	// Admins cannot disable themselves
+	response = suite.request(http.MethodPost, "/api/users/admin/disable", adminToken, "", nil)
+	assert.Equal(suite.T(), http.StatusConflict, response.Code)
+}
+
+func (suite *ServerTestSuite) TestRoles() {
+	userStore := newGormUserStore(suite.db)
+	assert.Nil(suite.T(), userStore.createUser(user{Username: "viewer", Role: roleViewer}, "password"))
+	assert.Nil(suite.T(), userStore.createUser(user{Username: "writer", Role: roleWriter}, "password"))
+	config := suite.config
+	config.authenticator = newGormUserAuthenticator(suite.db)
+	// Roles are checked without access policies
+	config.allowWithoutAccessPolicies = true
+	server, err := NewServer(config)
+	assert.Nil(suite.T(), err)
+	suite.server = server
+
+	id, _ := uuid.Parse("1b4e32c7-61b5-4b38-a1cd-023c25f9965c")
+	suite.db.Create(&gormRec{ID: id, Dis: s("rec")})
+	recBody, _ := json.Marshal(rec{ID: id, Dis: s("updated")})
+	now := time.Now()
+	hisBody, _ := json.Marshal(hisItem{Ts: &now, Value: f(1.0)})
+	hisRoute := fmt.Sprintf("/api/recs/%s/history", id)
+
+	viewerToken := suite.getAuthTokenFor("viewer", "password")
+	response := suite.request(http.MethodGet, "/api/recs", viewerToken, "", nil)
+	assert.Equal(suite.T(), http.StatusOK, response.Code)
+	response = suite.request(http.MethodPut, fmt.Sprintf("/api/recs/%s", id), viewerToken, "", recBody)
+	assert.Equal(suite.T(), http.StatusForbidden, response.Code)
+	response = suite.request(http.MethodPost, hisRoute, viewerToken, "", hisBody)
+	assert.Equal(suite.T(), http.StatusForbidden, response.Code)
+
+	writerToken := suite.getAuthTokenFor("writer", "password")
+	response = suite.request(http.MethodPut, fmt.Sprintf("/api/recs/%s", id), writerToken, "", recBody)
+	assert.Equal(suite.T(), http.StatusOK, response.Code)
+	response = suite.request(http.MethodPost, hisRoute, writerToken, "", hisBody)
+	assert.Equal(suite.T(), http.StatusOK, response.Code)
+	response = suite.request(http.MethodDelete, hisRoute, writerToken, "", nil)
+	assert.Equal(suite.T(), http.StatusForbidden, response.Code)
+	response = suite.request(http.MethodDelete, fmt.Sprintf("/api/recs/%s", id), writerToken, "", nil)
+	assert.Equal(suite.T(), http.StatusForbidden, response.Code)
+
+	// The API key has the configured role
+	request, _ := http.NewRequest(http.MethodDelete, hisRoute, nil)
+	request.Header.Add("Authorization", fmt.Sprintf("ApiKey %s", "valid"))
+	response = httptest.NewRecorder()
+	suite.server.ServeHTTP(response, request)
+	assert.Equal(suite.T(), http.StatusForbidden, response.Code)
+
+	var hisCount int64
+	suite.db.Model(&gormHis{}).Where(&gormHis{PointId: id}).Count(&hisCount)
+	assert.Equal(suite.T(), int64(1), hisCount)
+}
+
+func (suite *ServerTestSuite) TestAccessPolicies() {
+	idA, _ := uuid.Parse("1b4e32c7-61b5-4b38-a1cd-023c25f9965c")
+	idB, _ := uuid.Parse("ff7d8a33-1dc4-4a1b-a1b1-5b1c1f0b1b1b")
+	suite.db.Create(&gormRec{ID: idA, Dis: s("A"), Tags: datatypes.JSONMap(map[string]interface{}{"siteRef": "@siteA"})})
+	suite.db.Create(&gormRec{ID: idB, Dis: s("B"), Tags: datatypes.JSONMap(map[string]interface{}{"siteRef": "@siteB"})})
+	authToken := suite.getAuthToken()
+
+	body, _ := json.Marshal(accessPolicy{Subject: "apiKey:default", Filter: "siteRef=="})
+	response := suite.request(http.MethodPost, "/api/policies", authToken, "", body)
+	assert.Equal(suite.T(), http.StatusBadRequest, response.Code)
+	body, _ = json.Marshal(accessPolicy{Subject: "apiKey:default", Filter: "siteRef==@siteA"})
+	response = suite.request(http.MethodPost, "/api/policies", authToken, "", body)
+	assert.Equal(suite.T(), http.StatusOK, response.Code)
+	var policy accessPolicy
+	assert.Nil(suite.T(), json.Unmarshal(response.Body.Bytes(), &policy))
+
+	apiKeyRequest := func(method string, route string, body []byte) *httptest.ResponseRecorder {
+		request, _ := http.NewRequest(method, route, bytes.NewReader(body))
+		request.Header.Add("Authorization", fmt.Sprintf("ApiKey %s", "valid"))
+		response := httptest.NewRecorder()
+		suite.server.ServeHTTP(response, request)
+		return response
+	}
+
+	response = apiKeyRequest(http.MethodGet, "/api/recs", nil)
+	var recs []rec
+	assert.Nil(suite.T(), json.Unmarshal(response.Body.Bytes(), &recs))
+	assert.Equal(suite.T(), 1, len(recs))
+	assert.Equal(suite.T(), idA, recs[0].ID)
+
+	// Inaccessible recs look like missing ones
+	now := time.Now()
+	hisBody, _ := json.Marshal(hisItem{Ts: &now, Value: f(1.0)})
+	currentBody, _ := json.Marshal(currentInput{Value: f(1.0)})
+	for _, c := range []struct {
+		method string
+		route  string
+		body   []byte
+	}{
+		{http.MethodGet, fmt.Sprintf("/api/recs/%s", idB), nil},
+		{http.MethodPut, fmt.Sprintf("/api/recs/%s", idB), []byte(`{"dis":"C"}`)},
+		{http.MethodGet, fmt.Sprintf("/api/recs/%s/history", idB), nil},
+		{http.MethodPost, fmt.Sprintf("/api/recs/%s/history", idB), hisBody},
+		{http.MethodGet, fmt.Sprintf("/api/recs/%s/current", idB), nil},
+		{http.MethodPost, fmt.Sprintf("/api/recs/%s/current", idB), currentBody},
+		{http.MethodGet, fmt.Sprintf("/api/recs/%s/revisions", idB), nil},
+		{http.MethodGet, fmt.Sprintf("/api/recs/%s/history", uuid.New()), nil},
+	} {
+		response = apiKeyRequest(c.method, c.route, c.body)
+		assert.Equal(suite.T(), http.StatusNotFound, response.Code, "%s %s", c.method, c.route)
+	}
+	response = apiKeyRequest(http.MethodPost, fmt.Sprintf("/api/recs/%s/history", idA), hisBody)
+	assert.Equal(suite.T(), http.StatusOK, response.Code)
+
+	// Recs cannot be created or moved outside the policy
+	response = apiKeyRequest(http.MethodPost, "/api/recs", []byte(`{"id":"2a9f3f0e-6c0c-4f0e-9a8e-2f5c7c3f1d2e","tags":{"siteRef":"@siteB"}}`))
+	assert.Equal(suite.T(), http.StatusForbidden, response.Code)
+	response = apiKeyRequest(http.MethodPut, fmt.Sprintf("/api/recs/%s", idA), []byte(`{"tags":{"siteRef":"@siteB"}}`))
+	assert.Equal(suite.T(), http.StatusForbidden, response.Code)
+	response = apiKeyRequest(http.MethodPost, "/api/recs/bulk", []byte(fmt.Sprintf(`[{"id":"%s","tags":{"siteRef":"@siteA"}}]`, idB)))
+	assert.Equal(suite.T(), http.StatusUnprocessableEntity, response.Code)
+	var result bulkResult
+	assert.Nil(suite.T(), json.Unmarshal(response.Body.Bytes(), &result))
+	assert.Equal(suite.T(), "access denied", result.Rejected[0].Reason)
+
+	// Admins without policies are unrestricted, and others may access no recs unless that is allowed
+	suite.get("/api/recs", authToken, &recs)
+	assert.Equal(suite.T(), 2, len(recs))
+	suite.delete(fmt.Sprintf("/api/policies/%s", policy.ID), authToken)
+	response = apiKeyRequest(http.MethodGet, "/api/recs", nil)
+	assert.Nil(suite.T(), json.Unmarshal(response.Body.Bytes(), &recs))
+	assert.Equal(suite.T(), 0, len(recs))
+	response = apiKeyRequest(http.MethodGet, fmt.Sprintf("/api/recs/%s", idA), nil)
+	assert.Equal(suite.T(), http.StatusNotFound, response.Code)
+	config := suite.config
+	config.allowWithoutAccessPolicies = true
+	suite.server, _ = NewServer(config)
+	response = apiKeyRequest(http.MethodGet, fmt.Sprintf("/api/recs/%s", idB), nil)
+	assert.Equal(suite.T(), http.StatusOK, response.Code)
+}
+
+func (suite *ServerTestSuite) TestAPIKeys() {
+	authToken := suite.getAuthToken()
+	apiKeyRequest := func(secret string, method string, route string) int {
+		request, _ := http.NewRequest(method, route, bytes.NewReader([]byte(`{}`)))
+		request.Header.Add("Authorization", fmt.Sprintf("ApiKey %s", secret))
+		response := httptest.NewRecorder()
+		suite.server.ServeHTTP(response, request)
+		return response.Code
+	}
+
+	body, _ := json.Marshal(apiKeyInput{Name: "dashboard", Scopes: []string{"everything"}})
+	response := suite.request(http.MethodPost, "/api/apikeys", authToken, "", body)
+	assert.Equal(suite.T(), http.StatusBadRequest, response.Code)
+	body, _ = json.Marshal(apiKeyInput{Name: "dashboard", Scopes: []string{scopeRead}})
+	response = suite.request(http.MethodPost, "/api/apikeys", authToken, "", body)
+	assert.Equal(suite.T(), http.StatusOK, response.Code)
+	var created createdAPIKey
+	assert.Nil(suite.T(), json.Unmarshal(response.Body.Bytes(), &created))
+	assert.NotEmpty(suite.T(), created.Secret)
+	response = suite.request(http.MethodPost, "/api/apikeys", authToken, "", body)
+	assert.Equal(suite.T(), http.StatusConflict, response.Code)
+
+	// Only the hash is stored
+	var gormAPIKey gormAPIKey
+	suite.db.First(&gormAPIKey, "name = ?", "dashboard")
+	assert.NotEqual(suite.T(), created.Secret, gormAPIKey.Hash)
+	assert.NotContains(suite.T(), suite.request(http.MethodGet, "/api/apikeys", authToken, "", nil).Body.String(), created.Secret)
+
+	// Keys are limited to their scopes
+	assert.Equal(suite.T(), http.StatusOK, apiKeyRequest(created.Secret, http.MethodGet, "/api/recs"))
+	assert.Equal(suite.T(), http.StatusForbidden, apiKeyRequest(created.Secret, http.MethodPost, "/api/recs"))
+	assert.Equal(suite.T(), http.StatusForbidden, apiKeyRequest("valid", http.MethodGet, "/api/apikeys"))
+
+	var apiKeys []apiKey
+	suite.get("/api/apikeys", authToken, &apiKeys)
+	assert.Equal(suite.T(), 2, len(apiKeys))
+	assert.Equal(suite.T(), "dashboard", apiKeys[0].Name)
+	assert.NotNil(suite.T(), apiKeys[0].LastUsedAt)
+	assert.Equal(suite.T(), "default", apiKeys[1].Name)
+
+	// Revoked keys are rejected, but others still work
+	suite.delete(fmt.Sprintf("/api/apikeys/%s", created.ID), authToken)
+	assert.Equal(suite.T(), http.StatusUnauthorized, apiKeyRequest(created.Secret, http.MethodGet, "/api/recs"))
+	assert.Equal(suite.T(), http.StatusOK, apiKeyRequest("valid", http.MethodGet, "/api/recs"))
+
+	// Expired keys are rejected
+	expired := time.Now().Add(-time.Minute)
+	body, _ = json.Marshal(apiKeyInput{Name: "expired", Scopes: []string{scopeRead}, ExpiresAt: &expired})
+	response = suite.request(http.MethodPost, "/api/apikeys", authToken, "", body)
+	assert.Nil(suite.T(), json.Unmarshal(response.Body.Bytes(), &created))
+	assert.Equal(suite.T(), http.StatusUnauthorized, apiKeyRequest(created.Secret, http.MethodGet, "/api/recs"))
+
+	// Reseeding rotates the secret of the existing key
+	assert.Nil(suite.T(), seedAPIKey(suite.config.apiKeyStore, "default", "rotated", roleScopes[roleViewer]))
+	assert.Equal(suite.T(), http.StatusUnauthorized, apiKeyRequest("valid", http.MethodGet, "/api/recs"))
+	assert.Equal(suite.T(), http.StatusOK, apiKeyRequest("rotated", http.MethodGet, "/api/recs"))
+
+	// Seeding without a secret revokes the key
+	assert.Nil(suite.T(), seedAPIKey(suite.config.apiKeyStore, "default", "", roleScopes[roleViewer]))
+	assert.Equal(suite.T(), http.StatusUnauthorized, apiKeyRequest("rotated", http.MethodGet, "/api/recs"))
+}
+
+func (suite *ServerTestSuite) TestProblems() {
+	authToken := suite.getAuthToken()
+	readProblem := func(response *httptest.ResponseRecorder) problem {
+		assert.Equal(suite.T(), "application/problem+json", response.Header().Get("Content-Type"))
+		var problem problem
+		assert.Nil(suite.T(), json.Unmarshal(response.Body.Bytes(), &problem))
+		assert.Equal(suite.T(), response.Code, problem.Status)
+		assert.Equal(suite.T(), response.Header().Get("X-Request-ID"), problem.RequestID)
+		assert.NotEmpty(suite.T(), problem.RequestID)
+		return problem
+	}
+
+	// Malformed and missing IDs are distinguished
+	response := suite.request(http.MethodGet, "/api/recs/not-a-uuid", authToken, "", nil)
+	assert.Equal(suite.T(), http.StatusNotFound, response.Code)
+	assert.Equal(suite.T(), errorCodeInvalidID, readProblem(response).Code)
+	response = suite.request(http.MethodGet, fmt.Sprintf("/api/recs/%s", uuid.New()), authToken, "", nil)
+	assert.Equal(suite.T(), http.StatusNotFound, response.Code)
+	assert.Equal(suite.T(), errorCodeNotFound, readProblem(response).Code)
+
+	response = suite.request(http.MethodPost, "/api/recs", authToken, "", []byte("{"))
+	assert.Equal(suite.T(), http.StatusBadRequest, response.Code)
+	problem := readProblem(response)
+	assert.Equal(suite.T(), errorCodeInvalidBody, problem.Code)
+	assert.Equal(suite.T(), "urn:timeseries-api:problem:invalid_body", problem.Type)
+	assert.Equal(suite.T(), "Bad Request", problem.Title)
+
+	// Duplicate keys are conflicts
+	rec := rec{ID: uuid.New(), Tags: datatypes.JSONMap(map[string]interface{}{"site": true})}
+	suite.post("/api/recs", authToken, rec)
+	body, _ := json.Marshal(rec)
+	response = suite.request(http.MethodPost, "/api/recs", authToken, "", body)
+	assert.Equal(suite.T(), http.StatusConflict, response.Code)
+	assert.Equal(suite.T(), errorCodeConflict, readProblem(response).Code)
+
+	response = suite.request(http.MethodGet, "/api/recs", "invalid", "", nil)
+	assert.Equal(suite.T(), http.StatusUnauthorized, response.Code)
+	assert.Equal(suite.T(), errorCodeUnauthorized, readProblem(response).Code)
+
+	// Request IDs from clients are kept if they are safe to log
+	request, _ := http.NewRequest(http.MethodGet, "/api/recs/not-a-uuid", nil)
+	request.Header.Add("Authorization", fmt.Sprintf("Bearer %s", authToken))
+	request.Header.Set("X-Request-ID", "client-id-1")
+	response = httptest.NewRecorder()
+	suite.server.ServeHTTP(response, request)
+	assert.Equal(suite.T(), "client-id-1", readProblem(response).RequestID)
+	request.Header.Set("X-Request-ID", "bad\nid")
+	response = httptest.NewRecorder()
+	suite.server.ServeHTTP(response, request)
+	assert.NotEqual(suite.T(), "bad\nid", readProblem(response).RequestID)
+}
+
+func (suite *ServerTestSuite) TestRefreshTokens() {
+	refresh := func(refreshToken string) (int, clientToken) {
+		body, _ := json.Marshal(refreshTokenInput{RefreshToken: refreshToken})
+		response := suite.request(http.MethodPost, "/api/auth/refresh", "", "", body)
+		var clientToken clientToken
+		json.Unmarshal(response.Body.Bytes(), &clientToken)
+		return response.Code, clientToken
+	}
+
+	request, _ := http.NewRequest(http.MethodGet, "/api/auth/token", nil)
+	request.SetBasicAuth("test", "password")
+	response := httptest.NewRecorder()
+	suite.server.ServeHTTP(response, request)
+	var login clientToken
+	assert.Nil(suite.T(), json.Unmarshal(response.Body.Bytes(), &login))
+	assert.NotEmpty(suite.T(), login.RefreshToken)
+
+	// Refreshing rotates the refresh token
+	code, first := refresh(login.RefreshToken)
+	assert.Equal(suite.T(), http.StatusOK, code)
+	assert.NotEqual(suite.T(), login.RefreshToken, first.RefreshToken)
+	assert.Equal(suite.T(), http.StatusOK, suite.request(http.MethodGet, "/api/recs", first.Token, "", nil).Code)
+	code, second := refresh(first.RefreshToken)
+	assert.Equal(suite.T(), http.StatusOK, code)
+
+	// Reusing a rotated token revokes the whole family
+	code, _ = refresh(first.RefreshToken)
+	assert.Equal(suite.T(), http.StatusUnauthorized, code)
+	code, _ = refresh(second.RefreshToken)
+	assert.Equal(suite.T(), http.StatusUnauthorized, code)
+
+	code, _ = refresh("invalid")
+	assert.Equal(suite.T(), http.StatusUnauthorized, code)
+}
+
+func (suite *ServerTestSuite) TestLogout() {
+	request, _ := http.NewRequest(http.MethodGet, "/api/auth/token", nil)
+	request.SetBasicAuth("test", "password")
+	response := httptest.NewRecorder()
+	suite.server.ServeHTTP(response, request)
+	var login clientToken
+	assert.Nil(suite.T(), json.Unmarshal(response.Body.Bytes(), &login))
+	otherToken := suite.getAuthToken()
+
+	body, _ := json.Marshal(refreshTokenInput{RefreshToken: login.RefreshToken})
+	response = suite.request(http.MethodPost, "/api/auth/logout", login.Token, "", body)
+	assert.Equal(suite.T(), http.StatusOK, response.Code)
+
+	// The access token and refresh token are revoked, but other sessions are not
+	assert.Equal(suite.T(), http.StatusUnauthorized, suite.request(http.MethodGet, "/api/recs", login.Token, "", nil).Code)
+	response = suite.request(http.MethodPost, "/api/auth/refresh", "", "", body)
+	assert.Equal(suite.T(), http.StatusUnauthorized, response.Code)
+	assert.Equal(suite.T(), http.StatusOK, suite.request(http.MethodGet, "/api/recs", otherToken, "", nil).Code)
+}
+
+func TestTokenDenylists(t *testing.T) {
+	db, err := gorm.Open(sqlite.Open(":memory:"), &gorm.Config{TranslateError: true})
+	assert.Nil(t, err)
+	err = db.AutoMigrate(&gormDeniedToken{})
+	assert.Nil(t, err)
+	denylists := map[string]tokenDenylist{
+		"memory": newInMemoryTokenDenylist(),
+		"gorm":   newGormTokenDenylist(db),
+	}
+	for name, denylist := range denylists {
+		t.Run(name, func(t *testing.T) {
+			assert.Nil(t, denylist.deny("a", time.Now().Add(time.Hour)))
+			assert.Nil(t, denylist.deny("b", time.Now().Add(-time.Second)))
+			// Denying a token twice is allowed, as logouts may be retried
+			assert.Nil(t, denylist.deny("a", time.Now().Add(time.Hour)))
+
+			denied, err := denylist.isDenied("a")
+			assert.Nil(t, err)
+			assert.True(t, denied)
+			// Expired tokens no longer need to be denied
+			denied, err = denylist.isDenied("b")
+			assert.Nil(t, err)
+			assert.False(t, denied)
+			denied, err = denylist.isDenied("c")
+			assert.Nil(t, err)
+			assert.False(t, denied)
+		})
+	}
+}
+
+func (suite *ServerTestSuite) TestExternalTokens() {
+	rsaKey, err := rsa.GenerateKey(rand.Reader, 2048)
+	assert.Nil(suite.T(), err)
+	ecKey, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	assert.Nil(suite.T(), err)
+	encode := func(i *big.Int) string { return base64.RawURLEncoding.EncodeToString(i.Bytes()) }
+	jwks := map[string]any{"keys": []jsonWebKey{
+		{Kty: "RSA", Kid: "rsa", Use: "sig", N: encode(rsaKey.N), E: encode(big.NewInt(int64(rsaKey.E)))},
+		{Kty: "EC", Kid: "ec", Crv: "P-256", X: encode(ecKey.X), Y: encode(ecKey.Y)},
+	}}
+	jwksServer := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		json.NewEncoder(w).Encode(jwks)
+	}))
+	defer jwksServer.Close()
+
+	config := suite.config
+	config.allowWithoutAccessPolicies = true
+	config.externalTokenVerifier = &externalTokenVerifier{
+		keys:          newJWKSKeySource(jwksServer.URL),
+		issuer:        "https://idp.example.com",
+		audience:      "timeseries-api",
+		usernameClaim: "email",
+		roleClaim:     "groups",
+		roleMapping:   map[string]string{"viewers": roleViewer, "writers": roleWriter},
+	}
+	server, err := NewServer(config)
+	assert.Nil(suite.T(), err)
+
+	sign := func(method jwt.SigningMethod, kid string, key any, claims jwt.MapClaims) string {
+		token := jwt.NewWithClaims(method, claims)
+		token.Header["kid"] = kid
+		tokenString, err := token.SignedString(key)
+		assert.Nil(suite.T(), err)
+		return tokenString
+	}
+	claims := func(modify func(jwt.MapClaims)) jwt.MapClaims {
+		claims := jwt.MapClaims{
+			"iss":    "https://idp.example.com",
+			"aud":    []string{"timeseries-api"},
+			"email":  "someone@example.com",
+			"groups": []string{"viewers", "writers"},
+			"exp":    time.Now().Add(time.Minute).Unix(),
+		}
+		if modify != nil {
+			modify(claims)
+		}
+		return claims
+	}
+	request := func(authToken string, method string) int {
+		request, _ := http.NewRequest(method, "/api/recs", bytes.NewReader([]byte(`{}`)))
+		request.Header.Add("Authorization", fmt.Sprintf("Bearer %s", authToken))
+		response := httptest.NewRecorder()
+		server.ServeHTTP(response, request)
+		return response.Code
+	}
+
+	// Both key types are accepted, with the most permissive mapped role
+	assert.Equal(suite.T(), http.StatusOK, request(sign(jwt.SigningMethodRS256, "rsa", rsaKey, claims(nil)), http.MethodGet))
+	assert.Equal(suite.T(), http.StatusOK, request(sign(jwt.SigningMethodES256, "ec", ecKey, claims(nil)), http.MethodGet))
+	assert.NotEqual(suite.T(), http.StatusForbidden, request(sign(jwt.SigningMethodES256, "ec", ecKey, claims(nil)), http.MethodPost))
+	viewer := claims(func(c jwt.MapClaims) { c["groups"] = "viewers" })
+	assert.Equal(suite.T(), http.StatusForbidden, request(sign(jwt.SigningMethodRS256, "rsa", rsaKey, viewer), http.MethodPost))
+
+	// Local tokens still work
+	assert.Equal(suite.T(), http.StatusOK, request(suite.getAuthToken(), http.MethodGet))
+
+	rejected := map[string]string{
+		"wrong issuer":   sign(jwt.SigningMethodRS256, "rsa", rsaKey, claims(func(c jwt.MapClaims) { c["iss"] = "https://other.example.com" })),
+		"wrong audience": sign(jwt.SigningMethodRS256, "rsa", rsaKey, claims(func(c jwt.MapClaims) { c["aud"] = "other" })),
+		"no role":        sign(jwt.SigningMethodRS256, "rsa", rsaKey, claims(func(c jwt.MapClaims) { c["groups"] = []string{"others"} })),
+		"expired":        sign(jwt.SigningMethodRS256, "rsa", rsaKey, claims(func(c jwt.MapClaims) { c["exp"] = time.Now().Add(-time.Minute).Unix() })),
+		"wrong key":      sign(jwt.SigningMethodRS256, "ec", rsaKey, claims(nil)),
+		"unknown key":    sign(jwt.SigningMethodRS256, "other", rsaKey, claims(nil)),
+		"wrong alg":      sign(jwt.SigningMethodRS512, "rsa", rsaKey, claims(nil)),
+	}
+	for name, token := range rejected {
+		assert.Equal(suite.T(), http.StatusUnauthorized, request(token, http.MethodGet), name)
+	}
+}
+
+func (suite *ServerTestSuite) TestClientCertificates() {
+	config := suite.config
+	config.clientCertificateRoles = map[string]string{"ingest-01": roleWriter}
+	server, err := NewServer(config)
+	assert.Nil(suite.T(), err)
+	request := func(commonName string, method string) int {
+		request, _ := http.NewRequest(method, "/api/recs", bytes.NewReader([]byte(`{}`)))
+		if commonName != "" {
+			certificate := &x509.Certificate{Subject: pkix.Name{CommonName: commonName}}
+			request.TLS = &tls.ConnectionState{VerifiedChains: [][]*x509.Certificate{{certificate}}}
+		}
+		response := httptest.NewRecorder()
+		server.ServeHTTP(response, request)
+		return response.Code
+	}
+
+	assert.Equal(suite.T(), http.StatusOK, request("ingest-01", http.MethodGet))
+	assert.Equal(suite.T(), http.StatusUnauthorized, request("unknown", http.MethodGet))
+	assert.Equal(suite.T(), http.StatusUnauthorized, request("", http.MethodGet))
+
+	// Access policies apply to the certificate subject
+	suite.post("/api/policies", suite.getAuthToken(), accessPolicy{Subject: "cert:ingest-01", Filter: "site"})
+	assert.Equal(suite.T(), http.StatusForbidden, request("ingest-01", http.MethodPost))
+}
+
+func TestFileKeySource(t *testing.T) {
+	ecKey, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	assert.Nil(t, err)
+	der, err := x509.MarshalPKIXPublicKey(&ecKey.PublicKey)
+	assert.Nil(t, err)
+	path := t.TempDir() + "/key.pem"
+	file, err := os.Create(path)
+	assert.Nil(t, err)
+	assert.Nil(t, pem.Encode(file, &pem.Block{Type: "PUBLIC KEY", Bytes: der}))
+	file.Close()
+
+	keys, err := newFileKeySource(path)
+	assert.Nil(t, err)
+	key, err := keys.publicKey("any")
+	assert.Nil(t, err)
+	assert.True(t, ecKey.PublicKey.Equal(key))
+}
+
+func TestJWKSKeySourceUnavailable(t *testing.T) {
+	var requests atomic.Int32
+	jwksServer := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		requests.Add(1)
+		w.WriteHeader(http.StatusServiceUnavailable)
+	}))
+	defer jwksServer.Close()
+
+	// A failed fetch is not repeated for every unknown key
+	keys := newJWKSKeySource(jwksServer.URL)
+	_, err := keys.publicKey("a")
+	assert.NotNil(t, err)
+	_, err = keys.publicKey("b")
+	assert.NotNil(t, err)
+	assert.Equal(t, int32(1), requests.Load())
+}
+
+func (suite *ServerTestSuite) TestLoginLockout() {
+	config := suite.config
+	config.loginLimiter = newLoginLimiter(2, time.Minute, time.Hour)
+	server, err := NewServer(config)
+	assert.Nil(suite.T(), err)
+	login := func(username string, password string, remoteAddr string) *httptest.ResponseRecorder {
+		request, _ := http.NewRequest(http.MethodGet, "/api/auth/token", nil)
+		request.SetBasicAuth(username, password)
+		request.RemoteAddr = remoteAddr
+		response := httptest.NewRecorder()
+		server.ServeHTTP(response, request)
+		return response
+	}
+
+	assert.Equal(suite.T(), http.StatusForbidden, login("test", "wrong", "10.0.0.1:1000").Code)
+	assert.Equal(suite.T(), http.StatusForbidden, login("test", "wrong", "10.0.0.1:1000").Code)
+
+	// Both the client and the username are locked out, even with the right password
+	response := login("test", "password", "10.0.0.1:1000")
+	assert.Equal(suite.T(), http.StatusTooManyRequests, response.Code)
+	assert.Equal(suite.T(), "60", response.Header().Get("Retry-After"))
+	assert.Equal(suite.T(), http.StatusTooManyRequests, login("test", "password", "10.0.0.2:1000").Code)
+	assert.Equal(suite.T(), http.StatusTooManyRequests, login("other", "password", "10.0.0.1:1000").Code)
+	assert.Equal(suite.T(), http.StatusForbidden, login("other", "password", "10.0.0.2:1000").Code)
+}
+
+func (suite *ServerTestSuite) TestLoginLockoutBehindProxy() {
+	config := suite.config
+	config.loginLimiter = newLoginLimiter(2, time.Minute, time.Hour)
+	config.trustedProxies, _ = parseTrustedProxies("10.0.0.0/8")
+	server, err := NewServer(config)
+	assert.Nil(suite.T(), err)
+	login := func(username string, password string, remoteAddr string, forwardedFor string) int {
+		request, _ := http.NewRequest(http.MethodGet, "/api/auth/token", nil)
+		request.SetBasicAuth(username, password)
+		request.RemoteAddr = remoteAddr
+		request.Header.Set("X-Forwarded-For", forwardedFor)
+		response := httptest.NewRecorder()
+		server.ServeHTTP(response, request)
+		return response.Code
+	}
+
+	// Clients behind the proxy are told apart, and a spoofed address before theirs is ignored
+	assert.Equal(suite.T(), http.StatusForbidden, login("a", "wrong", "10.0.0.1:1000", "1.2.3.4, 192.0.2.1"))
+	assert.Equal(suite.T(), http.StatusForbidden, login("b", "wrong", "10.0.0.1:1000", "5.6.7.8, 192.0.2.1, 10.0.0.2"))
+	assert.Equal(suite.T(), http.StatusTooManyRequests, login("c", "password", "10.0.0.1:1000", "192.0.2.1"))
+	assert.Equal(suite.T(), http.StatusOK, login("test", "password", "10.0.0.1:1000", "192.0.2.2"))
+
+	// An untrusted client cannot choose its address
+	assert.Equal(suite.T(), http.StatusForbidden, login("d", "wrong", "192.0.2.3:1000", "192.0.2.4"))
+	assert.Equal(suite.T(), http.StatusForbidden, login("e", "wrong", "192.0.2.3:1000", "192.0.2.5"))
+	assert.Equal(suite.T(), http.StatusTooManyRequests, login("f", "password", "192.0.2.3:1000", "192.0.2.6"))
+
+	// A successful login does not reset the failures of the client
+	assert.Equal(suite.T(), http.StatusForbidden, login("test", "wrong", "10.0.0.1:1000", "192.0.2.7"))
+	assert.Equal(suite.T(), http.StatusOK, login("test", "password", "10.0.0.1:1000", "192.0.2.7"))
+	assert.Equal(suite.T(), http.StatusForbidden, login("g", "wrong", "10.0.0.1:1000", "192.0.2.7"))
+	assert.Equal(suite.T(), http.StatusTooManyRequests, login("test", "password", "10.0.0.1:1000", "192.0.2.7"))
+}
+
+func TestLoginLimiterBackoff(t *testing.T) {
+	limiter := newLoginLimiter(2, time.Second, 5*time.Second)
+	limiter.fail("a")
+	assert.Equal(t, time.Duration(0), limiter.retryAfter("a"))
+
+	// Each failure beyond the maximum doubles the lockout, up to the maximum lockout
+	for _, expected := range []time.Duration{time.Second, 2 * time.Second, 4 * time.Second, 5 * time.Second} {
+		limiter.fail("a")
+		retryAfter := limiter.retryAfter("a", "b")
+		assert.LessOrEqual(t, retryAfter, expected)
+		assert.Greater(t, retryAfter, expected-time.Second/2)
+	}
+
+	limiter.succeed("a")
+	assert.Equal(t, time.Duration(0), limiter.retryAfter("a"))
+}
+
+func (suite *ServerTestSuite) TestRateLimit() {
+	config := suite.config
+	config.requestLimiter = newRequestLimiter(0.1, 2)
+	server, err := NewServer(config)
+	assert.Nil(suite.T(), err)
+	get := func(header string) *httptest.ResponseRecorder {
+		request, _ := http.NewRequest(http.MethodGet, "/api/recs", nil)
+		request.Header.Add("Authorization", header)
+		response := httptest.NewRecorder()
+		server.ServeHTTP(response, request)
+		return response
+	}
+	bearer := fmt.Sprintf("Bearer %s", suite.getAuthToken())
+
+	assert.Equal(suite.T(), http.StatusOK, get(bearer).Code)
+	assert.Equal(suite.T(), http.StatusOK, get(bearer).Code)
+	response := get(bearer)
+	assert.Equal(suite.T(), http.StatusTooManyRequests, response.Code)
+	assert.Equal(suite.T(), "10", response.Header().Get("Retry-After"))
+
+	// Limits are per user or API key
+	assert.Equal(suite.T(), http.StatusOK, get("ApiKey valid").Code)
+}
+
+func (suite *ServerTestSuite) TestHealth() {
+	var mqttErr error
+	shuttingDown := &atomic.Bool{}
+	config := suite.config
+	config.dependencies = map[string]pinger{"mqtt": pingerFunc(func(ctx context.Context) error { return mqttErr })}
+	config.shuttingDown = shuttingDown
+	server, err := NewServer(config)
+	assert.Nil(suite.T(), err)
+	get := func(route string) (int, health) {
+		request, _ := http.NewRequest(http.MethodGet, route, nil)
+		response := httptest.NewRecorder()
+		server.ServeHTTP(response, request)
+		var result health
+		err := json.Unmarshal(response.Body.Bytes(), &result)
+		assert.Nil(suite.T(), err)
+		return response.Code, result
+	}
+
+	code, result := get("/readyz")
+	assert.Equal(suite.T(), http.StatusOK, code)
+	assert.Equal(suite.T(), healthStatusOK, result.Status)
+	// The in-memory current store has no dependency to check
+	assert.Len(suite.T(), result.Dependencies, 3)
+	assert.Equal(suite.T(), healthStatusOK, result.Dependencies["historyStore"].Status)
+	assert.Equal(suite.T(), healthStatusOK, result.Dependencies["recStore"].Status)
+	assert.Equal(suite.T(), healthStatusOK, result.Dependencies["mqtt"].Status)
+
+	// Unavailable dependencies fail readiness, but not liveness
+	mqttErr = errors.New("not connected")
+	code, result = get("/readyz")
+	assert.Equal(suite.T(), http.StatusServiceUnavailable, code)
+	assert.Equal(suite.T(), healthStatusUnavailable, result.Status)
+	assert.Equal(suite.T(), healthStatusUnavailable, result.Dependencies["mqtt"].Status)
+	assert.Equal(suite.T(), healthStatusOK, result.Dependencies["recStore"].Status)
+	code, result = get("/healthz")
+	assert.Equal(suite.T(), http.StatusOK, code)
+	assert.Equal(suite.T(), healthStatusUnavailable, result.Status)
+
+	mqttErr = nil
+	shuttingDown.Store(true)
+	code, result = get("/readyz")
+	assert.Equal(suite.T(), http.StatusServiceUnavailable, code)
+	assert.Equal(suite.T(), healthStatusShuttingDown, result.Status)
+	code, _ = get("/healthz")
+	assert.Equal(suite.T(), http.StatusOK, code)
+}
+
+// pingerFunc adapts a function to a pinger.
+type pingerFunc func(ctx context.Context) error
+
+func (f pingerFunc) ping(ctx context.Context) error {
+	return f(ctx)
+}
+
 // These functions just take literals and return a pointer to them. For easier DB/JSON construction
 func s(s string) *string   { return &s }
 func f(f float64) *float64 { return &f }
 
 func (suite *ServerTestSuite) getAuthToken() string {
+	return suite.getAuthTokenFor("test", "password")
+}
+
+func (suite *ServerTestSuite) getAuthTokenFor(username string, password string) string {
 	request, _ := http.NewRequest(http.MethodGet, "/api/auth/token", nil)
-	request.SetBasicAuth("test", "password")
+	request.SetBasicAuth(username, password)
 	response := httptest.NewRecorder()
 
 	suite.server.ServeHTTP(response, request)
@@ -511,3 +1715,15 @@ func (suite *ServerTestSuite) put(route string, authToken string, toMarshal any)
 	suite.server.ServeHTTP(response, request)
 	assert.Equal(suite.T(), response.Code, http.StatusOK)
 }
+
+func (suite *ServerTestSuite) request(method string, route string, authToken string, contentType string, body []byte) *httptest.ResponseRecorder {
+	request, err := http.NewRequest(method, route, bytes.NewReader(body))
+	assert.Nil(suite.T(), err)
+	request.Header.Add("Authorization", fmt.Sprintf("Bearer %s", authToken))
+	if contentType != "" {
+		request.Header.Set("Content-Type", contentType)
+	}
+	response := httptest.NewRecorder()
+	suite.server.ServeHTTP(response, request)
+	return response
+}
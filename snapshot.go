@@ -0,0 +1,85 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"io/fs"
+	"log"
+	"os"
+	"path/filepath"
+	"time"
+)
+
+// snapshotter is a store that keeps its data in memory, and can save it to disk so that it survives a restart.
+type snapshotter interface {
+	snapshot() error
+}
+
+// runSnapshots snapshots the stores at the interval until the stop channel is closed. It closes the done channel once
+// a snapshot in progress has finished.
+func runSnapshots(stores []snapshotter, interval time.Duration, stop <-chan struct{}, done chan<- struct{}) {
+	defer close(done)
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-stop:
+			return
+		case <-ticker.C:
+			for _, store := range stores {
+				err := store.snapshot()
+				if err != nil {
+					log.Printf("Unable to snapshot store: %s", err)
+				}
+			}
+		}
+	}
+}
+
+// writeSnapshot writes the value to the file as JSON. It is written to a temporary file that replaces the file once
+// synced, so that a crash leaves either the previous snapshot or the new one, never a partial one.
+func writeSnapshot(path string, value any) error {
+	data, err := json.Marshal(value)
+	if err != nil {
+		return err
+	}
+	dir := filepath.Dir(path)
+	err = os.MkdirAll(dir, 0o755)
+	if err != nil {
+		return err
+	}
+	file, err := os.CreateTemp(dir, filepath.Base(path)+".*.tmp")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(file.Name())
+	_, err = file.Write(data)
+	if err == nil {
+		err = file.Sync()
+	}
+	closeErr := file.Close()
+	if err != nil {
+		return err
+	}
+	if closeErr != nil {
+		return closeErr
+	}
+	err = os.Rename(file.Name(), path)
+	if err != nil {
+		return err
+	}
+	return syncDir(dir)
+}
+
+// readSnapshot reads a snapshot written by writeSnapshot into the value. If there is no snapshot, the value is left
+// unchanged.
+func readSnapshot(path string, value any) error {
+	data, err := os.ReadFile(path)
+	if errors.Is(err, fs.ErrNotExist) {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	return json.Unmarshal(data, value)
+}
@@ -0,0 +1,92 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+
+	"gorm.io/gorm"
+)
+
+type tagDefController struct {
+	store tagDefStore
+}
+
+// GET /tags
+func (tagDefController tagDefController) getTagDefs(w http.ResponseWriter, r *http.Request) {
+	tagDefs, err := tagDefController.store.readTagDefs()
+	if err != nil {
+		writeStoreError(w, r, err)
+		return
+	}
+
+	httpJson, err := json.Marshal(tagDefs)
+	if err != nil {
+		writeInternalError(w, r, "Cannot encode response JSON", err)
+		return
+	}
+
+	w.WriteHeader(http.StatusOK)
+	w.Write(httpJson)
+}
+
+// GET /tags/:name
+func (tagDefController tagDefController) getTagDef(w http.ResponseWriter, r *http.Request) {
+	name := r.PathValue("name")
+	tagDef, err := tagDefController.store.readTagDef(name)
+	if errors.Is(err, gorm.ErrRecordNotFound) {
+		writeProblem(w, r, http.StatusNotFound, errorCodeNotFound, "Tag definition not found")
+		return
+	}
+	if err != nil {
+		writeStoreError(w, r, err)
+		return
+	}
+
+	httpJson, err := json.Marshal(tagDef)
+	if err != nil {
+		writeInternalError(w, r, "Cannot encode response JSON", err)
+		return
+	}
+
+	w.WriteHeader(http.StatusOK)
+	w.Write(httpJson)
+}
+
+// PUT /tags/:name
+// Creates or replaces the tag definition. Existing recs are not re-validated.
+func (tagDefController tagDefController) putTagDef(w http.ResponseWriter, r *http.Request) {
+	decoder := json.NewDecoder(r.Body)
+	var tagDef tagDef
+	err := decoder.Decode(&tagDef)
+	if err != nil {
+		writeProblem(w, r, http.StatusBadRequest, errorCodeInvalidBody, fmt.Sprintf("Cannot decode request JSON: %s", err))
+		return
+	}
+	tagDef.Name = r.PathValue("name")
+	err = tagDef.validate()
+	if err != nil {
+		writeProblem(w, r, http.StatusBadRequest, errorCodeInvalidValue, fmt.Sprintf("Invalid tag definition: %s", err))
+		return
+	}
+
+	err = tagDefController.store.writeTagDef(tagDef)
+	if err != nil {
+		writeStoreError(w, r, err)
+		return
+	}
+
+	w.WriteHeader(http.StatusOK)
+}
+
+// DELETE /tags/:name
+func (tagDefController tagDefController) deleteTagDef(w http.ResponseWriter, r *http.Request) {
+	err := tagDefController.store.deleteTagDef(r.PathValue("name"))
+	if err != nil {
+		writeStoreError(w, r, err)
+		return
+	}
+
+	w.WriteHeader(http.StatusOK)
+}
@@ -0,0 +1,200 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"sort"
+
+	"gorm.io/datatypes"
+	"gorm.io/gorm"
+)
+
+// tagDefStore is able to store tag definitions, which describe the tags that recs may use.
+type tagDefStore interface {
+	readTagDefs() ([]tagDef, error)
+	readTagDef(string) (*tagDef, error)
+	// writeTagDef creates the tag definition, or replaces it if one with the same name exists.
+	writeTagDef(tagDef) error
+	deleteTagDef(string) error
+}
+
+// Tag types that a definition may require.
+const (
+	tagTypeString = "string"
+	tagTypeNumber = "number"
+	tagTypeBool   = "bool"
+	// tagTypeMarker tags only indicate presence, so their value is not checked.
+	tagTypeMarker = "marker"
+)
+
+// tagDef defines the type and allowed values of a tag, and which other tags must be present alongside it.
+// Recs are only checked against the definitions of the tags that they have, so undefined tags are allowed.
+type tagDef struct {
+	Name string `json:"name"`
+	Type string `json:"type"`
+	// Allowed values. If empty, any value of the correct type is allowed.
+	Allowed datatypes.JSONSlice[interface{}] `json:"allowed"`
+	// Tag names that must also be present on any rec with this tag. `dis` and `unit` refer to the rec fields.
+	Requires datatypes.JSONSlice[string] `json:"requires"`
+}
+
+// validate checks that the definition itself is well-formed.
+func (d tagDef) validate() error {
+	if d.Name == "" {
+		return fmt.Errorf("name is required")
+	}
+	switch d.Type {
+	case tagTypeString, tagTypeNumber, tagTypeBool, tagTypeMarker:
+	default:
+		return fmt.Errorf("unknown type: %s", d.Type)
+	}
+	for _, value := range d.Allowed {
+		if !tagValueHasType(value, d.Type) {
+			return fmt.Errorf("allowed value %v is not a %s", value, d.Type)
+		}
+	}
+	return nil
+}
+
+// tagViolation describes a way that a rec does not conform to the tag definitions.
+type tagViolation struct {
+	Tag     string `json:"tag"`
+	Message string `json:"message"`
+}
+
+// validateRecTags checks the rec against the definitions of the tags it has.
+// Violations are returned in tag name order.
+func validateRecTags(rec rec, tagDefs []tagDef) []tagViolation {
+	present := map[string]bool{}
+	for name := range rec.Tags {
+		present[name] = true
+	}
+	if rec.Dis != nil {
+		present["dis"] = true
+	}
+	if rec.Unit != nil {
+		present["unit"] = true
+	}
+
+	violations := []tagViolation{}
+	for _, tagDef := range tagDefs {
+		value, ok := rec.Tags[tagDef.Name]
+		if !ok {
+			continue
+		}
+		if !tagValueHasType(value, tagDef.Type) {
+			violations = append(violations, tagViolation{
+				Tag:     tagDef.Name,
+				Message: fmt.Sprintf("must be a %s", tagDef.Type),
+			})
+		} else if len(tagDef.Allowed) > 0 && !tagValueAllowed(value, tagDef.Allowed) {
+			violations = append(violations, tagViolation{
+				Tag:     tagDef.Name,
+				Message: fmt.Sprintf("must be one of %v", []interface{}(tagDef.Allowed)),
+			})
+		}
+		for _, required := range tagDef.Requires {
+			if !present[required] {
+				violations = append(violations, tagViolation{
+					Tag:     required,
+					Message: fmt.Sprintf("is required by %s", tagDef.Name),
+				})
+			}
+		}
+	}
+	sort.SliceStable(violations, func(i, j int) bool {
+		return violations[i].Tag < violations[j].Tag
+	})
+	return violations
+}
+
+func tagValueHasType(value interface{}, tagType string) bool {
+	switch tagType {
+	case tagTypeString:
+		_, ok := value.(string)
+		return ok
+	case tagTypeNumber:
+		switch value.(type) {
+		case float64, float32, int, int64, json.Number:
+			return true
+		}
+		return false
+	case tagTypeBool:
+		_, ok := value.(bool)
+		return ok
+	case tagTypeMarker:
+		return true
+	}
+	return false
+}
+
+// tagValueAllowed compares values by their JSON encoding, so that numbers match regardless of how they were decoded.
+func tagValueAllowed(value interface{}, allowed []interface{}) bool {
+	valueJson, err := json.Marshal(value)
+	if err != nil {
+		return false
+	}
+	for _, allowedValue := range allowed {
+		allowedJson, err := json.Marshal(allowedValue)
+		if err != nil {
+			continue
+		}
+		if string(valueJson) == string(allowedJson) {
+			return true
+		}
+	}
+	return false
+}
+
+// gormTagDefStore stores tag definitions in a GORM database.
+type gormTagDefStore struct {
+	db *gorm.DB
+}
+
+func newGormTagDefStore(db *gorm.DB) gormTagDefStore {
+	return gormTagDefStore{db: db}
+}
+
+func (s gormTagDefStore) readTagDefs() ([]tagDef, error) {
+	var sqlResult []gormTagDef
+	err := s.db.Order("name").Find(&sqlResult).Error
+	if err != nil {
+		return []tagDef{}, err
+	}
+
+	result := []tagDef{}
+	for _, sqlRow := range sqlResult {
+		result = append(result, tagDef(sqlRow))
+	}
+	return result, nil
+}
+
+func (s gormTagDefStore) readTagDef(name string) (*tagDef, error) {
+	var gormTagDef gormTagDef
+	err := s.db.First(&gormTagDef, "name = ?", name).Error
+	if err != nil {
+		return nil, err
+	}
+	tagDef := tagDef(gormTagDef)
+	return &tagDef, nil
+}
+
+func (s gormTagDefStore) writeTagDef(tagDef tagDef) error {
+	gormTagDef := gormTagDef(tagDef)
+	return s.db.Save(&gormTagDef).Error
+}
+
+func (s gormTagDefStore) deleteTagDef(name string) error {
+	return s.db.Delete(&gormTagDef{}, "name = ?", name).Error
+}
+
+type gormTagDef struct {
+	Name     string `gorm:"primaryKey"`
+	Type     string
+	Allowed  datatypes.JSONSlice[interface{}]
+	Requires datatypes.JSONSlice[string]
+}
+
+func (gormTagDef) TableName() string {
+	return "tag_def"
+}
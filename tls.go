@@ -0,0 +1,147 @@
+package main
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"fmt"
+	"log"
+	"net"
+	"net/http"
+	"os"
+	"strconv"
+	"sync"
+	"time"
+)
+
+// certificateReloader serves a certificate from files, reloading it when they change so that renewed certificates
+// are used without a restart. If reloading fails, such as while the files are being replaced, the previous
+// certificate is kept.
+type certificateReloader struct {
+	certFile string
+	keyFile  string
+	// checkInterval limits how often the files are checked for changes.
+	checkInterval time.Duration
+
+	mux         sync.Mutex
+	certificate *tls.Certificate
+	modTimes    [2]time.Time
+	lastChecked time.Time
+}
+
+func newCertificateReloader(certFile string, keyFile string) (*certificateReloader, error) {
+	reloader := &certificateReloader{
+		certFile:      certFile,
+		keyFile:       keyFile,
+		checkInterval: 10 * time.Second,
+	}
+	err := reloader.reload()
+	if err != nil {
+		return nil, err
+	}
+	return reloader, nil
+}
+
+// getCertificate is intended for use as tls.Config.GetCertificate.
+func (c *certificateReloader) getCertificate(*tls.ClientHelloInfo) (*tls.Certificate, error) {
+	c.mux.Lock()
+	defer c.mux.Unlock()
+
+	if time.Since(c.lastChecked) >= c.checkInterval {
+		modTimes, err := c.readModTimes()
+		if err == nil && modTimes != c.modTimes {
+			err = c.reload()
+			if err == nil {
+				log.Printf("Reloaded TLS certificate from %s", c.certFile)
+			}
+		}
+		if err != nil {
+			log.Printf("Cannot reload TLS certificate: %s", err)
+		}
+	}
+	return c.certificate, nil
+}
+
+// reload loads the certificate from the files. The mutex must be held, except during construction.
+func (c *certificateReloader) reload() error {
+	modTimes, err := c.readModTimes()
+	if err != nil {
+		return err
+	}
+	certificate, err := tls.LoadX509KeyPair(c.certFile, c.keyFile)
+	if err != nil {
+		return err
+	}
+	c.certificate = &certificate
+	c.modTimes = modTimes
+	c.lastChecked = time.Now()
+	return nil
+}
+
+func (c *certificateReloader) readModTimes() ([2]time.Time, error) {
+	c.lastChecked = time.Now()
+	var result [2]time.Time
+	for i, file := range []string{c.certFile, c.keyFile} {
+		info, err := os.Stat(file)
+		if err != nil {
+			return result, err
+		}
+		result[i] = info.ModTime()
+	}
+	return result, nil
+}
+
+// newTLSConfig returns a TLS configuration serving the reloader's certificate. If clientCAFile is set, clients may
+// authenticate with certificates signed by the CAs in it. Client certificates are optional, so that other clients
+// can authenticate with tokens or API keys.
+func newTLSConfig(reloader *certificateReloader, clientCAFile string) (*tls.Config, error) {
+	config := &tls.Config{
+		MinVersion:     tls.VersionTLS12,
+		GetCertificate: reloader.getCertificate,
+	}
+	if clientCAFile != "" {
+		pem, err := os.ReadFile(clientCAFile)
+		if err != nil {
+			return nil, err
+		}
+		clientCAs := x509.NewCertPool()
+		if !clientCAs.AppendCertsFromPEM(pem) {
+			return nil, fmt.Errorf("no certificates found in %s", clientCAFile)
+		}
+		config.ClientCAs = clientCAs
+		config.ClientAuth = tls.VerifyClientCertIfGiven
+	}
+	return config, nil
+}
+
+// clientCertificateSubjectPrefix prefixes the common names of client certificates to form the username of their
+// requests, as used by access policies.
+const clientCertificateSubjectPrefix = "cert:"
+
+// clientCertificateIdentity returns the username and role of a request authenticated by a verified client
+// certificate, using the mapping from certificate common names to roles. ok is false if the request has no verified
+// certificate, or its common name is not mapped.
+func clientCertificateIdentity(r *http.Request, roles map[string]string) (username string, role string, ok bool) {
+	if r.TLS == nil || len(r.TLS.VerifiedChains) == 0 || len(r.TLS.VerifiedChains[0]) == 0 {
+		return "", "", false
+	}
+	commonName := r.TLS.VerifiedChains[0][0].Subject.CommonName
+	role, ok = roles[commonName]
+	if !ok {
+		return "", "", false
+	}
+	return clientCertificateSubjectPrefix + commonName, role, true
+}
+
+// httpsRedirectHandler redirects every request to the same URL over HTTPS on the port.
+func httpsRedirectHandler(httpsPort int) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		host, _, err := net.SplitHostPort(r.Host)
+		if err != nil {
+			host = r.Host
+		}
+		if httpsPort != 443 {
+			host = net.JoinHostPort(host, strconv.Itoa(httpsPort))
+		}
+		http.Redirect(w, r, "https://"+host+r.URL.RequestURI(), http.StatusPermanentRedirect)
+	})
+}
@@ -0,0 +1,82 @@
+package main
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/pem"
+	"math/big"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestCertificateReloader(t *testing.T) {
+	dir := t.TempDir()
+	certFile := filepath.Join(dir, "cert.pem")
+	keyFile := filepath.Join(dir, "key.pem")
+	writeTestCertificate(t, certFile, keyFile, "first")
+
+	reloader, err := newCertificateReloader(certFile, keyFile)
+	assert.Nil(t, err)
+	reloader.checkInterval = 0
+	assert.Equal(t, "first", leafCommonName(t, reloader))
+
+	writeTestCertificate(t, certFile, keyFile, "second")
+	// Ensure the modification times differ on filesystems with coarse timestamps
+	later := time.Now().Add(time.Minute)
+	assert.Nil(t, os.Chtimes(certFile, later, later))
+	assert.Equal(t, "second", leafCommonName(t, reloader))
+
+	// A broken certificate is ignored in favor of the previous one
+	assert.Nil(t, os.WriteFile(certFile, []byte("broken"), 0600))
+	later = later.Add(time.Minute)
+	assert.Nil(t, os.Chtimes(certFile, later, later))
+	assert.Equal(t, "second", leafCommonName(t, reloader))
+}
+
+func TestHTTPSRedirect(t *testing.T) {
+	request := httptest.NewRequest(http.MethodPost, "http://example.com:8080/api/recs?tag=site", nil)
+	response := httptest.NewRecorder()
+	httpsRedirectHandler(8443).ServeHTTP(response, request)
+	assert.Equal(t, http.StatusPermanentRedirect, response.Code)
+	assert.Equal(t, "https://example.com:8443/api/recs?tag=site", response.Header().Get("Location"))
+
+	response = httptest.NewRecorder()
+	httpsRedirectHandler(443).ServeHTTP(response, request)
+	assert.Equal(t, "https://example.com/api/recs?tag=site", response.Header().Get("Location"))
+}
+
+func leafCommonName(t *testing.T, reloader *certificateReloader) string {
+	certificate, err := reloader.getCertificate(nil)
+	assert.Nil(t, err)
+	leaf, err := x509.ParseCertificate(certificate.Certificate[0])
+	assert.Nil(t, err)
+	return leaf.Subject.CommonName
+}
+
+// writeTestCertificate writes a self-signed certificate with the common name, and its key.
+func writeTestCertificate(t *testing.T, certFile string, keyFile string, commonName string) {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	assert.Nil(t, err)
+	template := &x509.Certificate{
+		SerialNumber: big.NewInt(1),
+		Subject:      pkix.Name{CommonName: commonName},
+		NotBefore:    time.Now().Add(-time.Hour),
+		NotAfter:     time.Now().Add(time.Hour),
+	}
+	der, err := x509.CreateCertificate(rand.Reader, template, template, &key.PublicKey, key)
+	assert.Nil(t, err)
+	keyDer, err := x509.MarshalECPrivateKey(key)
+	assert.Nil(t, err)
+
+	assert.Nil(t, os.WriteFile(certFile, pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: der}), 0600))
+	assert.Nil(t, os.WriteFile(keyFile, pem.EncodeToMemory(&pem.Block{Type: "EC PRIVATE KEY", Bytes: keyDer}), 0600))
+}
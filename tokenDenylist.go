@@ -0,0 +1,132 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"sync"
+	"time"
+
+	"github.com/redis/go-redis/v9"
+	"gorm.io/gorm"
+	"gorm.io/gorm/clause"
+)
+
+// tokenDenylist is able to store the IDs (`jti` claims) of revoked JWTs until they would have expired anyway.
+type tokenDenylist interface {
+	deny(jti string, expiresAt time.Time) error
+	isDenied(jti string) (bool, error)
+}
+
+// inMemoryTokenDenylist stores revoked token IDs in a local in-memory map.
+// These are not shared between instances.
+type inMemoryTokenDenylist struct {
+	mux    *sync.Mutex
+	denied map[string]time.Time
+}
+
+func newInMemoryTokenDenylist() inMemoryTokenDenylist {
+	return inMemoryTokenDenylist{
+		mux:    &sync.Mutex{},
+		denied: map[string]time.Time{},
+	}
+}
+
+func (d inMemoryTokenDenylist) deny(jti string, expiresAt time.Time) error {
+	d.mux.Lock()
+	defer d.mux.Unlock()
+
+	// Drop expired entries as new ones are added, so that the map does not grow without bound.
+	now := time.Now()
+	for deniedJti, deniedExpiresAt := range d.denied {
+		if now.After(deniedExpiresAt) {
+			delete(d.denied, deniedJti)
+		}
+	}
+	d.denied[jti] = expiresAt
+	return nil
+}
+
+func (d inMemoryTokenDenylist) isDenied(jti string) (bool, error) {
+	d.mux.Lock()
+	defer d.mux.Unlock()
+	expiresAt, ok := d.denied[jti]
+	return ok && time.Now().Before(expiresAt), nil
+}
+
+// redisTokenDenylist stores revoked token IDs in a Redis database, where they expire with the tokens.
+type redisTokenDenylist struct {
+	db        redis.UniversalClient
+	keyPrefix string
+	ctx       context.Context
+}
+
+func newRedisTokenDenylist(db redis.UniversalClient) redisTokenDenylist {
+	return redisTokenDenylist{
+		db:        db,
+		keyPrefix: "timeseries-api:denied-token:",
+		ctx:       context.Background(),
+	}
+}
+
+func (d redisTokenDenylist) deny(jti string, expiresAt time.Time) error {
+	ttl := time.Until(expiresAt)
+	if ttl <= 0 {
+		return nil
+	}
+	return d.db.Set(d.ctx, d.keyPrefix+jti, 1, ttl).Err()
+}
+
+func (d redisTokenDenylist) isDenied(jti string) (bool, error) {
+	err := d.db.Get(d.ctx, d.keyPrefix+jti).Err()
+	if errors.Is(err, redis.Nil) {
+		return false, nil
+	}
+	if err != nil {
+		return false, err
+	}
+	return true, nil
+}
+
+// gormTokenDenylist stores revoked token IDs in a GORM database, so that they are shared between instances without
+// Redis.
+type gormTokenDenylist struct {
+	db *gorm.DB
+}
+
+func newGormTokenDenylist(db *gorm.DB) gormTokenDenylist {
+	return gormTokenDenylist{db: db}
+}
+
+func (d gormTokenDenylist) deny(jti string, expiresAt time.Time) error {
+	now := time.Now()
+	if !expiresAt.After(now) {
+		return nil
+	}
+	// Drop expired entries as new ones are added, so that the table does not grow without bound.
+	err := d.db.Where("expires_at <= ?", now).Delete(&gormDeniedToken{}).Error
+	if err != nil {
+		return err
+	}
+	return d.db.Clauses(clause.OnConflict{DoNothing: true}).Create(&gormDeniedToken{
+		JTI:       jti,
+		ExpiresAt: expiresAt,
+	}).Error
+}
+
+func (d gormTokenDenylist) isDenied(jti string) (bool, error) {
+	var count int64
+	err := d.db.Model(&gormDeniedToken{}).Where("jti = ? AND expires_at > ?", jti, time.Now()).Count(&count).Error
+	if err != nil {
+		return false, err
+	}
+	return count > 0, nil
+}
+
+type gormDeniedToken struct {
+	JTI       string    `gorm:"column:jti;primaryKey"`
+	ExpiresAt time.Time `gorm:"not null;index"`
+}
+
+func (gormDeniedToken) TableName() string {
+	return "denied_token"
+}
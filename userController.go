@@ -0,0 +1,146 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"net/http"
+	"strings"
+	"time"
+
+	"gorm.io/gorm"
+)
+
+type userController struct {
+	store userStore
+	// refreshTokenStore is optional. If set, the refresh tokens of users are revoked when they are disabled.
+	refreshTokenStore refreshTokenStore
+}
+
+// GET /users
+func (userController userController) getUsers(w http.ResponseWriter, r *http.Request) {
+	users, err := userController.store.readUsers()
+	if err != nil {
+		writeStoreError(w, r, err)
+		return
+	}
+
+	httpJson, err := json.Marshal(users)
+	if err != nil {
+		writeInternalError(w, r, "Cannot encode response JSON", err)
+		return
+	}
+
+	w.WriteHeader(http.StatusOK)
+	w.Write(httpJson)
+}
+
+// POST /users
+func (userController userController) postUsers(w http.ResponseWriter, r *http.Request) {
+	decoder := json.NewDecoder(r.Body)
+	var userInput userInput
+	err := decoder.Decode(&userInput)
+	if err != nil {
+		writeProblem(w, r, http.StatusBadRequest, errorCodeInvalidBody, fmt.Sprintf("Cannot decode request JSON: %s", err))
+		return
+	}
+	if userInput.Username == "" || userInput.Password == "" {
+		writeProblem(w, r, http.StatusBadRequest, errorCodeInvalidValue, "Username and password are required")
+		return
+	}
+	// Access policy subjects with these prefixes are API keys and client certificates, not users
+	for _, prefix := range []string{apiKeySubjectPrefix, clientCertificateSubjectPrefix} {
+		if strings.HasPrefix(userInput.Username, prefix) {
+			writeProblem(w, r, http.StatusBadRequest, errorCodeInvalidValue, fmt.Sprintf("Usernames cannot begin with %s", prefix))
+			return
+		}
+	}
+	if userInput.Role == "" {
+		userInput.Role = roleViewer
+	}
+	if !isValidRole(userInput.Role) {
+		writeProblem(w, r, http.StatusBadRequest, errorCodeInvalidValue, fmt.Sprintf("Invalid role: %s", userInput.Role))
+		return
+	}
+
+	err = userController.store.createUser(user{Username: userInput.Username, Role: userInput.Role}, userInput.Password)
+	if errors.Is(err, errUserExists) {
+		writeProblem(w, r, http.StatusConflict, errorCodeConflict, "User already exists")
+		return
+	}
+	if err != nil {
+		writeStoreError(w, r, err)
+		return
+	}
+	log.Printf("User %s created by %s", userInput.Username, requestUsername(r))
+
+	w.WriteHeader(http.StatusOK)
+}
+
+// PUT /users/:username/password
+func (userController userController) putUserPassword(w http.ResponseWriter, r *http.Request) {
+	decoder := json.NewDecoder(r.Body)
+	var passwordInput passwordInput
+	err := decoder.Decode(&passwordInput)
+	if err != nil {
+		writeProblem(w, r, http.StatusBadRequest, errorCodeInvalidBody, fmt.Sprintf("Cannot decode request JSON: %s", err))
+		return
+	}
+	if passwordInput.Password == "" {
+		writeProblem(w, r, http.StatusBadRequest, errorCodeInvalidValue, "Password is required")
+		return
+	}
+
+	username := r.PathValue("username")
+	err = userController.store.setUserPassword(username, passwordInput.Password)
+	if errors.Is(err, gorm.ErrRecordNotFound) {
+		writeProblem(w, r, http.StatusNotFound, errorCodeNotFound, "User not found")
+		return
+	}
+	if err != nil {
+		writeStoreError(w, r, err)
+		return
+	}
+	log.Printf("Password of user %s reset by %s", username, requestUsername(r))
+
+	w.WriteHeader(http.StatusOK)
+}
+
+// POST /users/:username/disable
+func (userController userController) postUserDisable(w http.ResponseWriter, r *http.Request) {
+	userController.setDisabled(w, r, true)
+}
+
+// POST /users/:username/enable
+func (userController userController) postUserEnable(w http.ResponseWriter, r *http.Request) {
+	userController.setDisabled(w, r, false)
+}
+
+func (userController userController) setDisabled(w http.ResponseWriter, r *http.Request, disabled bool) {
+	username := r.PathValue("username")
+	if disabled && username == requestUsername(r) {
+		// Otherwise, the only admin could lock everyone out.
+		writeProblem(w, r, http.StatusConflict, errorCodeConflict, "Users cannot disable themselves")
+		return
+	}
+
+	err := userController.store.setUserDisabled(username, disabled)
+	if errors.Is(err, gorm.ErrRecordNotFound) {
+		writeProblem(w, r, http.StatusNotFound, errorCodeNotFound, "User not found")
+		return
+	}
+	if err != nil {
+		writeStoreError(w, r, err)
+		return
+	}
+	if disabled && userController.refreshTokenStore != nil {
+		err = userController.refreshTokenStore.revokeUserRefreshTokens(username, time.Now())
+		if err != nil {
+			writeStoreError(w, r, err)
+			return
+		}
+	}
+
+	w.WriteHeader(http.StatusOK)
+}
@@ -0,0 +1,203 @@
+package main
+
+import (
+	"errors"
+	"slices"
+	"time"
+
+	"golang.org/x/crypto/bcrypt"
+	"gorm.io/gorm"
+)
+
+// userStore is able to store user accounts. Passwords are only ever stored hashed.
+type userStore interface {
+	readUsers() ([]user, error)
+	readUser(string) (*user, error)
+	// createUser fails with errUserExists if the username is taken.
+	createUser(user, string) error
+	setUserDisabled(string, bool) error
+	setUserPassword(string, string) error
+}
+
+type user struct {
+	Username  string    `json:"username"`
+	Role      string    `json:"role"`
+	Disabled  bool      `json:"disabled"`
+	CreatedAt time.Time `json:"createdAt"`
+}
+
+// userInput is the body used to create a user.
+type userInput struct {
+	Username string `json:"username"`
+	Password string `json:"password"`
+	// Role defaults to viewer.
+	Role string `json:"role"`
+}
+
+// passwordInput is the body used to reset a user's password.
+type passwordInput struct {
+	Password string `json:"password"`
+}
+
+var errUserExists = errors.New("user already exists")
+
+var errBootstrapPassword = errors.New("the first admin user requires a password")
+
+// Roles, in order of increasing access. Each role is granted everything the previous ones are.
+const (
+	// roleViewer can read data.
+	roleViewer = "viewer"
+	// roleWriter can also write data, but not delete it.
+	roleWriter = "writer"
+	// roleAdmin can also delete data, change tag definitions and manage users.
+	roleAdmin = "admin"
+)
+
+// Scopes are the permissions that routes require. Users are granted the scopes of their role, and API keys are
+// granted scopes individually.
+const (
+	scopeRead   = "read"
+	scopeWrite  = "write"
+	scopeDelete = "delete"
+	scopeAdmin  = "admin"
+)
+
+var roleScopes = map[string][]string{
+	roleViewer: {scopeRead},
+	roleWriter: {scopeRead, scopeWrite},
+	roleAdmin:  {scopeRead, scopeWrite, scopeDelete, scopeAdmin},
+}
+
+// isValidRole returns true if the role is one of the known roles.
+func isValidRole(role string) bool {
+	_, ok := roleScopes[role]
+	return ok
+}
+
+// isValidScope returns true if the scope is one of the known scopes.
+func isValidScope(scope string) bool {
+	return slices.Contains(roleScopes[roleAdmin], scope)
+}
+
+// bootstrapAdmin creates an admin user with the given credentials if the store has no users, so that a new
+// deployment can be administered. It does nothing if the username is empty, and fails if the password is.
+func bootstrapAdmin(store userStore, username string, password string) error {
+	if username == "" {
+		return nil
+	}
+	if password == "" {
+		return errBootstrapPassword
+	}
+	users, err := store.readUsers()
+	if err != nil {
+		return err
+	}
+	if len(users) > 0 {
+		return nil
+	}
+	return store.createUser(user{Username: username, Role: roleAdmin}, password)
+}
+
+// gormUserStore stores users in a GORM database.
+type gormUserStore struct {
+	db *gorm.DB
+}
+
+func newGormUserStore(db *gorm.DB) gormUserStore {
+	return gormUserStore{db: db}
+}
+
+func (s gormUserStore) readUsers() ([]user, error) {
+	var sqlResult []gormUser
+	err := s.db.Order("username").Find(&sqlResult).Error
+	if err != nil {
+		return []user{}, err
+	}
+
+	result := []user{}
+	for _, sqlRow := range sqlResult {
+		result = append(result, sqlRow.toUser())
+	}
+	return result, nil
+}
+
+func (s gormUserStore) readUser(username string) (*user, error) {
+	var gormUser gormUser
+	err := s.db.First(&gormUser, "username = ?", username).Error
+	if err != nil {
+		return nil, err
+	}
+	user := gormUser.toUser()
+	return &user, nil
+}
+
+func (s gormUserStore) createUser(user user, password string) error {
+	hash, err := bcrypt.GenerateFromPassword([]byte(password), bcrypt.DefaultCost)
+	if err != nil {
+		return err
+	}
+	return s.db.Transaction(func(tx *gorm.DB) error {
+		var count int64
+		err := tx.Model(&gormUser{}).Where("username = ?", user.Username).Count(&count).Error
+		if err != nil {
+			return err
+		}
+		if count > 0 {
+			return errUserExists
+		}
+		return tx.Create(&gormUser{
+			Username:     user.Username,
+			PasswordHash: string(hash),
+			Role:         user.Role,
+			Disabled:     user.Disabled,
+			CreatedAt:    time.Now(),
+		}).Error
+	})
+}
+
+func (s gormUserStore) setUserDisabled(username string, disabled bool) error {
+	result := s.db.Model(&gormUser{}).Where("username = ?", username).Update("disabled", disabled)
+	if result.Error != nil {
+		return result.Error
+	}
+	if result.RowsAffected == 0 {
+		return gorm.ErrRecordNotFound
+	}
+	return nil
+}
+
+func (s gormUserStore) setUserPassword(username string, password string) error {
+	hash, err := bcrypt.GenerateFromPassword([]byte(password), bcrypt.DefaultCost)
+	if err != nil {
+		return err
+	}
+	result := s.db.Model(&gormUser{}).Where("username = ?", username).Update("password_hash", string(hash))
+	if result.Error != nil {
+		return result.Error
+	}
+	if result.RowsAffected == 0 {
+		return gorm.ErrRecordNotFound
+	}
+	return nil
+}
+
+type gormUser struct {
+	Username     string `gorm:"primaryKey"`
+	PasswordHash string `gorm:"not null"`
+	Role         string `gorm:"not null;default:viewer"`
+	Disabled     bool   `gorm:"not null;default:false"`
+	CreatedAt    time.Time
+}
+
+func (gormUser) TableName() string {
+	return "user"
+}
+
+func (u gormUser) toUser() user {
+	return user{
+		Username:  u.Username,
+		Role:      u.Role,
+		Disabled:  u.Disabled,
+		CreatedAt: u.CreatedAt,
+	}
+}
@@ -1,7 +1,9 @@
 package main
 
 import (
+	"context"
 	"encoding/json"
+	"errors"
 	"log"
 	"time"
 
@@ -22,11 +24,12 @@ type mqttValueEmitter struct {
 
 func newMQTTValueEmitter(
 	mqttClient mqtt.Client,
+	connectionTimeout time.Duration,
+	subscribeTimeout time.Duration,
 ) mqttValueEmitter {
 	return mqttValueEmitter{
-		// TODO: Make configurable
-		connectionTimeout: time.Duration(5 * time.Second),
-		subscribeTimeout:  time.Duration(5 * time.Second),
+		connectionTimeout: connectionTimeout,
+		subscribeTimeout:  subscribeTimeout,
 		mqttClient:        mqttClient,
 	}
 }
@@ -50,6 +53,15 @@ func (m *mqttValueEmitter) subscribe(source string, onEvent func(string, float64
 	log.Printf("Subscribed to %s", source)
 }
 
+// ping checks that the client is connected to the broker. The client reconnects automatically, so this is all
+// that can be checked.
+func (m *mqttValueEmitter) ping(ctx context.Context) error {
+	if !m.mqttClient.IsConnectionOpen() {
+		return errors.New("not connected to the MQTT broker")
+	}
+	return nil
+}
+
 func (m *mqttValueEmitter) unsubscribe(source string) {
 	unsubscribeToken := m.mqttClient.Unsubscribe(source)
 	if !unsubscribeToken.WaitTimeout(m.subscribeTimeout) {